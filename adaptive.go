@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+)
+
+// --- Adaptive throttle ---
+
+// --requests_per_second is a fixed ceiling, and the rate the endpoint accepts
+// moves with the shared capacity behind it. Under --adaptive_throttle the
+// worker's limiter adapts the way TCP congestion control does (AIMD): a 429 or
+// RESOURCE_EXHAUSTED answer halves the worker's rate, down to
+// --adaptive_min_rate, and every run of adaptiveRampRequests successful
+// requests raises it by a twentieth of --requests_per_second, back up to it.
+// The 429s of the requests in flight when the endpoint starts pushing back are
+// one signal, so the rate is cut at most once per adaptiveCutGap. Only the
+// worker-wide limiter adapts; --stage_rate_limits stay as set. The current
+// rate is the vertexai/effective_rate_milli_rps gauge (thousandths of a
+// request per second), and throttle_decreases_total and
+// throttle_increases_total count the changes.
+
+const (
+	adaptiveRampRequests = 20
+	adaptiveRampSteps    = 20
+	adaptiveCutGap       = time.Second
+)
+
+// aimdThrottle moves the rate of a worker's token bucket between min and
+// max. Every bundle thread shares it, see registry.go.
+type aimdThrottle struct {
+	bucket   *tokenBucket
+	min, max float64
+
+	mu        sync.Mutex
+	rate      float64
+	successes int // Successful requests since the rate last changed
+	lastCut   time.Time
+}
+
+func newAIMDThrottle(bucket *tokenBucket, floor float64) *aimdThrottle {
+	ceiling := bucket.currentRate()
+	return &aimdThrottle{bucket: bucket, min: floor, max: ceiling, rate: ceiling}
+}
+
+// record feeds the outcome of a request to the throttle. It returns the rate
+// afterwards and whether record lowered (-1) or raised (+1) it.
+func (t *aimdThrottle) record(throttled, ok bool) (rate float64, change int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case throttled:
+		t.successes = 0
+		if time.Since(t.lastCut) < adaptiveCutGap || t.rate <= t.min {
+			return t.rate, 0
+		}
+		t.lastCut = time.Now()
+		t.rate = max(t.rate/2, t.min)
+		change = -1
+	case ok:
+		if t.rate >= t.max {
+			return t.rate, 0
+		}
+		if t.successes++; t.successes < adaptiveRampRequests {
+			return t.rate, 0
+		}
+		t.successes = 0
+		t.rate = min(t.rate+t.max/adaptiveRampSteps, t.max)
+		change = 1
+	default:
+		return t.rate, 0 // Other failures say nothing about the endpoint's capacity
+	}
+	t.bucket.setRate(t.rate)
+	return t.rate, change
+}
+
+// isThrottled reports whether the endpoint pushed back on a request.
+func isThrottled(err error) bool {
+	var apiErr *vertexAPIError
+	return errors.As(err, &apiErr) && (apiErr.HTTPStatus == http.StatusTooManyRequests || apiErr.Status == "RESOURCE_EXHAUSTED")
+}
+
+// adaptRate feeds a call result to the adaptive throttle and reports the rate.
+func (fn *GenerateTextFn) adaptRate(ctx context.Context, err error) {
+	if fn.throttle == nil {
+		return
+	}
+	rate, change := fn.throttle.record(isThrottled(err), err == nil)
+	switch change {
+	case -1:
+		beam.NewCounter("vertexai", "throttle_decreases_total").Inc(ctx, 1)
+		beamlog.Infof(ctx, "GenerateTextFn: Vertex AI is throttling, lowering this worker's rate to %.3g requests/s", rate)
+	case 1:
+		beam.NewCounter("vertexai", "throttle_increases_total").Inc(ctx, 1)
+	}
+	beam.NewGauge("vertexai", "effective_rate_milli_rps").Set(ctx, int64(rate*1000))
+}
+
+// flagAdaptiveMinRate returns the floor of the adaptive throttle, 0 when it is off.
+func flagAdaptiveMinRate() float64 {
+	if !*adaptiveThrottle {
+		return 0
+	}
+	return *adaptiveMinRate
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/bigqueryio"
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+)
+
+// --- Agent mode: multi-turn tool use ---
+
+// The predict endpoint has no native function calling, so tools are offered in
+// the prompt and the model answers each turn with a JSON action:
+//
+//	{"tool": "<name>", "input": "<argument>"}   to call a tool, or
+//	{"final": "<answer>"}                       to finish.
+//
+// Each tool result is appended to the transcript as an observation for the next
+// turn. Answers that are not a JSON action are taken as final. A run that
+// ends without one (max_turns, budget_exhausted, or error) is dead-lettered
+// with that status as its ErrorStatus and its turns as its Trajectory.
+
+// agentObservationLimit caps how much of a tool result is fed back to the model.
+const agentObservationLimit = 16 << 10
+
+// Trajectory statuses.
+const (
+	agentFinal      = "final"
+	agentMaxTurns   = "max_turns"
+	agentOverBudget = "budget_exhausted"
+	agentError      = "error"
+)
+
+// agentTool is a capability the model may invoke by name.
+type agentTool interface {
+	Name() string
+	Description() string
+	Call(ctx context.Context, input string) (string, error)
+}
+
+// AgentTurn is one model response and the tool call it made, if any.
+type AgentTurn struct {
+	Turn        int    `beam:"Turn"`
+	ModelText   string `beam:"ModelText"`
+	Tool        string `beam:"Tool"`
+	ToolInput   string `beam:"ToolInput"`
+	Observation string `beam:"Observation"`
+	RequestID   string `beam:"RequestID"` // Server-side ID of the model call, for support escalation
+}
+
+// AgentTrajectory is the audit record of one row's agent run.
+type AgentTrajectory struct {
+	RunID        string      `beam:"RunID"`
+	PromptHash   string      `beam:"PromptHash"`
+	Prompt       string      `beam:"Prompt"`
+	Status       string      `beam:"Status"` // final, max_turns, budget_exhausted, or error
+	Turns        []AgentTurn `beam:"Turns"`
+	PromptTokens int64       `beam:"PromptTokens"`
+	OutputTokens int64       `beam:"OutputTokens"`
+	CompletedAt  time.Time   `beam:"CompletedAt"`
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*AgentTrajectory)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*AgentFn)(nil)).Elem())
+}
+
+// agentAction is the JSON the model replies with on each turn. Input may be a
+// string or, for tools taking structured arguments, a JSON object.
+type agentAction struct {
+	Tool  string          `json:"tool"`
+	Input json.RawMessage `json:"input"`
+	Final *string         `json:"final"`
+}
+
+// input returns the tool argument: a JSON string is unquoted, anything else is
+// passed through as JSON text.
+func (a agentAction) input() string {
+	var s string
+	if err := json.Unmarshal(a.Input, &s); err == nil {
+		return s
+	}
+	return string(a.Input)
+}
+
+// parseAgentAction extracts the action from a model answer, tolerating code
+// fences and surrounding prose. Anything unparseable is a final answer.
+func parseAgentAction(text string) agentAction {
+	body := strings.TrimSpace(text)
+	if start, end := strings.Index(body, "{"), strings.LastIndex(body, "}"); start >= 0 && end > start {
+		body = body[start : end+1]
+	}
+	var a agentAction
+	if err := json.Unmarshal([]byte(body), &a); err != nil || (a.Tool == "" && a.Final == nil) {
+		return agentAction{Final: &text}
+	}
+	return a
+}
+
+// AgentFn runs the agent loop for each prompt. Model calls go through Gen, so
+// pacing, rate limiting, and the circuit breaker all apply.
+type AgentFn struct {
+	Gen         *GenerateTextFn
+	MaxTurns    int
+	TokenBudget int64 // Prompt plus output tokens across all turns; 0 means unlimited
+
+	HTTPAllow    []string      // URL prefixes http_get may fetch
+	HTTPTimeout  time.Duration // Per-fetch time limit for http_get
+	HTTPMaxBytes int64         // Response bytes http_get reads before truncating
+	GCSAllow     []string      // gs:// prefixes gcs_read may read
+
+	ReferenceTables []string // alias=project.dataset.table:key_column entries bq_lookup may query
+	LookupProject   string   // Project bq_lookup queries run in, the input project
+
+	tools map[string]agentTool
+}
+
+func (fn *AgentFn) Setup(ctx context.Context) error {
+	fn.Gen.Setup(ctx)
+	fn.tools = make(map[string]agentTool)
+	if len(fn.GCSAllow) > 0 {
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to create storage client for gcs_read: %w", err)
+		}
+		fn.register(&gcsReadTool{client: client, allow: fn.GCSAllow})
+	}
+	if len(fn.ReferenceTables) > 0 {
+		tables, err := parseReferenceTables(fn.ReferenceTables)
+		if err != nil {
+			return err
+		}
+		client, err := bigquery.NewClient(ctx, fn.LookupProject)
+		if err != nil {
+			return fmt.Errorf("failed to create bigquery client for bq_lookup: %w", err)
+		}
+		fn.register(newBQLookupTool(client, tables))
+	}
+	if len(fn.HTTPAllow) > 0 {
+		fn.register(newHTTPGetTool(fn.HTTPAllow, fn.HTTPTimeout, fn.HTTPMaxBytes))
+	}
+	return nil
+}
+
+func (fn *AgentFn) register(t agentTool) {
+	fn.tools[t.Name()] = t
+}
+
+func (fn *AgentFn) StartBundle(ctx context.Context, emit func(GeminiResult), emitTrajectory func(AgentTrajectory), emitFailed func(FailedCall)) {
+	fn.Gen.startBundle()
+}
+
+func (fn *AgentFn) FinishBundle(ctx context.Context, emit func(GeminiResult), emitTrajectory func(AgentTrajectory), emitFailed func(FailedCall)) {
+	fn.Gen.finishBundle(ctx)
+}
+
+func (fn *AgentFn) Teardown(ctx context.Context) {
+	fn.Gen.Teardown(ctx)
+}
+
+// preamble describes the registered tools and the reply protocol.
+func (fn *AgentFn) preamble() string {
+	names := make([]string, 0, len(fn.tools))
+	for name := range fn.tools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("You can use tools to complete the task. Reply with exactly one JSON object per turn: ")
+	b.WriteString(`{"tool": "<name>", "input": "<argument>"} to call a tool, or {"final": "<answer>"} when done.`)
+	b.WriteString("\nTools:\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "- %s: %s\n", name, fn.tools[name].Description())
+	}
+	return b.String()
+}
+
+func (fn *AgentFn) ProcessElement(ctx context.Context, p Prompt, emit func(GeminiResult), emitTrajectory func(AgentTrajectory), emitFailed func(FailedCall)) {
+	gen := fn.Gen
+	if gen.identityErr != nil {
+		beamlog.Errorf(ctx, "AgentFn: Skipping processing for prompt '%s' due to worker identity error: %v", gen.LogPolicy.redact(p.Prompt), gen.identityErr)
+		return
+	}
+	model := gen.ModelName
+	promptHash := PromptHash(p.Prompt, model, gen.parameters())
+	traj := AgentTrajectory{RunID: gen.RunID, PromptHash: promptHash, Prompt: p.Prompt, Status: agentMaxTurns}
+	transcript := fn.preamble() + "\nTask: " + p.Prompt
+
+	callStart := time.Now()
+	var final vertexOutput
+	var callErr error
+	for turn := 1; turn <= fn.MaxTurns; turn++ {
+		out, err := gen.guardedPredict(ctx, model, transcript, gen.parameters())
+		if err != nil {
+			callErr = err
+			gen.ErrorCounter.Inc(ctx, 1)
+			beamlog.Errorf(ctx, "AgentFn: Turn %d failed for prompt '%s': %v", turn, gen.LogPolicy.redact(p.Prompt), err)
+			traj.Status = agentError
+			traj.Turns = append(traj.Turns, AgentTurn{Turn: turn, Observation: gen.LogPolicy.redact(err.Error()), RequestID: requestIDOf(err)})
+			break
+		}
+		traj.PromptTokens += out.PromptTokens
+		traj.OutputTokens += out.OutputTokens
+
+		step := AgentTurn{Turn: turn, ModelText: out.Text, RequestID: out.RequestID}
+		action := parseAgentAction(out.Text)
+		if action.Final != nil {
+			traj.Turns = append(traj.Turns, step)
+			traj.Status = agentFinal
+			final = out
+			final.Text = *action.Final
+			break
+		}
+		if fn.TokenBudget > 0 && traj.PromptTokens+traj.OutputTokens >= fn.TokenBudget {
+			traj.Turns = append(traj.Turns, step)
+			traj.Status = agentOverBudget
+			break
+		}
+
+		step.Tool, step.ToolInput = action.Tool, action.input()
+		step.Observation = fn.callTool(ctx, step.Tool, step.ToolInput)
+		traj.Turns = append(traj.Turns, step)
+		transcript += "\nAssistant: " + out.Text + "\nObservation: " + step.Observation
+	}
+	traj.CompletedAt = time.Now().UTC()
+	emitTrajectory(traj)
+
+	if traj.Status != agentFinal {
+		beamlog.Warnf(ctx, "AgentFn: Prompt '%s' ended with status %s after %d turns", gen.LogPolicy.redact(p.Prompt), traj.Status, len(traj.Turns))
+		emitFailed(fn.failedRun(p, promptHash, model, traj, callErr))
+		return
+	}
+	final.PromptTokens, final.OutputTokens = traj.PromptTokens, traj.OutputTokens
+	final.LatencyMs = time.Since(callStart).Milliseconds()
+	gen.emitResult(p, promptHash, model, final, emit)
+}
+
+// failedRun builds the dead letter of a run that ended without an answer,
+// with the trajectory that led there.
+func (fn *AgentFn) failedRun(p Prompt, promptHash, model string, traj AgentTrajectory, err error) FailedCall {
+	if err == nil {
+		err = fmt.Errorf("agent run ended with status %s after %d turns", traj.Status, len(traj.Turns))
+	}
+	fc := fn.Gen.failedCall(p, promptHash, model, err)
+	if fc.ErrorStatus == "" {
+		fc.ErrorStatus = traj.Status
+	}
+	if turns, err := json.Marshal(traj.Turns); err == nil {
+		fc.Trajectory = string(turns)
+	}
+	return fc
+}
+
+// callTool runs a tool and renders its result (or error) as an observation.
+func (fn *AgentFn) callTool(ctx context.Context, name, input string) string {
+	t, ok := fn.tools[name]
+	if !ok {
+		return fmt.Sprintf("error: unknown tool %q", name)
+	}
+	obs, err := t.Call(ctx, input)
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	if len(obs) > agentObservationLimit {
+		obs = obs[:agentObservationLimit] + "\n[truncated]"
+	}
+	return obs
+}
+
+// underPrefix reports whether a path is the prefix or lies below it, matching
+// whole segments only: /docs allows /docs and /docs/a, not /docs-old.
+func underPrefix(p, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// splitObjectURI splits a gs://bucket/object URI; the object may be empty.
+func splitObjectURI(uri string) (bucket, object string, ok bool) {
+	rest, ok := strings.CutPrefix(uri, "gs://")
+	if !ok {
+		return "", "", false
+	}
+	bucket, object, _ = strings.Cut(rest, "/")
+	return bucket, object, bucket != ""
+}
+
+// allowedObject reports whether the object is in the bucket of an
+// allow-listed gs:// prefix, under its object prefix.
+func allowedObject(uri string, allow []string) bool {
+	bucket, object, ok := splitObjectURI(uri)
+	if !ok || object == "" {
+		return false
+	}
+	for _, a := range allow {
+		if b, prefix, ok := splitObjectURI(a); ok && b == bucket && underPrefix(object, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkObjectAllowList validates --agent_gcs_allow.
+func checkObjectAllowList(allow []string) error {
+	for _, a := range allow {
+		if _, _, ok := splitObjectURI(a); !ok {
+			return fmt.Errorf("invalid entry %q (want gs://bucket or gs://bucket/prefix)", a)
+		}
+	}
+	return nil
+}
+
+// --- Built-in tools ---
+
+// gcsReadTool returns the start of an allow-listed GCS object.
+type gcsReadTool struct {
+	client *storage.Client
+	allow  []string
+}
+
+func (t *gcsReadTool) Name() string { return "gcs_read" }
+func (t *gcsReadTool) Description() string {
+	return "read a text object; input is a gs://bucket/object URI"
+}
+
+func (t *gcsReadTool) Call(ctx context.Context, input string) (string, error) {
+	uri := strings.TrimSpace(input)
+	bucket, object, ok := splitObjectURI(uri)
+	if !ok || object == "" {
+		return "", fmt.Errorf("not a gs:// object URI: %s", uri)
+	}
+	if !allowedObject(uri, t.allow) {
+		return "", fmt.Errorf("%s is not allow-listed", uri)
+	}
+	r, err := t.client.Bucket(bucket).Object(object).NewRangeReader(ctx, 0, agentObservationLimit+1)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	body, err := io.ReadAll(r)
+	return string(body), err
+}
+
+// runAgent answers each prompt with the agent loop and writes trajectories for audit.
+func runAgent(s beam.Scope, projects runProjects, model *modelStage, prompts beam.PCollection) beam.PCollection {
+	s = s.Scope("Agent")
+	model.inputs = append(model.inputs, prompts)
+	results, trajectories, failed := beam.ParDo3(s, &AgentFn{
+		Gen:         model.fnFor(stageAgent),
+		MaxTurns:    *maxTurns,
+		TokenBudget: *agentTokenBudget,
+		HTTPAllow:   splitList(*agentHTTPAllow),
+		GCSAllow:    splitList(*agentGCSAllow),
+
+		HTTPTimeout:  *agentHTTPTimeout,
+		HTTPMaxBytes: *agentHTTPMaxBytes,
+
+		ReferenceTables: splitList(*agentBQTables),
+		LookupProject:   projects.Input,
+	}, prompts)
+	if *agentTrajectoryTable != "" {
+		tableName := fmt.Sprintf("%s:%s.%s", projects.Output, outputDataset, *agentTrajectoryTable)
+		bigqueryio.Write(s.Scope("WriteTrajectories"), projects.Output, tableName, trajectories)
+	}
+	model.failures = append(model.failures, failed)
+	return results
+}
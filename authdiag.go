@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+	"golang.org/x/oauth2"
+)
+
+// --- 401/403 diagnostics ---
+
+// A 401 or 403 from Vertex AI says little more than "permission denied", and
+// the usual causes (the API is disabled, the identity lacks
+// roles/aiplatform.user, the token was minted without the cloud-platform scope)
+// look the same. The first such error of a project on a worker is diagnosed:
+// the ErrorInfo reason of the error names the cause when Google sent one,
+// otherwise the token's scopes, the API's state in Service Usage and the
+// identity's permissions on the project are probed, each with the credentials
+// that failed. The resulting remediation, a command to run where there is one,
+// is appended to the error, so it reaches the logs and the dead letters.
+// Probes that are themselves denied are skipped.
+
+const (
+	vertexService     = "aiplatform.googleapis.com"
+	predictPermission = "aiplatform.endpoints.predict"
+	authProbeTimeout  = 10 * time.Second
+)
+
+// authDiagnosis is the remediation for one kind of auth failure in a project,
+// worked out once per worker; see registry.go.
+type authDiagnosis struct {
+	once sync.Once
+	hint string
+}
+
+// authFailure reports whether the call was rejected for its credentials.
+func (e *vertexAPIError) authFailure() bool {
+	return e.HTTPStatus == http.StatusUnauthorized || e.HTTPStatus == http.StatusForbidden
+}
+
+// errorInfo returns the reason and metadata of the google.rpc.ErrorInfo detail
+// of an API error, if it has one.
+func errorInfo(details string) (string, map[string]string) {
+	var ds []struct {
+		Type     string            `json:"@type"`
+		Reason   string            `json:"reason"`
+		Metadata map[string]string `json:"metadata"`
+	}
+	if details == "" || json.Unmarshal([]byte(details), &ds) != nil {
+		return "", nil
+	}
+	for _, d := range ds {
+		if strings.HasSuffix(d.Type, "google.rpc.ErrorInfo") {
+			return d.Reason, d.Metadata
+		}
+	}
+	return "", nil
+}
+
+// diagnoseAuthError sets the remediation hint of a 401 or 403 response.
+func (fn *GenerateTextFn) diagnoseAuthError(ctx context.Context, client *http.Client, e *vertexAPIError) {
+	if !e.authFailure() {
+		return
+	}
+	reason, meta := errorInfo(e.Details)
+	d := sharedWorkerRegistry().authDiagnosis(fmt.Sprintf("%s|%d|%s", e.Project, e.HTTPStatus, reason))
+	d.once.Do(func() {
+		// Probes must finish even when the element's context is about to be cancelled
+		probeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), authProbeTimeout)
+		defer cancel()
+		d.hint = fn.authRemediation(probeCtx, client, e, reason, meta)
+		beamlog.Errorf(ctx, "GenerateTextFn: Vertex AI rejected the credentials for project %s (status %d, reason %q): %s", e.Project, e.HTTPStatus, reason, d.hint)
+	})
+	e.Hint = d.hint
+}
+
+// authRemediation explains the failure from its reason, or probes for the cause.
+func (fn *GenerateTextFn) authRemediation(ctx context.Context, client *http.Client, e *vertexAPIError, reason string, meta map[string]string) string {
+	scopes, email, scopesErr := tokenInfo(ctx, client)
+	identity := email
+	if identity == "" && fn.workerIdentity != "unknown" {
+		identity = fn.workerIdentity
+	}
+	enable := fmt.Sprintf("the Vertex AI API is disabled in project %s; enable it with `gcloud services enable %s --project=%s` and allow a few minutes to propagate", e.Project, vertexService, e.Project)
+	grant := func(permission string) string {
+		return fmt.Sprintf("%s lacks %s on project %s; grant it with `gcloud projects add-iam-policy-binding %s --member=%s --role=roles/aiplatform.user`",
+			identityName(identity), permission, e.Project, e.Project, iamMember(identity))
+	}
+	scope := func(has []string) string {
+		return fmt.Sprintf("the access token of %s lacks the %s scope (it has: %s); on Compute Engine give the VM the cloud-platform access scope, for user credentials rerun `gcloud auth application-default login`",
+			identityName(identity), cloudPlatformScope, strings.Join(has, " "))
+	}
+
+	switch reason {
+	case "SERVICE_DISABLED":
+		return enable
+	case "IAM_PERMISSION_DENIED":
+		permission := meta["permission"]
+		if permission == "" {
+			permission = predictPermission
+		}
+		return grant(permission)
+	case "ACCESS_TOKEN_SCOPE_INSUFFICIENT":
+		return scope(scopes)
+	case "BILLING_DISABLED":
+		return fmt.Sprintf("billing is disabled on project %s; link a billing account with `gcloud billing projects link %s --billing-account=ACCOUNT_ID`", e.Project, e.Project)
+	case "SECURITY_POLICY_VIOLATED":
+		return fmt.Sprintf("a VPC Service Controls perimeter around project %s blocked the call; run the workers inside the perimeter or add an ingress rule for %s", e.Project, identityName(identity))
+	case "ACCESS_TOKEN_EXPIRED", "ACCOUNT_STATE_INVALID", "CREDENTIALS_MISSING":
+		return credentialsHint(identity)
+	}
+
+	// No telling reason; probe with the credentials that failed
+	var unknown []string
+	switch {
+	case scopesErr != nil:
+		unknown = append(unknown, "token scopes")
+	case !slices.Contains(scopes, cloudPlatformScope):
+		return scope(scopes)
+	}
+	if enabled, err := serviceEnabled(ctx, client, e.Project, vertexService); err != nil {
+		unknown = append(unknown, "API state")
+	} else if !enabled {
+		return enable
+	}
+	if granted, err := hasPermission(ctx, client, e.Project, predictPermission); err != nil {
+		unknown = append(unknown, "IAM permissions")
+	} else if !granted {
+		return grant(predictPermission)
+	}
+	if e.HTTPStatus == http.StatusUnauthorized {
+		return credentialsHint(identity)
+	}
+	hint := fmt.Sprintf("check that %s is enabled in project %s and that %s has roles/aiplatform.user there (or on the model's endpoint)", vertexService, e.Project, identityName(identity))
+	if len(unknown) > 0 {
+		hint += fmt.Sprintf("; could not check the %s", strings.Join(unknown, ", "))
+	}
+	return hint
+}
+
+// credentialsHint is the remediation for credentials Google no longer accepts.
+func credentialsHint(identity string) string {
+	account := "SA_EMAIL"
+	if strings.HasSuffix(identity, ".gserviceaccount.com") {
+		account = identity
+	}
+	return fmt.Sprintf("the credentials of %s were rejected as expired, revoked, or disabled; rerun `gcloud auth application-default login` for user credentials, or check that the service account and its key are enabled (`gcloud iam service-accounts keys list --iam-account=%s`)", identityName(identity), account)
+}
+
+// identityName is the identity for a message, or a stand-in when it is unknown.
+func identityName(identity string) string {
+	if identity == "" {
+		return "the worker's identity"
+	}
+	return identity
+}
+
+// iamMember is the IAM principal of an identity, e.g. serviceAccount:sa@p.iam.gserviceaccount.com.
+func iamMember(identity string) string {
+	switch {
+	case identity == "":
+		return "serviceAccount:SA_EMAIL"
+	case strings.HasSuffix(identity, ".gserviceaccount.com"):
+		return "serviceAccount:" + identity
+	}
+	return "user:" + identity
+}
+
+// tokenInfo returns the scopes and, when the token carries it, the email of
+// the client's access token.
+func tokenInfo(ctx context.Context, client *http.Client) ([]string, string, error) {
+	t, ok := client.Transport.(*oauth2.Transport)
+	if !ok {
+		return nil, "", fmt.Errorf("client has no token source")
+	}
+	tok, err := t.Source.Token()
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get token: %w", err)
+	}
+	var info struct {
+		Scope string `json:"scope"`
+		Email string `json:"email"`
+	}
+	// The token goes in the query, so ask without the client's own credentials
+	u := "https://oauth2.googleapis.com/tokeninfo?access_token=" + url.QueryEscape(tok.AccessToken)
+	if err := probeJSON(ctx, http.DefaultClient, http.MethodGet, u, nil, &info); err != nil {
+		return nil, "", err
+	}
+	return strings.Fields(info.Scope), info.Email, nil
+}
+
+// serviceEnabled reports whether the service is enabled in the project.
+func serviceEnabled(ctx context.Context, client *http.Client, project, service string) (bool, error) {
+	var state struct {
+		State string `json:"state"`
+	}
+	u := fmt.Sprintf("https://serviceusage.googleapis.com/v1/projects/%s/services/%s", url.PathEscape(project), service)
+	if err := probeJSON(ctx, client, http.MethodGet, u, nil, &state); err != nil {
+		return false, err
+	}
+	return state.State == "ENABLED", nil
+}
+
+// hasPermission reports whether the client's identity holds the permission on the project.
+func hasPermission(ctx context.Context, client *http.Client, project, permission string) (bool, error) {
+	var granted struct {
+		Permissions []string `json:"permissions"`
+	}
+	u := fmt.Sprintf("https://cloudresourcemanager.googleapis.com/v1/projects/%s:testIamPermissions", url.PathEscape(project))
+	body := map[string][]string{"permissions": {permission}}
+	if err := probeJSON(ctx, client, http.MethodPost, u, body, &granted); err != nil {
+		return false, err
+	}
+	return slices.Contains(granted.Permissions, permission), nil
+}
+
+// probeJSON sends a probe request and decodes its JSON response.
+func probeJSON(ctx context.Context, client *http.Client, method, u string, body, out any) error {
+	var payload io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, payload)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("probe %s returned status %d", req.URL.Host, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+	"unicode/utf8"
+
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+)
+
+// --- Multiple instances per predict request ---
+
+// Models served through :predict accept several instances in one request and
+// answer with one prediction per instance, in order. Under
+// --instances_per_request GenerateTextFn holds prompts back until it has that
+// many with the same parameters (or the bundle ends) and sends them together.
+// Cache hits and stale elements never wait. A batch that fails as a whole is
+// retried as a batch under the same backoff as a single prompt. Only when the
+// endpoint rejects the batch itself (a 400 or 413, or the wrong number of
+// predictions) are its prompts sent one at a time, so model upgrades work as
+// they do without batching; any other final error dead-letters every prompt
+// in it. Models called through generateContent take one prompt per request
+// and are never held back.
+
+// errBatchMismatch means the endpoint answered a batch with the wrong number of predictions.
+var errBatchMismatch = errors.New("prediction count does not match instance count")
+
+// pendingInstance is a prompt waiting for a batched request.
+type pendingInstance struct {
+	Prompt     Prompt
+	Model      string // Routed model; a batch shares one, see router.go
+	Params     VertexParameters
+	PromptHash string
+	trace      *rowTrace // Carried over so the row's trace covers its wait
+}
+
+// enqueue adds a prompt to the pending batch, sending the batch first when the
+// prompt needs another model or other parameters and afterwards when it is full.
+func (fn *GenerateTextFn) enqueue(ctx context.Context, pi pendingInstance, emit func(GeminiResult), emitFailed func(FailedCall)) {
+	if len(fn.pending) > 0 && (fn.pending[0].Model != pi.Model || !reflect.DeepEqual(fn.pending[0].Params, pi.Params)) {
+		fn.flushPending(ctx, emit, emitFailed)
+	}
+	if len(fn.pending) == 0 {
+		fn.batchTarget = fn.batchSize()
+	}
+	fn.pending = append(fn.pending, pi)
+	if len(fn.pending) >= fn.batchTarget {
+		fn.flushPending(ctx, emit, emitFailed)
+	}
+}
+
+// flushPending sends the pending prompts as one request and finishes each row
+// from its own prediction.
+func (fn *GenerateTextFn) flushPending(ctx context.Context, emit func(GeminiResult), emitFailed func(FailedCall)) {
+	batch := fn.pending
+	fn.pending = nil
+	if len(batch) == 0 {
+		return
+	}
+	if len(batch) == 1 {
+		fn.trace = batch[0].trace
+		fn.generate(ctx, batch[0].Prompt, batch[0].Params, batch[0].PromptHash, false, emit, emitFailed)
+		return
+	}
+
+	prompts := make([]string, len(batch))
+	for i, pi := range batch {
+		prompts[i] = pi.Prompt.Prompt
+	}
+	model := batch[0].Model
+	callStart := time.Now()
+	outs, err := fn.predictBatch(ctx, model, batch, prompts)
+
+	if isBatchRejection(err) {
+		fn.BatchFallbackCounter.Inc(ctx, 1)
+		beamlog.Warnf(ctx, "GenerateTextFn: Request with %d instances was rejected, sending them one at a time: %v", len(batch), err)
+		for _, pi := range batch {
+			fn.trace = pi.trace
+			fn.generate(ctx, pi.Prompt, pi.Params, pi.PromptHash, false, emit, emitFailed)
+		}
+		return
+	}
+	if err != nil {
+		for _, pi := range batch {
+			fn.trace = pi.trace
+			fn.failGeneration(ctx, pi.Prompt, pi.PromptHash, model, err, emit, emitFailed)
+		}
+		return
+	}
+	for i, pi := range batch {
+		fn.trace = pi.trace
+		fn.finishGeneration(ctx, pi.Prompt, pi.Params, pi.PromptHash, model, false, outs[i], callStart, emit, emitFailed)
+	}
+}
+
+// predictBatch sends a batch as one request, retrying it whole as
+// --retry_config or --max_retries classify its errors. Every attempt is
+// recorded in each prompt's trace, and a returned error carries the number of
+// calls made, for the dead letters.
+func (fn *GenerateTextFn) predictBatch(ctx context.Context, model string, batch []pendingInstance, prompts []string) ([]vertexOutput, error) {
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		outs, err := fn.guardedPredictInstances(ctx, model, prompts, batch[0].Params)
+		fn.BatchRequestCounter.Inc(ctx, 1)
+		for i, pi := range batch {
+			fn.trace = pi.trace
+			var out vertexOutput
+			if err == nil {
+				out = outs[i]
+			}
+			fn.traceAttempt(model, out, err, start)
+		}
+		fn.noteQuotaError(ctx, err)
+		if err == nil || isBatchRejection(err) || !fn.retryWait(ctx, err, attempt) {
+			fn.AttemptDistribution.Update(ctx, int64(attempt))
+			return outs, withAttempts(err, attempt)
+		}
+	}
+}
+
+// isBatchRejection reports whether an error is about the batch rather than
+// the service: a bad request, which a prompt too long for the model also
+// gets, a payload over the request size limit, or a miscounted response.
+func isBatchRejection(err error) bool {
+	if err == nil {
+		return false
+	}
+	var apiErr *vertexAPIError
+	if errors.As(err, &apiErr) && (apiErr.HTTPStatus == http.StatusBadRequest || apiErr.HTTPStatus == http.StatusRequestEntityTooLarge) {
+		return true
+	}
+	return errors.Is(err, errBatchMismatch) || isContextOverflowError(err)
+}
+
+// splitBatchResponse turns a response to several instances into one
+// single-prediction response per prompt. Token counts are only reported for
+// the whole request, so they are shared out: input tokens in proportion to
+// prompt length and output tokens in proportion to answer length, keeping the
+// totals exact.
+func splitBatchResponse(body []byte, prompts []string) ([][]byte, error) {
+	var resp struct {
+		Predictions    []json.RawMessage `json:"predictions"`
+		ModelVersionID string            `json:"modelVersionId,omitempty"`
+		Metadata       VertexMetadata    `json:"metadata"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal batched vertex response: %w", err)
+	}
+	if len(resp.Predictions) != len(prompts) {
+		return nil, fmt.Errorf("%w: sent %d, got %d", errBatchMismatch, len(prompts), len(resp.Predictions))
+	}
+
+	inWeights := make([]int, len(prompts))
+	outWeights := make([]int, len(prompts))
+	for i, raw := range resp.Predictions {
+		inWeights[i] = utf8.RuneCountInString(prompts[i])
+		var pred VertexPrediction
+		if json.Unmarshal(raw, &pred) == nil {
+			outWeights[i] = utf8.RuneCountInString(pred.Content)
+		}
+	}
+	tokens := resp.Metadata.TokenMetadata
+	inShares := shareOut(tokens.InputTokenCount.TotalTokens, inWeights)
+	outShares := shareOut(tokens.OutputTokenCount.TotalTokens, outWeights)
+
+	bodies := make([][]byte, len(prompts))
+	for i, raw := range resp.Predictions {
+		part := resp
+		part.Predictions = []json.RawMessage{raw}
+		part.Metadata.TokenMetadata.InputTokenCount.TotalTokens = inShares[i]
+		part.Metadata.TokenMetadata.OutputTokenCount.TotalTokens = outShares[i]
+		b, err := json.Marshal(part)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal prediction %d: %w", i, err)
+		}
+		bodies[i] = b
+	}
+	return bodies, nil
+}
+
+// shareOut splits total in proportion to the weights (evenly when they are
+// all zero); the shares always add up to total.
+func shareOut(total int64, weights []int) []int64 {
+	sum := 0
+	for _, w := range weights {
+		sum += w
+	}
+	shares := make([]int64, len(weights))
+	var given, cum int64
+	for i, w := range weights {
+		if sum == 0 {
+			cum = int64(i + 1)
+		} else {
+			cum += int64(w)
+		}
+		n := int64(sum)
+		if sum == 0 {
+			n = int64(len(weights))
+		}
+		upTo := total * cum / n
+		shares[i] = upTo - given
+		given = upTo
+	}
+	return shares
+}
+
+// totalOutput sums the token counts of a request's outputs, for accounting
+// that is kept per request.
+func totalOutput(outs []vertexOutput) vertexOutput {
+	var t vertexOutput
+	for _, out := range outs {
+		t.PromptTokens += out.PromptTokens
+		t.OutputTokens += out.OutputTokens
+	}
+	return t
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// --- Prompt batches ahead of the model stage ---
+
+// GenerateTextFn fills its requests from the prompts of one bundle (see
+// batch.go), so a runner that hands it small bundles gets small requests.
+// Under --batch_size the prompts are grouped into batches of that many first,
+// the way GroupIntoBatches does: each upstream bundle numbers its prompts and
+// keys every run of --batch_size under a key of its own, a GroupByKey collects
+// the runs, and each batch is handed on as consecutive elements.
+// --batch_size sets --instances_per_request to match. This is best-effort:
+// requests follow GenerateTextFn's pending queue, not the batch keys, so the
+// short last batch of an upstream bundle shifts the batches after it across
+// two requests, a bundle can end mid-batch, cache hits and stale elements
+// skip the queue, and a prompt for another model or with other parameters
+// sends the queue early. Only predict models take several instances per
+// request; prompts for generateContent models are still sent one at a time.
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*KeyPromptBatchFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*EmitPromptBatchFn)(nil)).Elem())
+}
+
+// KeyPromptBatchFn assigns every run of Size prompts of a bundle to one batch.
+type KeyPromptBatchFn struct {
+	Size int
+
+	bundle string // Random per bundle, so batches of different bundles never share a key
+	n      int
+}
+
+func (fn *KeyPromptBatchFn) StartBundle() {
+	fn.bundle = strconv.FormatUint(rand.Uint64(), 36)
+	fn.n = 0
+}
+
+func (fn *KeyPromptBatchFn) ProcessElement(p Prompt) (string, Prompt) {
+	key := fmt.Sprintf("%s/%d", fn.bundle, fn.n/fn.Size)
+	fn.n++
+	return key, p
+}
+
+// EmitPromptBatchFn hands the prompts of a batch on one after another.
+type EmitPromptBatchFn struct {
+	batches beam.Counter
+}
+
+func (fn *EmitPromptBatchFn) Setup() {
+	fn.batches = beam.NewCounter("batching", "batches_total")
+}
+
+func (fn *EmitPromptBatchFn) ProcessElement(ctx context.Context, _ string, prompts func(*Prompt) bool, emit func(Prompt)) {
+	var p Prompt
+	for prompts(&p) {
+		emit(p)
+	}
+	fn.batches.Inc(ctx, 1)
+}
+
+// groupIntoBatches regroups the prompts into batches of size.
+func groupIntoBatches(s beam.Scope, size int, prompts beam.PCollection) beam.PCollection {
+	s = s.Scope("GroupIntoBatches")
+	keyed := beam.ParDo(s, &KeyPromptBatchFn{Size: size}, prompts)
+	return beam.ParDo(s, &EmitPromptBatchFn{}, beam.GroupByKey(s, keyed))
+}
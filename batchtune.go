@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+)
+
+// --- Batch size auto-tuning ---
+
+// The best --instances_per_request depends on the quota, the rate limiter, and
+// how the endpoint's latency grows with the request size, none of which are
+// known before the run. Under --batch_autotune every worker experiments with
+// sizes from 1 up to --instances_per_request (powers of two, plus the limit
+// itself) for that long at the start of the run, giving each size in turn to
+// the next batch so they are sampled about equally. Each request is timed from
+// the rate limiter wait to the response, so throttling and quota waits count
+// against the size that caused them, and prompts answered per second of that
+// time scores the size. Once the period is over and every size has enough
+// requests, the worker keeps the best one for the rest of the run and logs the
+// scores behind its decision. Each stage is tuned separately, as its prompts
+// differ.
+
+// minTrialRequests is how many requests a size needs before it can be judged.
+const minTrialRequests = 5
+
+// batchTrial is the record of the requests sent with one size.
+type batchTrial struct {
+	Requests int64
+	Failed   int64
+	Prompts  int64 // Prompts answered by the successful requests
+	Elapsed  time.Duration
+}
+
+// throughput is the prompts answered per second of request time.
+func (t *batchTrial) throughput() float64 {
+	if t.Elapsed <= 0 {
+		return 0
+	}
+	return float64(t.Prompts) / t.Elapsed.Seconds()
+}
+
+// batchTuner chooses the instances per request of one stage on a worker. Every
+// bundle thread shares it, see registry.go.
+type batchTuner struct {
+	stage  string
+	sizes  []int // Candidate sizes, ascending
+	period time.Duration
+
+	mu     sync.Mutex
+	start  time.Time // First recorded request
+	trials map[int]*batchTrial
+	chosen int // 0 while experimenting
+}
+
+func newBatchTuner(stage string, maxSize int, period time.Duration) *batchTuner {
+	var sizes []int
+	for n := 1; n < maxSize; n *= 2 {
+		sizes = append(sizes, n)
+	}
+	sizes = append(sizes, maxSize)
+	return &batchTuner{stage: stage, sizes: sizes, period: period, trials: make(map[int]*batchTrial)}
+}
+
+// size returns the size for the next batch: the chosen one, or while
+// experimenting the candidate with the fewest requests so far.
+func (t *batchTuner) size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.chosen > 0 {
+		return t.chosen
+	}
+	next := t.sizes[0]
+	for _, n := range t.sizes[1:] {
+		if t.requests(n) < t.requests(next) {
+			next = n
+		}
+	}
+	return next
+}
+
+func (t *batchTuner) requests(size int) int64 {
+	if trial, ok := t.trials[size]; ok {
+		return trial.Requests
+	}
+	return 0
+}
+
+// record adds a request of the given size to its trial and settles on a size
+// once the experiment is complete. Sizes that are not candidates (batches cut
+// short at the end of a bundle) are recorded but never chosen.
+func (t *batchTuner) record(ctx context.Context, size int, elapsed time.Duration, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.start.IsZero() {
+		t.start = time.Now().Add(-elapsed)
+	}
+	trial, found := t.trials[size]
+	if !found {
+		trial = &batchTrial{}
+		t.trials[size] = trial
+	}
+	trial.Requests++
+	trial.Elapsed += elapsed
+	if ok {
+		trial.Prompts += int64(size)
+	} else {
+		trial.Failed++
+	}
+	if t.chosen > 0 || time.Since(t.start) < t.period {
+		return
+	}
+	best := 0
+	for _, n := range t.sizes {
+		if t.requests(n) < minTrialRequests {
+			return
+		}
+		if best == 0 || t.trials[n].throughput() > t.trials[best].throughput() {
+			best = n
+		}
+	}
+	t.chosen = best
+	beamlog.Infof(ctx, "GenerateTextFn: Batch tuner settled on %d instances per request for stage %s after %v (%s)", best, t.stage, time.Since(t.start).Round(time.Second), t.summary())
+}
+
+// summary lists the score of every candidate, for the decision log.
+func (t *batchTuner) summary() string {
+	parts := make([]string, len(t.sizes))
+	for i, n := range t.sizes {
+		trial := t.trials[n]
+		parts[i] = fmt.Sprintf("%d: %.2f prompts/s over %d requests, %d failed", n, trial.throughput(), trial.Requests, trial.Failed)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// batchSize is the number of prompts to collect before sending a batch.
+func (fn *GenerateTextFn) batchSize() int {
+	if fn.tuner != nil {
+		return fn.tuner.size()
+	}
+	return fn.InstancesPerRequest
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// --- BigQuery lookup tool ---
+
+// bqLookupRowLimit caps the rows one lookup returns to the model.
+const bqLookupRowLimit = 20
+
+// referenceTable is one allow-listed lookup target from --agent_bq_tables.
+type referenceTable struct {
+	Alias     string // Name the model uses
+	Table     string // project.dataset.table
+	KeyColumn string // Column matched against the lookup key
+}
+
+// parseReferenceTables parses "alias=project.dataset.table:key_column" entries.
+func parseReferenceTables(entries []string) ([]referenceTable, error) {
+	var tables []referenceTable
+	for _, e := range entries {
+		alias, rest, ok := strings.Cut(e, "=")
+		table, column, ok2 := strings.Cut(rest, ":")
+		if !ok || !ok2 || alias == "" || table == "" || column == "" {
+			return nil, fmt.Errorf("invalid reference table %q (want alias=project.dataset.table:key_column)", e)
+		}
+		if strings.ContainsAny(table+column, "`") {
+			return nil, fmt.Errorf("invalid reference table %q: backticks are not allowed", e)
+		}
+		tables = append(tables, referenceTable{Alias: strings.TrimSpace(alias), Table: strings.TrimSpace(table), KeyColumn: strings.TrimSpace(column)})
+	}
+	return tables, nil
+}
+
+// bqLookupTool looks up rows by key in allow-listed reference tables. The model
+// only chooses the table alias and the key; the SQL is fixed and the key is
+// passed as a query parameter.
+type bqLookupTool struct {
+	client *bigquery.Client
+	tables map[string]referenceTable
+}
+
+func newBQLookupTool(client *bigquery.Client, tables []referenceTable) *bqLookupTool {
+	t := &bqLookupTool{client: client, tables: make(map[string]referenceTable)}
+	for _, rt := range tables {
+		t.tables[rt.Alias] = rt
+	}
+	return t
+}
+
+func (t *bqLookupTool) Name() string { return "bq_lookup" }
+
+func (t *bqLookupTool) Description() string {
+	aliases := make([]string, 0, len(t.tables))
+	for alias, rt := range t.tables {
+		aliases = append(aliases, fmt.Sprintf("%s (by %s)", alias, rt.KeyColumn))
+	}
+	sort.Strings(aliases)
+	return `look up reference rows; input is {"table": "<name>", "key": "<value>"}; tables: ` + strings.Join(aliases, ", ")
+}
+
+func (t *bqLookupTool) Call(ctx context.Context, input string) (string, error) {
+	var req struct {
+		Table string `json:"table"`
+		Key   string `json:"key"`
+	}
+	if err := json.Unmarshal([]byte(input), &req); err != nil {
+		return "", fmt.Errorf(`input must be {"table": ..., "key": ...}: %w`, err)
+	}
+	rt, ok := t.tables[req.Table]
+	if !ok {
+		return "", fmt.Errorf("table %q is not allow-listed", req.Table)
+	}
+
+	q := t.client.Query(fmt.Sprintf("SELECT * FROM `%s` WHERE CAST(`%s` AS STRING) = @key LIMIT %d", rt.Table, rt.KeyColumn, bqLookupRowLimit))
+	q.Parameters = []bigquery.QueryParameter{{Name: "key", Value: req.Key}}
+	it, err := q.Read(ctx)
+	if err != nil {
+		return "", fmt.Errorf("lookup in %s failed: %w", rt.Alias, err)
+	}
+	var lines []string
+	for {
+		var row map[string]bigquery.Value
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("lookup in %s failed: %w", rt.Alias, err)
+		}
+		b, err := json.Marshal(row)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, string(b))
+	}
+	if len(lines) == 0 {
+		return fmt.Sprintf("no rows in %s where %s = %q", rt.Alias, rt.KeyColumn, req.Key), nil
+	}
+	return strings.Join(lines, "\n"), nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"text/template"
+	"time"
+
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+)
+
+// --- Circuit breaker and fallback responder ---
+
+// errCircuitOpen is returned instead of calling the endpoint while the breaker is open.
+var errCircuitOpen = errors.New("vertex ai circuit breaker is open")
+
+// circuitBreaker trips after a run of consecutive endpoint failures and stays
+// open for a cooldown, after which one probe request is let through.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool // A half-open probe is in flight
+}
+
+// allow reports whether a request may be sent now.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record updates the breaker with the outcome of a request it allowed.
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// release gives back a request the breaker allowed but that was never sent,
+// so a half-open breaker can let another probe through.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// parseFallbackTemplate compiles --fallback_template; fields of Prompt are
+// available, e.g. "Unavailable for {{.ParentKey}}", as are the template variables.
+func parseFallbackTemplate(text string, vars map[string]string) (*template.Template, error) {
+	return template.New("fallback").Option("missingkey=error").Funcs(templateFuncs(vars)).Parse(text)
+}
+
+// breakerAllows reports whether the endpoint may be called, counting rejections.
+func (fn *GenerateTextFn) breakerAllows(ctx context.Context) bool {
+	if fn.breaker == nil || fn.breaker.allow() {
+		return true
+	}
+	fn.CircuitOpenCounter.Inc(ctx, 1)
+	return false
+}
+
+// recordOutcome feeds a call result to the breaker. Prompts that are too long
+// say nothing about endpoint health and are not counted as failures, nor are
+// quota errors while the quota pause or the project pool is backing off for
+// them.
+func (fn *GenerateTextFn) recordOutcome(err error) {
+	if fn.breaker == nil {
+		return
+	}
+	quotaHandled := (fn.quotaPause != nil || fn.projects != nil) && errors.Is(err, errQuotaExhausted)
+	fn.breaker.record(err != nil && !isContextOverflowError(err) && !quotaHandled)
+}
+
+// emitTemplateFallback renders the fallback template for a prompt that could not
+// be sent because the circuit is open. It reports false when no template is set.
+func (fn *GenerateTextFn) emitTemplateFallback(ctx context.Context, p Prompt, promptHash string, emit func(GeminiResult)) bool {
+	if fn.fallbackTmpl == nil {
+		return false
+	}
+	var buf bytes.Buffer
+	if err := fn.fallbackTmpl.Execute(&buf, p); err != nil {
+		beamlog.Errorf(ctx, "GenerateTextFn: Failed to render fallback template for prompt '%s': %v", fn.LogPolicy.redact(p.Prompt), err)
+		return false
+	}
+	fn.traceFallback("circuit_open")
+	fn.emitResult(p, promptHash, fn.route(p, fn.parametersFor(p)).Model, vertexOutput{Text: buf.String(), SafetyStatus: safetyUnknown, Fallback: true}, emit)
+	return true
+}
+
+// guardedPredict calls the endpoint through the quota pause, circuit breaker, and
+// rate limiter. A quota error with --quota_cooldown set gets one more attempt
+// once the cool-down is over, instead of failing the row, and under
+// --quota_projects one on each other project first; other errors are retried
+// as --retry_config or --max_retries classify them. A returned error
+// carries the number of calls made, for the dead letter.
+func (fn *GenerateTextFn) guardedPredict(ctx context.Context, model, prompt string, params VertexParameters) (vertexOutput, error) {
+	calls := 0
+	for attempt := 1; ; attempt++ {
+		out, err := fn.tracedPredictOnce(ctx, model, prompt, params)
+		calls++
+		quotaRetries := 1
+		if fn.projects != nil {
+			quotaRetries = len(fn.projects.members)
+		}
+		for fn.noteQuotaError(ctx, err) && quotaRetries > 0 {
+			quotaRetries--
+			out, err = fn.tracedPredictOnce(ctx, model, prompt, params)
+			calls++
+		}
+		if err == nil || !fn.retryWait(ctx, err, attempt) {
+			fn.AttemptDistribution.Update(ctx, int64(attempt))
+			return out, withAttempts(err, calls)
+		}
+	}
+}
+
+// singlePredict is the one call a stale element gets without --fallback_text:
+// no backoff and no re-send after a quota error, which still pauses the worker
+// or cools its project for the elements behind it.
+func (fn *GenerateTextFn) singlePredict(ctx context.Context, model, prompt string, params VertexParameters) (vertexOutput, error) {
+	out, err := fn.tracedPredictOnce(ctx, model, prompt, params)
+	fn.noteQuotaError(ctx, err)
+	fn.AttemptDistribution.Update(ctx, 1)
+	return out, withAttempts(err, 1)
+}
+
+// waitToSend takes a request from the stage budget and waits for the rate
+// limiters to let it go.
+func (fn *GenerateTextFn) waitToSend(ctx context.Context) error {
+	if fn.stageBudget != nil && !fn.stageBudget.take() {
+		return errStageBudgetSpent
+	}
+	if fn.stageBucket != nil {
+		if err := fn.stageBucket.wait(ctx); err != nil {
+			return fmt.Errorf("stage rate limiter wait: %w", err)
+		}
+	}
+	if fn.bucket != nil {
+		if err := fn.bucket.wait(ctx); err != nil {
+			return fmt.Errorf("rate limiter wait: %w", err)
+		}
+	}
+	return nil
+}
+
+// tracedPredictOnce is guardedPredictOnce, recorded in the row trace.
+func (fn *GenerateTextFn) tracedPredictOnce(ctx context.Context, model, prompt string, params VertexParameters) (vertexOutput, error) {
+	start := time.Now()
+	out, err := fn.guardedPredictOnce(ctx, model, prompt, params)
+	fn.traceAttempt(model, out, err, start)
+	return out, err
+}
+
+func (fn *GenerateTextFn) guardedPredictOnce(ctx context.Context, model, prompt string, params VertexParameters) (vertexOutput, error) {
+	outs, err := fn.guardedPredictInstances(ctx, model, []string{prompt}, params)
+	if err != nil {
+		return vertexOutput{}, err
+	}
+	return outs[0], nil
+}
+
+// guardedPredictInstances sends one request for several prompts through the
+// same quota, rate, and circuit guards as a single prompt. The breaker is
+// asked first, so calls it rejects spend neither the stage budget nor rate
+// tokens. The batch tuner times the request from the first guard on, see
+// batchtune.go.
+func (fn *GenerateTextFn) guardedPredictInstances(ctx context.Context, model string, prompts []string, params VertexParameters) (outs []vertexOutput, err error) {
+	if fn.tuner != nil && !usesGenerateContent(fn.APIMode, model) {
+		start := time.Now()
+		defer func() { fn.tuner.record(ctx, len(prompts), time.Since(start), err == nil) }()
+	}
+	waitStart := time.Now()
+	if fn.quotaPause != nil {
+		err := fn.quotaPause.wait(ctx)
+		fn.recordWait(ctx, time.Since(waitStart))
+		if err != nil {
+			return nil, fmt.Errorf("quota cool-down wait: %w", err)
+		}
+	}
+	if !fn.breakerAllows(ctx) {
+		return nil, errCircuitOpen
+	}
+	waitStart = time.Now()
+	err = fn.waitToSend(ctx)
+	fn.recordWait(ctx, time.Since(waitStart))
+	if err != nil {
+		if fn.breaker != nil {
+			fn.breaker.release()
+		}
+		return nil, err
+	}
+	outs, err = fn.callBackend(ctx, model, prompts, params)
+	fn.recordOutcome(err)
+	fn.adaptRate(ctx, err)
+	return outs, err
+}
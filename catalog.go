@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+// --- Data Catalog tagging ---
+
+const dataCatalogAPI = "https://datacatalog.googleapis.com/v1"
+
+// Fields of the --catalog_tag_template, created with the template when it
+// does not exist yet.
+var catalogTemplateFields = map[string]map[string]any{
+	"ai_generated":   {"displayName": "AI generated", "type": map[string]any{"primitiveType": "BOOL"}, "isRequired": true},
+	"model":          {"displayName": "Model", "type": map[string]any{"primitiveType": "STRING"}},
+	"run_id":         {"displayName": "Run ID", "type": map[string]any{"primitiveType": "STRING"}},
+	"prompt_version": {"displayName": "Prompt version", "type": map[string]any{"primitiveType": "STRING"}},
+	"tagged_at":      {"displayName": "Tagged at", "type": map[string]any{"primitiveType": "TIMESTAMP"}},
+}
+
+// catalogTemplateName expands a bare template ID to a resource name in the
+// job's project and region.
+func catalogTemplateName(template, project, region string) string {
+	if strings.HasPrefix(template, "projects/") {
+		return template
+	}
+	return fmt.Sprintf("projects/%s/locations/%s/tagTemplates/%s", project, region, template)
+}
+
+// tagOutputTables attaches the tag template to every planned output table, so
+// governance tooling can find AI-generated data. A table's existing tag from
+// the template is overwritten with the latest run's values.
+func tagOutputTables(ctx context.Context, project, region string) error {
+	client, err := google.DefaultClient(ctx, cloudPlatformScope)
+	if err != nil {
+		return fmt.Errorf("failed to create google default client (ADC issue?): %w", err)
+	}
+	template := catalogTemplateName(*catalogTagTemplate, project, region)
+	if err := ensureCatalogTemplate(ctx, client, template); err != nil {
+		return err
+	}
+
+	fields := map[string]any{
+		"ai_generated":   map[string]any{"boolValue": true},
+		"model":          map[string]any{"stringValue": *modelName},
+		"run_id":         map[string]any{"stringValue": *runID},
+		"prompt_version": map[string]any{"stringValue": *promptVersion},
+		"tagged_at":      map[string]any{"timestampValue": time.Now().UTC().Format(time.RFC3339)},
+	}
+	if *promptVersion == "" {
+		delete(fields, "prompt_version") // Data Catalog rejects empty strings
+	}
+	for _, spec := range plannedOutputTables() {
+		resource := fmt.Sprintf("//bigquery.googleapis.com/projects/%s/datasets/%s/tables/%s", project, outputDataset, spec.Table)
+		if err := tagCatalogEntry(ctx, client, resource, template, fields); err != nil {
+			return fmt.Errorf("table %s.%s: %w", outputDataset, spec.Table, err)
+		}
+	}
+	return nil
+}
+
+// ensureCatalogTemplate creates the tag template when it does not exist.
+func ensureCatalogTemplate(ctx context.Context, client *http.Client, template string) error {
+	status, err := catalogCall(ctx, client, "GET", dataCatalogAPI+"/"+template, nil, nil)
+	if err == nil || status != http.StatusNotFound {
+		return err
+	}
+	parent, id, _ := strings.Cut(template, "/tagTemplates/")
+	body := map[string]any{"displayName": "AI-generated data", "fields": catalogTemplateFields}
+	createURL := fmt.Sprintf("%s/%s/tagTemplates?tagTemplateId=%s", dataCatalogAPI, parent, url.QueryEscape(id))
+	if _, err := catalogCall(ctx, client, "POST", createURL, body, nil); err != nil {
+		return fmt.Errorf("failed to create tag template %s: %w", template, err)
+	}
+	log.Printf("Created Data Catalog tag template %s", template)
+	return nil
+}
+
+// tagCatalogEntry creates the tag on the entry of a linked resource, or
+// updates the entry's existing tag from the same template.
+func tagCatalogEntry(ctx context.Context, client *http.Client, resource, template string, fields map[string]any) error {
+	var entry struct {
+		Name string `json:"name"`
+	}
+	lookupURL := dataCatalogAPI + "/entries:lookup?linkedResource=" + url.QueryEscape(resource)
+	if status, err := catalogCall(ctx, client, "GET", lookupURL, nil, &entry); status == http.StatusNotFound {
+		log.Printf("Not tagging %s: the table was not created by this run", resource)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to look up catalog entry: %w", err)
+	}
+
+	var tags struct {
+		Tags []struct {
+			Name     string `json:"name"`
+			Template string `json:"template"`
+		} `json:"tags"`
+	}
+	if _, err := catalogCall(ctx, client, "GET", dataCatalogAPI+"/"+entry.Name+"/tags", nil, &tags); err != nil {
+		return fmt.Errorf("failed to list tags: %w", err)
+	}
+	for _, t := range tags.Tags {
+		if t.Template == template {
+			_, err := catalogCall(ctx, client, "PATCH", dataCatalogAPI+"/"+t.Name+"?updateMask=fields", map[string]any{"fields": fields}, nil)
+			if err != nil {
+				return fmt.Errorf("failed to update tag: %w", err)
+			}
+			return nil
+		}
+	}
+	if _, err := catalogCall(ctx, client, "POST", dataCatalogAPI+"/"+entry.Name+"/tags", map[string]any{"template": template, "fields": fields}, nil); err != nil {
+		return fmt.Errorf("failed to create tag: %w", err)
+	}
+	return nil
+}
+
+// catalogCall sends a Data Catalog request and decodes the response into out,
+// when given. The HTTP status is returned alongside errors so callers can
+// tell a missing resource from a failure.
+func catalogCall(ctx context.Context, client *http.Client, method, reqURL string, body, out any) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return 0, fmt.Errorf("failed to marshal data catalog request body: %w", err)
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, reader)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create data catalog request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send request to data catalog api: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("data catalog api %s failed with status %d: %s", method, resp.StatusCode, string(respBody))
+	}
+	if out != nil {
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return resp.StatusCode, fmt.Errorf("failed to parse data catalog response: %w", err)
+		}
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,42 @@
+#!/bin/bash
+# Translates the Go pipeline of every task into the portable Beam pipeline a
+# runner receives, without submitting it: Dataflow's --dry_run marshals the
+# same job proto the Flink and Spark job servers get through --runner
+# universal, so unregistered DoFns and other graph errors show up here.
+# Needs no credentials and no job server; BigQuery preparation warns and moves on.
+# --task classify reads its taxonomy from BigQuery at launch and is left out.
+set -u
+cd "$(dirname "$0")"
+
+BIN=$(mktemp)
+WORKFLOW=$(mktemp --suffix=.json)
+trap 'rm -f "$BIN" "$WORKFLOW"' EXIT
+go build -o "$BIN" . || exit 1
+echo '{"steps": [{"name": "extract", "template": "List the ingredients in: {{.Input}}"}]}' > "$WORKFLOW"
+
+status=0
+check() {
+    out=$("$BIN" --runner dataflow --dry_run \
+        --project smoke-check --region us-central1 \
+        --temp_location gs://smoke-check/temp --staging_location gs://smoke-check/staging \
+        "$@" 2>&1)
+    if [ $? -eq 0 ] && grep -q "Dry-run: not submitting job" <<< "$out"; then
+        echo "ok    $*"
+    else
+        echo "FAIL  $*"
+        grep -v '^[[:space:]]' <<< "$out" | grep -iv "credentials" | tail -5
+        status=1
+    fi
+}
+
+check --task generate
+check --task generate --fan_out --dedupe_prompts --batch_size 4 --hoist_shared_prefix_chars 100
+check --task group_summarize --group_by category
+check --task pairwise
+check --task best_of_n
+check --task workflow --workflow_file "$WORKFLOW"
+check --task agent
+check --input_sheet_id smoke-check --output_sheet_id smoke-check
+check --input_documents_prefix gs://smoke-check/docs --api_mode generate_content
+check --resume --output_gcs_prefix gs://smoke-check/results
+exit $status
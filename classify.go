@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/bigqueryio"
+	"google.golang.org/api/iterator"
+)
+
+// --- Hierarchical classification against a taxonomy ---
+
+// Under --task=classify each row is classified in two constrained calls: the
+// first picks a top-level category, the second picks among that category's
+// children. The taxonomy table has `code`, `parent_code` (NULL or empty for
+// top-level categories), and `name` columns; the model chooses by name.
+
+// Classification statuses.
+const (
+	classifyOK            = "ok"
+	classifyFailed        = "failed"         // A model call failed; see the level that is empty
+	classifyInvalidLevel1 = "invalid_level1" // Top-level answer is not a top-level category
+	classifyInvalidLevel2 = "invalid_level2" // Second answer is not a child of the chosen category
+)
+
+// taxonomyNode is one category.
+type taxonomyNode struct {
+	Code string
+	Name string
+}
+
+// taxonomy maps a parent code to its children; top-level categories are under "".
+type taxonomy map[string][]taxonomyNode
+
+// names returns the children's names, which are the allowed answers.
+func (t taxonomy) names(parent string) []string {
+	children := t[parent]
+	names := make([]string, len(children))
+	for i, c := range children {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// find returns the child of parent with the given name.
+func (t taxonomy) find(parent, name string) (taxonomyNode, bool) {
+	name = strings.TrimSpace(name)
+	for _, c := range t[parent] {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return taxonomyNode{}, false
+}
+
+// validate checks that every level can be offered as an enum: non-empty,
+// unique names among siblings, and within the enum size limit.
+func (t taxonomy) validate() error {
+	if len(t[""]) == 0 {
+		return fmt.Errorf("no top-level categories (rows with an empty parent_code)")
+	}
+	codes := make(map[string]bool)
+	for _, children := range t {
+		for _, c := range children {
+			codes[c.Code] = true
+		}
+	}
+	for parent, children := range t {
+		if parent != "" && !codes[parent] {
+			return fmt.Errorf("parent_code %q is not a category code", parent)
+		}
+		if len(children) > maxResponseEnumValues {
+			return fmt.Errorf("%q has %d children, more than the limit of %d", parent, len(children), maxResponseEnumValues)
+		}
+		seen := make(map[string]bool)
+		for _, c := range children {
+			if c.Name == "" || seen[c.Name] {
+				return fmt.Errorf("children of %q need distinct, non-empty names (got %q)", parent, c.Name)
+			}
+			seen[c.Name] = true
+		}
+	}
+	return nil
+}
+
+// classifyTaxonomy is loaded by main for --task=classify, before the graph is built.
+var classifyTaxonomy taxonomy
+
+// loadTaxonomy reads and validates a project.dataset.table taxonomy.
+func loadTaxonomy(ctx context.Context, project, table string) (taxonomy, error) {
+	if strings.Count(table, ".") != 2 || strings.Contains(table, "`") {
+		return nil, fmt.Errorf("invalid table %q (want project.dataset.table)", table)
+	}
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bigquery client: %w", err)
+	}
+	defer client.Close()
+	q := client.Query(fmt.Sprintf("SELECT CAST(code AS STRING) AS code, IFNULL(CAST(parent_code AS STRING), '') AS parent_code, CAST(name AS STRING) AS name FROM `%s` ORDER BY name", table))
+	it, err := q.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read taxonomy %s: %w", table, err)
+	}
+	t := make(taxonomy)
+	for {
+		var row struct {
+			Code       string `bigquery:"code"`
+			ParentCode string `bigquery:"parent_code"`
+			Name       string `bigquery:"name"`
+		}
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read taxonomy %s: %w", table, err)
+		}
+		t[row.ParentCode] = append(t[row.ParentCode], taxonomyNode{Code: row.Code, Name: strings.TrimSpace(row.Name)})
+	}
+	if err := t.validate(); err != nil {
+		return nil, fmt.Errorf("invalid taxonomy %s: %w", table, err)
+	}
+	return t, nil
+}
+
+// ClassificationResult is one row's two-level classification.
+type ClassificationResult struct {
+	RunID        string    `beam:"RunID"`
+	ParentKey    string    `beam:"ParentKey"`
+	Input        string    `beam:"Input"`
+	Level1Code   string    `beam:"Level1Code"`
+	Level1Name   string    `beam:"Level1Name"`
+	Level2Code   string    `beam:"Level2Code"` // Empty for leaf top-level categories
+	Level2Name   string    `beam:"Level2Name"`
+	Status       string    `beam:"Status"`    // ok, failed, invalid_level1, or invalid_level2
+	RawAnswer    string    `beam:"RawAnswer"` // Model answer for the level that failed validation
+	ClassifiedAt time.Time `beam:"ClassifiedAt"`
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*ClassificationResult)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*BuildTopLevelPromptFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*ChooseChildrenFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*FinishClassificationFn)(nil)).Elem())
+}
+
+// classifyPrompt renders the prompt for one level.
+func classifyPrompt(instruction, input, level string) string {
+	return fmt.Sprintf("%s\n\nChoose the %s that best fits the item below. Answer with the category name only.\n\nItem:\n%s", instruction, level, input)
+}
+
+// BuildTopLevelPromptFn emits the top-level prompt for each row and the row's
+// input, keyed, for the second level.
+type BuildTopLevelPromptFn struct {
+	Instruction string
+	Taxonomy    taxonomy
+}
+
+func (fn *BuildTopLevelPromptFn) ProcessElement(ctx context.Context, row PromptFromBQ, emit func(Prompt), emitInput func(string, string)) {
+	key := row.RowKey
+	if key == "" {
+		key = row.Prompt
+	}
+	emit(Prompt{Prompt: classifyPrompt(fn.Instruction, row.Prompt, "category"), ParentKey: key, Choices: fn.Taxonomy.names("")})
+	emitInput(key, row.Prompt)
+}
+
+// ChooseChildrenFn validates the top-level answer. Rows whose category has
+// children get a second prompt limited to those children; the rest are done.
+type ChooseChildrenFn struct {
+	RunID       string
+	Instruction string
+	Taxonomy    taxonomy
+}
+
+func (fn *ChooseChildrenFn) ProcessElement(key string, inputs func(*string) bool, results func(*GeminiResult) bool, emitPrompt func(Prompt), emitPending func(string, ClassificationResult), emitDone func(ClassificationResult)) {
+	var input string
+	if !inputs(&input) {
+		return
+	}
+	res := ClassificationResult{RunID: fn.RunID, ParentKey: key, Input: input}
+	var r GeminiResult
+	if !results(&r) {
+		res.Status = classifyFailed
+		res.ClassifiedAt = time.Now().UTC()
+		emitDone(res)
+		return
+	}
+	top, ok := fn.Taxonomy.find("", r.GeneratedText)
+	if !ok {
+		res.Status, res.RawAnswer = classifyInvalidLevel1, r.GeneratedText
+		res.ClassifiedAt = time.Now().UTC()
+		emitDone(res)
+		return
+	}
+	res.Level1Code, res.Level1Name = top.Code, top.Name
+	if len(fn.Taxonomy[top.Code]) == 0 {
+		res.Status = classifyOK
+		res.ClassifiedAt = time.Now().UTC()
+		emitDone(res)
+		return
+	}
+	level := fmt.Sprintf("subcategory of %q", top.Name)
+	emitPrompt(Prompt{Prompt: classifyPrompt(fn.Instruction, input, level), ParentKey: key, SubIndex: 1, Choices: fn.Taxonomy.names(top.Code)})
+	emitPending(key, res)
+}
+
+// FinishClassificationFn validates the second-level answer against the
+// children of the chosen top-level category.
+type FinishClassificationFn struct {
+	Taxonomy taxonomy
+}
+
+func (fn *FinishClassificationFn) ProcessElement(key string, pending func(*ClassificationResult) bool, results func(*GeminiResult) bool, emit func(ClassificationResult)) {
+	var res ClassificationResult
+	if !pending(&res) {
+		return
+	}
+	res.ClassifiedAt = time.Now().UTC()
+	var r GeminiResult
+	if !results(&r) {
+		res.Status = classifyFailed
+		emit(res)
+		return
+	}
+	child, ok := fn.Taxonomy.find(res.Level1Code, r.GeneratedText)
+	if !ok {
+		res.Status, res.RawAnswer = classifyInvalidLevel2, r.GeneratedText
+		emit(res)
+		return
+	}
+	res.Level2Code, res.Level2Name, res.Status = child.Code, child.Name, classifyOK
+	emit(res)
+}
+
+// classifyRows runs the classify task and writes one ClassificationResult per
+// row. The raw generations of both levels are returned for the regular result
+// sinks, distinguished by SubIndex 0 and 1.
+func classifyRows(s beam.Scope, projectID string, model *modelStage, t taxonomy, rows beam.PCollection) beam.PCollection {
+	s = s.Scope("Classify")
+	prompts, inputs := beam.ParDo2(s.Scope("BuildTopLevelPrompts"), &BuildTopLevelPromptFn{Instruction: *classifyInstruction, Taxonomy: t}, rows)
+	level1 := model.generate(s.Scope("ClassifyTopLevel"), stageClassify, prompts)
+
+	joined := beam.CoGroupByKey(s, inputs, beam.ParDo(s, keyByParent, level1))
+	childPrompts, pending, done := beam.ParDo3(s.Scope("ChooseChildren"), &ChooseChildrenFn{RunID: *runID, Instruction: *classifyInstruction, Taxonomy: t}, joined)
+	level2 := model.generate(s.Scope("ClassifySecondLevel"), stageClassify, childPrompts)
+
+	joined = beam.CoGroupByKey(s, pending, beam.ParDo(s, keyByParent, level2))
+	finished := beam.ParDo(s.Scope("FinishClassification"), &FinishClassificationFn{Taxonomy: t}, joined)
+
+	tableName := fmt.Sprintf("%s:%s.%s", projectID, outputDataset, *classificationTable)
+	bigqueryio.Write(s.Scope("WriteClassifications"), projectID, tableName, beam.Flatten(s, done, finished))
+	return beam.Flatten(s, level1, level2)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"reflect"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// --- Customer-managed encryption (CMEK) ---
+
+// applyKMSKey makes every artifact the job creates use the --kms_key:
+//   - Dataflow staging/temp files, by forwarding the key to --dataflow_kms_key
+//   - BigQuery output tables, by pre-creating missing tables with the key, since
+//     bigqueryio would otherwise create them with Google-managed encryption
+func applyKMSKey(ctx context.Context, project string) error {
+	if f := flag.Lookup("dataflow_kms_key"); f != nil {
+		if f.Value.String() == "" {
+			if err := f.Value.Set(*kmsKey); err != nil {
+				return fmt.Errorf("failed to set --dataflow_kms_key: %w", err)
+			}
+		} else if f.Value.String() != *kmsKey {
+			log.Printf("Warning: --dataflow_kms_key (%s) differs from --kms_key; Dataflow artifacts use the former", f.Value.String())
+		}
+	}
+
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return fmt.Errorf("failed to create bigquery client: %w", err)
+	}
+	defer client.Close()
+
+	for _, spec := range plannedOutputTables() {
+		if err := ensureEncryptedTable(ctx, client.Dataset(outputDataset).Table(spec.Table), spec.Row); err != nil {
+			return fmt.Errorf("table %s.%s: %w", outputDataset, spec.Table, err)
+		}
+	}
+	return nil
+}
+
+// ensureEncryptedTable creates the table with the KMS key when it does not exist yet and
+// warns when an existing table is encrypted with a different key.
+func ensureEncryptedTable(ctx context.Context, table *bigquery.Table, row reflect.Type) error {
+	md, err := table.Metadata(ctx)
+	if err == nil {
+		if md.EncryptionConfig == nil || md.EncryptionConfig.KMSKeyName != *kmsKey {
+			log.Printf("Warning: existing table %s is not encrypted with --kms_key; recreate it to apply CMEK", table.FullyQualifiedName())
+		}
+		return nil
+	}
+	if !isBigQueryNotFound(err) {
+		return fmt.Errorf("failed to read table metadata: %w", err)
+	}
+
+	schema, err := bigquery.InferSchema(reflect.Zero(row).Interface())
+	if err != nil {
+		return fmt.Errorf("failed to infer schema from %v: %w", row, err)
+	}
+	err = table.Create(ctx, &bigquery.TableMetadata{
+		Schema:           schema,
+		EncryptionConfig: &bigquery.EncryptionConfig{KMSKeyName: *kmsKey},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create CMEK-encrypted table: %w", err)
+	}
+	log.Printf("Created table %s encrypted with %s", table.FullyQualifiedName(), *kmsKey)
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+	"gopkg.in/yaml.v3"
+)
+
+// --- Run configuration sources ---
+
+// A configSource supplies flag values from somewhere other than the command
+// line, so a deployment can keep its whole run configuration in one central
+// place. Sources are listed in --config_sources and applied in order after
+// flag parsing: later sources override earlier ones, and flags given on the
+// command line override them all.
+type configSource interface {
+	Name() string
+	// Load returns flag values keyed by flag name (without dashes).
+	Load(ctx context.Context) (map[string]string, error)
+}
+
+// envConfigPrefix is prepended to upper-cased flag names to form environment
+// variable names, e.g. VERTEX_GEMINI_MODEL_NAME for --model_name.
+const envConfigPrefix = "VERTEX_GEMINI_"
+
+// Source specifiers accepted by --config_sources besides file paths.
+const (
+	configSourceFlags  = "flags"     // The command line itself; listing it is optional
+	configSourceEnv    = "env"       // VERTEX_GEMINI_* environment variables
+	secretSourcePrefix = "secret://" // secret://projects/P/secrets/S[/versions/V] holding a YAML document
+)
+
+// newConfigSource parses one --config_sources entry. Anything that is not a
+// keyword or a secret:// reference is a YAML file, local or on GCS.
+func newConfigSource(spec string) configSource {
+	switch {
+	case spec == configSourceFlags:
+		return flagsConfigSource{}
+	case spec == configSourceEnv:
+		return envConfigSource{}
+	case strings.HasPrefix(spec, secretSourcePrefix):
+		return secretConfigSource{Secret: secretVersion(spec)}
+	}
+	return yamlConfigSource{Path: spec}
+}
+
+// flagsConfigSource stands for the command line, which flag.Parse has
+// already applied.
+type flagsConfigSource struct{}
+
+func (flagsConfigSource) Name() string { return configSourceFlags }
+
+func (flagsConfigSource) Load(context.Context) (map[string]string, error) { return nil, nil }
+
+// envConfigSource reads VERTEX_GEMINI_* variables for every defined flag.
+type envConfigSource struct{}
+
+func (envConfigSource) Name() string { return configSourceEnv }
+
+func (envConfigSource) Load(context.Context) (map[string]string, error) {
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(envConfigPrefix + strings.ToUpper(f.Name)); ok {
+			values[f.Name] = v
+		}
+	})
+	return values, nil
+}
+
+// yamlConfigSource reads a YAML mapping of flag names to values from a local
+// path or gs:// URI. Lists are joined with commas, matching the list flags.
+type yamlConfigSource struct {
+	Path string
+}
+
+func (s yamlConfigSource) Name() string { return s.Path }
+
+func (s yamlConfigSource) Load(ctx context.Context) (map[string]string, error) {
+	raw, err := readConfigFile(ctx, s.Path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfigYAML(raw)
+}
+
+// secretConfigSource reads a YAML document from a Secret Manager secret
+// version, for configurations that carry credentials or keys.
+type secretConfigSource struct {
+	Secret string // projects/P/secrets/S/versions/V
+}
+
+func (s secretConfigSource) Name() string { return secretSourcePrefix + s.Secret }
+
+func (s secretConfigSource) Load(ctx context.Context) (map[string]string, error) {
+	raw, err := accessSecret(ctx, s.Secret)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfigYAML(raw)
+}
+
+// secretVersion turns a secret:// reference into a secret version name,
+// defaulting to the latest version.
+func secretVersion(spec string) string {
+	name := strings.TrimPrefix(spec, secretSourcePrefix)
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+	return name
+}
+
+// accessSecret returns the payload of a secret version (projects/P/secrets/S/versions/V).
+func accessSecret(ctx context.Context, version string) ([]byte, error) {
+	client, err := google.DefaultClient(ctx, cloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create google default client (ADC issue?): %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://secretmanager.googleapis.com/v1/"+version+":access", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create secret manager request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request to secret manager: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("secret manager access failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	var access struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &access); err != nil {
+		return nil, fmt.Errorf("failed to parse secret manager response: %w", err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(access.Payload.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode secret payload: %w", err)
+	}
+	return raw, nil
+}
+
+// parseConfigYAML flattens a YAML mapping into flag values.
+func parseConfigYAML(raw []byte) (map[string]string, error) {
+	var doc map[string]any
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse YAML config: %w", err)
+	}
+	values := make(map[string]string, len(doc))
+	for k, v := range doc {
+		switch x := v.(type) {
+		case nil:
+			values[k] = ""
+		case []any:
+			items := make([]string, len(x))
+			for i, item := range x {
+				items[i] = fmt.Sprint(item)
+			}
+			values[k] = strings.Join(items, ",")
+		case map[string]any:
+			return nil, fmt.Errorf("config key %s: nested mappings are not supported", k)
+		default:
+			values[k] = fmt.Sprint(x)
+		}
+	}
+	return values, nil
+}
+
+// applyConfigSources sets flags from each source in turn, skipping flags given
+// on the command line. Unknown keys are an error, so a typo cannot silently
+// leave a setting at its default.
+func applyConfigSources(ctx context.Context, specs []string) error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for _, spec := range specs {
+		src := newConfigSource(spec)
+		values, err := src.Load(ctx)
+		if err != nil {
+			return fmt.Errorf("config source %s: %w", src.Name(), err)
+		}
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		applied := 0
+		for _, name := range names {
+			if name == "config_sources" {
+				return fmt.Errorf("config source %s: config_sources cannot be set from a config source", src.Name())
+			}
+			if flag.Lookup(name) == nil {
+				return fmt.Errorf("config source %s: unknown flag %q", src.Name(), name)
+			}
+			if explicit[name] {
+				continue
+			}
+			if err := flag.Set(name, values[name]); err != nil {
+				return fmt.Errorf("config source %s: invalid value for %s: %w", src.Name(), name, err)
+			}
+			applied++
+		}
+		log.Printf("Applied %d settings from config source %s", applied, src.Name())
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// --- Token accounting and cost estimate ---
+
+// The tokens of every call are counted per model in the vertexai_models
+// namespace (prompt_tokens/<model> and output_tokens/<model>), including calls
+// whose answer a retry replaced, as those are billed too. Once the job
+// finishes the launcher prices the counts with --token_prices, or with
+// --input_price_per_1k_tokens and --output_price_per_1k_tokens for models the
+// table doesn't list, and logs the estimate per model. The run metrics row
+// prices its result rows the same way. Discounts on cached tokens are not
+// taken into account.
+
+const modelTokensNamespace = "vertexai_models"
+
+// tokenPrice is what a model charges, in USD per 1,000 tokens.
+type tokenPrice struct {
+	Input  float64
+	Output float64
+}
+
+func (p tokenPrice) cost(promptTokens, outputTokens int64) float64 {
+	return float64(promptTokens)/1000*p.Input + float64(outputTokens)/1000*p.Output
+}
+
+// tokenPrices is the price table of the run, with the flat prices for
+// models it doesn't list.
+type tokenPrices struct {
+	Default tokenPrice
+	Models  map[string]tokenPrice
+}
+
+// of returns the price of a model.
+func (t tokenPrices) of(model string) tokenPrice {
+	if p, ok := t.Models[model]; ok {
+		return p
+	}
+	return t.Default
+}
+
+// parseTokenPrices parses --token_prices entries of the form model=input:output.
+func parseTokenPrices(entries []string, def tokenPrice) (tokenPrices, error) {
+	t := tokenPrices{Default: def, Models: make(map[string]tokenPrice)}
+	for _, e := range entries {
+		model, prices, ok := strings.Cut(e, "=")
+		in, out, ok2 := strings.Cut(prices, ":")
+		if !ok || !ok2 || model == "" {
+			return tokenPrices{}, fmt.Errorf("invalid token price %q (want model=input:output)", e)
+		}
+		var p tokenPrice
+		var err error
+		if p.Input, err = strconv.ParseFloat(in, 64); err != nil || p.Input < 0 {
+			return tokenPrices{}, fmt.Errorf("invalid input price in %q (want USD per 1,000 tokens)", e)
+		}
+		if p.Output, err = strconv.ParseFloat(out, 64); err != nil || p.Output < 0 {
+			return tokenPrices{}, fmt.Errorf("invalid output price in %q (want USD per 1,000 tokens)", e)
+		}
+		if _, dup := t.Models[model]; dup {
+			return tokenPrices{}, fmt.Errorf("model %s is priced twice", model)
+		}
+		t.Models[model] = p
+	}
+	return t, nil
+}
+
+// flagTokenPrices returns the price table of the flags, validated in main.
+func flagTokenPrices() tokenPrices {
+	t, _ := parseTokenPrices(splitList(*tokenPriceTable), tokenPrice{Input: *inputPricePer1KTokens, Output: *outputPricePer1KTokens})
+	return t
+}
+
+// countTokens adds the tokens of a call to the counters of its model.
+func countTokens(ctx context.Context, model string, out vertexOutput) {
+	beam.NewCounter(modelTokensNamespace, "prompt_tokens/"+model).Inc(ctx, out.PromptTokens)
+	beam.NewCounter(modelTokensNamespace, "output_tokens/"+model).Inc(ctx, out.OutputTokens)
+}
+
+// logCostReport writes the tokens each model consumed and what they cost to
+// the launcher log.
+func logCostReport(pr beam.PipelineResult, prices tokenPrices) {
+	t := counterTotals(pr, modelTokensNamespace)
+	seen := make(map[string]bool)
+	var models []string
+	for name := range t {
+		_, model, _ := strings.Cut(name, "/")
+		if !seen[model] {
+			seen[model] = true
+			models = append(models, model)
+		}
+	}
+	if len(models) == 0 {
+		return
+	}
+	sort.Strings(models)
+	log.Printf("Token usage and estimated cost:")
+	var total float64
+	var unpriced []string
+	for _, model := range models {
+		in, out := t["prompt_tokens/"+model], t["output_tokens/"+model]
+		p := prices.of(model)
+		if p == (tokenPrice{}) {
+			unpriced = append(unpriced, model)
+		}
+		c := p.cost(in, out)
+		total += c
+		log.Printf("  %s: %d prompt + %d output tokens, $%.4f", model, in, out, c)
+	}
+	log.Printf("  Total: $%.4f", total)
+	if len(unpriced) > 0 {
+		log.Printf("No price set for %s; add them to --token_prices for a complete estimate.", strings.Join(unpriced, ", "))
+	}
+}
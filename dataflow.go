@@ -2,18 +2,23 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip" // Needed for request/response compression
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log" // Standard Go logger for job start/stop
 	"net/http"
 	"net/url" // Needed for tokeninfo URL query parameters
+	"os"
 	"reflect"
 	"strings" // Needed for trimming email response
 	"sync"    // Needed for mutex in stateful DoFn
-	"time"    // Needed for job duration logging & http client timeout
+	"sync/atomic"
+	"text/template"
+	"time" // Needed for job duration logging & http client timeout
 
 	"github.com/apache/beam/sdks/v2/go/pkg/beam"
 	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/bigqueryio"
@@ -25,13 +30,266 @@ import (
 var (
 	// Default model can be overridden; ensure it's compatible with the predict endpoint
 	modelName = flag.String("model_name", "gemini-pro", "Gemini model name (e.g., gemini-pro, gemini-1.0-pro)")
+	// Gzip is on by default to reduce egress for large prompts; disable it to inspect raw payloads
+	disableGzip = flag.Bool("disable_gzip", false, "Disable gzip compression of Vertex AI request and response bodies (useful for debugging)")
+	// Ordered from smallest to largest context window; empty disables automatic upgrades
+	modelLadder = flag.String("model_ladder", "", "Comma-separated models to escalate to on input token limit errors (e.g., gemini-1.5-flash,gemini-1.5-pro)")
+	// Cheapest-first models picked per row by estimated complexity, see router.go; empty sends every row to --model_name
+	modelTiers           = flag.String("model_tiers", "", "Comma-separated model:max_points tiers, cheapest first, the last without a bound (e.g., gemini-2.0-flash-lite:500,gemini-2.0-flash:4000,gemini-1.5-pro)")
+	tierStructuredPoints = flag.Int64("tier_structured_points", 500, "Complexity points added for prompts whose answer must follow a schema, a closed set, or JSON")
+	// Results destination, see outputtable.go; every other table is created in the same dataset
+	outputDatasetFlag   = flag.String("output_dataset", "sandboxdataset", "BigQuery dataset receiving the results and every auxiliary table")
+	outputTableFlag     = flag.String("output_table", "gemini_dataflow_results", "BigQuery table (in --output_dataset) receiving one row per answer")
+	createDisposition   = flag.String("create_disposition", createIfNeeded, "CREATE_IF_NEEDED creates a missing results table at launch; CREATE_NEVER fails the launch instead")
+	outputPartitioning  = flag.String("output_partitioning", "", "HOUR, DAY, MONTH, or YEAR partitioning on GeneratedAt for a results table created by the run (empty leaves it unpartitioned)")
+	outputClusterByHash = flag.Bool("output_cluster_by_hash", false, "Cluster a results table created by the run by PromptHash")
+	createOutputDataset = flag.Bool("create_output_dataset", false, "Create a missing --output_dataset in the location of the input data instead of refusing to run, see datasetlocation.go")
+	// Projects the run spans besides the Dataflow job's --project, see projects.go
+	inputProject  = flag.String("input_project", "", "Project the input query and reference tables are read and billed in (default --project)")
+	outputProject = flag.String("output_project", "", "Project of --output_dataset, receiving every table the run writes (default --project)")
+	vertexProject = flag.String("vertex_project", "", "Project whose Vertex AI endpoint and quota serve the requests unless --quota_projects spreads them (default --project)")
+	// Identifies this execution in auxiliary tables; generated from the start time when empty
+	runID = flag.String("run_id", "", "Identifier recorded with this run's results and spot checks (default: UTC start timestamp)")
+	// View over the output table exposing only the newest row per key
+	latestView    = flag.String("latest_view", "", "Create or update this view (in the output dataset) with the newest result per key after each run")
+	latestViewKey = flag.String("latest_view_key", "ParentKey,SubIndex", "Comma-separated output columns identifying a result for --latest_view")
+	// Deterministic review sample; set the rate to 0 to disable
+	spotCheckRate  = flag.Float64("spot_check_rate", 0.01, "Fraction of results copied to the spot-check table (0 disables)")
+	spotCheckSeed  = flag.String("spot_check_seed", "", "Seed for spot-check sampling; the same seed selects the same prompts")
+	spotCheckTable = flag.String("spot_check_table", "spot_checks", "BigQuery table (in the output dataset) receiving spot-check samples")
+	// Fan-out expects the input query to return a repeated STRING column named `items` (and optionally `row_key`)
+	fanOut               = flag.Bool("fan_out", false, "Emit one prompt per element of the input's repeated `items` column")
+	fanOutPlaceholder    = flag.String("fan_out_placeholder", "{item}", "Placeholder in the prompt replaced by each fanned-out item")
+	fanOutAggregateTable = flag.String("fan_out_aggregate_table", "", "Optional BigQuery table (in the output dataset) receiving answers regrouped per parent row")
+	// Per-key ordering expects optional `ordering_key` and `sequence` input columns
+	orderedTable     = flag.String("ordered_table", "", "Optional BigQuery table (in the output dataset) receiving each ordering key's results joined in sequence order")
+	orderedSeparator = flag.String("ordered_separator", "\n\n", "Separator placed between fragments in --ordered_table")
+	// Task selection; group_summarize produces one generation per --group_by value
+	task                   = flag.String("task", taskGenerate, "Task mode: generate, group_summarize, pairwise, workflow, agent, best_of_n, or classify")
+	groupBy                = flag.String("group_by", "", "Input column to group rows by for --task=group_summarize")
+	groupChunkChars        = flag.Int("group_chunk_chars", 24000, "Maximum characters of group text packed into a single summarization call")
+	groupInstruction       = flag.String("group_instruction", "Summarize the following entries:", "Instruction prepended to each packed group chunk")
+	groupReduceInstruction = flag.String("group_reduce_instruction", "Combine these partial summaries into a single summary:", "Instruction used to merge partial summaries of large groups")
+	// Pairwise comparison reads a pairs table, or self-joins the input prompts when none is given
+	pairsTable          = flag.String("pairs_table", "", "BigQuery table (dataset.table) with left_key, left_text, right_key, right_text columns for --task=pairwise")
+	pairwiseInstruction = flag.String("pairwise_instruction", "Compare the two candidates below and decide which one is better.", "Instruction used for --task=pairwise")
+	pairwiseTable       = flag.String("pairwise_table", "pairwise_results", "BigQuery table (in the output dataset) receiving parsed pairwise preferences")
+	// Best-of-N generates several candidates per row and keeps the one a judge call scores highest
+	numCandidates        = flag.Int("num_candidates", 5, "Candidates generated per row for --task=best_of_n")
+	judgeInstruction     = flag.String("judge_instruction", "Score each candidate from 0 to 10 for how well it completes the task.", "Instruction given to the judge call for --task=best_of_n")
+	candidateScoresTable = flag.String("candidate_scores_table", "candidate_scores", "BigQuery table (in the output dataset) receiving every candidate's score for --task=best_of_n")
+	// Closed-set outputs constrain each answer to one value, e.g. an existing category taxonomy
+	responseEnumValues = flag.String("response_enum", "", "Comma-separated values every answer must be exactly one of; an answer outside them is asked for once more, then dead-lettered (--task=generate only)")
+	responseEnumColumn = flag.String("response_enum_column", "", "BigQuery column (project.dataset.table.column) whose distinct values form the allowed answers; alternative to --response_enum")
+	// Hierarchical classification reads a taxonomy table with code, parent_code, and name columns
+	taxonomyTable       = flag.String("taxonomy_table", "", "BigQuery taxonomy table (project.dataset.table) for --task=classify")
+	classifyInstruction = flag.String("classify_instruction", "Classify the item into the product taxonomy.", "Instruction used for both levels of --task=classify")
+	classificationTable = flag.String("classification_table", "classifications", "BigQuery table (in the output dataset) receiving each row's validated two-level classification")
+	// Multi-step workflows chain prompts per row; see workflow.go for the file format
+	workflowFile = flag.String("workflow_file", "", "JSON workflow definition (local path or gs:// URI) for --task=workflow")
+	// Agent mode; a tool is only offered when its allow-list is non-empty
+	maxTurns             = flag.Int("max_turns", 5, "Maximum model turns per row for --task=agent")
+	agentTokenBudget     = flag.Int64("agent_token_budget", 20000, "Prompt plus output tokens an agent run may spend per row (0 is unlimited)")
+	agentHTTPAllow       = flag.String("agent_http_allow", "", "Comma-separated URLs the http_get tool may fetch, on their exact scheme and host and below their path")
+	agentHTTPTimeout     = flag.Duration("agent_http_timeout", 10*time.Second, "Time limit for one http_get fetch, including redirects")
+	agentHTTPMaxBytes    = flag.Int64("agent_http_max_bytes", 1<<20, "Response bytes http_get reads before truncating; HTML is reduced to text afterwards")
+	agentGCSAllow        = flag.String("agent_gcs_allow", "", "Comma-separated gs://bucket[/prefix] the gcs_read tool may read objects of, below the prefix")
+	agentBQTables        = flag.String("agent_bq_tables", "", "Comma-separated alias=project.dataset.table:key_column reference tables the bq_lookup tool may query by key")
+	agentTrajectoryTable = flag.String("agent_trajectory_table", "agent_trajectories", "BigQuery table (in the output dataset) receiving each row's agent trajectory (empty disables)")
+	// Customer-managed encryption key applied to every table and staging artifact the job creates
+	kmsKey = flag.String("kms_key", "", "Cloud KMS key (projects/.../locations/.../keyRings/.../cryptoKeys/...) for created tables and Dataflow artifacts")
+	// Table and column descriptions on the output tables, see tabledocs.go
+	documentTables = flag.Bool("document_tables", true, "Create output tables with (or update them to) column descriptions and a table description summarizing the run configuration")
+	// Central run configuration, see configsource.go
+	configSources = flag.String("config_sources", "", "Comma-separated sources of flag values applied in order: env (VERTEX_GEMINI_* variables), a YAML file (local or gs://), or secret://projects/P/secrets/S[/versions/V]; command-line flags take precedence")
+	// Governed destinations, see governance.go
+	columnPolicyTags       = flag.String("column_policy_tags", "", "Comma-separated Column=policy tag resource name pairs applied to those columns in every output table carrying them (e.g., GeneratedText=projects/p/locations/us/taxonomies/1/policyTags/2)")
+	requireRowAccessPolicy = flag.Bool("require_row_access_policy", false, "Refuse to run unless each table receiving result rows already has a row access policy")
+	// Governance tags on the output tables, see catalog.go
+	catalogTagTemplate = flag.String("catalog_tag_template", "", "Data Catalog tag template (ID in the job's project and region, or full resource name) attached to output tables after the run; created if missing (empty disables)")
+	// Google Sheets input replaces the BigQuery query for small, analyst-maintained prompt lists
+	inputSheetID    = flag.String("input_sheet_id", "", "Google Sheets spreadsheet ID to read prompts from instead of BigQuery")
+	inputSheetRange = flag.String("input_sheet_range", "Sheet1", "A1 range of the prompt sheet; the first row must be a header with a `prompt` column")
+	// Google Sheets output for small runs; rows past the cap overflow to the BigQuery output table
+	outputSheetID      = flag.String("output_sheet_id", "", "Google Sheets spreadsheet ID to write results to (overflow goes to BigQuery)")
+	outputSheetRange   = flag.String("output_sheet_range", "Results", "A1 range (usually a tab name) results are written to")
+	outputSheetMaxRows = flag.Int("output_sheet_max_rows", 1000, "Maximum result rows written to the output sheet before overflowing to BigQuery")
+	// Results as JSONL shards in Cloud Storage for non-BigQuery consumers, see gcsoutput.go
+	outputGCSPrefix = flag.String("output_gcs_prefix", "", "gs:// folder receiving the results as <run_id>/results-SSSSS-of-NNNNN.jsonl (empty disables)")
+	outputGCSShards = flag.Int("output_gcs_shards", 16, "Number of JSONL shards written under --output_gcs_prefix")
+	outputBigQuery  = flag.Bool("output_bigquery", true, "Write results to the BigQuery output table; false with --output_gcs_prefix writes them to Cloud Storage only")
+	// Prompt SQL in place of the built-in query, see inputquery.go; it must return a prompt column
+	inputQueryFlag = flag.String("input_query", "", "Standard SQL returning a STRING `prompt` column (plus optional row_key, items, ... columns); empty uses the built-in query")
+	inputQueryFile = flag.String("input_query_file", "", "Local path or gs:// URI of a SQL file used as --input_query")
+	snapshotTime   = flag.String("snapshot_time", "", "Read the input tables as they were at this time (RFC 3339, or the --run_id of the run to repeat), see snapshot.go")
+	// Prompt rendered from the columns of the input query, see prompttemplate.go
+	rowTemplateFlag = flag.String("prompt_template", "", "Go text/template rendering each input row's prompt from its columns (e.g., Describe {{.title}}: {{.description}}), instead of a prompt column")
+	rowTemplateFile = flag.String("prompt_template_file", "", "Local path or gs:// URI of a template used as --prompt_template")
+	// Only the input rows changed since the last completed run, see incremental.go
+	incrementalMode       = flag.String("incremental", "", "Read only the input rows appended (appends) or changed (changes) since the last completed run, or whose --incremental_column is past it (column); empty reads every row")
+	incrementalColumnFlag = flag.String("incremental_column", "", "TIMESTAMP, DATETIME, or DATE column of the input query recording when a row last changed (e.g., updated_at), for --incremental column")
+	incrementalTables     = flag.String("incremental_tables", "", "Comma-separated dataset.table names --incremental appends or changes reads the changes of (default every table the input query reads)")
+	incrementalState      = flag.String("incremental_state_table", "incremental_state", "Table of the output dataset recording the input window of every completed --incremental run")
+	// Prompt composed from several columns of the input query, see promptcolumns.go
+	promptColumns         = flag.String("prompt_columns", "", "Comma-separated columns of the input query composed into the prompt (e.g., title,description,ingredients), instead of a prompt column")
+	promptColumnFormat    = flag.String("prompt_column_format", "{column}: {value}", "How each --prompt_columns column is rendered; {column} is its name and {value} its value")
+	promptColumnSeparator = flag.String("prompt_column_separator", `\n`, "Text between the rendered --prompt_columns columns (\\n is a newline)")
+	promptColumnBudgets   = flag.String("prompt_column_budgets", "", "Comma-separated column=tokens caps on --prompt_columns columns (e.g., title=50,description=500); longer values are cut at a word boundary")
+	// Newline-delimited prompt files in Cloud Storage instead of the query, see gcsinput.go
+	inputGCSPattern = flag.String("input_gcs_pattern", "", "gs:// glob of text or JSONL files to read prompts from instead of BigQuery (e.g., gs://bucket/prompts/*.jsonl)")
+	promptField     = flag.String("prompt_field", "", "JSONL key holding the prompt in --input_gcs_pattern files (empty reads every line as a prompt)")
+	// Long-running prompt serving from Pub/Sub instead of a one-shot batch, see streaming.go
+	mode              = flag.String("mode", modeBatch, "Execution mode: batch (read the input query once) or streaming (serve --input_subscription until drained)")
+	inputSubscription = flag.String("input_subscription", "", "Pub/Sub subscription ID of JSON prompt messages for --mode=streaming")
+	inputTopic        = flag.String("input_topic", "", "Pub/Sub topic ID --input_subscription is attached to")
+	streamingWindow   = flag.Duration("streaming_window", streamingWindowDefault, "How often --mode=streaming flushes answers to BigQuery")
+	// Localized instructions selected by the input's `locale` column, see locales.go
+	promptTemplates = flag.String("prompt_templates", "", "Directory (local or gs://) of <locale>.yaml prompt templates applied by each row's `locale` column (empty sends prompts as they are)")
+	defaultLocale   = flag.String("default_locale", "en", "Locale whose template renders rows whose locale has none, directly or through fallbacks")
+	// Run context for prompt templates as {{var "name"}}, see templatevars.go
+	templateVarsFlag = flag.String("template_vars", "", "Comma-separated name=value template variables on top of run_id, date, launch_time, project, and model; secret://projects/P/secrets/S values are read from Secret Manager")
+	// Document crawler input: one prompt per file under a GCS prefix or in a Drive folder
+	inputDocumentsPrefix = flag.String("input_documents_prefix", "", "gs://bucket/prefix whose files become one prompt each, attached to the request")
+	inputDriveFolderID   = flag.String("input_drive_folder_id", "", "Google Drive folder ID whose files, subfolders included, become one prompt each")
+	inputFileGlob        = flag.String("input_file_glob", "", "Glob on file names (e.g., *.pdf) applied by the document crawler")
+	inputMimeTypes       = flag.String("input_mime_types", "", "Comma-separated MIME types accepted by the document crawler (empty accepts all)")
+	documentInstruction  = flag.String("document_instruction", "Summarize the following document.", "Instruction used for each crawled document")
+	// Run-level aggregates for dashboards; prices feed the cost estimate
+	metricsTable = flag.String("metrics_table", "metrics", "BigQuery table (in the output dataset) receiving one aggregate row per run (empty disables)")
+	// Server-side request-response logs of the called models, see vertexlogging.go
+	vertexRequestLogging  = flag.Bool("vertex_request_logging", false, "Enable Vertex AI request-response logging for every model the run may call, into --vertex_log_table")
+	vertexLogTable        = flag.String("vertex_log_table", "vertex_request_log", "BigQuery table (in the output dataset) Vertex AI writes its request-response logs to")
+	vertexLogSamplingRate = flag.Float64("vertex_log_sampling_rate", 1, "Fraction of requests Vertex AI logs under --vertex_request_logging")
+	// Running totals while the job runs, see progress.go
+	progressTable          = flag.String("progress_table", "", "BigQuery table (in the output dataset) receiving per-worker progress rows during the run (empty disables)")
+	progressInterval       = flag.Duration("progress_interval", time.Minute, "How often each worker writes a progress row to --progress_table")
+	inputPricePer1KTokens  = flag.Float64("input_price_per_1k_tokens", 0, "USD per 1,000 prompt tokens used for cost estimates")
+	outputPricePer1KTokens = flag.Float64("output_price_per_1k_tokens", 0, "USD per 1,000 output tokens used for cost estimates")
+	tokenPriceTable        = flag.String("token_prices", "", "Comma-separated model=input:output USD per 1,000 prompt and output tokens, for models priced differently from --input_price_per_1k_tokens and --output_price_per_1k_tokens")
+	// Provenance labelling of generated rows
+	promptVersion = flag.String("prompt_version", "", "Version label of the prompt/query, recorded in the PromptVersion column")
+	textWatermark = flag.Bool("text_watermark", false, "Append an invisible zero-width provenance marker to generated text")
+	// In-memory per-worker cache of recent generations keyed by prompt hash
+	lruCacheSize = flag.Int("lru_cache_size", 0, "Number of recent results each worker keeps in memory to short-circuit duplicate prompts (0 disables)")
+	// Streaming SLA protection; cached results still win over the fallback
+	maxElementAge = flag.Duration("max_element_age", 0, "Elements whose event time is older than this skip model upgrades and get --fallback_text (0 disables)")
+	fallbackText  = flag.String("fallback_text", "", "Fallback response emitted for elements older than --max_element_age (empty makes a single attempt instead)")
+	// One reworded retry when the model stops for recitation or safety
+	finishRetryStrategy    = flag.String("finish_retry_strategy", "", "Retry once after a RECITATION or SAFETY finish reason using paraphrase, lower_temperature, or own_words (empty disables)")
+	finishRetryTemperature = flag.Float64("finish_retry_temperature", 0.2, "Temperature for the lower_temperature retry strategy")
+	// Project quota errors (429 RESOURCE_EXHAUSTED naming a quota) pause a worker instead of failing rows
+	quotaCooldown = flag.Duration("quota_cooldown", 0, "Pause a worker's requests this long after a project quota error, then retry the row once (0 disables); under --quota_projects, how long a project whose quota ran out is skipped (default 1m), with the pause only once all are")
+	// Raw response bodies for re-parsing later; compression keeps large responses under row limits
+	storeRawResponse    = flag.Bool("store_raw_response", false, "Write each full response body to the RawResponse output column")
+	compressRawResponse = flag.Bool("compress_raw_response", false, "Gzip and base64-encode RawResponse (RawResponseEncoding says which)")
+	// Which failed calls are retried, by HTTP status, Google API status, or message; see retry.go
+	retryConfigPath = flag.String("retry_config", "", "JSON retry classification (local path or gs:// URI); unset uses the built-in policy of --max_retries")
+	maxRetries      = flag.Int("max_retries", 3, "Retries of a call that got no response, HTTP 408, 429, or 5xx, with jittered exponential backoff and Retry-After honored, when --retry_config is unset (0 disables)")
+	// Failed calls, with Google API error details and request IDs for support escalation
+	dlqTable = flag.String("dlq_table", "dead_letters", "BigQuery table (in the output dataset) receiving prompts whose generation failed (empty disables)")
+	// One more pass over transient failures before they are dead-lettered, see retrywave.go
+	endOfJobRetry = flag.Bool("end_of_job_retry", false, "Retry transiently failed prompts once after each model stage's first pass, dead-lettering only what fails again")
+	// Each distinct request sent once, its answer copied to the duplicates, see dedupe.go
+	dedupePromptsFlag = flag.Bool("dedupe_prompts", false, "Call Vertex AI once per distinct prompt (same PromptHash) and copy the answer to every duplicate input row")
+	// Rerun of a partly failed job, see resume.go
+	resume = flag.Bool("resume", false, "Skip the prompts the results table already answers (same PromptHash), so a rerun only calls Vertex AI for the rest")
+	// Quota pooling across projects; the job's own project is only used when listed
+	quotaProjects       = flag.String("quota_projects", "", "Comma-separated project or project=credentials_uri (service account key, local or gs://) entries whose Vertex AI quota is pooled")
+	quotaProjectBudgets = flag.String("quota_project_budgets", "", "Comma-separated project=requests budgets per worker for --quota_projects (unlisted projects are unlimited)")
+	projectRotation     = flag.String("project_rotation", rotateRoundRobin, "How --quota_projects are chosen: round_robin or budget (most requests left)")
+	// Sampling settings sent with every request, see generation.go
+	temperature    = flag.Float64("temperature", generationParameters.Temperature, "Sampling temperature, 0 to 2")
+	topK           = flag.Int("top_k", generationParameters.TopK, "topK sampling cutoff (0 uses the endpoint default)")
+	topP           = flag.Float64("top_p", 0, "topP (nucleus) sampling cutoff, 0 to 1 (0 uses the endpoint default)")
+	stopSequences  = flag.String("stop_sequences", "", "Comma-separated sequences that end generation, at most 5")
+	candidateCount = flag.Int("candidate_count", 0, "Candidates generated per request; only the first is stored (0 uses the endpoint default)")
+	// Output length limit; see the size report logged when the job finishes
+	maxOutputTokens = flag.Int("max_output_tokens", 0, "maxOutputTokens sent with every request (0 uses the endpoint default)")
+	// Stray bytes in source strings (invalid UTF-8, control characters, BOMs)
+	sanitizePrompts = flag.Bool("sanitize_prompts", true, "Strip invalid UTF-8, control characters, and byte order marks from prompts before calling the model")
+	// Instructions and few-shot examples every prompt opens with, sent once as the system instruction, see prefix.go
+	hoistSharedPrefixChars = flag.Int("hoist_shared_prefix_chars", 0, "Send a prefix shared by all prompts of a stage as the generateContent system instruction when it is at least this many characters, so the context cache serves it (0 disables)")
+	// HTML or Markdown input columns converted to plain text, see markup.go
+	inputMarkup     = flag.String("input_markup", "", "Convert the prompt and items input columns from html or markdown to plain text (empty leaves them as is)")
+	markupSkipTags  = flag.String("markup_skip_tags", "", "Comma-separated HTML elements dropped with their content, on top of script, style, and the like")
+	markupKeepLinks = flag.Bool("markup_keep_links", false, "Keep link targets as \"text (url)\" when converting markup")
+	// Markdown answers rendered for web frontends, see outputformat.go
+	outputFormats = flag.String("output_formats", "", "Comma-separated renderings of each answer to add: html (GeneratedHTML) and/or text (GeneratedPlainText)")
+	// Input entities (the required_terms column) that answers must repeat verbatim
+	entityCheck = flag.String("entity_check", entityCheckFlag, "What to do when an answer drops one of its row's required_terms: off, flag (MissingTerms column), or retry (once, with the terms spelled out)")
+	// Brand and regulatory terminology, see glossary.go
+	glossaryTable = flag.String("glossary_table", "", "BigQuery glossary (project.dataset.table with source_term and target_term) injected into prompts and checked in answers (GlossaryMisses column)")
+	// Sanity bounds on numbers in answers (e.g. nutrition facts); violators go to the DLQ, not the results
+	numericBounds      = flag.String("numeric_bounds", "", "Comma-separated label=min:max bounds, e.g. calories=0:2000,%=0:100 (% bounds every percentage)")
+	numericBoundsRetry = flag.Bool("numeric_bounds_retry", true, "Retry an answer that breaks --numeric_bounds once before dead-lettering it")
+	// Cross-field checks on values in answers, see rules.go
+	consistencyRulesPath = flag.String("consistency_rules", "", "JSON consistency rules (local path or gs:// URI) checked against the values in each answer")
+	// Hard length limits of the destination field; violators are retried, then dead-lettered, see lengths.go
+	minChars      = flag.Int("min_chars", 0, "Minimum answer length in characters (0 disables)")
+	maxChars      = flag.Int("max_chars", 0, "Maximum answer length in characters (0 disables)")
+	lengthRetries = flag.Int("length_retries", 1, "Retries with explicit length instructions before an answer outside --min_chars/--max_chars is dead-lettered")
+	// Answers above this Flesch-Kincaid grade get one retry asking for simpler wording, see readability.go
+	maxReadingGrade = flag.Float64("max_reading_grade", 0, "Retry answers whose ReadingGrade is above this once, asking for simpler wording (0 disables)")
+	// Prohibited terms in answers (profanity, health claims), see lexicons.go
+	lexiconsPath = flag.String("lexicons", "", "JSON lexicon categories (local path or gs:// URI) whose terms are flagged, masked, or dead-lettered in each answer")
+	// Quantities in answers rewritten into one unit system, see units.go
+	unitConversions = flag.String("unit_conversions", "", "Comma-separated from=to unit rewrites applied to every answer, e.g. oz=g,kcal=kJ")
+	// Per-row debugging
+	traceRows = flag.Bool("trace_rows", false, "Fill the nested Trace column with each row's attempts, latencies, cache status, fallback use, and worker")
+	// Gemini models need generateContent; PaLM-era models only serve :predict
+	apiMode = flag.String("api_mode", apiModeAuto, "Vertex AI API: auto (generateContent for gemini-* models, predict otherwise), generate_content, or predict")
+	// Service answering the requests, see textgen.go
+	backend           = flag.String("backend", backendVertex, "Service answering the requests: vertex, gemini_api (Google AI Studio), or openai (an OpenAI-compatible endpoint such as Ollama)")
+	backendURL        = flag.String("backend_url", "http://localhost:11434/v1", "Base URL of the chat completions endpoint of --backend openai")
+	backendAPIKeyFile = flag.String("backend_api_key_file", "", "Local path or gs:// URI of the API key of --backend gemini_api or openai (default the GEMINI_API_KEY or OPENAI_API_KEY environment variable)")
+	// Legacy :predict models accept several instances per request
+	instancesPerRequest = flag.Int("instances_per_request", 1, "Prompts packed into one predict request as separate instances (1 sends one request per prompt)")
+	batchSize           = flag.Int("batch_size", 0, "Group prompts into batches of this many ahead of the model stage, so predict requests fill up even when the runner's bundles are small; sets --instances_per_request (0 or 1 disables)")
+	batchAutotune       = flag.Duration("batch_autotune", 0, "Experiment with 1 up to --instances_per_request instances per request for this long, then keep the size with the highest throughput (0 always uses --instances_per_request)")
+	// Deterministic input partition for backfills launched as several jobs, see shard.go
+	shard = flag.String("shard", "", "Only process the input rows whose key hashes to i of N, given as i/N with 0 <= i < N (empty processes everything)")
+	// Post-run check that the sinks wrote every row they were handed, see writeverify.go
+	verifyWrites         = flag.Bool("verify_writes", true, "After the run, compare the rows handed to the results and dead-letter sinks with the rows of the run in their tables, and fail on a gap")
+	writeVerifyTolerance = flag.Float64("write_verify_tolerance", 0.001, "Fraction of rows by which a verified table may differ from the rows handed to its sink")
+	// Hard deadline for scheduled windows, see runtime.go
+	maxRuntime = flag.Duration("max_runtime", 0, "Wall-clock time after launch past which prompts are dead-lettered as MAX_RUNTIME instead of sent, and the run ends partial (0 disables)")
+	// Quickstart mode: DirectRunner with local files in place of BigQuery, see local.go
+	localMode        = flag.Bool("local", false, "Run on the DirectRunner reading --local_input and writing --local_output instead of BigQuery (--task=generate only)")
+	localInput       = flag.String("local_input", "", "CSV (with a `prompt` header column) or JSONL file of prompts for --local")
+	localOutput      = flag.String("local_output", "", "File results are written to under --local: .csv, .jsonl, or a SQLite database (.db, .sqlite)")
+	localDeadLetters = flag.String("local_dead_letters", "", "File failed calls are written to under --local, in the same formats as --local_output")
+	// The reparse subcommand, see reparse.go
+	reparseRunID = flag.String("reparse_run_id", "", "Only re-parse rows of this run (empty re-parses every row with a stored response)")
+	reparseTable = flag.String("reparse_table", "gemini_dataflow_results_reparsed", "BigQuery table (in the output dataset) receiving re-parsed rows")
+	// Worker-local circuit breaker; while open, rows get the fallback template (flagged Fallback) or are dropped
+	circuitFailures  = flag.Int("circuit_failures", 0, "Consecutive Vertex AI failures that open the circuit breaker (0 disables it)")
+	circuitCooldown  = flag.Duration("circuit_cooldown", 30*time.Second, "How long the circuit stays open before a single probe request is sent")
+	fallbackTemplate = flag.String("fallback_template", "", "Go text/template over the prompt fields (e.g., {{.ParentKey}}) emitted while the circuit is open")
+	// Per-worker request pacing; state can survive worker restarts in long streaming jobs
+	requestsPerSecond = flag.Float64("requests_per_second", 0, "Maximum Vertex AI requests per second per worker (0 disables the limiter)")
+	rateBurst         = flag.Int("rate_burst", 1, "Token bucket capacity for --requests_per_second")
+	adaptiveThrottle  = flag.Bool("adaptive_throttle", false, "Halve the worker's request rate on 429s from Vertex AI and raise it again after sustained success, between --adaptive_min_rate and --requests_per_second (see adaptive.go)")
+	adaptiveMinRate   = flag.Float64("adaptive_min_rate", 0.1, "Lowest requests per second per worker --adaptive_throttle backs off to")
+	stageRateLimits   = flag.String("stage_rate_limits", "", "Comma-separated stage=requests_per_second[:burst] limits per worker for a task's model-calling stages, on top of --requests_per_second (see stages.go)")
+	stageBudgets      = flag.String("stage_budgets", "", "Comma-separated stage=requests budgets per worker; a stage's calls fail once its budget is spent")
+	limiterStateRedis = flag.String("limiter_state_redis", "", "Redis host:port used to persist rate limiter and circuit breaker state across worker restarts")
+	// Controls how prompt/response text appears in worker logs
+	logContentPolicy = flag.String("log_content_policy", logContentTruncate, "How prompt/response content is logged: full, truncate, hash, or none")
+	// Refuse to run when any touched resource lives outside these locations
+	allowedRegions = flag.String("allowed_regions", "", "Comma-separated locations (e.g., us-central1,US) the Vertex endpoint, BigQuery datasets, and GCS buckets must be in")
+	// Refuse to run when the Vertex AI or BigQuery API is disabled, see serviceapis.go
+	autoEnableAPIs = flag.Bool("auto_enable_apis", false, "Enable the Vertex AI and BigQuery APIs in the project when they are disabled, instead of refusing to run")
 )
 
-// --- Constants for BigQuery Output ---
-const (
-	outputDataset = "sandboxdataset"          // Your BigQuery dataset ID
-	outputTable   = "gemini_dataflow_results" // Your BigQuery table ID
-)
+// --- Input Query ---
+
+// Prompts are built in SQL; each task reads the input query (possibly wrapped) from
+// BigQuery. This one is used unless --input_query or --input_query_file replace it.
+const defaultInputQuery = `
+    SELECT CONCAT('generate nutrition label for ', products_brand_name) AS prompt
+    FROM sandboxdataset.food_products
+    LIMIT 100
+`
 
 // --- Identity Helper Functions (Unchanged) ---
 
@@ -39,11 +297,15 @@ const metadataHost = "http://metadata.google.internal"
 const metadataTimeout = 2 * time.Second // Short timeout for metadata check
 
 func getMetadataServiceAccountEmail() (string, error) {
-	// ... (implementation unchanged) ...
+	return getMetadataValue("instance/service-accounts/default/email")
+}
+
+// getMetadataValue reads one value from the GCE metadata server, e.g. "instance/machine-type".
+func getMetadataValue(path string) (string, error) {
 	client := &http.Client{
 		Timeout: metadataTimeout,
 	}
-	url := fmt.Sprintf("%s/computeMetadata/v1/instance/service-accounts/default/email", metadataHost)
+	url := fmt.Sprintf("%s/computeMetadata/v1/%s", metadataHost, path)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return "", fmt.Errorf("failed to create metadata request: %w", err)
@@ -118,15 +380,101 @@ func getADCIdentityEmail(ctx context.Context) (string, error) {
 
 // --- Data Structures ---
 
-// Input prompt structure (unchanged)
+// Input prompt structure
 type Prompt struct {
-	Prompt string `beam:"Prompt"`
+	Prompt    string `beam:"Prompt"`
+	ParentKey string `beam:"ParentKey"` // Source row key, shared by all prompts fanned out from one row
+	SubIndex  int    `beam:"SubIndex"`  // Position of this prompt within its parent row
+	SubCount  int    `beam:"SubCount"`  // Prompts of the parent row when they are merged again, e.g. group_summarize chunks; else 0
+
+	// Optional per-key ordering carried through to the results, see ordering.go
+	OrderingKey string `beam:"OrderingKey"`
+	Sequence    int64  `beam:"Sequence"`
+
+	WorkflowStep string `beam:"WorkflowStep"` // Step name under --task=workflow
+	WorkflowPath string `beam:"WorkflowPath"` // Steps the row ran so far, including this one
+
+	Choices       []string `beam:"Choices"`       // Allowed answers for this prompt alone, overriding --response_enum
+	RequiredTerms []string `beam:"RequiredTerms"` // Entities the answer must repeat verbatim, see entities.go
+	SharedPrefix  int      `beam:"SharedPrefix"`  // Leading bytes of Prompt sent as the system instruction, see prefix.go
+
+	// Source file metadata for prompts produced by the document crawler
+	SourceURI       string `beam:"SourceURI"`
+	SourceMimeType  string `beam:"SourceMimeType"`
+	SourceSizeBytes int64  `beam:"SourceSizeBytes"`
+	SourceFileID    string `beam:"SourceFileID"` // Drive file ID, which SourceURI (its web link) can't be downloaded by
 }
 
-// Output result structure (unchanged)
+// Output result structure
 type GeminiResult struct {
-	Prompt        string `beam:"Prompt"`
-	GeneratedText string `beam:"GeneratedText"`
+	RunID          string    `beam:"RunID"`
+	GeneratedAt    time.Time `beam:"GeneratedAt"`
+	Prompt         string    `beam:"Prompt"`
+	PromptHash     string    `beam:"PromptHash"` // See PromptHash; stable across runs with the same model and parameters
+	ParentKey      string    `beam:"ParentKey"`
+	SubIndex       int       `beam:"SubIndex"`
+	SubCount       int       `beam:"SubCount"` // Copied from the prompt
+	GeneratedText  string    `beam:"GeneratedText"`
+	ModelUsed      string    `beam:"ModelUsed"`    // Model that produced GeneratedText
+	UpgradedFrom   string    `beam:"UpgradedFrom"` // Original model when a larger-context model was substituted
+	ModelTier      int       `beam:"ModelTier"`    // --model_tiers tier the row was routed to (1 is cheapest); 0 when routing is off
+	Complexity     int64     `beam:"Complexity"`   // Complexity estimate behind ModelTier
+	PromptTokens   int64     `beam:"PromptTokens"` // As reported by the endpoint; 0 when unavailable
+	CachedTokens   int64     `beam:"CachedTokens"` // Of PromptTokens, served from the context cache, see prefix.go
+	OutputTokens   int64     `beam:"OutputTokens"`
+	TotalTokens    int64     `beam:"TotalTokens"`    // PromptTokens + OutputTokens
+	LatencyMs      int64     `beam:"LatencyMs"`      // API time for this row; 0 for cache hits
+	Fallback       bool      `beam:"Fallback"`       // GeneratedText came from a fallback responder; regenerate via replay
+	FinishReason   string    `beam:"FinishReason"`   // Endpoint-reported finish reason, if any
+	Attempt        int       `beam:"Attempt"`        // Above 1 when a --finish_retry_strategy or --entity_check retry produced GeneratedText
+	Mutation       string    `beam:"Mutation"`       // Retry strategy of that attempt
+	MissingTerms   []string  `beam:"MissingTerms"`   // Input required_terms absent from GeneratedText under --entity_check
+	RuleViolations []string  `beam:"RuleViolations"` // --consistency_rules (flag action) GeneratedText breaks
+	GlossaryMisses []string  `beam:"GlossaryMisses"` // "source -> target" --glossary_table entries GeneratedText breaks
+	LexiconHits    []string  `beam:"LexiconHits"`    // "category: term" --lexicons hits in the answer (masked under the mask action)
+	VertexProject  string    `beam:"VertexProject"`  // Project that served the request; differs from the job's under --quota_projects
+	RequestID      string    `beam:"RequestID"`      // Server-side request ID of the call that produced this row
+
+	// Full response body under --store_raw_response, so parsing can be re-applied without calling the model
+	RawResponse         string `beam:"RawResponse"`
+	RawResponseEncoding string `beam:"RawResponseEncoding"` // json or gzip+base64; empty when not stored
+
+	// Provenance columns, see provenance.go
+	Generator     string `beam:"Generator"`     // Always "gemini"; marks the row as AI-generated
+	ModelVersion  string `beam:"ModelVersion"`  // Endpoint-reported model version, if any
+	PromptVersion string `beam:"PromptVersion"` // Operator-supplied --prompt_version
+	SafetyStatus  string `beam:"SafetyStatus"`  // passed, blocked, or unknown
+	ContentHash   string `beam:"ContentHash"`   // SHA-256 of GeneratedText as stored
+
+	// Response metadata for audits of blocked or truncated answers, see responsemeta.go
+	SafetyRatings []SafetyRating `beam:"SafetyRatings"`
+	Citations     []Citation     `beam:"Citations"`
+
+	// Source file metadata, set for document crawler input
+	SourceURI       string `beam:"SourceURI"`
+	SourceMimeType  string `beam:"SourceMimeType"`
+	SourceSizeBytes int64  `beam:"SourceSizeBytes"`
+
+	// Per-key ordering copied from the prompt; ORDER BY OrderingKey, Sequence, SubIndex restores input order
+	OrderingKey string `beam:"OrderingKey"`
+	Sequence    int64  `beam:"Sequence"`
+
+	WorkflowStep string `beam:"WorkflowStep"` // Workflow step that produced this row, if any
+	WorkflowPath string `beam:"WorkflowPath"` // Steps taken to get here, e.g. classify>nutrition
+
+	Trace RowTrace `beam:"Trace"` // Attempts, latencies, and cache status under --trace_rows, see trace.go
+
+	ReadingGrade float64 `beam:"ReadingGrade"` // Flesch-Kincaid grade level of GeneratedText, see readability.go
+
+	// GeneratedText converted from Markdown under --output_formats; empty when not requested
+	GeneratedHTML      string `beam:"GeneratedHTML"` // Escaped, safe to embed
+	GeneratedPlainText string `beam:"GeneratedPlainText"`
+}
+
+func init() {
+	// bigqueryio requires row types to be registered before beam.Init
+	beam.RegisterType(reflect.TypeOf((*GeminiResult)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*GenerateTextFn)(nil)).Elem())
 }
 
 // --- Vertex AI Request/Response Structs ---
@@ -136,10 +484,19 @@ type VertexInstance struct {
 }
 
 type VertexParameters struct {
-	Temperature     float64 `json:"temperature"`
-	TopK            int     `json:"topK"`
-	MaxOutputTokens int     `json:"maxOutputTokens,omitempty"` // Optional: Example parameter
-	// Add other parameters like TopP if needed
+	Temperature     float64  `json:"temperature"`
+	TopK            int      `json:"topK,omitempty"`
+	TopP            float64  `json:"topP,omitempty"`
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+	CandidateCount  int      `json:"candidateCount,omitempty"`
+
+	// Constrained decoding, set per DoFn by parameters() for --response_enum runs
+	ResponseMimeType string        `json:"responseMimeType,omitempty"`
+	ResponseSchema   *VertexSchema `json:"responseSchema,omitempty"`
+
+	// File a crawled prompt is about, attached to its generateContent request, see documents.go
+	Document *DocumentRef `json:"-"`
 }
 
 type VertexRequest struct {
@@ -148,14 +505,57 @@ type VertexRequest struct {
 }
 
 type VertexPrediction struct {
-	Content string `json:"content"`
-	// SafetyAttributes map[string]interface{} `json:"safetyAttributes"` // Example if needed
-	// CitationMetadata map[string]interface{} `json:"citationMetadata"` // Example if needed
+	Content          string                  `json:"content"`
+	SafetyAttributes *VertexSafetyAttributes `json:"safetyAttributes,omitempty"`
+	FinishReason     string                  `json:"finishReason,omitempty"` // e.g. STOP, MAX_TOKENS, SAFETY, RECITATION
+	CitationMetadata *VertexCitationMetadata `json:"citationMetadata,omitempty"`
+}
+
+type VertexSafetyAttributes struct {
+	Blocked    bool      `json:"blocked"`
+	Categories []string  `json:"categories,omitempty"` // Parallel to Scores, see responsemeta.go
+	Scores     []float64 `json:"scores,omitempty"`
 }
 
 type VertexResponse struct {
-	Predictions []VertexPrediction `json:"predictions"`
-	// Metadata map[string]interface{} `json:"metadata"` // Example if needed
+	Predictions    []VertexPrediction `json:"predictions"`
+	ModelVersionID string             `json:"modelVersionId,omitempty"`
+	Metadata       VertexMetadata     `json:"metadata"`
+}
+
+type VertexMetadata struct {
+	TokenMetadata struct {
+		InputTokenCount  VertexTokenCount `json:"inputTokenCount"`
+		OutputTokenCount VertexTokenCount `json:"outputTokenCount"`
+	} `json:"tokenMetadata"`
+}
+
+type VertexTokenCount struct {
+	TotalTokens int64 `json:"totalTokens"`
+}
+
+// vertexOutput is the parsed result of one successful API call
+type vertexOutput struct {
+	Text           string
+	Project        string // Project whose endpoint served the request
+	RequestID      string // Server-side request ID, for support escalation
+	RawResponse    string // Response body as received, under --store_raw_response
+	ModelVersion   string // modelVersionId reported by the endpoint, when present
+	SafetyStatus   string // One of the safety* constants
+	PromptTokens   int64
+	CachedTokens   int64 // Of PromptTokens, served from the context cache
+	OutputTokens   int64
+	LatencyMs      int64 // Time spent calling the API for this prompt, including model upgrades
+	Fallback       bool  // Text came from a fallback responder rather than the model
+	FinishReason   string
+	Attempt        int      // 1 for the first call, higher when a mutated retry produced Text; 0 for fallbacks
+	Mutation       string   // Retry strategy applied on the attempt that produced Text
+	MissingTerms   []string // Required terms absent from Text, see entities.go
+	RuleViolations []string // Consistency rules Text breaks, see rules.go
+	GlossaryMisses []string // Glossary entries Text breaks, see glossary.go
+	LexiconHits    []string // Lexicon terms found in Text, see lexicons.go
+	SafetyRatings  []SafetyRating
+	Citations      []Citation
 }
 
 // --- Stateful DoFn for Vertex AI call ---
@@ -164,13 +564,136 @@ const maxRedundantErrors = 20 // Cap for redundant errors per worker
 
 // GenerateTextFn now includes projectID and region
 type GenerateTextFn struct {
-	ProjectID string // Added
-	Region    string // Added
-	ModelName string
-
-	mu           sync.Mutex
-	errorCounts  map[string]int
-	ErrorCounter beam.Counter
+	ProjectID   string // Added
+	Region      string // Added
+	OnDataflow  bool   // Workers can ask the metadata server for their identity, see runners.go
+	ModelName   string
+	APIMode     string      // auto, generate_content, or predict; see generatecontent.go
+	Backend     string      // Service answering the requests, see textgen.go; empty is Vertex AI
+	Stage       string      // Model-calling stage of the task, see stages.go
+	RunID       string      // Stamped on every result row
+	DisableGzip bool        // Send/accept uncompressed bodies when true
+	ModelLadder []string    // Larger-context models to try when the prompt overflows ModelName
+	ModelTiers  []modelTier // Cheapest-first models routed to by complexity, see router.go; empty uses ModelName
+
+	BackendURL     string // Base URL of the openai backend
+	BackendKeyFile string // API key of the gemini_api and openai backends, read on the workers
+
+	TierStructuredPoints int64         // Complexity surcharge for structured answers
+	LogPolicy            contentPolicy // Redaction applied to content in log statements
+
+	PromptVersion string // Recorded in the provenance columns
+	Watermark     bool   // Append an invisible provenance marker to generated text
+	LRUSize       int    // Worker-local result cache size; 0 disables it
+
+	MaxElementAge time.Duration // Elements older than this skip model upgrades; 0 disables
+	FallbackText  string        // Emitted for stale elements when non-empty
+
+	CircuitFailures  int           // Consecutive endpoint failures that open the circuit; 0 disables it
+	CircuitCooldown  time.Duration // How long the circuit stays open before a probe
+	FallbackTemplate string        // text/template over Prompt emitted while the circuit is open
+
+	TemplateVars map[string]string // {{var "name"}} values of the templates, see templatevars.go
+
+	RequestsPerSecond float64    // Worker-wide request rate; 0 disables the limiter
+	RateBurst         int        // Token bucket capacity
+	AdaptiveMinRate   float64    // Floor of the adaptive throttle, see adaptive.go; 0 keeps the rate fixed
+	StateRedisAddr    string     // Redis host:port persisting limiter/breaker state; empty disables
+	StageLimit        stageLimit // This stage's own limits on top of the worker-wide ones
+
+	ResponseEnum []string         // Closed set of allowed answers sent as an enum responseSchema; empty is free-form
+	Generation   VertexParameters // Sampling settings from the generation flags, see generation.go
+
+	FinishRetryStrategy    string             // Mutation for one retry after a RECITATION or SAFETY stop; empty disables
+	FinishRetryTemperature float64            // Temperature used by the lower_temperature strategy
+	EntityCheck            string             // off, flag, or retry; see entities.go
+	NumericBounds          []string           // label=min:max sanity bounds; out-of-range answers are dead-lettered
+	NumericRetry           bool               // Retry an out-of-range answer once before dead-lettering it
+	ConsistencyRules       *consistencyConfig // Cross-field checks from --consistency_rules; nil disables them
+	Glossary               []glossaryEntry    // --glossary_table entries checked in answers
+	Lexicons               *lexiconConfig     // Prohibited-term categories from --lexicons; nil disables them
+	MaxReadingGrade        float64            // Grade level above which an answer is retried once in simpler words; 0 disables
+	MinChars               int                // Minimum answer length in characters, see lengths.go; 0 is unset
+	MaxChars               int                // Maximum answer length in characters; 0 is unset
+	LengthRetries          int                // Retries of an answer outside the length limits before it is dead-lettered
+
+	InstancesPerRequest int           // Prompts packed into one predict request; 1 sends each on its own
+	BatchAutotune       time.Duration // How long to experiment with smaller sizes first, see batchtune.go; 0 disables
+
+	QuotaCooldown time.Duration // Worker-wide pause after a project quota error; 0 fails the row instead
+	Retry         *retryPolicy  // Retryable-vs-permanent classification from --retry_config or --max_retries; nil never retries
+
+	StoreRawResponse    bool // Keep each response body in the RawResponse column
+	CompressRawResponse bool // Store it gzipped and base64-encoded
+
+	OutputFormats []string // html and/or text renderings of GeneratedText to fill
+	TraceRows     bool     // Fill the Trace column
+
+	ProgressProject  string        // Output project of the launch
+	ProgressDataset  string        // outputDataset of the launch
+	ProgressTable    string        // Table in ProgressDataset receiving progress heartbeats; empty disables
+	ProgressInterval time.Duration // Time between heartbeats
+	Deadline         time.Time     // Prompts arriving later are dead-lettered, see runtime.go; zero disables
+
+	QuotaProjects   []string // project or project=credentials_uri entries to spread requests over
+	ProjectBudgets  []string // project=requests budgets per worker
+	ProjectRotation string   // round_robin or budget
+
+	mu                    sync.Mutex
+	errorCounts           map[string]int
+	ErrorCounter          beam.Counter
+	UpgradeCounter        beam.Counter
+	LRUHits               beam.Counter
+	LRUMisses             beam.Counter
+	StaleCounter          beam.Counter
+	CircuitOpenCounter    beam.Counter
+	EnumMismatchCounter   beam.Counter
+	FinishRetryCounter    beam.Counter
+	QuotaExhaustedCounter beam.Counter
+	RetryCounter          beam.Counter
+	AttemptDistribution   beam.Distribution // Attempts per call, retries included
+	EntityMismatchCounter beam.Counter
+	EntityRetryCounter    beam.Counter
+	GlossaryCounter       beam.Counter
+	SimplifyCounter       beam.Counter
+	LengthRetryCounter    beam.Counter
+	LengthCounter         beam.Counter
+	OutOfRangeCounter     beam.Counter
+	NumericRetryCounter   beam.Counter
+	BatchRequestCounter   beam.Counter
+	BatchFallbackCounter  beam.Counter
+	RuntimeSkipCounter    beam.Counter
+	CachedTokensCounter   beam.Counter
+	pacingCounters
+	sizeDistributions
+	unitNormalizer
+
+	client       *http.Client // Authorized Vertex AI client, kept from Setup; see registry.go
+	lru          *resultLRU
+	breaker      *circuitBreaker
+	bucket       *tokenBucket
+	stageBucket  *tokenBucket
+	stageBudget  *requestBudget
+	generator    TextGenerator
+	generatorErr error
+	stateStore   *limiterStateStore
+	quotaPause   *quotaPause
+	projects     *projectPool
+	projectsErr  error
+	progress     *progressReporter
+	fallbackTmpl *template.Template
+
+	warnedDeadline atomic.Bool // The --max_runtime warning is logged once per instance
+
+	numericBounds []numericBound
+	rules         *ruleSet
+	lexicons      *lexiconSet
+	hoisted       string            // Shared prefix of the element being processed, see prefix.go
+	trace         *rowTrace         // Trace of the element being processed under TraceRows
+	pending       []pendingInstance // Prompts waiting for a batched request, see batch.go
+	batchTarget   int               // Size the pending batch is sent at
+	tuner         *batchTuner       // Chooses batchTarget under BatchAutotune
+	throttle      *aimdThrottle     // Moves the bucket's rate under AdaptiveMinRate
 
 	workerIdentity string
 	identityErr    error
@@ -180,15 +703,125 @@ type GenerateTextFn struct {
 func (fn *GenerateTextFn) Setup(ctx context.Context) {
 	fn.errorCounts = make(map[string]int)
 	fn.ErrorCounter = beam.NewCounter("vertexai", "predict_errors_total") // Updated counter name
-
-	// Determine worker identity (try metadata server first, fallback to ADC tokeninfo)
-	email, err := getMetadataServiceAccountEmail()
-	if err != nil {
-		beamlog.Warnf(ctx, "GenerateTextFn: Failed to get identity from metadata server (%v), trying ADC tokeninfo fallback...", err)
-		email, err = getADCIdentityEmail(ctx)
+	fn.UpgradeCounter = beam.NewCounter("vertexai", "model_upgrades_total")
+	fn.LRUHits = beam.NewCounter("vertexai", "lru_hits_total")
+	fn.LRUMisses = beam.NewCounter("vertexai", "lru_misses_total")
+	fn.StaleCounter = beam.NewCounter("vertexai", "stale_elements_total")
+	fn.RuntimeSkipCounter = beam.NewCounter("vertexai", "max_runtime_skipped_total")
+	if fn.LRUSize > 0 {
+		fn.lru = sharedResultLRU(fn.LRUSize)
 	}
-
-	if err != nil {
+	if fn.ProgressTable != "" {
+		fn.progress = sharedProgressReporter(ctx, fn.ProgressProject, fn.ProgressDataset, fn.ProgressTable, fn.RunID, fn.ProgressInterval)
+	}
+	fn.CircuitOpenCounter = beam.NewCounter("vertexai", "circuit_open_rejections_total")
+	fn.EnumMismatchCounter = beam.NewCounter("vertexai", "enum_mismatches_total")
+	fn.FinishRetryCounter = beam.NewCounter("vertexai", "finish_reason_retries_total")
+	fn.QuotaExhaustedCounter = beam.NewCounter("vertexai", "quota_exhausted_total")
+	fn.RetryCounter = beam.NewCounter("vertexai", "retries_total")
+	fn.AttemptDistribution = beam.NewDistribution("vertexai", "attempts_per_call")
+	fn.EntityMismatchCounter = beam.NewCounter("vertexai", "entity_mismatches_total")
+	fn.EntityRetryCounter = beam.NewCounter("vertexai", "entity_retries_total")
+	fn.GlossaryCounter = beam.NewCounter("vertexai", "glossary_violations_total")
+	fn.SimplifyCounter = beam.NewCounter("vertexai", "simplify_retries_total")
+	fn.CachedTokensCounter = beam.NewCounter("vertexai", "cached_prompt_tokens_total")
+	fn.LengthRetryCounter = beam.NewCounter("vertexai", "length_retries_total")
+	fn.LengthCounter = beam.NewCounter("vertexai", "length_violations_total")
+	fn.OutOfRangeCounter = beam.NewCounter("vertexai", "out_of_range_total")
+	fn.NumericRetryCounter = beam.NewCounter("vertexai", "numeric_bounds_retries_total")
+	fn.BatchRequestCounter = beam.NewCounter("vertexai", "batched_requests_total")
+	fn.BatchFallbackCounter = beam.NewCounter("vertexai", "batch_fallbacks_total")
+	if fn.ConsistencyRules != nil {
+		// Validated in main; a failure here disables the rules
+		if rs, err := fn.ConsistencyRules.compile(); err != nil {
+			beamlog.Errorf(ctx, "GenerateTextFn: Invalid consistency rules: %v", err)
+		} else {
+			fn.rules = rs
+		}
+	}
+	if fn.Lexicons != nil {
+		// Validated in main; a failure here disables the filters
+		if ls, err := fn.Lexicons.compile(); err != nil {
+			beamlog.Errorf(ctx, "GenerateTextFn: Invalid lexicons: %v", err)
+		} else {
+			fn.lexicons = ls
+		}
+	}
+	if len(fn.NumericBounds) > 0 {
+		// Validated in main; a failure here disables the check
+		if bounds, err := parseNumericBounds(fn.NumericBounds); err != nil {
+			beamlog.Errorf(ctx, "GenerateTextFn: Invalid numeric bounds: %v", err)
+		} else {
+			fn.numericBounds = bounds
+		}
+	}
+	if fn.QuotaCooldown > 0 {
+		fn.quotaPause = sharedWorkerRegistry().quotaPause(vertexEndpoint)
+	}
+	if len(fn.QuotaProjects) > 0 {
+		// Validated in main; a failure here fails every call with the same error
+		specs, err := parseQuotaProjects(fn.QuotaProjects, fn.ProjectBudgets)
+		if err == nil {
+			fn.projects, err = sharedProjectPool(ctx, specs, fn.ProjectRotation, fn.QuotaCooldown)
+		}
+		if err != nil {
+			fn.projectsErr = fmt.Errorf("failed to set up --quota_projects: %w", err)
+			beamlog.Errorf(ctx, "GenerateTextFn: %v", fn.projectsErr)
+		}
+	} else if fn.usesVertex() {
+		if client, err := sharedWorkerRegistry().client(ctx, "", cloudPlatformScope); err != nil {
+			// Authenticate before the first bundle; calls retry and report the error if it persists
+			beamlog.Warnf(ctx, "GenerateTextFn: Could not pre-authenticate the Vertex AI client: %v", err)
+		} else {
+			fn.client = client
+		}
+	}
+	// Validated in main; a failure here (e.g. an unreadable key) fails every call with the same error
+	if fn.generator, fn.generatorErr = fn.newTextGenerator(ctx); fn.generatorErr != nil {
+		beamlog.Errorf(ctx, "GenerateTextFn: Failed to set up --backend %s: %v", fn.Backend, fn.generatorErr)
+	}
+	if fn.CircuitFailures > 0 {
+		fn.breaker = sharedWorkerRegistry().breaker(vertexEndpoint, fn.CircuitFailures, fn.CircuitCooldown)
+	}
+	if fn.RequestsPerSecond > 0 {
+		fn.bucket = sharedWorkerRegistry().bucket(vertexEndpoint, fn.RequestsPerSecond, fn.RateBurst)
+		if fn.AdaptiveMinRate > 0 {
+			fn.throttle = sharedWorkerRegistry().adaptiveThrottle(vertexEndpoint, fn.bucket, fn.AdaptiveMinRate)
+		}
+	}
+	if fn.StageLimit.Rate > 0 {
+		fn.stageBucket = sharedWorkerRegistry().bucket(stageGuardName(fn.Stage), fn.StageLimit.Rate, fn.StageLimit.Burst)
+	}
+	if fn.StageLimit.Budget > 0 {
+		fn.stageBudget = sharedWorkerRegistry().budget(stageGuardName(fn.Stage), fn.StageLimit.Budget)
+	}
+	if fn.BatchAutotune > 0 && fn.InstancesPerRequest > 1 {
+		fn.tuner = sharedWorkerRegistry().batchTuner(fn.Stage, fn.InstancesPerRequest, fn.BatchAutotune)
+	}
+	if fn.StateRedisAddr != "" && (fn.bucket != nil || fn.breaker != nil) {
+		fn.stateStore = sharedLimiterStateStore(fn.StateRedisAddr, limiterStateKey(fn.RunID))
+		fn.restoreLimiterState(ctx)
+	}
+	if fn.FallbackTemplate != "" {
+		// Validated in main; a failure here leaves the template unset
+		if tmpl, err := parseFallbackTemplate(fn.FallbackTemplate, fn.TemplateVars); err != nil {
+			beamlog.Errorf(ctx, "GenerateTextFn: Invalid fallback template: %v", err)
+		} else {
+			fn.fallbackTmpl = tmpl
+		}
+	}
+	fn.setupPacing()
+	fn.setupSizes()
+	fn.setupUnits()
+
+	// Determine worker identity (metadata server on Dataflow, then ADC; see runners.go)
+	email, err := resolveWorkerIdentity(ctx, fn.OnDataflow)
+
+	if err != nil && !fn.OnDataflow {
+		// Portable runners authenticate however the cluster is set up; the identity is only informational
+		fn.workerIdentity = "unknown"
+		beamlog.Warnf(ctx, "GenerateTextFn: Could not determine worker identity, continuing: %v", err)
+	} else if err != nil {
 		fn.identityErr = fmt.Errorf("failed to determine worker identity: %w", err)
 		beamlog.Errorf(ctx, "GenerateTextFn: %v", fn.identityErr)
 	} else {
@@ -197,174 +830,779 @@ func (fn *GenerateTextFn) Setup(ctx context.Context) {
 	}
 }
 
+// StartBundle marks the beginning of a bundle for the pacing report
+func (fn *GenerateTextFn) StartBundle(ctx context.Context, emit func(GeminiResult), emitFailed func(FailedCall)) {
+	fn.startBundle()
+}
+
+// FinishBundle sends any partly filled batch, records bundle wall time for the
+// pacing report, and snapshots limiter state
+func (fn *GenerateTextFn) FinishBundle(ctx context.Context, emit func(GeminiResult), emitFailed func(FailedCall)) {
+	fn.flushPending(ctx, emit, emitFailed)
+	fn.finishBundle(ctx)
+	if fn.stateStore != nil {
+		fn.saveLimiterState(ctx)
+	}
+}
+
 // ProcessElement calls the updated callVertexPredictAPI method
-func (fn *GenerateTextFn) ProcessElement(ctx context.Context, p Prompt, emit func(GeminiResult)) {
+func (fn *GenerateTextFn) ProcessElement(ctx context.Context, ts beam.EventTime, p Prompt, emit func(GeminiResult), emitFailed func(FailedCall)) {
 	if fn.identityErr != nil {
-		beamlog.Errorf(ctx, "GenerateTextFn: Skipping processing for prompt '%.50s...' due to worker identity error: %v", p.Prompt, fn.identityErr)
+		beamlog.Errorf(ctx, "GenerateTextFn: Skipping processing for prompt '%s' due to worker identity error: %v", fn.LogPolicy.redact(p.Prompt), fn.identityErr)
 		return
 	}
 
-	// Call the renamed and updated API function
-	result, err := fn.callVertexPredictAPI(ctx, p.Prompt)
+	fn.progress.addElement()
+	fn.startTrace()
+	fn.hoisted = hoistedPrefix(p)
+	params := fn.parametersFor(p)
+	model := fn.route(p, params).Model
+	promptHash := PromptHash(p.Prompt, model, params)
+	if fn.lru != nil {
+		hit, ok := fn.lru.get(promptHash)
+		fn.traceCache(ok)
+		if ok {
+			fn.LRUHits.Inc(ctx, 1)
+			fn.emitResult(p, promptHash, hit.Model, hit.Out, emit)
+			return
+		}
+		fn.LRUMisses.Inc(ctx, 1)
+	}
+	if fn.pastDeadline() {
+		fn.skipPastDeadline(ctx, p, promptHash, model, emitFailed)
+		return
+	}
 
-	if err != nil {
-		fn.ErrorCounter.Inc(ctx, 1)
-		errorString := err.Error()
-		fn.mu.Lock()
-		count := fn.errorCounts[errorString]
-		if count < maxRedundantErrors {
-			// Updated error log message
-			beamlog.Errorf(ctx, "GenerateTextFn: Error calling Vertex AI predict (identity: '%s', prompt: '%.50s...') (Count: %d): %v", fn.workerIdentity, p.Prompt, count+1, err)
-			fn.errorCounts[errorString] = count + 1
-		} else if count == maxRedundantErrors {
-			beamlog.Warnf(ctx, "GenerateTextFn: Reached error cap (%d) for identity '%s' and Vertex AI error starting with: %.100s...", maxRedundantErrors, fn.workerIdentity, errorString)
-			fn.errorCounts[errorString] = count + 1
-		}
-		fn.mu.Unlock()
+	// Stale elements get the fallback text, or a single attempt without upgrades, to protect downstream SLAs
+	stale := fn.isStale(ctx, ts)
+	if stale && fn.FallbackText != "" {
+		fn.emitFallback(ctx, p, promptHash, emit)
 		return
 	}
 
-	// beamlog.Infof(ctx, "GenerateTextFn: Successfully generated text via Vertex AI for prompt: %.50s...", p.Prompt)
-	emit(GeminiResult{Prompt: p.Prompt, GeneratedText: result})
+	// Several prompts may share one request, see batch.go; stale ones are not held back
+	if fn.InstancesPerRequest > 1 && !stale && !usesGenerateContent(fn.APIMode, model) {
+		fn.enqueue(ctx, pendingInstance{Prompt: p, Model: model, Params: params, PromptHash: promptHash, trace: fn.trace}, emit, emitFailed)
+		return
+	}
+	fn.generate(ctx, p, params, promptHash, stale, emit, emitFailed)
 }
 
-// callVertexPredictAPI handles the HTTP request to the Vertex AI predict endpoint.
-func (fn *GenerateTextFn) callVertexPredictAPI(ctx context.Context, prompt string) (string, error) {
-	// Use the broader cloud-platform scope, standard for most GCP APIs including Vertex AI
-	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform")
+// generate calls the model for one prompt and emits its row or dead letter.
+func (fn *GenerateTextFn) generate(ctx context.Context, p Prompt, params VertexParameters, promptHash string, stale bool, emit func(GeminiResult), emitFailed func(FailedCall)) {
+	// Call the renamed and updated API function, escalating to larger-context models on overflow
+	callStart := time.Now()
+	model := fn.route(p, params).Model
+	predict := fn.guardedPredict
+	if stale {
+		predict = fn.singlePredict
+	}
+	out, err := predict(ctx, model, p.Prompt, params)
+	for _, next := range fn.upgradePath(model) {
+		if stale {
+			break
+		}
+		if err == nil || !isContextOverflowError(err) {
+			break
+		}
+		beamlog.Warnf(ctx, "GenerateTextFn: Prompt '%s' exceeded the input token limit of %s, retrying with %s", fn.LogPolicy.redact(p.Prompt), model, next)
+		fn.UpgradeCounter.Inc(ctx, 1)
+		model = next
+		out, err = fn.guardedPredict(ctx, model, p.Prompt, params)
+	}
+
 	if err != nil {
-		return "", fmt.Errorf("failed to create google default client (ADC issue?): %w", err)
+		fn.failGeneration(ctx, p, promptHash, model, err, emit, emitFailed)
+		return
+	}
+	fn.finishGeneration(ctx, p, params, promptHash, model, stale, out, callStart, emit, emitFailed)
+}
+
+// failGeneration answers a prompt whose call failed with the circuit-open
+// fallback template, or logs the error and dead-letters the prompt.
+func (fn *GenerateTextFn) failGeneration(ctx context.Context, p Prompt, promptHash, model string, err error, emit func(GeminiResult), emitFailed func(FailedCall)) {
+	if errors.Is(err, errCircuitOpen) && fn.emitTemplateFallback(ctx, p, promptHash, emit) {
+		return
+	}
+	fn.ErrorCounter.Inc(ctx, 1)
+	errorString := err.Error()
+	fn.mu.Lock()
+	count := fn.errorCounts[errorString]
+	if count < maxRedundantErrors {
+		// Updated error log message
+		beamlog.Errorf(ctx, "GenerateTextFn: Error calling Vertex AI predict (identity: '%s', prompt: '%s') (Count: %d): %v", fn.workerIdentity, fn.LogPolicy.redact(p.Prompt), count+1, err)
+		fn.errorCounts[errorString] = count + 1
+	} else if count == maxRedundantErrors {
+		beamlog.Warnf(ctx, "GenerateTextFn: Reached error cap (%d) for identity '%s' and Vertex AI error starting with: %.100s...", maxRedundantErrors, fn.workerIdentity, errorString)
+		fn.errorCounts[errorString] = count + 1
+	}
+	fn.mu.Unlock()
+	emitFailed(fn.failedCall(p, promptHash, model, err))
+}
+
+// finishGeneration applies the retries and answer checks to a successful call
+// and emits the row, or dead-letters an answer that fails a check.
+func (fn *GenerateTextFn) finishGeneration(ctx context.Context, p Prompt, params VertexParameters, promptHash, model string, stale bool, out vertexOutput, callStart time.Time, emit func(GeminiResult), emitFailed func(FailedCall)) {
+	// beamlog.Infof(ctx, "GenerateTextFn: Successfully generated text via Vertex AI for prompt: %s", fn.LogPolicy.redact(p.Prompt))
+	out.Attempt = 1
+	if !stale {
+		out = fn.retryFinish(ctx, p, model, params, out)
 	}
+	out = fn.checkTerms(ctx, p, model, params, out)
+	if !stale {
+		out = fn.simplify(ctx, p, model, params, out)
+	}
+	if !fn.checkEnum(ctx, p, model, params, stale, &out) {
+		beamlog.Warnf(ctx, "GenerateTextFn: Answer to prompt '%s' is not one of the allowed values, dead-lettering it", fn.LogPolicy.redact(p.Prompt))
+		emitFailed(fn.invalidAnswerCall(p, promptHash, model, out, "ENUM_MISMATCH", fmt.Errorf("%w: %q", errEnumMismatch, fn.LogPolicy.redact(strings.TrimSpace(out.Text)))))
+		return
+	}
+	if violation := fn.checkLength(ctx, p, model, params, &out); violation != "" {
+		fn.LengthCounter.Inc(ctx, 1)
+		beamlog.Warnf(ctx, "GenerateTextFn: Answer to prompt '%s' is %s, dead-lettering it", fn.LogPolicy.redact(p.Prompt), violation)
+		emitFailed(fn.invalidAnswerCall(p, promptHash, model, out, "LENGTH_VIOLATION", fmt.Errorf("%w: %s", errLengthViolation, violation)))
+		return
+	}
+	fn.checkGlossary(ctx, p, &out)
+	if violations := fn.checkBounds(ctx, p, model, params, &out); len(violations) > 0 {
+		fn.OutOfRangeCounter.Inc(ctx, 1)
+		beamlog.Warnf(ctx, "GenerateTextFn: Answer to prompt '%s' is out of range (%s), dead-lettering it", fn.LogPolicy.redact(p.Prompt), fn.LogPolicy.redact(strings.Join(violations, "; ")))
+		emitFailed(fn.invalidAnswerCall(p, promptHash, model, out, "OUT_OF_RANGE", fmt.Errorf("%w: %s", errOutOfRange, strings.Join(violations, "; "))))
+		return
+	}
+	if fn.rules != nil {
+		violations, dlq := fn.rules.check(ctx, out.Text)
+		if dlq {
+			beamlog.Warnf(ctx, "GenerateTextFn: Answer to prompt '%s' breaks consistency rules, dead-lettering it", fn.LogPolicy.redact(p.Prompt))
+			emitFailed(fn.invalidAnswerCall(p, promptHash, model, out, "RULE_VIOLATION", fmt.Errorf("%w: %s", errRuleViolation, strings.Join(violations, "; "))))
+			return
+		}
+		out.RuleViolations = violations
+	}
+	if fn.lexicons != nil {
+		hits, text, dlq := fn.lexicons.check(ctx, out.Text)
+		if dlq {
+			beamlog.Warnf(ctx, "GenerateTextFn: Answer to prompt '%s' uses prohibited terms, dead-lettering it", fn.LogPolicy.redact(p.Prompt))
+			emitFailed(fn.invalidAnswerCall(p, promptHash, model, out, "LEXICON_VIOLATION", fmt.Errorf("%w: %s", errLexiconViolation, strings.Join(hits, "; "))))
+			return
+		}
+		out.Text, out.LexiconHits = text, hits
+	}
+	out.LatencyMs = time.Since(callStart).Milliseconds()
+	if fn.lru != nil {
+		cached := out
+		cached.LatencyMs = 0 // Cache hits cost no API time
+		fn.lru.put(promptHash, cachedGeneration{Out: cached, Model: model})
+	}
+	fn.emitResult(p, promptHash, model, out, emit)
+}
+
+// emitResult builds the output row for a prompt from a fresh or cached generation.
+func (fn *GenerateTextFn) emitResult(p Prompt, promptHash, model string, out vertexOutput, emit func(GeminiResult)) {
+	params := fn.parametersFor(p)
+	route := fn.route(p, params)
+	res := GeminiResult{
+		RunID:          fn.RunID,
+		GeneratedAt:    time.Now().UTC(),
+		Prompt:         p.Prompt,
+		PromptHash:     promptHash,
+		ParentKey:      p.ParentKey,
+		SubIndex:       p.SubIndex,
+		SubCount:       p.SubCount,
+		GeneratedText:  out.Text,
+		ModelUsed:      model,
+		ModelTier:      route.Tier,
+		Complexity:     route.Complexity,
+		PromptTokens:   out.PromptTokens,
+		CachedTokens:   out.CachedTokens,
+		OutputTokens:   out.OutputTokens,
+		TotalTokens:    out.PromptTokens + out.OutputTokens,
+		LatencyMs:      out.LatencyMs,
+		Fallback:       out.Fallback,
+		FinishReason:   out.FinishReason,
+		VertexProject:  out.Project,
+		RequestID:      out.RequestID,
+		Attempt:        out.Attempt,
+		Mutation:       out.Mutation,
+		MissingTerms:   out.MissingTerms,
+		RuleViolations: out.RuleViolations,
+		GlossaryMisses: out.GlossaryMisses,
+		LexiconHits:    out.LexiconHits,
+
+		SourceURI:       p.SourceURI,
+		SourceMimeType:  p.SourceMimeType,
+		SourceSizeBytes: p.SourceSizeBytes,
+
+		OrderingKey: p.OrderingKey,
+		Sequence:    p.Sequence,
+
+		WorkflowStep: p.WorkflowStep,
+		WorkflowPath: p.WorkflowPath,
+	}
+	if model != route.Model {
+		res.UpgradedFrom = route.Model
+	}
+	fn.stampProvenance(&res, out, params.ResponseSchema != nil)
+	fn.formatOutput(&res)
+	res.ReadingGrade = readingGrade(res.GeneratedText)
+	res.Trace = fn.finishTrace()
+	fn.storeRawResponse(&res, out.RawResponse)
+	fn.progress.addRow(res)
+	emit(res)
+}
+
+// upgradePath returns the ladder models that come after the given model.
+// A model that is not on the ladder may escalate to any ladder entry.
+func (fn *GenerateTextFn) upgradePath(model string) []string {
+	for i, m := range fn.ModelLadder {
+		if m == model {
+			return fn.ModelLadder[i+1:]
+		}
+	}
+	var path []string
+	for _, m := range fn.ModelLadder {
+		if m != model {
+			path = append(path, m)
+		}
+	}
+	return path
+}
 
-	// Construct the Vertex AI Predict endpoint URL
+// isContextOverflowError reports whether the API rejected the prompt for exceeding the model's input token limit.
+func isContextOverflowError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, marker := range []string{
+		"input token limit",
+		"input token count",
+		"exceeds the maximum number of tokens",
+		"context length",
+	} {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// callVertexPredictAPI handles the HTTP request to the Vertex AI predict endpoint,
+// with one instance per prompt (see batch.go).
+// With --quota_projects the call goes to the next pooled project instead of ProjectID.
+func (fn *GenerateTextFn) callVertexPredictAPI(ctx context.Context, model string, prompts []string, params VertexParameters) ([]vertexOutput, error) {
+	if len(fn.QuotaProjects) > 0 {
+		if fn.projectsErr != nil {
+			return nil, fn.projectsErr
+		}
+		m, err := fn.projects.pick()
+		if err != nil {
+			return nil, err
+		}
+		outs, err := fn.predict(ctx, m.client, m.Project, model, prompts, params)
+		fn.projects.record(ctx, m, totalOutput(outs), err)
+		return outs, err
+	}
+
+	if fn.client == nil {
+		// Setup could not authenticate; use the broader cloud-platform scope, standard for most GCP APIs including Vertex AI
+		client, err := sharedWorkerRegistry().client(ctx, "", cloudPlatformScope)
+		if err != nil {
+			return nil, err
+		}
+		fn.client = client
+	}
+	return fn.predict(ctx, fn.client, fn.ProjectID, model, prompts, params)
+}
+
+// predict sends one request, with one instance per prompt, to the predict
+// endpoint of the given project and returns the outputs in prompt order.
+func (fn *GenerateTextFn) predict(ctx context.Context, client *http.Client, project, model string, prompts []string, params VertexParameters) ([]vertexOutput, error) {
+	// Construct the Vertex AI endpoint URL, generateContent for Gemini models, see generatecontent.go
 	// Example: https://us-central1-aiplatform.googleapis.com/v1/projects/my-project/locations/us-central1/publishers/google/models/gemini-pro:predict
-	vertexPredictURL := fmt.Sprintf("https://%s-aiplatform.googleapis.com/v1/projects/%s/locations/%s/publishers/google/models/%s:predict",
-		fn.Region, fn.ProjectID, fn.Region, fn.ModelName)
+	method := "predict"
+	if usesGenerateContent(fn.APIMode, model) {
+		method = "generateContent"
+	}
+	vertexPredictURL := fmt.Sprintf("https://%s-aiplatform.googleapis.com/v1/projects/%s/locations/%s/publishers/google/models/%s:%s",
+		fn.Region, project, fn.Region, model, method)
 
 	// Construct the Vertex AI request body
-	reqBody := VertexRequest{
-		Instances: []VertexInstance{
-			{Prompt: prompt},
-		},
-		Parameters: VertexParameters{
-			Temperature: 0.8, // Example parameters - adjust as needed
-			TopK:        3,
-			// MaxOutputTokens: 256, // Uncomment or add if needed
-		},
-	}
-
-	reqBytes, err := json.Marshal(reqBody)
+	var reqBytes []byte
+	var err error
+	if method == "generateContent" {
+		if len(prompts) != 1 {
+			return nil, fmt.Errorf("generateContent takes one prompt per request, got %d", len(prompts))
+		}
+		system, prompt := fn.splitHoisted(prompts[0])
+		var attached []GeminiPart
+		if attached, err = fn.documentParts(ctx, params.Document); err != nil {
+			return nil, err
+		}
+		reqBytes, err = generateContentBody(system, prompt, params, attached)
+	} else {
+		if params.Document != nil {
+			return nil, fmt.Errorf("model %s is called through predict, which can't take the document %s; use a Gemini model or --api_mode=%s", model, params.Document.URI, apiModeGenerateContent)
+		}
+		reqBody := VertexRequest{Parameters: params}
+		for _, prompt := range prompts {
+			reqBody.Instances = append(reqBody.Instances, VertexInstance{Prompt: prompt})
+		}
+		reqBytes, err = json.Marshal(reqBody)
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal vertex request body: %w", err)
+		return nil, fmt.Errorf("failed to marshal vertex request body: %w", err)
+	}
+	if !fn.DisableGzip {
+		if reqBytes, err = gzipBytes(reqBytes); err != nil {
+			return nil, fmt.Errorf("failed to gzip vertex request body: %w", err)
+		}
 	}
 
 	// Create and send the request
 	req, err := http.NewRequestWithContext(ctx, "POST", vertexPredictURL, bytes.NewBuffer(reqBytes))
 	if err != nil {
-		return "", fmt.Errorf("failed to create http request for vertex ai: %w", err)
+		return nil, fmt.Errorf("failed to create http request for vertex ai: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	if fn.DisableGzip {
+		// Explicitly opt out, otherwise the transport negotiates gzip on its own
+		req.Header.Set("Accept-Encoding", "identity")
+	} else {
+		req.Header.Set("Content-Encoding", "gzip")
+		// Setting this ourselves disables transparent decompression, see readResponseBody
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
 
+	reqStart := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to send request to vertex ai predict api: %w", err)
+		fn.recordRequest(ctx, time.Since(reqStart), false)
+		return nil, fmt.Errorf("failed to send request to vertex ai predict api: %w", err)
 	}
 	defer resp.Body.Close()
 
-	respBodyBytes, err := io.ReadAll(resp.Body)
+	respBodyBytes, err := readResponseBody(resp)
+	fn.recordRequest(ctx, time.Since(reqStart), resp.StatusCode == http.StatusTooManyRequests)
 	if err != nil {
-		return "", fmt.Errorf("failed to read vertex response body: %w", err)
+		return nil, fmt.Errorf("failed to read vertex response body: %w", err)
 	}
 
-	// Handle non-OK status codes
+	// Handle non-OK status codes, keeping the Google API error details and request ID for the DLQ,
+	// and a remediation for auth failures (see authdiag.go)
 	if resp.StatusCode != http.StatusOK {
-		// Attempt to parse standard Google API error structure for more details
-		var googleApiError struct {
-			Error struct {
-				Code    int    `json:"code"`
-				Message string `json:"message"`
-				Status  string `json:"status"`
-			} `json:"error"`
+		apiErr := fn.newVertexAPIError(resp, respBodyBytes, project)
+		fn.diagnoseAuthError(ctx, client, apiErr)
+		return nil, apiErr
+	}
+
+	// A batched response is split into one single-prediction body per prompt, so
+	// every row stores (and reparse reads) a response of its own
+	bodies := [][]byte{respBodyBytes}
+	if len(prompts) > 1 {
+		if bodies, err = splitBatchResponse(respBodyBytes, prompts); err != nil {
+			return nil, err
 		}
-		if json.Unmarshal(respBodyBytes, &googleApiError) == nil && googleApiError.Error.Message != "" {
-			return "", fmt.Errorf("vertex ai predict api request failed with status %d (%s): %s",
-				resp.StatusCode, googleApiError.Error.Status, googleApiError.Error.Message)
+	}
+	outs := make([]vertexOutput, len(prompts))
+	for i, prompt := range prompts {
+		out, err := parseVertexResponse(ctx, bodies[i], prompt, fn.LogPolicy)
+		if err != nil {
+			return nil, err
 		}
-		// Fallback to raw body if not standard error format
-		return "", fmt.Errorf("vertex ai predict api request failed with status %d: %s", resp.StatusCode, string(respBodyBytes))
+		out = fn.finishOutput(ctx, model, prompt, bodies[i], out)
+		out.Project = project
+		out.RequestID = resp.Header.Get(requestIDHeader)
+		outs[i] = out
 	}
+	return outs, nil
+}
 
-	// Unmarshal the successful response
+// parseVertexResponse extracts the content of the first prediction from a
+// successful response body. The reparse subcommand runs it over stored bodies,
+// so parser fixes apply to past runs without calling the model again.
+func parseVertexResponse(ctx context.Context, body []byte, prompt string, policy contentPolicy) (vertexOutput, error) {
+	if isGenerateContentBody(body) {
+		return parseGenerateContentResponse(ctx, body, prompt, policy)
+	}
+	if isChatCompletionBody(body) {
+		return parseChatCompletionResponse(body, policy)
+	}
 	var vertexResp VertexResponse
-	if err := json.Unmarshal(respBodyBytes, &vertexResp); err != nil {
-		return "", fmt.Errorf("failed to unmarshal vertex response (body: %.100s...): %w", string(respBodyBytes), err)
+	if err := json.Unmarshal(body, &vertexResp); err != nil {
+		return vertexOutput{}, fmt.Errorf("failed to unmarshal vertex response (body: %s): %w", policy.redact(string(body)), err)
 	}
 
 	// Extract the content from the first prediction
+	out := vertexOutput{
+		ModelVersion: vertexResp.ModelVersionID,
+		SafetyStatus: safetyUnknown,
+		PromptTokens: vertexResp.Metadata.TokenMetadata.InputTokenCount.TotalTokens,
+		OutputTokens: vertexResp.Metadata.TokenMetadata.OutputTokenCount.TotalTokens,
+	}
 	if len(vertexResp.Predictions) == 0 {
-		beamlog.Warnf(ctx, "Received empty predictions list from Vertex AI for prompt: %.50s...", prompt)
-		return "No prediction content from Vertex AI", nil // Indicate empty result
+		beamlog.Warnf(ctx, "Received empty predictions list from Vertex AI for prompt: %s", policy.redact(prompt))
+		out.Text = "No prediction content from Vertex AI" // Indicate empty result
+		return out, nil
 	}
-	if vertexResp.Predictions[0].Content == "" {
-		beamlog.Warnf(ctx, "Received empty content in first prediction from Vertex AI for prompt: %.50s...", prompt)
-		return "Empty prediction content from Vertex AI", nil // Indicate empty content
+	pred := vertexResp.Predictions[0]
+	out.FinishReason = pred.FinishReason
+	out.SafetyRatings = predictSafetyRatings(pred.SafetyAttributes)
+	out.Citations = predictCitations(pred.CitationMetadata)
+	if pred.SafetyAttributes != nil {
+		out.SafetyStatus = safetyPassed
+		if pred.SafetyAttributes.Blocked {
+			out.SafetyStatus = safetyBlocked
+		}
+	}
+	if pred.Content == "" {
+		beamlog.Warnf(ctx, "Received empty content in first prediction from Vertex AI for prompt: %s", policy.redact(prompt))
+		out.Text = "Empty prediction content from Vertex AI" // Indicate empty content
+		return out, nil
 	}
 
-	return vertexResp.Predictions[0].Content, nil
+	out.Text = pred.Content
+	return out, nil
+}
+
+// gzipBytes compresses a request payload with the default compression level.
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readResponseBody reads the full response body, decompressing it if the server answered with gzip.
+func readResponseBody(resp *http.Response) ([]byte, error) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return io.ReadAll(resp.Body)
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
 }
 
 // Teardown remains the same
 func (fn *GenerateTextFn) Teardown(ctx context.Context) {
+	fn.progress.flush(ctx) // Final totals; later heartbeats repeat them
 	beamlog.Infof(ctx, "GenerateTextFn Teardown complete for worker (Identity used: %s).", fn.workerIdentity)
 }
 
 // --- Pipeline Definition ---
 
-// run function now takes projectID and region to pass to the DoFn
-func run(p *beam.Pipeline, projectID, region, tempLocation, stagingLocation, model string) error { // Added region
+// run function now takes the run's projects and region to pass to the DoFn
+func run(p *beam.Pipeline, projects runProjects, region, tempLocation, stagingLocation, model string) error { // Added region
 	s := p.Root().Scope("GenerateNutritionLabels")
 
-	// Step 1: Read Prompts from BigQuery (Unchanged)
-	query := `
-    SELECT CONCAT('generate nutrition label for ', products_brand_name) AS prompt
-    FROM sandboxdataset.food_products
-    LIMIT 100
-`
-	type PromptFromBQ struct {
-		Prompt string `bigquery:"prompt"`
+	// Step 1: Input query, read from BigQuery by the selected task below
+	query := inputQuery
+
+	tiers, err := parseModelTiers(splitList(*modelTiers))
+	if err != nil {
+		return fmt.Errorf("invalid --model_tiers: %w", err)
 	}
-	promptsFromBQ := bigqueryio.Query(s.Scope("ReadPrompts"),
-		projectID,
-		query,
-		reflect.TypeOf(PromptFromBQ{}))
 
-	// Step 2: Format prompts (Unchanged)
-	prompts := beam.ParDo(s.Scope("FormatPrompts"),
-		func(ctx context.Context, bqPrompt PromptFromBQ, emit func(Prompt)) {
-			emit(Prompt{Prompt: bqPrompt.Prompt})
-		}, promptsFromBQ)
+	var deadline time.Time
+	if *maxRuntime > 0 {
+		deadline = launchTime.Add(*maxRuntime)
+	}
+
+	// Pass the Vertex AI project and region to the DoFn instances, one per model-calling stage
+	newGeminiFn := func() *GenerateTextFn {
+		return &GenerateTextFn{
+			ProjectID:   projects.Vertex,
+			Region:      region,
+			OnDataflow:  isDataflowRunner(flagValue("runner")),
+			ModelName:   model,
+			APIMode:     *apiMode,
+			Backend:     *backend,
+			RunID:       *runID,
+			DisableGzip: *disableGzip,
+			ModelLadder: splitList(*modelLadder),
+			ModelTiers:  tiers,
+
+			BackendURL:     *backendURL,
+			BackendKeyFile: *backendAPIKeyFile,
+
+			TierStructuredPoints: *tierStructuredPoints,
+			LogPolicy:            contentPolicy(*logContentPolicy),
+
+			PromptVersion: *promptVersion,
+			Watermark:     *textWatermark,
+			LRUSize:       *lruCacheSize,
+
+			MaxElementAge: *maxElementAge,
+			FallbackText:  *fallbackText,
+
+			CircuitFailures:  *circuitFailures,
+			CircuitCooldown:  *circuitCooldown,
+			FallbackTemplate: *fallbackTemplate,
+
+			TemplateVars: templateVars,
+
+			RequestsPerSecond: *requestsPerSecond,
+			RateBurst:         *rateBurst,
+			AdaptiveMinRate:   flagAdaptiveMinRate(),
+			StateRedisAddr:    *limiterStateRedis,
+
+			ResponseEnum: responseEnum,
+			Generation:   generationParameters,
+
+			FinishRetryStrategy:    *finishRetryStrategy,
+			FinishRetryTemperature: *finishRetryTemperature,
+			EntityCheck:            *entityCheck,
+			NumericBounds:          splitList(*numericBounds),
+			NumericRetry:           *numericBoundsRetry,
+			ConsistencyRules:       consistencyRules,
+			Glossary:               glossary,
+			Lexicons:               lexicons,
+			MaxReadingGrade:        *maxReadingGrade,
+			MinChars:               *minChars,
+			MaxChars:               *maxChars,
+			LengthRetries:          *lengthRetries,
+			unitNormalizer:         unitNormalizer{UnitConversions: splitList(*unitConversions)},
+
+			InstancesPerRequest: *instancesPerRequest,
+			BatchAutotune:       *batchAutotune,
+
+			QuotaCooldown: *quotaCooldown,
+			Retry:         retryConfig,
+
+			StoreRawResponse:    *storeRawResponse,
+			CompressRawResponse: *compressRawResponse,
+
+			OutputFormats: splitList(*outputFormats),
+			TraceRows:     *traceRows,
+
+			ProgressProject:  projects.Output,
+			ProgressDataset:  outputDataset,
+			ProgressTable:    *progressTable,
+			ProgressInterval: *progressInterval,
+			Deadline:         deadline,
+
+			QuotaProjects:   splitList(*quotaProjects),
+			ProjectBudgets:  splitList(*quotaProjectBudgets),
+			ProjectRotation: *projectRotation,
+		}
+	}
+	stageLimits, err := parseStageLimits(splitList(*stageRateLimits), splitList(*stageBudgets), taskStages(*task, workflow))
+	if err != nil {
+		return fmt.Errorf("invalid stage limits: %w", err)
+	}
+
+	stage := &modelStage{model: model, newFn: newGeminiFn, limits: stageLimits, sanitize: *sanitizePrompts, glossary: glossary, retry: *endOfJobRetry, prefix: *hoistSharedPrefixChars, batch: *batchSize, dedupe: *dedupePromptsFlag}
+	if streamingMode() {
+		runStreaming(s, projects, stage)
+		return nil
+	}
+
+	var geminiResults beam.PCollection
+	switch *task {
+	case taskGenerate, taskAgent:
+		var prompts beam.PCollection
+		if documentInputEnabled() {
+			// Step 2: One prompt per crawled document
+			prompts = crawlDocuments(s)
+			if inputShard.enabled() {
+				prompts = beam.ParDo(s.Scope("ShardDocuments"), &ShardPromptsFn{Shard: inputShard}, prompts)
+			}
+		} else {
+			promptsFromBQ := readPrompts(s, projects.Input, query)
+
+			// Step 2: Format prompts, fanning out rows with repeated items when enabled
+			prompts = beam.ParDo(s.Scope("FormatPrompts"), &FormatPromptsFn{
+				FanOut:      *fanOut,
+				Placeholder: *fanOutPlaceholder,
+			}, promptsFromBQ)
+		}
+
+		// Step 3: Call Vertex AI using the stateful DoFn, or let the model use tools over several turns
+		if *resume && *task == taskGenerate {
+			stage.answered = readAnsweredPrompts(s, projects.Output)
+		}
+		if *task == taskAgent {
+			geminiResults = runAgent(s, projects, stage, prompts)
+		} else {
+			geminiResults = stage.generate(s.Scope("CallVertexAI"), stageGenerate, prompts) // Renamed scope
+		}
+	case taskGroupSummarize:
+		if *groupBy == "" {
+			return fmt.Errorf("--task=%s requires --group_by", taskGroupSummarize)
+		}
+		// Steps 2-3: Pack groups into chunks and summarize them map-reduce style
+		geminiResults = summarizeGroups(s, stage, readPrompts(s, projects.Input, groupSummarizeQuery(query, *groupBy)))
+	case taskPairwise:
+		// Steps 2-3: Ask the model to compare each pair and record its preference
+		geminiResults = comparePairs(s, projects, stage, query)
+	case taskWorkflow:
+		if workflow == nil {
+			return fmt.Errorf("--task=%s requires --workflow_file", taskWorkflow)
+		}
+		// Steps 2-3: Feed each row through the configured chain of prompts
+		geminiResults = runWorkflow(s, projects.Output, stage, workflow, readPrompts(s, projects.Input, query))
+	case taskBestOfN:
+		if *numCandidates < 2 {
+			return fmt.Errorf("--task=%s requires --num_candidates of at least 2", taskBestOfN)
+		}
+		// Steps 2-3: Generate candidates per row, have the model judge them, and keep the best
+		geminiResults = rankCandidates(s, projects.Output, stage, readPrompts(s, projects.Input, query))
+	case taskClassify:
+		if classifyTaxonomy == nil {
+			return fmt.Errorf("--task=%s requires --taxonomy_table", taskClassify)
+		}
+		// Steps 2-3: Pick a top-level category, then one of its children, each from a closed set
+		geminiResults = classifyRows(s, projects.Output, stage, classifyTaxonomy, readPrompts(s, projects.Input, query))
+	default:
+		return fmt.Errorf("unknown --task %q", *task)
+	}
 
-	// Step 3: Call Vertex AI using the stateful DoFn
-	// Pass projectID and region to the DoFn instance
-	geminiFn := &GenerateTextFn{
-		ProjectID: projectID,
-		Region:    region,
-		ModelName: model,
+	// Step 4 (quickstart): Write results and failed calls to local files only
+	if *localMode {
+		writeLocalOutputs(s, geminiResults, stage)
+		log.Println("Pipeline graph constructed successfully.")
+		return nil
 	}
-	geminiResults := beam.ParDo(s.Scope("CallVertexAI"), geminiFn, prompts) // Renamed scope
 
-	// Step 4: Write Results to BigQuery (Unchanged)
-	tableName := fmt.Sprintf("%s:%s.%s", projectID, outputDataset, outputTable)
-	bigqueryio.Write(s.Scope("WriteResults"), projectID, tableName, geminiResults)
+	// Step 4: Write Results to BigQuery, or to a Google Sheet with overflow rows going to BigQuery
+	bqResults := geminiResults
+	if *outputSheetID != "" {
+		bqResults = writeSheetResults(s, geminiResults)
+	}
+	if *outputBigQuery {
+		tableName := fmt.Sprintf("%s:%s.%s", projects.Output, outputDataset, outputTable)
+		bigqueryio.Write(s.Scope("WriteResults"), projects.Output, tableName, countedForSink(s, outputTable, bqResults), resultsCreateDisposition())
+	}
+
+	// Step 4a: Optionally write them to Cloud Storage as JSONL shards too
+	writeGCSResults(s, *runID, geminiResults)
+
+	// Step 4b: Dead-letter failed calls with their error details and request IDs
+	writeDeadLetters(s, projects.Output, stage)
+
+	// Step 5: Copy a deterministic sample to the spot-check table
+	writeSpotChecks(s, projects.Output, *runID, geminiResults)
+
+	// Step 6: Optionally regroup fanned-out answers into one nested row per parent
+	writeFanOutAggregates(s, projects.Output, geminiResults)
+
+	// Step 6b: Optionally reassemble results sharing an ordering key in sequence order
+	writeOrderedDocuments(s, projects.Output, geminiResults)
+
+	// Step 7: Aggregate run-level quality metrics for dashboards
+	writeRunMetrics(s, projects.Output, stage, geminiResults)
 
 	log.Println("Pipeline graph constructed successfully.")
 	return nil
 }
 
+// modelStage applies GenerateTextFn and remembers every PCollection of prompts sent to
+// the model, so run-level accounting covers the calls made by any task.
+type modelStage struct {
+	model    string                 // --model_name, for run-level accounting
+	newFn    func() *GenerateTextFn // A GenerateTextFn with the run's settings
+	limits   map[string]stageLimit  // Per-stage quotas, see stages.go
+	sanitize bool                   // Clean prompt text before every call, see sanitize.go
+	glossary []glossaryEntry        // Terminology appended to the prompts that need it, see glossary.go
+	prefix   int                    // Minimum length of a shared prompt prefix sent as the system instruction, see prefix.go
+	retry    bool                   // Retry transient failures once at the end, see retrywave.go
+	batch    int                    // Prompts grouped per request ahead of the stage, see batchstage.go
+	answered beam.PCollection       // PromptHashes the results table answers under --resume, see resume.go
+	dedupe   bool                   // Send each distinct request once, see dedupe.go
+	inputs   []beam.PCollection
+	failures []beam.PCollection // FailedCall dead letters from every generate call
+	scores   beam.PCollection   // CandidateScore rows under --task=best_of_n, see rank.go
+}
+
+// fnFor returns the GenerateTextFn of one model-calling stage.
+func (m *modelStage) fnFor(stage string) *GenerateTextFn {
+	fn := m.newFn()
+	fn.Stage = stage
+	fn.StageLimit = m.limits[stage]
+	return fn
+}
+
+// generate sends prompts to the model as the given stage of the task.
+func (m *modelStage) generate(s beam.Scope, stage string, prompts beam.PCollection) beam.PCollection {
+	if m.sanitize {
+		prompts = beam.ParDo(s.Scope("SanitizePrompts"), &SanitizePromptFn{}, prompts)
+	}
+	if len(m.glossary) > 0 {
+		prompts = beam.ParDo(s.Scope("InjectGlossary"), &InjectGlossaryFn{Glossary: m.glossary}, prompts)
+	}
+	if m.prefix > 0 {
+		prompts = hoistSharedPrefix(s, m.prefix, prompts)
+	}
+	if m.answered.IsValid() {
+		prompts = skipAnswered(s, m.fnFor(stage), m.answered, prompts)
+	}
+	m.inputs = append(m.inputs, prompts)
+	var duplicates beam.PCollection
+	if m.dedupe {
+		prompts, duplicates = dedupePrompts(s, m.fnFor(stage), prompts)
+	}
+	if m.batch > 1 {
+		prompts = groupIntoBatches(s, m.batch, prompts)
+	}
+	results, failed := beam.ParDo2(s, m.fnFor(stage), prompts)
+	if m.retry {
+		results, failed = retryWave(s, m.fnFor(stage), prompts, results, failed)
+	}
+	if m.dedupe {
+		results, failed = copyToDuplicates(s, duplicates, results, failed)
+	}
+	m.failures = append(m.failures, failed)
+	return results
+}
+
+// readPrompts runs the input query and returns its rows as PromptFromBQ.
+// When a Google Sheet or Cloud Storage files are configured they replace the
+// BigQuery input. Rows outside --shard are dropped and markup is stripped here,
+// before any task formats or templates the rows.
+func readPrompts(s beam.Scope, projectID, query string) beam.PCollection {
+	var rows beam.PCollection
+	switch {
+	case *localMode:
+		rows = readLocalPrompts(s)
+	case *inputSheetID != "":
+		rows = readSheetPrompts(s)
+	case gcsInputEnabled():
+		rows = readGCSPrompts(s)
+	default:
+		rows = bigqueryio.Query(s.Scope("ReadPrompts"), projectID, query, reflect.TypeOf(PromptFromBQ{}), bigqueryio.UseStandardSQL())
+	}
+	return localizeRows(s, stripMarkup(s, shardRows(s, renderRowTemplates(s, rows))))
+}
+
+// splitList parses a comma-separated flag value, dropping empty entries.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
 // --- Main Function ---
 
 func main() {
+	reparse := isReparseCommand()
 	flag.Parse()
+	if *configSources != "" {
+		if err := applyConfigSources(context.Background(), splitList(*configSources)); err != nil {
+			log.Fatalf("Failed to load --config_sources: %v", err)
+		}
+	}
+	if *localMode {
+		flag.Set("runner", "direct")
+	}
 	beam.Init()
 
 	ctx := context.Background()
@@ -377,15 +1615,293 @@ func main() {
 	if region == "" {
 		log.Fatal("Missing required flag --region") // Region is now required for the Vertex AI endpoint
 	}
+	onDataflow := isDataflowRunner(flagValue("runner"))
 	temp_location := flag.Lookup("temp_location").Value.String()
-	if temp_location == "" {
+	if temp_location == "" && onDataflow {
 		log.Fatal("Missing required flag --temp_location")
 	}
 	stagingLocation := flag.Lookup("staging_location").Value.String()
-	if stagingLocation == "" {
+	if stagingLocation == "" && onDataflow {
 		log.Println("Warning: Missing flag --staging_location, may be required for DataflowRunner")
 	}
 	model := *modelName
+	outputDataset, outputTable = *outputDatasetFlag, *outputTableFlag
+	if outputDataset == "" || outputTable == "" {
+		log.Fatal("--output_dataset and --output_table must not be empty")
+	}
+	if _, err := parseCreateDisposition(*createDisposition); err != nil {
+		log.Fatalf("Invalid --create_disposition: %v", err)
+	}
+	if !validPartitioning(*outputPartitioning) {
+		log.Fatalf("Invalid --output_partitioning %q (want HOUR, DAY, MONTH, or YEAR)", *outputPartitioning)
+	}
+	if *outputSheetID != "" && *outputSheetMaxRows < 1 {
+		log.Fatalf("Invalid --output_sheet_max_rows %d (want at least 1)", *outputSheetMaxRows)
+	}
+	if *inputDocumentsPrefix != "" && *inputDriveFolderID != "" {
+		log.Fatal("--input_documents_prefix and --input_drive_folder_id are mutually exclusive")
+	}
+	if documentInputEnabled() && (*backend != backendVertex || !usesGenerateContent(*apiMode, model)) {
+		log.Fatalf("Invalid document input: crawled files are attached to the request, which only Vertex AI generateContent models take (a gemini-* model, or --api_mode=%s)", apiModeGenerateContent)
+	}
+	if *fallbackTemplate != "" {
+		if _, err := parseFallbackTemplate(*fallbackTemplate, nil); err != nil {
+			log.Fatalf("Invalid --fallback_template: %v", err)
+		}
+	}
+	if _, err := parseReferenceTables(splitList(*agentBQTables)); err != nil {
+		log.Fatalf("Invalid --agent_bq_tables: %v", err)
+	}
+	if err := checkURLAllowList(splitList(*agentHTTPAllow)); err != nil {
+		log.Fatalf("Invalid --agent_http_allow: %v", err)
+	}
+	if err := checkObjectAllowList(splitList(*agentGCSAllow)); err != nil {
+		log.Fatalf("Invalid --agent_gcs_allow: %v", err)
+	}
+	if *agentHTTPMaxBytes <= 0 || *agentHTTPTimeout <= 0 {
+		log.Fatal("--agent_http_max_bytes and --agent_http_timeout must be positive")
+	}
+	if !validAPIMode(*apiMode) {
+		log.Fatalf("Invalid --api_mode %q (want %s, %s, or %s)", *apiMode, apiModeAuto, apiModeGenerateContent, apiModePredict)
+	}
+	if _, err := parseSnapshotTime(*snapshotTime); *snapshotTime != "" && err != nil {
+		log.Fatalf("Invalid --snapshot_time: %v", err)
+	}
+	if err := checkIncrementalFlags(); err != nil {
+		log.Fatalf("Invalid --incremental: %v", err)
+	}
+	if !validBackend(*backend) {
+		log.Fatalf("Invalid --backend %q (want %s, %s, or %s)", *backend, backendVertex, backendGeminiAPI, backendOpenAI)
+	}
+	if *backend != backendVertex && (*instancesPerRequest > 1 || *quotaProjects != "") {
+		log.Fatalf("Invalid --backend %s: --instances_per_request, --batch_size, and --quota_projects only apply to Vertex AI", *backend)
+	}
+	if *maxRetries < 0 {
+		log.Fatalf("Invalid --max_retries %d (want 0 or more)", *maxRetries)
+	}
+	if *batchSize < 0 || *batchSize > 1 && *instancesPerRequest != 1 && *instancesPerRequest != *batchSize {
+		log.Fatalf("Invalid --batch_size %d (want 0 or more, with --instances_per_request left at 1 or equal)", *batchSize)
+	}
+	if *dedupePromptsFlag && streamingMode() {
+		log.Fatalf("Invalid --dedupe_prompts: streaming runs can't hold a stage back to copy its answers")
+	}
+	if *resume && (*task != taskGenerate || !*outputBigQuery || *outputSheetID != "" || *localMode || streamingMode()) {
+		log.Fatalf("Invalid --resume: only batch runs of --task %s that write their results to BigQuery can resume", taskGenerate)
+	}
+	if *adaptiveThrottle && (*requestsPerSecond <= 0 || *adaptiveMinRate <= 0 || *adaptiveMinRate > *requestsPerSecond) {
+		log.Fatalf("Invalid --adaptive_throttle: needs --requests_per_second as its ceiling and --adaptive_min_rate %g between 0 and it", *adaptiveMinRate)
+	}
+	if *batchSize > 1 {
+		if streamingMode() {
+			log.Fatalf("--batch_size groups a batch run's prompts; it doesn't apply to --mode=%s", modeStreaming)
+		}
+		flag.Set("instances_per_request", fmt.Sprint(*batchSize))
+	}
+	if *instancesPerRequest < 1 {
+		log.Fatal("--instances_per_request must be at least 1")
+	}
+	if params, err := generationFromFlags(); err != nil {
+		log.Fatalf("Invalid generation parameters: %v", err)
+	} else {
+		generationParameters = params
+	}
+	if *batchAutotune < 0 || *batchAutotune > 0 && *instancesPerRequest < 2 {
+		log.Fatalf("Invalid --batch_autotune %v (want a positive duration with --instances_per_request above 1, or 0)", *batchAutotune)
+	}
+	if *candidateCount > 1 && *instancesPerRequest > 1 {
+		log.Fatal("--candidate_count above 1 can't be combined with --instances_per_request above 1")
+	}
+	if *inputMarkup != "" && *inputMarkup != markupHTML && *inputMarkup != markupMarkdown {
+		log.Fatalf("Invalid --input_markup %q (want %s or %s)", *inputMarkup, markupHTML, markupMarkdown)
+	}
+	if _, err := parseUnitConversions(splitList(*unitConversions)); err != nil {
+		log.Fatalf("Invalid --unit_conversions: %v", err)
+	}
+	if _, err := parseNumericBounds(splitList(*numericBounds)); err != nil {
+		log.Fatalf("Invalid --numeric_bounds: %v", err)
+	}
+	if *minChars < 0 || *maxChars < 0 || *maxChars > 0 && *minChars > *maxChars || *lengthRetries < 0 {
+		log.Fatalf("Invalid --min_chars %d, --max_chars %d, or --length_retries %d (want 0 <= min <= max, 0 for no limit, and 0 or more retries)", *minChars, *maxChars, *lengthRetries)
+	}
+	if *hoistSharedPrefixChars < 0 {
+		log.Fatalf("Invalid --hoist_shared_prefix_chars %d (want a length, or 0 to disable)", *hoistSharedPrefixChars)
+	}
+	if *maxReadingGrade < 0 {
+		log.Fatalf("Invalid --max_reading_grade %g (want a grade level, or 0 to disable)", *maxReadingGrade)
+	}
+	if _, err := parseColumnPolicyTags(splitList(*columnPolicyTags)); err != nil {
+		log.Fatalf("Invalid --column_policy_tags: %v", err)
+	}
+	if *vertexRequestLogging && (*vertexLogTable == "" || *vertexLogSamplingRate <= 0 || *vertexLogSamplingRate > 1) {
+		log.Fatalf("Invalid --vertex_log_table %q or --vertex_log_sampling_rate %g (want a table and a rate in (0, 1])", *vertexLogTable, *vertexLogSamplingRate)
+	}
+	if *writeVerifyTolerance < 0 {
+		log.Fatalf("Invalid --write_verify_tolerance %g (want a fraction of at least 0)", *writeVerifyTolerance)
+	}
+	if *maxRuntime < 0 {
+		log.Fatalf("Invalid --max_runtime %v (want a positive duration, or 0 to disable)", *maxRuntime)
+	}
+	if *progressTable != "" && *progressInterval <= 0 {
+		log.Fatalf("Invalid --progress_interval %v (want a positive duration)", *progressInterval)
+	}
+	if s, err := parseShard(*shard); err != nil {
+		log.Fatalf("Invalid --shard: %v", err)
+	} else {
+		inputShard = s
+	}
+	if _, err := parseModelTiers(splitList(*modelTiers)); err != nil {
+		log.Fatalf("Invalid --model_tiers: %v", err)
+	}
+	if *tierStructuredPoints < 0 {
+		log.Fatalf("Invalid --tier_structured_points %d (want 0 or more)", *tierStructuredPoints)
+	}
+	if !validEntityCheck(*entityCheck) {
+		log.Fatalf("Invalid --entity_check %q (want off, flag, or retry)", *entityCheck)
+	}
+	if !validOutputFormats(splitList(*outputFormats)) {
+		log.Fatalf("Invalid --output_formats %q (want %s and/or %s)", *outputFormats, outputFormatHTML, outputFormatText)
+	}
+	if _, err := parseTokenPrices(splitList(*tokenPriceTable), tokenPrice{}); err != nil {
+		log.Fatalf("Invalid --token_prices: %v", err)
+	}
+	if _, err := parseQuotaProjects(splitList(*quotaProjects), splitList(*quotaProjectBudgets)); err != nil {
+		log.Fatalf("Invalid --quota_projects: %v", err)
+	}
+	if *projectRotation != rotateRoundRobin && *projectRotation != rotateBudget {
+		log.Fatalf("Invalid --project_rotation %q (want %s or %s)", *projectRotation, rotateRoundRobin, rotateBudget)
+	}
+	if !validFinishRetryStrategy(*finishRetryStrategy) {
+		log.Fatalf("Invalid --finish_retry_strategy %q (want paraphrase, lower_temperature, or own_words)", *finishRetryStrategy)
+	}
+	if !validContentPolicy(*logContentPolicy) {
+		log.Fatalf("Invalid --log_content_policy %q (want full, truncate, hash, or none)", *logContentPolicy)
+	}
+	if *mode != modeBatch && *mode != modeStreaming {
+		log.Fatalf("Invalid --mode %q (want %s or %s)", *mode, modeBatch, modeStreaming)
+	}
+	if streamingMode() {
+		if reparse {
+			log.Fatal("--mode=streaming does not apply to the reparse command")
+		}
+		if err := checkStreamingFlags(); err != nil {
+			log.Fatalf("Invalid streaming flags: %v", err)
+		}
+	}
+	if err := checkGCSInputFlags(); err != nil {
+		log.Fatalf("Invalid --input_gcs_pattern flags: %v", err)
+	}
+	if err := checkGCSOutputFlags(); err != nil {
+		log.Fatalf("Invalid --output_gcs_prefix flags: %v", err)
+	}
+	if *localMode {
+		if reparse {
+			log.Fatal("--local does not apply to the reparse command")
+		}
+		if err := validateLocalFlags(); err != nil {
+			log.Fatalf("Invalid --local flags: %v", err)
+		}
+	}
+	projects := resolveProjects(project)
+	if reparse {
+		reparseMain(ctx, projects.Output)
+		return
+	}
+	if *runID == "" {
+		*runID = time.Now().UTC().Format(runIDLayout)
+	}
+	vars, err := resolveTemplateVars(ctx, project, model, splitList(*templateVarsFlag))
+	if err != nil {
+		log.Fatalf("Invalid --template_vars: %v", err)
+	}
+	templateVars = vars
+	if *task == taskWorkflow && *workflowFile != "" {
+		cfg, err := loadWorkflowConfig(ctx, *workflowFile)
+		if err != nil {
+			log.Fatalf("Failed to load --workflow_file: %v", err)
+		}
+		workflow = cfg
+	}
+	if err := loadRowTemplate(ctx, templateVars); err != nil {
+		log.Fatalf("Invalid --prompt_template: %v", err)
+	}
+	if err := loadInputQuery(ctx, projects.Input); err != nil {
+		log.Fatalf("Invalid input query: %v", err)
+	}
+	if *snapshotTime != "" && readsInputQuery() {
+		pinned, err := snapshotQuery(ctx, projects.Input, inputQuery)
+		if err != nil {
+			log.Fatalf("Invalid --snapshot_time: %v", err)
+		}
+		inputQuery = pinned
+	}
+	var window IncrementalWindow
+	if *incrementalMode != "" {
+		w, limited, err := incrementalQuery(ctx, projects.Input, projects.Output, inputQuery)
+		if err != nil {
+			log.Fatalf("Invalid --incremental: %v", err)
+		}
+		window, inputQuery = w, limited
+	}
+	if *promptTemplates != "" {
+		catalog, err := loadLocaleTemplates(ctx, *promptTemplates)
+		if err == nil {
+			err = validateLocaleCatalog(catalog, normalizeLocale(*defaultLocale), templateVars)
+		}
+		if err != nil {
+			log.Fatalf("Failed to load --prompt_templates: %v", err)
+		}
+		localeCatalog = catalog
+	}
+	if _, err := parseStageLimits(splitList(*stageRateLimits), splitList(*stageBudgets), taskStages(*task, workflow)); err != nil {
+		log.Fatalf("Invalid --stage_rate_limits or --stage_budgets: %v", err)
+	}
+	if *retryConfigPath != "" {
+		policy, err := loadRetryPolicy(ctx, *retryConfigPath)
+		if err != nil {
+			log.Fatalf("Failed to load --retry_config: %v", err)
+		}
+		retryConfig = policy
+	} else if *maxRetries > 0 {
+		retryConfig = defaultRetryPolicy(*maxRetries)
+	}
+	if *consistencyRulesPath != "" {
+		cfg, err := loadConsistencyRules(ctx, *consistencyRulesPath)
+		if err != nil {
+			log.Fatalf("Failed to load --consistency_rules: %v", err)
+		}
+		consistencyRules = cfg
+	}
+	if *lexiconsPath != "" {
+		cfg, err := loadLexicons(ctx, *lexiconsPath)
+		if err != nil {
+			log.Fatalf("Failed to load --lexicons: %v", err)
+		}
+		lexicons = cfg
+	}
+	if *glossaryTable != "" {
+		entries, err := loadGlossary(ctx, projects.Input, *glossaryTable)
+		if err != nil {
+			log.Fatalf("Failed to load --glossary_table: %v", err)
+		}
+		glossary = entries
+	}
+	if *task == taskClassify && *taxonomyTable != "" {
+		t, err := loadTaxonomy(ctx, projects.Input, *taxonomyTable)
+		if err != nil {
+			log.Fatalf("Failed to load --taxonomy_table: %v", err)
+		}
+		classifyTaxonomy = t
+	}
+	if *responseEnumValues != "" || *responseEnumColumn != "" {
+		if *task != taskGenerate {
+			log.Fatalf("--response_enum and --response_enum_column only apply to --task=%s", taskGenerate)
+		}
+		values, err := loadResponseEnum(ctx, projects.Input)
+		if err != nil {
+			log.Fatalf("Failed to load allowed answers: %v", err)
+		}
+		responseEnum = values
+	}
 
 	// Determine and Log Launcher Identity (Unchanged)
 	launcherIdentity := "unknown"
@@ -399,33 +1915,316 @@ func main() {
 
 	// Job Start Logging (Unchanged)
 	log.Printf("Starting Dataflow job...")
+	log.Printf("  Run ID: %s", *runID)
+	if *snapshotTime != "" {
+		log.Printf("  Snapshot Time: %s (input tables read as they were then)", *snapshotTime)
+	}
+	if *incrementalMode != "" {
+		logIncrementalWindow(window)
+	}
 	log.Printf("  Project: %s", project)
+	projects.logProjects()
 	log.Printf("  Region: %s", region) // Log region
 	log.Printf("  Temp Location: %s", temp_location)
 	log.Printf("  Staging Location: %s", stagingLocation)
 	log.Printf("  Model Name: %s (using Vertex AI endpoint)", model) // Updated log
-	log.Printf("  Output Table: %s:%s.%s", project, outputDataset, outputTable)
+	log.Printf("  Task: %s", *task)
+	log.Printf("  Generation: %s", describeGeneration(generationParameters))
+	if *inputSheetID != "" {
+		log.Printf("  Input Sheet: %s (%s)", *inputSheetID, *inputSheetRange)
+	}
+	if streamingMode() {
+		log.Printf("  Input Subscription: %s (topic %s, written every %v)", *inputSubscription, *inputTopic, *streamingWindow)
+	} else if gcsInputEnabled() {
+		log.Printf("  Input GCS Pattern: %s (prompt field %q)", *inputGCSPattern, *promptField)
+	} else if *inputQueryFile != "" {
+		log.Printf("  Input Query File: %s", *inputQueryFile)
+	} else if *inputQueryFlag != "" {
+		log.Printf("  Input Query: %s", strings.Join(strings.Fields(inputQuery), " "))
+	}
+	if inputShard.enabled() {
+		log.Printf("  Shard: %s", inputShard)
+	}
+	if *templateVarsFlag != "" {
+		log.Printf("  Template Vars: %s", strings.Join(templateVarNames(templateVars), ", "))
+	}
+	if *rowTemplateFile != "" {
+		log.Printf("  Prompt Template: %s (rendered from the input columns)", *rowTemplateFile)
+	} else if rowTemplate != "" {
+		log.Printf("  Prompt Template: inline (rendered from the input columns)")
+	}
+	if localeCatalog != nil {
+		log.Printf("  Prompt Templates: %s (%d locales, default %s)", *promptTemplates, len(localeCatalog), normalizeLocale(*defaultLocale))
+	}
+	if documentInputEnabled() {
+		log.Printf("  Document Input: %s%s (glob %q, mime %q)", *inputDocumentsPrefix, *inputDriveFolderID, *inputFileGlob, *inputMimeTypes)
+	}
+	if *outputSheetID != "" {
+		log.Printf("  Output Sheet: %s (%s, up to %d rows)", *outputSheetID, *outputSheetRange, *outputSheetMaxRows)
+	}
+	if *task == taskGroupSummarize {
+		log.Printf("  Group By: %s (chunks of up to %d chars)", *groupBy, *groupChunkChars)
+	}
+	if retryConfig != nil {
+		log.Printf("  Retries: up to %d attempts, %d rules (default %s)", retryConfig.MaxAttempts, len(retryConfig.Rules), retryConfig.Default)
+	}
+	if glossary != nil {
+		log.Printf("  Glossary: %s (%d entries)", *glossaryTable, len(glossary))
+	}
+	if consistencyRules != nil {
+		log.Printf("  Consistency Rules: %s (%d rules)", *consistencyRulesPath, len(consistencyRules.Rules))
+	}
+	if *minChars > 0 || *maxChars > 0 {
+		log.Printf("  Length Limits: %d to %d characters (%d retries)", *minChars, *maxChars, *lengthRetries)
+	}
+	if *hoistSharedPrefixChars > 0 {
+		log.Printf("  Hoist Shared Prefix: at least %d characters", *hoistSharedPrefixChars)
+	}
+	if *maxReadingGrade > 0 {
+		log.Printf("  Max Reading Grade: %g", *maxReadingGrade)
+	}
+	if lexicons != nil {
+		log.Printf("  Lexicons: %s (%d categories)", *lexiconsPath, len(lexicons.Categories))
+	}
+	if *quotaProjects != "" {
+		log.Printf("  Quota Projects: %s (%s)", *quotaProjects, *projectRotation)
+	}
+	if len(responseEnum) > 0 {
+		log.Printf("  Allowed Answers: %d values (e.g. %q)", len(responseEnum), responseEnum[0])
+	}
+	if classifyTaxonomy != nil {
+		log.Printf("  Taxonomy: %s (%d top-level categories, results in %s)", *taxonomyTable, len(classifyTaxonomy[""]), *classificationTable)
+	}
+	if *task == taskBestOfN {
+		log.Printf("  Candidates: %d per row (scores in %s)", *numCandidates, *candidateScoresTable)
+	}
+	if workflow != nil {
+		names := make([]string, len(workflow.Steps))
+		for i, step := range workflow.Steps {
+			names[i] = step.Name
+		}
+		log.Printf("  Workflow: %s (%s)", *workflowFile, strings.Join(names, " -> "))
+	}
+	if *localMode {
+		log.Printf("  Local Input: %s", *localInput)
+		log.Printf("  Local Output: %s", *localOutput)
+		if *localDeadLetters != "" {
+			log.Printf("  Local Dead Letters: %s", *localDeadLetters)
+		}
+	} else if *outputBigQuery {
+		log.Printf("  Output Table: %s:%s.%s", projects.Output, outputDataset, outputTable)
+	}
+	if gcsOutputEnabled() {
+		log.Printf("  Output GCS: %s/results-*.jsonl (%d shards)", gcsResultsDir(*outputGCSPrefix, *runID), *outputGCSShards)
+	}
+	if *kmsKey != "" {
+		log.Printf("  KMS Key: %s", *kmsKey)
+	}
+	if *columnPolicyTags != "" {
+		log.Printf("  Column Policy Tags: %s", *columnPolicyTags)
+	}
+	if *requireRowAccessPolicy {
+		log.Printf("  Row Access Policy: required on result tables")
+	}
+	if *catalogTagTemplate != "" {
+		log.Printf("  Catalog Tag Template: %s", catalogTemplateName(*catalogTagTemplate, projects.Output, region))
+	}
+	if *allowedRegions != "" {
+		log.Printf("  Allowed Regions: %s", *allowedRegions)
+	}
+	log.Printf("  Gzip Compression: %t", !*disableGzip)
+	log.Printf("  Log Content Policy: %s", *logContentPolicy)
+	if *spotCheckRate > 0 && *spotCheckTable != "" {
+		log.Printf("  Spot Checks: %.2f%% -> %s:%s.%s", 100*(*spotCheckRate), projects.Output, outputDataset, *spotCheckTable)
+	}
+	if *fanOut {
+		log.Printf("  Fan-out: enabled (placeholder %q, aggregate table %q)", *fanOutPlaceholder, *fanOutAggregateTable)
+	}
+	if *vertexRequestLogging {
+		log.Printf("  Vertex Request Logging: %.0f%% -> %s", 100*(*vertexLogSamplingRate), vertexLogTableRef(projects.Output))
+	}
+	if *tokenPriceTable != "" {
+		log.Printf("  Token Prices: %s (others $%g/$%g per 1K prompt/output tokens)", *tokenPriceTable, *inputPricePer1KTokens, *outputPricePer1KTokens)
+	}
+	if *dedupePromptsFlag {
+		log.Printf("  Dedupe Prompts: one call per distinct prompt, answers copied to duplicates")
+	}
+	if *resume {
+		log.Printf("  Resume: skipping prompts answered in %s:%s.%s", projects.Output, outputDataset, outputTable)
+	}
+	if *progressTable != "" {
+		log.Printf("  Progress: every %v -> %s:%s.%s", *progressInterval, projects.Output, outputDataset, *progressTable)
+	}
+	if *requestsPerSecond > 0 {
+		ceiling := "grows with the worker count"
+		if n := maxNumWorkers(); n > 0 {
+			ceiling = fmt.Sprintf("up to %g/s across %d workers", *requestsPerSecond*float64(n), n)
+		}
+		log.Printf("  Rate Limit: %g requests/s per worker, burst %d (job-wide %s)", *requestsPerSecond, *rateBurst, ceiling)
+		if *adaptiveThrottle {
+			log.Printf("  Adaptive Throttle: halved on 429s down to %g requests/s per worker, raised again after sustained success", *adaptiveMinRate)
+		}
+	}
+	switch *backend {
+	case backendVertex:
+		log.Printf("  API Mode: %s", *apiMode)
+	case backendOpenAI:
+		log.Printf("  Backend: %s at %s", *backend, *backendURL)
+	default:
+		log.Printf("  Backend: %s", *backend)
+	}
+	if *instancesPerRequest > 1 {
+		log.Printf("  Instances Per Request: %d (predict models only)", *instancesPerRequest)
+		if *batchSize > 1 {
+			log.Printf("  Batch Size: %d, grouped ahead of the model stage", *batchSize)
+		}
+		if *batchAutotune > 0 {
+			log.Printf("  Batch Autotune: sizes up to %d tried for %v per worker", *instancesPerRequest, *batchAutotune)
+		}
+	}
+	if *maxRuntime > 0 {
+		log.Printf("  Max Runtime: %v (until %s)", *maxRuntime, launchTime.Add(*maxRuntime).Format(time.RFC3339))
+	}
+	if ladder := splitList(*modelLadder); len(ladder) > 0 {
+		log.Printf("  Model Ladder: %s", strings.Join(ladder, " -> "))
+	}
 	startTime := time.Now()
 
+	if err := checkServices(ctx, projects); err != nil {
+		log.Fatalf("Refusing to run: %v", err)
+	}
+
+	if *allowedRegions != "" && !*localMode {
+		residencyQuery := taskInputQuery(inputQuery)
+		if *inputSheetID != "" && *task != taskPairwise {
+			residencyQuery = "" // Sheets have no BigQuery location to check
+		}
+		gcsPaths := []string{temp_location, stagingLocation}
+		if gcsInputEnabled() {
+			residencyQuery = ""
+			gcsPaths = append(gcsPaths, *inputGCSPattern)
+		}
+		if gcsOutputEnabled() {
+			gcsPaths = append(gcsPaths, *outputGCSPrefix)
+		}
+		if err := checkDataResidency(ctx, projects, region, residencyQuery, gcsPaths); err != nil {
+			log.Fatalf("Refusing to run: %v", err)
+		}
+	}
+
+	if !*localMode {
+		locationQuery := ""
+		if readsInputQuery() {
+			locationQuery = taskInputQuery(inputQuery)
+		}
+		if err := checkDatasetLocations(ctx, projects, locationQuery); err != nil {
+			log.Fatalf("Refusing to run: %v", err)
+		}
+	}
+
+	if (*columnPolicyTags != "" || *requireRowAccessPolicy) && !*localMode {
+		if err := applyGovernance(ctx, projects.Output); err != nil {
+			log.Fatalf("Refusing to run: %v", err)
+		}
+	}
+
+	if !*localMode {
+		if err := ensureResultsTable(ctx, projects.Output); errors.Is(err, errResultsTableMissing) || errors.Is(err, errSchemaConflict) {
+			log.Fatalf("Refusing to run: %v", err)
+		} else if err != nil {
+			log.Printf("Warning: could not create or update the results table, the first write will try: %v", err)
+		}
+		if *metricsTable != "" {
+			if err := ensureMetricsColumns(ctx, projects.Output); errors.Is(err, errSchemaConflict) {
+				log.Fatalf("Refusing to run: %v", err)
+			} else if err != nil {
+				log.Printf("Warning: could not update the run metrics table: %v", err)
+			}
+		}
+	}
+
+	if *kmsKey != "" && !*localMode {
+		if err := applyKMSKey(ctx, projects.Output); err != nil {
+			log.Fatalf("Failed to apply --kms_key: %v", err)
+		}
+	}
+
+	if *documentTables && !*localMode {
+		if err := documentOutputTables(ctx, projects, region); err != nil {
+			log.Printf("Warning: could not document output tables: %v", err)
+		}
+	}
+
+	if *vertexRequestLogging {
+		if err := enableVertexRequestLogging(ctx, projects, region, model); err != nil {
+			log.Printf("Warning: could not enable Vertex AI request-response logging: %v", err)
+		}
+	}
+
+	if *progressTable != "" {
+		if err := ensureProgressTable(ctx, projects.Output); err != nil {
+			log.Printf("Warning: could not create --progress_table, progress rows may be lost: %v", err)
+		}
+	}
+
 	p := beam.NewPipeline()
 	// Pass region to the run function
-	if err := run(p, project, region, temp_location, stagingLocation, model); err != nil {
+	if err := run(p, projects, region, temp_location, stagingLocation, model); err != nil {
 		log.Fatalf("Failed to construct the pipeline graph: %v", err)
 	}
 
-	if err := beamx.Run(ctx, p); err != nil {
+	pr, err := beamx.RunWithMetrics(ctx, p)
+	if err != nil {
 		endTime := time.Now()
 		log.Printf("Pipeline failed after %v.", endTime.Sub(startTime))
 		log.Fatalf("Failed to execute pipeline: %v", err)
 	}
 
-	// Job Stop Logging (Unchanged)
+	// Job Stop Logging, once the sinks are known to hold every row
 	endTime := time.Now()
+	// A drained streaming job may still have inserts in BigQuery's streaming buffer
+	if *verifyWrites && !*localMode && !streamingMode() {
+		if err := checkWrittenRows(ctx, projects.Output, pr); err != nil {
+			log.Printf("Pipeline ran for %v but its writes did not verify.", endTime.Sub(startTime))
+			log.Fatalf("Failed to verify pipeline writes: %v", err)
+		}
+	}
 	log.Printf("Pipeline finished successfully.")
 	log.Printf("Total execution time: %v.", endTime.Sub(startTime))
+	logPacingReport(pr, endTime.Sub(startTime))
+	logLRUHitRate(pr)
+	logSizeReport(pr, *maxOutputTokens)
+	logCostReport(pr, flagTokenPrices())
+	partial := reportPartialRun(pr)
+
+	if *localMode {
+		log.Printf("Results written to %s", *localOutput)
+		if partial {
+			os.Exit(exitPartial)
+		}
+		return
+	}
+
+	if *incrementalMode != "" {
+		finishIncrementalRun(ctx, projects.Output, window, partial)
+	}
+
+	if *catalogTagTemplate != "" {
+		if err := tagOutputTables(ctx, projects.Output, region); err != nil {
+			log.Printf("Warning: could not tag output tables in Data Catalog: %v", err)
+		}
+	}
+
+	if *latestView != "" {
+		if err := createOrUpdateLatestView(ctx, projects.Output); err != nil {
+			log.Printf("Warning: could not create or update view %s: %v", *latestView, err)
+		}
+	}
 
 	bqTableURL := fmt.Sprintf("https://console.cloud.google.com/bigquery?project=%s&page=table&d=%s&p=%s&t=%s",
-		project, outputDataset, project, outputTable)
+		projects.Output, outputDataset, projects.Output, outputTable)
 	log.Printf("BigQuery results table URL: %s", bqTableURL)
-
+	if partial {
+		os.Exit(exitPartial)
+	}
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// --- Dataset locations ---
+
+// BigQuery runs a query in the location of the datasets it reads and can't
+// mix locations within one job, so an output dataset in another location than
+// the input data breaks every query the run makes over both, and a missing
+// output dataset only fails the first write, on the workers. Before launching,
+// the launcher reads the locations of the datasets the input query reads
+// (found with a dry run, as for --allowed_regions) and of --output_dataset, and
+// refuses to run when the input spans several locations or the output dataset
+// is in another one. A missing output dataset is created in the input's
+// location under --create_output_dataset (in BigQuery's default location when
+// the prompts don't come from BigQuery), and refused otherwise. Query reads
+// need no temp dataset of ours: BigQuery keeps their results in an anonymous
+// dataset of the job's location. When the locations can't be read (the
+// identity may not see the input datasets), the run goes ahead with a warning.
+
+// checkDatasetLocations makes sure the output dataset exists in the location
+// of the input data, creating it under --create_output_dataset.
+func checkDatasetLocations(ctx context.Context, projects runProjects, inputQuery string) error {
+	client, err := bigquery.NewClient(ctx, projects.Input)
+	if err != nil {
+		log.Printf("Warning: could not check the locations of the run's datasets: %v", err)
+		return nil
+	}
+	defer client.Close()
+
+	inputLocation, err := queryLocation(ctx, client, inputQuery)
+	if err != nil {
+		if errors.As(err, new(mixedLocationsError)) {
+			return err
+		}
+		log.Printf("Warning: could not read the location of the input data: %v", err)
+	}
+
+	out := client.DatasetInProject(projects.Output, outputDataset)
+	name := projects.Output + "." + outputDataset
+	md, err := out.Metadata(ctx)
+	switch {
+	case err == nil:
+	case !isBigQueryNotFound(err):
+		log.Printf("Warning: could not read the location of dataset %s: %v", name, err)
+		return nil
+	case !*createOutputDataset:
+		return fmt.Errorf("output dataset %s does not exist; create it%s, or rerun with --create_output_dataset", name, inLocation(inputLocation))
+	default:
+		if err := out.Create(ctx, &bigquery.DatasetMetadata{Location: inputLocation}); err != nil {
+			return fmt.Errorf("failed to create output dataset %s%s: %w", name, inLocation(inputLocation), err)
+		}
+		log.Printf("Created output dataset %s%s", name, inLocation(inputLocation))
+		return nil
+	}
+
+	if inputLocation != "" && !strings.EqualFold(md.Location, inputLocation) {
+		return fmt.Errorf("output dataset %s is in %s but the input data is in %s; BigQuery can't join or copy across locations, so pick an --output_dataset in %s", name, md.Location, inputLocation, inputLocation)
+	}
+	log.Printf("Output dataset %s in %s", name, md.Location)
+	return nil
+}
+
+// mixedLocationsError is an input query reading datasets of several locations.
+type mixedLocationsError []string
+
+func (e mixedLocationsError) Error() string {
+	return fmt.Sprintf("the input query reads datasets in several locations (%s); BigQuery runs a query in one location only", strings.Join(e, ", "))
+}
+
+// queryLocation returns the location of the datasets the query reads, empty
+// for an empty query.
+func queryLocation(ctx context.Context, client *bigquery.Client, sql string) (string, error) {
+	datasets, err := queryDatasets(ctx, client, sql)
+	if err != nil {
+		return "", err
+	}
+	found := make(map[string]bool)
+	var location string
+	for _, ds := range datasets {
+		md, err := ds.Metadata(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to read location of dataset %s.%s: %w", ds.ProjectID, ds.DatasetID, err)
+		}
+		location = md.Location
+		found[strings.ToUpper(location)] = true
+	}
+	if len(found) > 1 {
+		var mixed mixedLocationsError
+		for loc := range found {
+			mixed = append(mixed, loc)
+		}
+		sort.Strings(mixed)
+		return "", mixed
+	}
+	return location, nil
+}
+
+// inLocation phrases a location for a message, empty when it is unknown.
+func inLocation(location string) string {
+	if location == "" {
+		return ""
+	}
+	return " in " + location
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/bigqueryio"
+)
+
+// --- Dead letters and support identifiers ---
+
+// requestIDHeader is the response header carrying the server-side request ID.
+const requestIDHeader = "X-Request-Id"
+
+// vertexAPIError is a non-OK response from the predict endpoint, with the
+// identifiers Google support asks for when a failure is escalated.
+type vertexAPIError struct {
+	HTTPStatus int
+	Status     string // Google API status, e.g. RESOURCE_EXHAUSTED; empty for non-standard bodies
+	Message    string
+	Details    string // The error's `details` array as raw JSON
+	RequestID  string // From the response header, or a google.rpc.RequestInfo detail
+	Project    string
+	RetryAfter time.Duration // From the Retry-After header; 0 when absent
+	Hint       string        // Remediation of a 401 or 403, see authdiag.go
+}
+
+func (e *vertexAPIError) Error() string {
+	if e.Hint != "" {
+		return fmt.Sprintf("%s; remediation: %s", e.summary(), e.Hint)
+	}
+	return e.summary()
+}
+
+func (e *vertexAPIError) summary() string {
+	switch {
+	case e.Status == "":
+		return fmt.Sprintf("vertex ai predict api request failed with status %d: %s", e.HTTPStatus, e.Message)
+	case e.quotaExhausted():
+		return fmt.Sprintf("%v: %s", errQuotaExhausted, e.Message)
+	}
+	return fmt.Sprintf("vertex ai predict api request failed with status %d (%s): %s", e.HTTPStatus, e.Status, e.Message)
+}
+
+// Unwrap lets errors.Is match errQuotaExhausted.
+func (e *vertexAPIError) Unwrap() error {
+	if e.quotaExhausted() {
+		return errQuotaExhausted
+	}
+	return nil
+}
+
+func (e *vertexAPIError) quotaExhausted() bool {
+	return isQuotaExhausted(e.HTTPStatus, e.Status, e.Message)
+}
+
+// newVertexAPIError parses a Google API error body. Bodies in another format
+// are kept (redacted) as the message.
+func (fn *GenerateTextFn) newVertexAPIError(resp *http.Response, body []byte, project string) *vertexAPIError {
+	e := &vertexAPIError{HTTPStatus: resp.StatusCode, RequestID: resp.Header.Get(requestIDHeader), Project: project,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+	var googleAPIError struct {
+		Error struct {
+			Code    int               `json:"code"`
+			Message string            `json:"message"`
+			Status  string            `json:"status"`
+			Details []json.RawMessage `json:"details"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &googleAPIError) != nil || googleAPIError.Error.Message == "" {
+		e.Message = fn.LogPolicy.redact(string(body))
+		return e
+	}
+	e.Status, e.Message = googleAPIError.Error.Status, googleAPIError.Error.Message
+	if len(googleAPIError.Error.Details) > 0 {
+		raw, _ := json.Marshal(googleAPIError.Error.Details)
+		e.Details = string(raw)
+	}
+	for _, d := range googleAPIError.Error.Details {
+		var info struct {
+			Type      string `json:"@type"`
+			RequestID string `json:"requestId"`
+		}
+		if json.Unmarshal(d, &info) == nil && strings.HasSuffix(info.Type, "google.rpc.RequestInfo") && e.RequestID == "" {
+			e.RequestID = info.RequestID
+		}
+	}
+	return e
+}
+
+// requestIDOf returns the request ID of a failed API call, if the error has one.
+func requestIDOf(err error) string {
+	var apiErr *vertexAPIError
+	if errors.As(err, &apiErr) {
+		return apiErr.RequestID
+	}
+	return ""
+}
+
+// FailedCall is a dead-lettered prompt: the row could not be generated, and the
+// error carries what is needed to replay it or to escalate it.
+type FailedCall struct {
+	RunID         string    `beam:"RunID"`
+	FailedAt      time.Time `beam:"FailedAt"`
+	Prompt        string    `beam:"Prompt"`
+	PromptHash    string    `beam:"PromptHash"`
+	ParentKey     string    `beam:"ParentKey"`
+	SubIndex      int       `beam:"SubIndex"`
+	ModelUsed     string    `beam:"ModelUsed"` // Last model attempted
+	VertexProject string    `beam:"VertexProject"`
+	HTTPStatus    int       `beam:"HTTPStatus"` // 0 when no response was received
+	ErrorStatus   string    `beam:"ErrorStatus"`
+	ErrorMessage  string    `beam:"ErrorMessage"`
+	ErrorDetails  string    `beam:"ErrorDetails"` // Raw JSON `details` of the API error
+	ErrorClass    string    `beam:"ErrorClass"`   // retry or permanent under --retry_config, else empty
+	RequestID     string    `beam:"RequestID"`
+	Attempts      int       `beam:"Attempts"`   // Calls made to the last model; 0 when no call failed
+	Trajectory    string    `beam:"Trajectory"` // JSON turns of an agent run that ended without an answer
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*FailedCall)(nil)).Elem())
+}
+
+// attemptsError records how many calls guardedPredict made before giving up.
+type attemptsError struct {
+	err      error
+	attempts int
+}
+
+func (e *attemptsError) Error() string { return e.err.Error() }
+func (e *attemptsError) Unwrap() error { return e.err }
+
+// withAttempts annotates a failed call with its attempt count; nil stays nil.
+func withAttempts(err error, attempts int) error {
+	if err == nil {
+		return nil
+	}
+	return &attemptsError{err: err, attempts: attempts}
+}
+
+// attemptsOf returns the attempt count recorded on err, or 0.
+func attemptsOf(err error) int {
+	var ae *attemptsError
+	if errors.As(err, &ae) {
+		return ae.attempts
+	}
+	return 0
+}
+
+// failedCall builds the dead letter for a prompt whose generation failed and
+// counts it toward the worker's progress.
+func (fn *GenerateTextFn) failedCall(p Prompt, promptHash, model string, err error) FailedCall {
+	fn.progress.addError()
+	fc := FailedCall{
+		RunID:        fn.RunID,
+		FailedAt:     time.Now().UTC(),
+		Prompt:       p.Prompt,
+		PromptHash:   promptHash,
+		ParentKey:    p.ParentKey,
+		SubIndex:     p.SubIndex,
+		ModelUsed:    model,
+		ErrorMessage: err.Error(),
+		ErrorClass:   fn.errorClass(err),
+		Attempts:     attemptsOf(err),
+	}
+	var apiErr *vertexAPIError
+	if errors.As(err, &apiErr) {
+		fc.VertexProject = apiErr.Project
+		fc.HTTPStatus = apiErr.HTTPStatus
+		fc.ErrorStatus = apiErr.Status
+		fc.ErrorDetails = apiErr.Details
+		fc.RequestID = apiErr.RequestID
+	}
+	return fc
+}
+
+// writeDeadLetters writes every failed call the model stages produced.
+func writeDeadLetters(s beam.Scope, projectID string, model *modelStage) {
+	if *dlqTable == "" || len(model.failures) == 0 {
+		return
+	}
+	s = s.Scope("WriteDeadLetters")
+	tableName := fmt.Sprintf("%s:%s.%s", projectID, outputDataset, *dlqTable)
+	bigqueryio.Write(s, projectID, tableName, countedForSink(s, *dlqTable, beam.Flatten(s, model.failures...)))
+}
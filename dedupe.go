@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// --- Duplicate prompts ---
+
+// Inputs often repeat a prompt word for word, e.g. one per product of a brand
+// when the prompt only names the brand. Under --dedupe_prompts a model stage
+// sends each distinct request once: prompts are grouped by the PromptHash they
+// would get (see hash.go), the first of each group is sent, and its row or dead
+// letter is copied to the others with their own keys (ParentKey, SubIndex,
+// ordering, workflow path, and source), once the stage is done. Duplicates
+// share the first prompt's --entity_check terms. The grouping holds the whole
+// stage back, so streaming runs can't dedupe.
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*SplitDuplicatesFn)(nil)).Elem())
+	beam.RegisterFunction(keyResultByHash)
+	beam.RegisterFunction(keyFailureByHash)
+	beam.RegisterType(reflect.TypeOf((*CopyToDuplicatesFn)(nil)).Elem())
+}
+
+// SplitDuplicatesFn passes on the first prompt of a hash and keys the others
+// by it.
+type SplitDuplicatesFn struct {
+	duplicates beam.Counter
+}
+
+func (fn *SplitDuplicatesFn) Setup() {
+	fn.duplicates = beam.NewCounter("vertexai", "duplicate_prompts_total")
+}
+
+func (fn *SplitDuplicatesFn) ProcessElement(ctx context.Context, hash string, prompts func(*Prompt) bool, emit func(Prompt), emitDuplicate func(string, Prompt)) {
+	var p Prompt
+	for first := true; prompts(&p); first = false {
+		if first {
+			emit(p)
+			continue
+		}
+		fn.duplicates.Inc(ctx, 1)
+		emitDuplicate(hash, p)
+	}
+}
+
+// dedupePrompts returns the first prompt of every hash gen would send, and
+// the other prompts keyed by their hash.
+func dedupePrompts(s beam.Scope, gen *GenerateTextFn, prompts beam.PCollection) (beam.PCollection, beam.PCollection) {
+	s = s.Scope("DedupePrompts")
+	grouped := beam.GroupByKey(s, beam.ParDo(s, &KeyPromptByHashFn{Gen: gen}, prompts))
+	return beam.ParDo2(s, &SplitDuplicatesFn{}, grouped)
+}
+
+func keyResultByHash(r GeminiResult) (string, GeminiResult) {
+	return r.PromptHash, r
+}
+
+func keyFailureByHash(fc FailedCall) (string, FailedCall) {
+	return fc.PromptHash, fc
+}
+
+// CopyToDuplicatesFn copies the rows and dead letters of a hash to its
+// duplicate prompts.
+type CopyToDuplicatesFn struct{}
+
+func (fn *CopyToDuplicatesFn) ProcessElement(_ string, duplicates func(*Prompt) bool, results func(*GeminiResult) bool, failures func(*FailedCall) bool, emit func(GeminiResult), emitFailed func(FailedCall)) {
+	var dups []Prompt
+	var p Prompt
+	for duplicates(&p) {
+		dups = append(dups, p)
+	}
+	if len(dups) == 0 {
+		return
+	}
+	var r GeminiResult
+	for results(&r) {
+		for _, d := range dups {
+			c := r
+			c.ParentKey, c.SubIndex, c.SubCount = d.ParentKey, d.SubIndex, d.SubCount
+			c.OrderingKey, c.Sequence = d.OrderingKey, d.Sequence
+			c.WorkflowStep, c.WorkflowPath = d.WorkflowStep, d.WorkflowPath
+			c.SourceURI, c.SourceMimeType, c.SourceSizeBytes = d.SourceURI, d.SourceMimeType, d.SourceSizeBytes
+			emit(c)
+		}
+	}
+	var fc FailedCall
+	for failures(&fc) {
+		for _, d := range dups {
+			c := fc
+			c.ParentKey, c.SubIndex = d.ParentKey, d.SubIndex
+			emitFailed(c)
+		}
+	}
+}
+
+// copyToDuplicates adds the copies for the duplicate prompts to a stage's
+// rows and dead letters.
+func copyToDuplicates(s beam.Scope, duplicates, results, failed beam.PCollection) (beam.PCollection, beam.PCollection) {
+	s = s.Scope("CopyToDuplicates")
+	joined := beam.CoGroupByKey(s, duplicates, beam.ParDo(s, keyResultByHash, results), beam.ParDo(s, keyFailureByHash, failed))
+	copies, failedCopies := beam.ParDo2(s, &CopyToDuplicatesFn{}, joined)
+	return beam.Flatten(s, results, copies), beam.Flatten(s, failed, failedCopies)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"cloud.google.com/go/storage"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iterator"
+)
+
+// --- Document crawler input ---
+
+// Under --input_documents_prefix or --input_drive_folder_id every file under
+// the prefix, or in the folder and its subfolders, becomes one prompt:
+// --document_instruction with the file attached to the request. Attachments
+// need a generateContent model on Vertex AI; a prompt routed to a predict
+// model fails rather than being answered from the file name.
+//
+//   - Cloud Storage objects of a MIME type Vertex AI reads (PDF, plain text,
+//     images, audio, video) are attached by URI as fileData, so the workers
+//     never download them.
+//   - Drive files, and objects of other types, are downloaded on the worker
+//     and attached inline: PDFs and media as inlineData, Google Docs, Sheets,
+//     and Slides exported to text or CSV, and other text files as text. A
+//     file that is neither, or larger than maxInlineDocumentBytes, fails its
+//     call and is dead-lettered.
+
+// maxInlineDocumentBytes caps downloaded files, under the request size limit
+// of Vertex AI.
+const maxInlineDocumentBytes = 20 << 20
+
+const driveReadonlyScope = "https://www.googleapis.com/auth/drive.readonly"
+
+// driveExports is the format Google Workspace files are exported to; they
+// have no content of their own to download.
+var driveExports = map[string]string{
+	"application/vnd.google-apps.document":     "text/plain",
+	"application/vnd.google-apps.spreadsheet":  "text/csv",
+	"application/vnd.google-apps.presentation": "text/plain",
+	"application/vnd.google-apps.drawing":      "image/png",
+}
+
+const driveFolderMimeType = "application/vnd.google-apps.folder"
+
+// documentFile is one file found by the crawler.
+type documentFile struct {
+	URI      string
+	ID       string // Drive file ID; empty for Cloud Storage objects
+	Name     string
+	MimeType string
+	Size     int64
+}
+
+// DocumentRef is the file a crawled prompt is about, see parametersFor.
+type DocumentRef struct {
+	URI      string
+	MimeType string
+	DriveID  string
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*CrawlDocumentsFn)(nil)).Elem())
+}
+
+// CrawlDocumentsFn lists files under a GCS prefix or in a Drive folder and emits one
+// prompt per file that matches the name glob and MIME filters. File metadata rides
+// along on the prompt so it reaches the output row.
+type CrawlDocumentsFn struct {
+	GCSPrefix     string
+	DriveFolderID string
+	NameGlob      string
+	MimeTypes     []string
+	Instruction   string
+}
+
+func (fn *CrawlDocumentsFn) ProcessElement(ctx context.Context, _ []byte, emit func(Prompt)) error {
+	var files []documentFile
+	var err error
+	if fn.GCSPrefix != "" {
+		files, err = listGCSFiles(ctx, fn.GCSPrefix)
+	} else {
+		files, err = listDriveFiles(ctx, fn.DriveFolderID)
+	}
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !fn.matches(f) {
+			continue
+		}
+		emit(Prompt{
+			// The file itself is attached to the request, see documentParts
+			Prompt:          fn.Instruction + "\n\nDocument: " + f.URI,
+			ParentKey:       f.URI,
+			SourceURI:       f.URI,
+			SourceMimeType:  f.MimeType,
+			SourceSizeBytes: f.Size,
+			SourceFileID:    f.ID,
+		})
+	}
+	return nil
+}
+
+func (fn *CrawlDocumentsFn) matches(f documentFile) bool {
+	if fn.NameGlob != "" {
+		if ok, _ := path.Match(fn.NameGlob, f.Name); !ok {
+			return false
+		}
+	}
+	if len(fn.MimeTypes) == 0 {
+		return true
+	}
+	for _, m := range fn.MimeTypes {
+		if strings.EqualFold(m, f.MimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// listGCSFiles lists every object under a gs://bucket/prefix path.
+func listGCSFiles(ctx context.Context, prefix string) ([]documentFile, error) {
+	bucket, ok := gcsBucket(prefix)
+	if !ok {
+		return nil, fmt.Errorf("invalid GCS prefix %q (want gs://bucket/path)", prefix)
+	}
+	objPrefix := strings.TrimPrefix(strings.TrimPrefix(prefix, "gs://"+bucket), "/")
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %w", err)
+	}
+	defer client.Close()
+
+	var files []documentFile
+	it := client.Bucket(bucket).Objects(ctx, &storage.Query{Prefix: objPrefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+		}
+		if strings.HasSuffix(attrs.Name, "/") {
+			continue // Folder placeholder
+		}
+		files = append(files, documentFile{
+			URI:      fmt.Sprintf("gs://%s/%s", bucket, attrs.Name),
+			Name:     path.Base(attrs.Name),
+			MimeType: attrs.ContentType,
+			Size:     attrs.Size,
+		})
+	}
+	return files, nil
+}
+
+// listDriveFiles lists the non-trashed files of a Drive folder and its
+// subfolders, as listGCSFiles lists every object under a prefix.
+func listDriveFiles(ctx context.Context, folderID string) ([]documentFile, error) {
+	client, err := google.DefaultClient(ctx, driveReadonlyScope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create google default client (ADC issue?): %w", err)
+	}
+
+	var files []documentFile
+	folders := []string{folderID}
+	seen := map[string]bool{folderID: true} // A folder can have several parents
+	for len(folders) > 0 {
+		folder := folders[0]
+		folders = folders[1:]
+		pageToken := ""
+		for {
+			q := url.Values{}
+			q.Set("q", fmt.Sprintf("'%s' in parents and trashed = false", folder))
+			q.Set("fields", "nextPageToken, files(id, name, mimeType, size, webViewLink)")
+			q.Set("supportsAllDrives", "true")
+			q.Set("includeItemsFromAllDrives", "true")
+			if pageToken != "" {
+				q.Set("pageToken", pageToken)
+			}
+			resp, err := client.Get("https://www.googleapis.com/drive/v3/files?" + q.Encode())
+			if err != nil {
+				return nil, fmt.Errorf("failed to query drive api: %w", err)
+			}
+			var page struct {
+				NextPageToken string `json:"nextPageToken"`
+				Files         []struct {
+					ID          string `json:"id"`
+					Name        string `json:"name"`
+					MimeType    string `json:"mimeType"`
+					Size        string `json:"size"` // int64 encoded as a string
+					WebViewLink string `json:"webViewLink"`
+				} `json:"files"`
+			}
+			if resp.StatusCode != http.StatusOK {
+				bodyBytes, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				return nil, fmt.Errorf("drive api request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+			}
+			err = json.NewDecoder(resp.Body).Decode(&page)
+			resp.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode drive response: %w", err)
+			}
+			for _, f := range page.Files {
+				if f.MimeType == driveFolderMimeType {
+					if !seen[f.ID] {
+						seen[f.ID] = true
+						folders = append(folders, f.ID)
+					}
+					continue
+				}
+				size, _ := strconv.ParseInt(f.Size, 10, 64)
+				files = append(files, documentFile{URI: f.WebViewLink, ID: f.ID, Name: f.Name, MimeType: f.MimeType, Size: size})
+			}
+			if page.NextPageToken == "" {
+				break
+			}
+			pageToken = page.NextPageToken
+		}
+	}
+	return files, nil
+}
+
+// fileDataMimeType reports whether Vertex AI reads Cloud Storage objects of
+// the MIME type itself.
+func fileDataMimeType(m string) bool {
+	m = strings.ToLower(m)
+	switch m {
+	case "application/pdf", "text/plain", "image/png", "image/jpeg", "image/webp", "image/heic", "image/heif":
+		return true
+	}
+	return strings.HasPrefix(m, "audio/") || strings.HasPrefix(m, "video/")
+}
+
+// documentParts returns the parts that attach a crawled file to its request,
+// none for prompts without one.
+func (fn *GenerateTextFn) documentParts(ctx context.Context, doc *DocumentRef) ([]GeminiPart, error) {
+	if doc == nil {
+		return nil, nil
+	}
+	if doc.DriveID == "" && fileDataMimeType(doc.MimeType) {
+		return []GeminiPart{{FileData: &GeminiFileData{MimeType: doc.MimeType, FileURI: doc.URI}}}, nil
+	}
+	data, mimeType, err := downloadDocument(ctx, doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download document %s: %w", doc.URI, err)
+	}
+	switch {
+	case fileDataMimeType(mimeType) && !strings.HasPrefix(mimeType, "text/"):
+		return []GeminiPart{{InlineData: &GeminiBlob{MimeType: mimeType, Data: data}}}, nil
+	case utf8.Valid(data):
+		return []GeminiPart{{Text: string(data)}}, nil
+	}
+	return nil, fmt.Errorf("document %s is %s, which the model can't read and which isn't text", doc.URI, doc.MimeType)
+}
+
+// downloadDocument reads the content of a file the model can't be pointed
+// at, and returns it with its MIME type.
+func downloadDocument(ctx context.Context, doc *DocumentRef) ([]byte, string, error) {
+	scope, mimeType := cloudPlatformScope, doc.MimeType
+	var u string
+	switch {
+	case doc.DriveID != "":
+		scope = driveReadonlyScope
+		if export, ok := driveExports[doc.MimeType]; ok {
+			mimeType = export
+			u = fmt.Sprintf("https://www.googleapis.com/drive/v3/files/%s/export?mimeType=%s", url.PathEscape(doc.DriveID), url.QueryEscape(export))
+		} else {
+			u = fmt.Sprintf("https://www.googleapis.com/drive/v3/files/%s?alt=media&supportsAllDrives=true", url.PathEscape(doc.DriveID))
+		}
+	default:
+		bucket, object, ok := strings.Cut(strings.TrimPrefix(doc.URI, "gs://"), "/")
+		if !ok {
+			return nil, "", fmt.Errorf("invalid object URI %q", doc.URI)
+		}
+		u = fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s?alt=media", url.PathEscape(bucket), url.PathEscape(object))
+	}
+	client, err := sharedWorkerRegistry().client(ctx, "", scope)
+	if err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, "", fmt.Errorf("status %d: %s", resp.StatusCode, body)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxInlineDocumentBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > maxInlineDocumentBytes {
+		return nil, "", fmt.Errorf("larger than %d MiB", maxInlineDocumentBytes>>20)
+	}
+	return data, mimeType, nil
+}
+
+// documentInputEnabled reports whether prompts come from crawled files instead of rows.
+func documentInputEnabled() bool {
+	return *inputDocumentsPrefix != "" || *inputDriveFolderID != ""
+}
+
+// crawlDocuments emits one prompt per matching file, listing on a single worker.
+func crawlDocuments(s beam.Scope) beam.PCollection {
+	s = s.Scope("CrawlDocuments")
+	return beam.ParDo(s, &CrawlDocumentsFn{
+		GCSPrefix:     *inputDocumentsPrefix,
+		DriveFolderID: *inputDriveFolderID,
+		NameGlob:      *inputFileGlob,
+		MimeTypes:     splitList(*inputMimeTypes),
+		Instruction:   *documentInstruction,
+	}, beam.Impulse(s))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+)
+
+// --- Required input entities ---
+
+// Modes for --entity_check, applied to prompts whose input row has required_terms.
+const (
+	entityCheckOff   = "off"
+	entityCheckFlag  = "flag"  // Record missing terms in the MissingTerms column
+	entityCheckRetry = "retry" // Also retry once with the terms spelled out
+)
+
+// entityReminder is the Mutation recorded when the retry produced the answer.
+const entityReminder = "required_terms"
+
+func validEntityCheck(mode string) bool {
+	return mode == entityCheckOff || mode == entityCheckFlag || mode == entityCheckRetry
+}
+
+// missingTerms returns the required terms that don't appear verbatim in text.
+// Matching is case-sensitive on purpose: "Cheerios" rewritten as "cheerios" is
+// the kind of rename catalog copy must not get.
+func missingTerms(text string, terms []string) []string {
+	var missing []string
+	for _, t := range terms {
+		if t != "" && !strings.Contains(text, t) {
+			missing = append(missing, t)
+		}
+	}
+	return missing
+}
+
+// checkTerms verifies that the answer keeps the prompt's required terms. Under
+// the retry mode a mismatch gets one more attempt with the terms spelled out,
+// kept only if it misses fewer of them.
+func (fn *GenerateTextFn) checkTerms(ctx context.Context, p Prompt, model string, params VertexParameters, first vertexOutput) vertexOutput {
+	if fn.EntityCheck == entityCheckOff || len(p.RequiredTerms) == 0 {
+		return first
+	}
+	first.MissingTerms = missingTerms(first.Text, p.RequiredTerms)
+	out := first
+	if len(first.MissingTerms) > 0 && fn.EntityCheck == entityCheckRetry {
+		fn.EntityRetryCounter.Inc(ctx, 1)
+		retry, err := fn.guardedPredict(ctx, model, p.Prompt+termsReminder(p.RequiredTerms), params)
+		if err != nil {
+			beamlog.Warnf(ctx, "GenerateTextFn: Required terms retry failed for prompt '%s': %v", fn.LogPolicy.redact(p.Prompt), err)
+		} else if retry.MissingTerms = missingTerms(retry.Text, p.RequiredTerms); len(retry.MissingTerms) < len(first.MissingTerms) {
+			retry.Attempt, retry.Mutation = first.Attempt+1, entityReminder
+			retry.PromptTokens += first.PromptTokens
+			retry.OutputTokens += first.OutputTokens
+			out = retry
+		} else {
+			out.PromptTokens += retry.PromptTokens
+			out.OutputTokens += retry.OutputTokens
+		}
+	}
+	if len(out.MissingTerms) > 0 {
+		fn.EntityMismatchCounter.Inc(ctx, 1)
+		beamlog.Warnf(ctx, "GenerateTextFn: Answer to prompt '%s' is missing %d required terms", fn.LogPolicy.redact(p.Prompt), len(out.MissingTerms))
+	}
+	return out
+}
+
+// termsReminder is appended to the prompt for the retry.
+func termsReminder(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, t := range terms {
+		quoted[i] = fmt.Sprintf("%q", t)
+	}
+	return "\n\nUse these names exactly as written, with the same spelling and capitalization: " + strings.Join(quoted, ", ") + "."
+}
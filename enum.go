@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+	"google.golang.org/api/iterator"
+)
+
+// --- Closed-set outputs (enum responseSchema) ---
+
+// enumMimeType asks the endpoint to answer with exactly one of the schema's enum values.
+const enumMimeType = "text/x.enum"
+
+// maxResponseEnumValues bounds the allowed set; a distinct-values query over the
+// wrong column would otherwise put millions of values into every request.
+const maxResponseEnumValues = 1000
+
+// enumRetry is the Mutation recorded when the allowed values retry produced the answer.
+const enumRetry = "enum"
+
+// errEnumMismatch marks answers dead-lettered for staying outside the allowed values.
+var errEnumMismatch = errors.New("generated text is not one of the allowed values")
+
+// VertexSchema is the subset of the OpenAPI schema used for constrained decoding.
+type VertexSchema struct {
+	Type string   `json:"type"`
+	Enum []string `json:"enum,omitempty"`
+}
+
+// responseEnum is resolved by main from --response_enum or --response_enum_column.
+var responseEnum []string
+
+// loadResponseEnum returns the allowed output values: the flag list as given,
+// or the distinct non-null values of a BigQuery column.
+func loadResponseEnum(ctx context.Context, project string) ([]string, error) {
+	if *responseEnumValues != "" && *responseEnumColumn != "" {
+		return nil, fmt.Errorf("--response_enum and --response_enum_column are mutually exclusive")
+	}
+	var values []string
+	if *responseEnumColumn != "" {
+		var err error
+		if values, err = queryDistinctValues(ctx, project, *responseEnumColumn); err != nil {
+			return nil, err
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("column %s has no values", *responseEnumColumn)
+		}
+	} else {
+		values = splitList(*responseEnumValues)
+	}
+	if len(values) > maxResponseEnumValues {
+		return nil, fmt.Errorf("%d allowed values exceed the limit of %d", len(values), maxResponseEnumValues)
+	}
+	return values, nil
+}
+
+// distinctValuesQuery selects the distinct values of a project.dataset.table.column reference.
+func distinctValuesQuery(column string) (string, error) {
+	i := strings.LastIndex(column, ".")
+	if i <= 0 || i == len(column)-1 || strings.Count(column, ".") != 3 || strings.Contains(column, "`") {
+		return "", fmt.Errorf("invalid column %q (want project.dataset.table.column)", column)
+	}
+	table, col := column[:i], column[i+1:]
+	return fmt.Sprintf("SELECT DISTINCT CAST(`%s` AS STRING) AS value FROM `%s` WHERE `%s` IS NOT NULL ORDER BY value LIMIT %d",
+		col, table, col, maxResponseEnumValues+1), nil
+}
+
+func queryDistinctValues(ctx context.Context, project, column string) ([]string, error) {
+	query, err := distinctValuesQuery(column)
+	if err != nil {
+		return nil, err
+	}
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bigquery client: %w", err)
+	}
+	defer client.Close()
+	it, err := client.Query(query).Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read distinct values of %s: %w", column, err)
+	}
+	var values []string
+	for {
+		var row struct {
+			Value string `bigquery:"value"`
+		}
+		err := it.Next(&row)
+		if err == iterator.Done {
+			return values, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read distinct values of %s: %w", column, err)
+		}
+		values = append(values, row.Value)
+	}
+}
+
+// parameters returns the generation parameters for this DoFn, adding the enum
+// schema when configured. The extra fields are omitted when
+// unset, so prompt hashes of runs without them are unchanged.
+func (fn *GenerateTextFn) parameters() VertexParameters {
+	params := fn.Generation
+	if len(fn.ResponseEnum) > 0 {
+		params.ResponseMimeType = enumMimeType
+		params.ResponseSchema = &VertexSchema{Type: "STRING", Enum: fn.ResponseEnum}
+	}
+	return params
+}
+
+// parametersFor returns the parameters for one prompt: its own Choices, when
+// set, replace the DoFn-wide enum.
+func (fn *GenerateTextFn) parametersFor(p Prompt) VertexParameters {
+	params := fn.parameters()
+	if p.SourceURI != "" {
+		params.Document = &DocumentRef{URI: p.SourceURI, MimeType: p.SourceMimeType, DriveID: p.SourceFileID}
+	}
+	if len(p.Choices) > 0 {
+		params.ResponseMimeType = enumMimeType
+		params.ResponseSchema = &VertexSchema{Type: "STRING", Enum: p.Choices}
+	}
+	return params
+}
+
+// isAllowed reports whether text, trimmed, is exactly one of the values.
+func isAllowed(text string, values []string) bool {
+	got := strings.TrimSpace(text)
+	for _, v := range values {
+		if got == v {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEnum asks once more, listing the allowed values, when an answer is
+// outside the allowed set, and reports whether the answer it leaves in out is
+// allowed. Constrained decoding should make a mismatch impossible; a non-zero
+// counter means the model ignored the schema. Stale elements are not asked
+// again.
+func (fn *GenerateTextFn) checkEnum(ctx context.Context, p Prompt, model string, params VertexParameters, stale bool, out *vertexOutput) bool {
+	if params.ResponseSchema == nil || isAllowed(out.Text, params.ResponseSchema.Enum) {
+		return true
+	}
+	fn.EnumMismatchCounter.Inc(ctx, 1)
+	beamlog.Warnf(ctx, "GenerateTextFn: Answer '%s' for prompt '%s' is not one of the allowed values", fn.LogPolicy.redact(strings.TrimSpace(out.Text)), fn.LogPolicy.redact(p.Prompt))
+	if stale {
+		return false
+	}
+	note := "\n\nA previous answer to this request was not one of the allowed values. Answer with exactly one of: " + strings.Join(params.ResponseSchema.Enum, ", ")
+	retry, err := fn.guardedPredict(ctx, model, p.Prompt+note, params)
+	if err != nil {
+		beamlog.Warnf(ctx, "GenerateTextFn: Allowed values retry failed for prompt '%s': %v", fn.LogPolicy.redact(p.Prompt), err)
+		return false
+	}
+	out.PromptTokens += retry.PromptTokens
+	out.OutputTokens += retry.OutputTokens
+	if !isAllowed(retry.Text, params.ResponseSchema.Enum) {
+		out.Text = retry.Text
+		return false
+	}
+	retry.Attempt, retry.Mutation = out.Attempt+1, enumRetry
+	retry.PromptTokens, retry.OutputTokens = out.PromptTokens, out.OutputTokens
+	retry.MissingTerms = missingTerms(retry.Text, p.RequiredTerms)
+	*out = retry
+	return true
+}
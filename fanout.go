@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/bigqueryio"
+)
+
+// --- Prompt formatting and fan-out ---
+
+// PromptFromBQ is one row of the input query. Only `prompt` is required;
+// `row_key` and `items` are used when fanning out, `group_key` by group_summarize,
+// `ordering_key`/`sequence` to keep outputs in input order per key, and
+// `required_terms` (e.g. the brand name) by --entity_check.
+type PromptFromBQ struct {
+	Prompt        string   `bigquery:"prompt"`
+	RowKey        string   `bigquery:"row_key"`
+	Items         []string `bigquery:"items"`
+	GroupKey      string   `bigquery:"group_key"`
+	OrderingKey   string   `bigquery:"ordering_key"`
+	Sequence      int64    `bigquery:"sequence"`
+	RequiredTerms []string `bigquery:"required_terms"`
+	Locale        string   `bigquery:"locale"` // Selects the --prompt_templates template
+
+	TemplateColumns string `bigquery:"template_columns"` // The row's columns as JSON, under --prompt_template
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*PromptFromBQ)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*FormatPromptsFn)(nil)).Elem())
+	beam.RegisterFunction(keyByParent)
+	beam.RegisterFunction(aggregateFanOut)
+}
+
+// FormatPromptsFn turns input rows into prompts. With FanOut enabled, a row
+// carrying items produces one prompt per item, each tagged with the parent key
+// and its sub-index so answers can be regrouped later.
+type FormatPromptsFn struct {
+	FanOut      bool
+	Placeholder string
+}
+
+func (fn *FormatPromptsFn) ProcessElement(ctx context.Context, row PromptFromBQ, emit func(Prompt)) {
+	parentKey := row.RowKey
+	if parentKey == "" {
+		parentKey = row.Prompt
+	}
+	if !fn.FanOut || len(row.Items) == 0 {
+		emit(Prompt{Prompt: row.Prompt, ParentKey: parentKey, OrderingKey: row.OrderingKey, Sequence: row.Sequence, RequiredTerms: row.RequiredTerms})
+		return
+	}
+	for i, item := range row.Items {
+		emit(Prompt{Prompt: fn.expand(row.Prompt, item), ParentKey: parentKey, SubIndex: i, OrderingKey: row.OrderingKey, Sequence: row.Sequence, RequiredTerms: row.RequiredTerms})
+	}
+}
+
+// expand substitutes the item into the prompt, appending it when the prompt has no placeholder.
+func (fn *FormatPromptsFn) expand(prompt, item string) string {
+	if fn.Placeholder != "" && strings.Contains(prompt, fn.Placeholder) {
+		return strings.ReplaceAll(prompt, fn.Placeholder, item)
+	}
+	return prompt + ": " + item
+}
+
+// --- Re-aggregation ---
+
+// FanOutAnswer is one sub-prompt's answer inside an aggregated row.
+type FanOutAnswer struct {
+	SubIndex      int    `beam:"SubIndex"`
+	Prompt        string `beam:"Prompt"`
+	GeneratedText string `beam:"GeneratedText"`
+}
+
+// FanOutAggregate collects all answers generated for one parent row, ordered by sub-index.
+type FanOutAggregate struct {
+	ParentKey string         `beam:"ParentKey"`
+	Answers   []FanOutAnswer `beam:"Answers"`
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*FanOutAggregate)(nil)).Elem())
+}
+
+func keyByParent(r GeminiResult) (string, GeminiResult) {
+	return r.ParentKey, r
+}
+
+func aggregateFanOut(parentKey string, results func(*GeminiResult) bool, emit func(FanOutAggregate)) {
+	agg := FanOutAggregate{ParentKey: parentKey}
+	var r GeminiResult
+	for results(&r) {
+		agg.Answers = append(agg.Answers, FanOutAnswer{SubIndex: r.SubIndex, Prompt: r.Prompt, GeneratedText: r.GeneratedText})
+	}
+	sort.Slice(agg.Answers, func(i, j int) bool { return agg.Answers[i].SubIndex < agg.Answers[j].SubIndex })
+	emit(agg)
+}
+
+// writeFanOutAggregates regroups results by parent row into a nested table when one is configured.
+func writeFanOutAggregates(s beam.Scope, projectID string, results beam.PCollection) {
+	if *fanOutAggregateTable == "" {
+		return
+	}
+	s = s.Scope("AggregateFanOut")
+	grouped := beam.GroupByKey(s, beam.ParDo(s, keyByParent, results))
+	aggregates := beam.ParDo(s, aggregateFanOut, grouped)
+	tableName := fmt.Sprintf("%s:%s.%s", projectID, outputDataset, *fanOutAggregateTable)
+	bigqueryio.Write(s, projectID, tableName, aggregates)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+)
+
+// --- Retry on recitation and safety stops ---
+
+// Finish reasons that may succeed on a reworded attempt.
+const (
+	finishRecitation = "RECITATION"
+	finishSafety     = "SAFETY"
+)
+
+// Mutation strategies for --finish_retry_strategy.
+const (
+	mutateParaphrase       = "paraphrase"        // Ask for original wording instead of quoted text
+	mutateLowerTemperature = "lower_temperature" // Same prompt at --finish_retry_temperature
+	mutateOwnWords         = "own_words"         // Append "in your own words"
+)
+
+// validFinishRetryStrategy reports whether s is empty (disabled) or a known strategy.
+func validFinishRetryStrategy(s string) bool {
+	switch s {
+	case "", mutateParaphrase, mutateLowerTemperature, mutateOwnWords:
+		return true
+	}
+	return false
+}
+
+// needsFinishRetry reports whether the model stopped for recitation or safety.
+func needsFinishRetry(out vertexOutput) bool {
+	return out.FinishReason == finishRecitation || out.FinishReason == finishSafety || out.SafetyStatus == safetyBlocked
+}
+
+// mutate returns the prompt and parameters for the retry.
+func (fn *GenerateTextFn) mutate(prompt string, params VertexParameters) (string, VertexParameters) {
+	switch fn.FinishRetryStrategy {
+	case mutateParaphrase:
+		prompt = "Answer the following request in original wording, without quoting or reproducing existing text.\n\n" + prompt
+	case mutateLowerTemperature:
+		params.Temperature = fn.FinishRetryTemperature
+	case mutateOwnWords:
+		prompt += "\n\nAnswer in your own words."
+	}
+	return prompt, params
+}
+
+// retryFinish makes one mutated attempt after a recitation or safety stop. The
+// retry's answer replaces the original unless the call itself fails; Attempt
+// and Mutation on the result record which one was kept.
+func (fn *GenerateTextFn) retryFinish(ctx context.Context, p Prompt, model string, params VertexParameters, first vertexOutput) vertexOutput {
+	if fn.FinishRetryStrategy == "" || !needsFinishRetry(first) {
+		return first
+	}
+	fn.FinishRetryCounter.Inc(ctx, 1)
+	prompt, retryParams := fn.mutate(p.Prompt, params)
+	out, err := fn.guardedPredict(ctx, model, prompt, retryParams)
+	if err != nil {
+		beamlog.Warnf(ctx, "GenerateTextFn: %s retry after finish reason %s failed for prompt '%s': %v", fn.FinishRetryStrategy, first.FinishReason, fn.LogPolicy.redact(p.Prompt), err)
+		return first
+	}
+	out.Attempt, out.Mutation = 2, fn.FinishRetryStrategy
+	out.PromptTokens += first.PromptTokens
+	out.OutputTokens += first.OutputTokens
+	if needsFinishRetry(out) {
+		beamlog.Warnf(ctx, "GenerateTextFn: Prompt '%s' stopped with %s again after %s retry", fn.LogPolicy.redact(p.Prompt), finishLabel(out), fn.FinishRetryStrategy)
+	}
+	return out
+}
+
+// finishLabel names why a response was stopped, for logs.
+func finishLabel(out vertexOutput) string {
+	if out.FinishReason != "" {
+		return out.FinishReason
+	}
+	return fmt.Sprintf("safety status %s", out.SafetyStatus)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	_ "github.com/apache/beam/sdks/v2/go/pkg/beam/io/filesystem/gcs" // gs:// for textio
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/textio"
+)
+
+// --- Cloud Storage text input ---
+
+// --input_gcs_pattern reads prompts from newline-delimited files in Cloud
+// Storage (e.g. gs://bucket/prompts/*.jsonl) instead of the input query. Without
+// --prompt_field every non-blank line is one prompt. With it every line is a
+// JSON object whose --prompt_field key holds the prompt, while the keys of the
+// local JSONL input (row_key, items, ordering_key, sequence, required_terms,
+// locale) and the --group_by key fill the other columns. Files are read in
+// parallel, so lines have no position: rows without a sequence get 0.
+// Compressed files are read by their extension (.gz, ...).
+
+// gcsInputEnabled reports whether prompts come from Cloud Storage files.
+func gcsInputEnabled() bool {
+	return *inputGCSPattern != ""
+}
+
+// checkGCSInputFlags rejects settings that need a different input.
+func checkGCSInputFlags() error {
+	switch {
+	case !gcsInputEnabled():
+		if *promptField != "" {
+			return fmt.Errorf("--prompt_field requires --input_gcs_pattern")
+		}
+	case !strings.HasPrefix(*inputGCSPattern, "gs://"):
+		return fmt.Errorf("--input_gcs_pattern %q: want a gs:// URI", *inputGCSPattern)
+	case *localMode, streamingMode(), *inputSheetID != "", documentInputEnabled():
+		return fmt.Errorf("--input_gcs_pattern replaces the input query; drop --local, --mode=%s, Sheets, and document input", modeStreaming)
+	case *task == taskPairwise:
+		return fmt.Errorf("--task=%s reads pairs from BigQuery, not --input_gcs_pattern", taskPairwise)
+	case *task == taskGroupSummarize && *promptField == "":
+		return fmt.Errorf("--task=%s needs JSONL input with the --group_by key; set --prompt_field", taskGroupSummarize)
+	}
+	return nil
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*ParseGCSLineFn)(nil)).Elem())
+}
+
+// ParseGCSLineFn turns the lines of the input files into input rows. A JSONL
+// line that doesn't parse fails the file's bundle, like a bad row of a local
+// input file does.
+type ParseGCSLineFn struct {
+	PromptField string // Empty reads lines as plain text
+	GroupBy     string
+}
+
+func (fn *ParseGCSLineFn) ProcessElement(ctx context.Context, file, line string, emit func(PromptFromBQ)) error {
+	if strings.TrimSpace(line) == "" {
+		return nil
+	}
+	if fn.PromptField == "" {
+		emit(PromptFromBQ{Prompt: line})
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	var row localPromptRow
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return fmt.Errorf("%s: invalid JSONL line %.80q: %w", file, line, err)
+	}
+	if err := json.Unmarshal([]byte(line), &row); err != nil {
+		return fmt.Errorf("%s: invalid JSONL line %.80q: %w", file, line, err)
+	}
+	var prompt string
+	if raw, ok := fields[fn.PromptField]; ok {
+		if err := json.Unmarshal(raw, &prompt); err != nil {
+			return fmt.Errorf("%s: %s is not a string in line %.80q", file, fn.PromptField, line)
+		}
+	}
+	if prompt == "" {
+		return nil
+	}
+	p := PromptFromBQ{
+		Prompt:        prompt,
+		RowKey:        row.RowKey,
+		Items:         row.Items,
+		OrderingKey:   row.OrderingKey,
+		RequiredTerms: row.RequiredTerms,
+		Locale:        row.Locale,
+	}
+	if row.Sequence != nil {
+		p.Sequence = *row.Sequence
+	}
+	if fn.GroupBy != "" {
+		p.GroupKey = jsonText(fields[fn.GroupBy])
+	}
+	emit(p)
+	return nil
+}
+
+// jsonText returns a JSON string value as is and any other value as its JSON
+// text, the way BigQuery casts a column to STRING; a missing or null value is "".
+func jsonText(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	if t := strings.TrimSpace(string(raw)); t != "null" {
+		return t
+	}
+	return ""
+}
+
+// readGCSPrompts reads the lines of every file matching --input_gcs_pattern.
+func readGCSPrompts(s beam.Scope) beam.PCollection {
+	s = s.Scope("ReadGCSFiles")
+	lines := textio.ReadWithFilename(s, *inputGCSPattern)
+	return beam.ParDo(s, &ParseGCSLineFn{PromptField: *promptField, GroupBy: *groupBy}, lines)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"strings"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/filesystem"
+)
+
+// --- Cloud Storage results output ---
+
+// Under --output_gcs_prefix the result rows are also written to Cloud Storage
+// as JSONL, for consumers that don't read BigQuery: one object per row with the
+// results table's column names as keys, in
+//
+//	<prefix>/<run_id>/results-SSSSS-of-NNNNN.jsonl
+//
+// with --output_gcs_shards shards. Rows are spread over the shards by
+// PromptHash, and a shard that gets no rows is not written. With
+// --output_bigquery=false the results go to Cloud Storage only; dead letters
+// and the run-level tables are still written to BigQuery.
+
+// gcsOutputEnabled reports whether results are written to Cloud Storage.
+func gcsOutputEnabled() bool {
+	return *outputGCSPrefix != ""
+}
+
+// checkGCSOutputFlags rejects settings the Cloud Storage sink can't serve.
+func checkGCSOutputFlags() error {
+	switch {
+	case !gcsOutputEnabled():
+		if !*outputBigQuery {
+			return fmt.Errorf("--output_bigquery=false requires --output_gcs_prefix")
+		}
+	case !strings.HasPrefix(*outputGCSPrefix, "gs://"):
+		return fmt.Errorf("--output_gcs_prefix %q: want a gs:// URI", *outputGCSPrefix)
+	case *outputGCSShards < 1:
+		return fmt.Errorf("invalid --output_gcs_shards %d (want 1 or more)", *outputGCSShards)
+	case *localMode, streamingMode():
+		return fmt.Errorf("--output_gcs_prefix writes a batch run's results; --local and --mode=%s don't apply", modeStreaming)
+	case !*outputBigQuery && *outputSheetID != "":
+		return fmt.Errorf("--output_sheet_id overflows to BigQuery; keep --output_bigquery")
+	}
+	return nil
+}
+
+// gcsResultsDir is the folder receiving the shards of the run.
+func gcsResultsDir(prefix, runID string) string {
+	return strings.TrimSuffix(prefix, "/") + "/" + runID
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*KeyResultShardFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*WriteResultShardFn)(nil)).Elem())
+}
+
+// KeyResultShardFn assigns every row to a shard by its PromptHash.
+type KeyResultShardFn struct {
+	Shards int
+}
+
+func (fn *KeyResultShardFn) ProcessElement(r GeminiResult) (int, GeminiResult) {
+	h := fnv.New64a()
+	h.Write([]byte(r.PromptHash))
+	return int(h.Sum64() % uint64(fn.Shards)), r
+}
+
+// WriteResultShardFn writes the rows of one shard as a JSONL object. A retried
+// bundle rewrites the whole object.
+type WriteResultShardFn struct {
+	Dir    string
+	Shards int
+
+	rows beam.Counter
+}
+
+func (fn *WriteResultShardFn) Setup() {
+	fn.rows = beam.NewCounter("gcs_output", "rows_written_total")
+}
+
+func (fn *WriteResultShardFn) ProcessElement(ctx context.Context, shard int, rows func(*GeminiResult) bool) error {
+	name := fmt.Sprintf("%s/results-%05d-of-%05d.jsonl", fn.Dir, shard, fn.Shards)
+	fs, err := filesystem.New(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to open file system for %s: %w", name, err)
+	}
+	defer fs.Close()
+	wc, err := fs.OpenWrite(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	w := bufio.NewWriter(wc)
+	enc := json.NewEncoder(w)
+	var r GeminiResult
+	var n int64
+	for rows(&r) {
+		if err := enc.Encode(r); err != nil {
+			wc.Close()
+			return fmt.Errorf("failed to encode row for %s: %w", name, err)
+		}
+		n++
+	}
+	if err := w.Flush(); err != nil {
+		wc.Close()
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := wc.Close(); err != nil {
+		return fmt.Errorf("failed to finish %s: %w", name, err)
+	}
+	fn.rows.Inc(ctx, n)
+	return nil
+}
+
+// writeGCSResults writes the results as JSONL shards under --output_gcs_prefix.
+func writeGCSResults(s beam.Scope, runID string, results beam.PCollection) {
+	if !gcsOutputEnabled() {
+		return
+	}
+	s = s.Scope("WriteGCSResults")
+	keyed := beam.ParDo(s, &KeyResultShardFn{Shards: *outputGCSShards}, results)
+	beam.ParDo0(s, &WriteResultShardFn{
+		Dir:    gcsResultsDir(*outputGCSPrefix, runID),
+		Shards: *outputGCSShards,
+	}, beam.GroupByKey(s, keyed))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+)
+
+// --- Gemini generateContent API ---
+
+// Gemini 1.5 and later reject the PaLM-era instances/parameters payload of
+// :predict, so Gemini models are called through :generateContent, which takes
+// contents and a generationConfig and answers with candidates. --api_mode
+// picks the API: auto sends gemini-* models to generateContent and every other
+// (legacy) model to predict. generateContent takes one prompt per request, so
+// --instances_per_request only batches predict models. Stored bodies of
+// either API parse with parseVertexResponse, which the reparse command uses.
+
+// Values of --api_mode.
+const (
+	apiModeAuto            = "auto"
+	apiModeGenerateContent = "generate_content"
+	apiModePredict         = "predict"
+)
+
+func validAPIMode(mode string) bool {
+	return mode == apiModeAuto || mode == apiModeGenerateContent || mode == apiModePredict
+}
+
+// usesGenerateContent reports whether the model is called through generateContent.
+func usesGenerateContent(mode, model string) bool {
+	switch mode {
+	case apiModeGenerateContent:
+		return true
+	case apiModePredict:
+		return false
+	}
+	return strings.HasPrefix(model, "gemini-")
+}
+
+type GeminiPart struct {
+	Text       string          `json:"text,omitempty"`
+	InlineData *GeminiBlob     `json:"inlineData,omitempty"` // File content sent in the request, see documents.go
+	FileData   *GeminiFileData `json:"fileData,omitempty"`   // File Vertex AI reads from Cloud Storage itself
+}
+
+type GeminiBlob struct {
+	MimeType string `json:"mimeType"`
+	Data     []byte `json:"data"` // Base64 in JSON
+}
+
+type GeminiFileData struct {
+	MimeType string `json:"mimeType"`
+	FileURI  string `json:"fileUri"`
+}
+
+type GeminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []GeminiPart `json:"parts"`
+}
+
+// GenerateContentRequest is the generateContent request body. The generation
+// settings share their JSON names with the predict parameters.
+type GenerateContentRequest struct {
+	Contents          []GeminiContent  `json:"contents"`
+	SystemInstruction *GeminiContent   `json:"systemInstruction,omitempty"` // Hoisted shared prefix, see prefix.go
+	GenerationConfig  VertexParameters `json:"generationConfig"`
+}
+
+type GeminiSafetyRating struct {
+	Category         string  `json:"category"`
+	Probability      string  `json:"probability,omitempty"`
+	ProbabilityScore float64 `json:"probabilityScore,omitempty"`
+	Severity         string  `json:"severity,omitempty"`
+	SeverityScore    float64 `json:"severityScore,omitempty"`
+	Blocked          bool    `json:"blocked,omitempty"`
+}
+
+type GeminiCandidate struct {
+	Content          GeminiContent           `json:"content"`
+	FinishReason     string                  `json:"finishReason,omitempty"`
+	SafetyRatings    []GeminiSafetyRating    `json:"safetyRatings,omitempty"`
+	CitationMetadata *GeminiCitationMetadata `json:"citationMetadata,omitempty"`
+}
+
+type GenerateContentResponse struct {
+	Candidates     []GeminiCandidate `json:"candidates"`
+	ModelVersion   string            `json:"modelVersion,omitempty"`
+	PromptFeedback *struct {
+		BlockReason string `json:"blockReason,omitempty"`
+	} `json:"promptFeedback,omitempty"`
+	UsageMetadata struct {
+		PromptTokenCount        int64 `json:"promptTokenCount"`
+		CachedContentTokenCount int64 `json:"cachedContentTokenCount"`
+		CandidatesTokenCount    int64 `json:"candidatesTokenCount"`
+	} `json:"usageMetadata"`
+}
+
+// generateContentBody builds the request body for one prompt, with the
+// system instruction when there is one.
+func generateContentBody(system, prompt string, params VertexParameters, attached []GeminiPart) ([]byte, error) {
+	req := GenerateContentRequest{
+		Contents:         []GeminiContent{{Role: "user", Parts: append([]GeminiPart{{Text: prompt}}, attached...)}},
+		GenerationConfig: params,
+	}
+	if system != "" {
+		req.SystemInstruction = &GeminiContent{Parts: []GeminiPart{{Text: system}}}
+	}
+	return json.Marshal(req)
+}
+
+// isGenerateContentBody reports whether a stored response body came from generateContent.
+func isGenerateContentBody(body []byte) bool {
+	var probe struct {
+		Candidates     json.RawMessage `json:"candidates"`
+		PromptFeedback json.RawMessage `json:"promptFeedback"`
+		UsageMetadata  json.RawMessage `json:"usageMetadata"`
+	}
+	return json.Unmarshal(body, &probe) == nil && (probe.Candidates != nil || probe.PromptFeedback != nil || probe.UsageMetadata != nil)
+}
+
+// parseGenerateContentResponse extracts the text of the first candidate, the
+// counterpart of parseVertexResponse for predict bodies.
+func parseGenerateContentResponse(ctx context.Context, body []byte, prompt string, policy contentPolicy) (vertexOutput, error) {
+	var resp GenerateContentResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return vertexOutput{}, fmt.Errorf("failed to unmarshal generateContent response (body: %s): %w", policy.redact(string(body)), err)
+	}
+	out := vertexOutput{
+		ModelVersion: resp.ModelVersion,
+		SafetyStatus: safetyUnknown,
+		PromptTokens: resp.UsageMetadata.PromptTokenCount,
+		CachedTokens: resp.UsageMetadata.CachedContentTokenCount,
+		OutputTokens: resp.UsageMetadata.CandidatesTokenCount,
+	}
+	if resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != "" {
+		// The prompt itself was blocked, so there are no candidates
+		beamlog.Warnf(ctx, "Vertex AI blocked the prompt (%s): %s", resp.PromptFeedback.BlockReason, policy.redact(prompt))
+		out.SafetyStatus = safetyBlocked
+		out.FinishReason = resp.PromptFeedback.BlockReason
+		out.Text = "Empty prediction content from Vertex AI"
+		return out, nil
+	}
+	if len(resp.Candidates) == 0 {
+		beamlog.Warnf(ctx, "Received empty candidates list from Vertex AI for prompt: %s", policy.redact(prompt))
+		out.Text = "No prediction content from Vertex AI"
+		return out, nil
+	}
+	cand := resp.Candidates[0]
+	out.FinishReason = cand.FinishReason
+	out.SafetyRatings = geminiSafetyRatings(cand.SafetyRatings)
+	out.Citations = geminiCitations(cand.CitationMetadata)
+	if len(cand.SafetyRatings) > 0 {
+		out.SafetyStatus = safetyPassed
+	}
+	for _, r := range cand.SafetyRatings {
+		if r.Blocked {
+			out.SafetyStatus = safetyBlocked
+		}
+	}
+	var text strings.Builder
+	for _, part := range cand.Content.Parts {
+		text.WriteString(part.Text)
+	}
+	if text.Len() == 0 {
+		beamlog.Warnf(ctx, "Received empty content in first candidate from Vertex AI for prompt: %s", policy.redact(prompt))
+		out.Text = "Empty prediction content from Vertex AI"
+		return out, nil
+	}
+	out.Text = text.String()
+	return out, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// --- Generation parameters ---
+
+// The sampling settings sent with every request come from --temperature,
+// --top_k, --top_p, --max_output_tokens, --stop_sequences, and
+// --candidate_count. main resolves them into generationParameters, which the
+// DoFns get as a field; zero values other than the temperature are left out
+// of the request, so the endpoint applies its defaults. The parameters are
+// part of PromptHash, so rows generated under different settings don't share
+// cache entries or skip each other on resume.
+
+// maxStopSequences is the most stop sequences Vertex AI accepts.
+const maxStopSequences = 5
+
+// generationParameters are sent with every request. main sets them from the
+// generation flags; these are the defaults of those flags.
+var generationParameters = VertexParameters{
+	Temperature: 0.8,
+	TopK:        3,
+}
+
+// generationFromFlags validates the generation flags and returns the
+// parameters they describe.
+func generationFromFlags() (VertexParameters, error) {
+	p := VertexParameters{
+		Temperature:     *temperature,
+		TopK:            *topK,
+		TopP:            *topP,
+		MaxOutputTokens: *maxOutputTokens,
+		StopSequences:   splitList(*stopSequences),
+		CandidateCount:  *candidateCount,
+	}
+	switch {
+	case p.Temperature < 0 || p.Temperature > 2:
+		return p, fmt.Errorf("--temperature %g: want 0 to 2", p.Temperature)
+	case p.TopK < 0:
+		return p, fmt.Errorf("--top_k %d: want 0 (endpoint default) or more", p.TopK)
+	case p.TopP < 0 || p.TopP > 1:
+		return p, fmt.Errorf("--top_p %g: want 0 (endpoint default) to 1", p.TopP)
+	case p.MaxOutputTokens < 0:
+		return p, fmt.Errorf("--max_output_tokens %d: must not be negative", p.MaxOutputTokens)
+	case len(p.StopSequences) > maxStopSequences:
+		return p, fmt.Errorf("--stop_sequences: at most %d, got %d", maxStopSequences, len(p.StopSequences))
+	case p.CandidateCount < 0:
+		return p, fmt.Errorf("--candidate_count %d: want 0 (endpoint default) or more", p.CandidateCount)
+	}
+	return p, nil
+}
+
+// describeGeneration summarizes the parameters for logs and table descriptions.
+func describeGeneration(p VertexParameters) string {
+	parts := []string{fmt.Sprintf("temperature %g", p.Temperature)}
+	if p.TopK > 0 {
+		parts = append(parts, fmt.Sprintf("topK %d", p.TopK))
+	}
+	if p.TopP > 0 {
+		parts = append(parts, fmt.Sprintf("topP %g", p.TopP))
+	}
+	maxTokens := "model default"
+	if p.MaxOutputTokens > 0 {
+		maxTokens = fmt.Sprint(p.MaxOutputTokens)
+	}
+	parts = append(parts, "maxOutputTokens "+maxTokens)
+	if len(p.StopSequences) > 0 {
+		parts = append(parts, fmt.Sprintf("stopSequences %q", p.StopSequences))
+	}
+	if p.CandidateCount > 0 {
+		parts = append(parts, fmt.Sprintf("candidateCount %d", p.CandidateCount))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+	"google.golang.org/api/iterator"
+)
+
+// --- Glossary enforcement ---
+
+// Under --glossary_table every prompt that mentions a glossary source term is
+// told which target term to use for it, and the answer is checked for that
+// target term afterwards. Answers that leave one out keep their row but list
+// the broken entries in the GlossaryMisses column, for review of brand and
+// regulatory wording. Source terms match case-insensitively; target terms
+// must appear exactly as written, like --entity_check's required terms.
+
+// glossaryEntry is one row of the glossary table.
+type glossaryEntry struct {
+	Source string // Term as it may appear in the prompt
+	Target string // Term the answer must use for it
+}
+
+// glossary is loaded by main from --glossary_table.
+var glossary []glossaryEntry
+
+// loadGlossary reads source_term and target_term from a project.dataset.table.
+func loadGlossary(ctx context.Context, project, table string) ([]glossaryEntry, error) {
+	if strings.Count(table, ".") != 2 || strings.Contains(table, "`") {
+		return nil, fmt.Errorf("invalid table %q (want project.dataset.table)", table)
+	}
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bigquery client: %w", err)
+	}
+	defer client.Close()
+	q := client.Query(fmt.Sprintf("SELECT CAST(source_term AS STRING) AS source_term, CAST(target_term AS STRING) AS target_term FROM `%s` ORDER BY source_term", table))
+	it, err := q.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read glossary %s: %w", table, err)
+	}
+	var entries []glossaryEntry
+	for {
+		var row struct {
+			Source string `bigquery:"source_term"`
+			Target string `bigquery:"target_term"`
+		}
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read glossary %s: %w", table, err)
+		}
+		e := glossaryEntry{Source: strings.TrimSpace(row.Source), Target: strings.TrimSpace(row.Target)}
+		if e.Source == "" || e.Target == "" {
+			return nil, fmt.Errorf("glossary %s has a row with an empty term", table)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("glossary %s is empty", table)
+	}
+	return entries, nil
+}
+
+// glossaryEntriesFor returns the entries whose source term the text mentions.
+func glossaryEntriesFor(text string, entries []glossaryEntry) []glossaryEntry {
+	lower := strings.ToLower(text)
+	var hits []glossaryEntry
+	for _, e := range entries {
+		if strings.Contains(lower, strings.ToLower(e.Source)) {
+			hits = append(hits, e)
+		}
+	}
+	return hits
+}
+
+// glossaryInstruction is appended to prompts that mention glossary terms.
+func glossaryInstruction(entries []glossaryEntry) string {
+	pairs := make([]string, len(entries))
+	for i, e := range entries {
+		pairs[i] = fmt.Sprintf("%q -> %q", e.Source, e.Target)
+	}
+	return "\n\nUse this terminology, with the same spelling and capitalization: " + strings.Join(pairs, ", ") + "."
+}
+
+// glossaryViolations returns "source -> target" for every entry the prompt
+// mentions whose target term the answer lacks.
+func glossaryViolations(prompt, answer string, entries []glossaryEntry) []string {
+	var violations []string
+	for _, e := range glossaryEntriesFor(prompt, entries) {
+		if !strings.Contains(answer, e.Target) {
+			violations = append(violations, e.Source+" -> "+e.Target)
+		}
+	}
+	return violations
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*InjectGlossaryFn)(nil)).Elem())
+}
+
+// InjectGlossaryFn appends the applicable glossary entries to each prompt, so
+// the instruction is part of the prompt hash and of the stored Prompt.
+type InjectGlossaryFn struct {
+	Glossary []glossaryEntry
+
+	injected beam.Counter
+}
+
+func (fn *InjectGlossaryFn) Setup() {
+	fn.injected = beam.NewCounter("vertexai", "glossary_prompts_total")
+}
+
+func (fn *InjectGlossaryFn) ProcessElement(ctx context.Context, p Prompt, emit func(Prompt)) {
+	if hits := glossaryEntriesFor(p.Prompt, fn.Glossary); len(hits) > 0 {
+		fn.injected.Inc(ctx, 1)
+		p.Prompt += glossaryInstruction(hits)
+	}
+	emit(p)
+}
+
+// checkGlossary records the glossary entries the answer breaks.
+func (fn *GenerateTextFn) checkGlossary(ctx context.Context, p Prompt, out *vertexOutput) {
+	if len(fn.Glossary) == 0 {
+		return
+	}
+	if out.GlossaryMisses = glossaryViolations(p.Prompt, out.Text, fn.Glossary); len(out.GlossaryMisses) > 0 {
+		fn.GlossaryCounter.Inc(ctx, 1)
+		beamlog.Warnf(ctx, "GenerateTextFn: Answer to prompt '%s' breaks %d glossary entries", fn.LogPolicy.redact(p.Prompt), len(out.GlossaryMisses))
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	bqapi "google.golang.org/api/bigquery/v2"
+)
+
+// --- Governed output tables ---
+
+// policyTagPattern matches a Data Catalog policy tag resource name.
+var policyTagPattern = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/taxonomies/[^/]+/policyTags/[^/]+$`)
+
+// parseColumnPolicyTags parses --column_policy_tags entries of the form
+// Column=projects/.../locations/.../taxonomies/.../policyTags/....
+func parseColumnPolicyTags(entries []string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, e := range entries {
+		col, tag, ok := strings.Cut(e, "=")
+		col, tag = strings.TrimSpace(col), strings.TrimSpace(tag)
+		if !ok || col == "" || !policyTagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("%q: want Column=projects/P/locations/L/taxonomies/T/policyTags/ID", e)
+		}
+		if _, dup := tags[col]; dup {
+			return nil, fmt.Errorf("column %s is listed twice", col)
+		}
+		tags[col] = tag
+	}
+	return tags, nil
+}
+
+// applyGovernance keeps generated data inside the destination's existing
+// governance before anything is written:
+//   - every --column_policy_tags column gets its policy tag in each planned
+//     output table carrying it, so sensitive generated text is masked or
+//     restricted wherever it lands; a column already tagged differently is an
+//     error rather than silently re-governed
+//   - with --require_row_access_policy, each table receiving result rows must
+//     already exist with at least one row access policy
+func applyGovernance(ctx context.Context, project string) error {
+	tags, err := parseColumnPolicyTags(splitList(*columnPolicyTags))
+	if err != nil {
+		return err
+	}
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return fmt.Errorf("failed to create bigquery client: %w", err)
+	}
+	defer client.Close()
+
+	if *requireRowAccessPolicy {
+		svc, err := bqapi.NewService(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to create bigquery api service: %w", err)
+		}
+		for _, spec := range plannedOutputTables() {
+			if spec.Row != reflect.TypeOf(GeminiResult{}) {
+				continue
+			}
+			if err := checkRowAccessPolicies(ctx, svc, project, spec.Table); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(tags) == 0 {
+		return nil
+	}
+	for _, spec := range plannedOutputTables() {
+		table := client.Dataset(outputDataset).Table(spec.Table)
+		if err := applyPolicyTags(ctx, table, spec.Row, tags); err != nil {
+			return fmt.Errorf("table %s.%s: %w", outputDataset, spec.Table, err)
+		}
+	}
+	return nil
+}
+
+// checkRowAccessPolicies fails unless the table exists and has a row access policy.
+func checkRowAccessPolicies(ctx context.Context, svc *bqapi.Service, project, table string) error {
+	resp, err := svc.RowAccessPolicies.List(project, outputDataset, table).Context(ctx).Do()
+	if isBigQueryNotFound(err) {
+		return fmt.Errorf("table %s.%s does not exist; create it with a row access policy before writing generated rows to it", outputDataset, table)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list row access policies of %s.%s: %w", outputDataset, table, err)
+	}
+	if len(resp.RowAccessPolicies) == 0 {
+		return fmt.Errorf("table %s.%s has no row access policy", outputDataset, table)
+	}
+	names := make([]string, len(resp.RowAccessPolicies))
+	for i, p := range resp.RowAccessPolicies {
+		names[i] = p.RowAccessPolicyReference.PolicyId
+	}
+	log.Printf("Table %s.%s is governed by row access policies %s", outputDataset, table, strings.Join(names, ", "))
+	return nil
+}
+
+// applyPolicyTags tags the listed columns of a table, creating the table when
+// it does not exist yet so its first rows are already covered.
+func applyPolicyTags(ctx context.Context, table *bigquery.Table, row reflect.Type, tags map[string]string) error {
+	md, err := table.Metadata(ctx)
+	if err != nil && !isBigQueryNotFound(err) {
+		return fmt.Errorf("failed to read table metadata: %w", err)
+	}
+	if err != nil {
+		schema, err := bigquery.InferSchema(reflect.Zero(row).Interface())
+		if err != nil {
+			return fmt.Errorf("failed to infer schema from %v: %w", row, err)
+		}
+		if _, err := tagColumns(schema, tags); err != nil {
+			return err
+		}
+		tm := &bigquery.TableMetadata{Schema: schema}
+		if *kmsKey != "" {
+			tm.EncryptionConfig = &bigquery.EncryptionConfig{KMSKeyName: *kmsKey}
+		}
+		if err := table.Create(ctx, tm); err != nil {
+			return fmt.Errorf("failed to create table with policy tags: %w", err)
+		}
+		log.Printf("Created table %s with policy tags", table.FullyQualifiedName())
+		return nil
+	}
+
+	changed, err := tagColumns(md.Schema, tags)
+	if err != nil || !changed {
+		return err
+	}
+	if _, err := table.Update(ctx, bigquery.TableMetadataToUpdate{Schema: md.Schema}, md.ETag); err != nil {
+		return fmt.Errorf("failed to apply policy tags: %w", err)
+	}
+	log.Printf("Applied policy tags to %s", table.FullyQualifiedName())
+	return nil
+}
+
+// tagColumns sets the policy tag of each listed top-level column present in
+// the schema and reports whether anything changed.
+func tagColumns(schema bigquery.Schema, tags map[string]string) (bool, error) {
+	changed := false
+	for _, f := range schema {
+		tag, ok := tags[f.Name]
+		if !ok {
+			continue
+		}
+		if f.PolicyTags != nil && len(f.PolicyTags.Names) > 0 {
+			if len(f.PolicyTags.Names) != 1 || f.PolicyTags.Names[0] != tag {
+				return false, fmt.Errorf("column %s is already governed by %s", f.Name, strings.Join(f.PolicyTags.Names, ", "))
+			}
+			continue
+		}
+		f.PolicyTags = &bigquery.PolicyTagList{Names: []string{tag}}
+		changed = true
+	}
+	return changed, nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// --- Prompt identity ---
+
+// PromptHash returns a stable identifier for a generation request: the SHA-256 of the
+// model, the generation parameters, and the prompt text. Every subsystem that needs to
+// recognise "the same request" (sampling, caching, dedup, incremental runs, DLQ replay)
+// must key on this value so they all agree.
+func PromptHash(prompt, model string, params VertexParameters) string {
+	// Struct fields marshal in declaration order, so the encoding is deterministic
+	paramBytes, _ := json.Marshal(params)
+	h := sha256.New()
+	h.Write([]byte(model))
+	h.Write([]byte{0})
+	h.Write(paramBytes)
+	h.Write([]byte{0})
+	h.Write([]byte(prompt))
+	return hex.EncodeToString(h.Sum(nil))
+}
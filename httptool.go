@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// --- HTTP fetch tool ---
+
+// httpGetTool fetches an allow-listed URL. Responses are capped in size and
+// time, and HTML is reduced to its visible text so a product page costs a few
+// hundred tokens instead of its full markup.
+type httpGetTool struct {
+	client   *http.Client
+	allow    []string
+	maxBytes int64
+}
+
+func newHTTPGetTool(allow []string, timeout time.Duration, maxBytes int64) *httpGetTool {
+	return &httpGetTool{
+		client: &http.Client{
+			Timeout: timeout,
+			// Redirects are re-checked so an allow-listed URL can't bounce elsewhere.
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 5 {
+					return fmt.Errorf("stopped after %d redirects", len(via))
+				}
+				if !allowedURL(req.URL, allow) {
+					return fmt.Errorf("redirect to %s is not allow-listed", req.URL)
+				}
+				return nil
+			},
+		},
+		allow:    allow,
+		maxBytes: maxBytes,
+	}
+}
+
+// allowedURL reports whether target is on the scheme and host (port
+// included) of an allow-listed URL and under its path. URLs with credentials
+// or dot segments are never allowed, so neither shop.example.com@evil.com nor
+// shop.example.com.evil.net passes for https://shop.example.com.
+func allowedURL(target *url.URL, allow []string) bool {
+	if target.User != nil || target.Opaque != "" || target.Host == "" || slices.Contains(strings.Split(target.Path, "/"), "..") {
+		return false
+	}
+	for _, a := range allow {
+		base, err := url.Parse(a)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(target.Scheme, base.Scheme) && strings.EqualFold(hostPort(target), hostPort(base)) && underPrefix(target.Path, base.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostPort is the host of a URL with the default port of its scheme made explicit.
+func hostPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return u.Host
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		return u.Host + ":80"
+	case "https":
+		return u.Host + ":443"
+	}
+	return u.Host
+}
+
+// checkURLAllowList validates --agent_http_allow.
+func checkURLAllowList(allow []string) error {
+	for _, a := range allow {
+		u, err := url.Parse(a)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+			return fmt.Errorf("invalid entry %q (want http:// or https:// with a host and no credentials)", a)
+		}
+	}
+	return nil
+}
+
+func (t *httpGetTool) Name() string { return "http_get" }
+func (t *httpGetTool) Description() string {
+	return "fetch a web page as plain text; input is the URL"
+}
+
+func (t *httpGetTool) Call(ctx context.Context, input string) (string, error) {
+	u := strings.TrimSpace(input)
+	target, err := url.Parse(u)
+	if err != nil || !allowedURL(target, t.allow) {
+		return "", fmt.Errorf("%s is not allow-listed", u)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "text/html, text/plain;q=0.9, application/json;q=0.8")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s returned status %d", u, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, t.maxBytes+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", u, err)
+	}
+	truncated := int64(len(body)) > t.maxBytes
+	if truncated {
+		body = body[:t.maxBytes]
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	var text string
+	switch {
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		text = htmlToText(string(body))
+	case strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || mediaType == "":
+		text = string(body)
+	default:
+		return "", fmt.Errorf("GET %s returned unsupported content type %q", u, mediaType)
+	}
+	if truncated {
+		text += "\n[truncated]"
+	}
+	return text, nil
+}
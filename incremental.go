@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// --- Incremental input reads ---
+
+// A scheduled run regenerates every row of its input, including the ones the
+// last run already answered. Under --incremental it reads only the rows that
+// changed since the last completed run with the same input query and output
+// table:
+//
+//   - appends: rows appended to the tables the query reads, through the
+//     APPENDS table function;
+//   - changes: rows inserted or updated in them, through the CHANGES table
+//     function (the tables need enable_change_history, and the window ends 10
+//     minutes before launch, as CHANGES can't read more recent changes);
+//   - column: rows whose --incremental_column (e.g. updated_at) is in the
+//     window, for views and tables without change history.
+//
+// The appends and changes modes read every table of the query that way
+// unless --incremental_tables names the ones to (a dimension table the query
+// joins is then still read whole). The window runs from the end of the last
+// recorded one to the launch, and is recorded in --incremental_state_table of
+// the output dataset once the run completes; a failed or partial run records
+// nothing, so the next run reads its window again. The first run reads every
+// row up to the window end. Rows dead-lettered in a window are not read again;
+// replay them from the dead letter table. APPENDS and CHANGES only reach back
+// over the tables' time travel window (7 days by default), so a schedule
+// sparser than that needs the column mode.
+
+const (
+	incrementalAppends = "appends"
+	incrementalChanges = "changes"
+	incrementalColumn  = "column"
+
+	changesLag = 10 * time.Minute // How recent a change CHANGES can read
+)
+
+// IncrementalWindow is a row of --incremental_state_table, the window of
+// input changes one completed run read.
+type IncrementalWindow struct {
+	Source      string                 // Hash of the output table and input query
+	Mode        string                 // --incremental
+	RunID       string                 // --run_id
+	WindowStart bigquery.NullTimestamp // Null for the first run, which reads every row
+	WindowEnd   time.Time
+	CompletedAt time.Time
+}
+
+// checkIncrementalFlags validates --incremental and its companion flags.
+func checkIncrementalFlags() error {
+	switch *incrementalMode {
+	case "":
+		if *incrementalColumnFlag != "" || *incrementalTables != "" {
+			return fmt.Errorf("--incremental_column and --incremental_tables need --incremental")
+		}
+		return nil
+	case incrementalAppends, incrementalChanges:
+		if *incrementalColumnFlag != "" {
+			return fmt.Errorf("--incremental_column only applies to --incremental %s", incrementalColumn)
+		}
+	case incrementalColumn:
+		if !columnNamePattern.MatchString(*incrementalColumnFlag) {
+			return fmt.Errorf("--incremental %s needs an --incremental_column name, got %q", incrementalColumn, *incrementalColumnFlag)
+		}
+		if *incrementalTables != "" {
+			return fmt.Errorf("--incremental_tables only applies to --incremental %s and %s", incrementalAppends, incrementalChanges)
+		}
+	default:
+		return fmt.Errorf("%q (want %s, %s, or %s)", *incrementalMode, incrementalAppends, incrementalChanges, incrementalColumn)
+	}
+	for _, t := range splitList(*incrementalTables) {
+		if strings.Count(t, ".") != 1 || strings.Contains(t, "`") {
+			return fmt.Errorf("invalid --incremental_tables entry %q (want dataset.table)", t)
+		}
+	}
+	switch {
+	case *snapshotTime != "":
+		return fmt.Errorf("--snapshot_time already fixes what the run reads")
+	case !readsInputQuery():
+		return fmt.Errorf("it needs the BigQuery input query, not --local, streaming, sheet, file, or --pairs_table input")
+	}
+	return nil
+}
+
+// incrementalSource identifies the input whose windows the state table
+// records, so that runs of other queries or into other tables don't share
+// them.
+func incrementalSource(project, query string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%s.%s\x00%s", project, outputDataset, outputTable, query)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// incrementalQuery reads the end of the last recorded window and limits the
+// query to the changes since then. It returns the window to record once the
+// run completes.
+func incrementalQuery(ctx context.Context, inputProject, outputProject, query string) (IncrementalWindow, string, error) {
+	w := IncrementalWindow{
+		Source:    incrementalSource(outputProject, query),
+		Mode:      *incrementalMode,
+		RunID:     *runID,
+		WindowEnd: launchTime.UTC(),
+	}
+	if w.Mode == incrementalChanges {
+		w.WindowEnd = w.WindowEnd.Add(-changesLag)
+	}
+	last, err := lastIncrementalWindowEnd(ctx, outputProject, w.Source)
+	if err != nil {
+		return IncrementalWindow{}, "", err
+	}
+	if !last.IsZero() {
+		if !last.Before(w.WindowEnd) {
+			return IncrementalWindow{}, "", fmt.Errorf("the last recorded window already ends at %s", last.Format(time.RFC3339))
+		}
+		w.WindowStart = bigquery.NullTimestamp{Timestamp: last, Valid: true}
+	}
+	if w.Mode == incrementalColumn {
+		return w, columnWindowQuery(query, *incrementalColumnFlag, w), nil
+	}
+	client, err := bigquery.NewClient(ctx, inputProject)
+	if err != nil {
+		return IncrementalWindow{}, "", fmt.Errorf("failed to create bigquery client: %w", err)
+	}
+	defer client.Close()
+	tables, err := queryTables(ctx, client, query)
+	if err != nil {
+		return IncrementalWindow{}, "", err
+	}
+	only := make(map[string]bool)
+	for _, t := range splitList(*incrementalTables) {
+		only[t] = true
+	}
+	for _, t := range tables {
+		if len(only) > 0 && !only[t.DatasetID+"."+t.TableID] {
+			continue
+		}
+		rewritten, n := rewriteTableReads(query, t.ProjectID, t.DatasetID, t.TableID, func(ref, _ string) string {
+			return windowTableRead(ref, w)
+		})
+		if n == 0 {
+			return IncrementalWindow{}, "", fmt.Errorf("can't find table %s.%s.%s in the input query to read its changes; name it as `%[1]s.%[2]s.%[3]s`", t.ProjectID, t.DatasetID, t.TableID)
+		}
+		delete(only, t.DatasetID+"."+t.TableID)
+		query = rewritten
+	}
+	for t := range only {
+		return IncrementalWindow{}, "", fmt.Errorf("--incremental_tables names %s, which the input query doesn't read", t)
+	}
+	q := client.Query(query)
+	q.DryRun = true
+	if _, err := q.Run(ctx); err != nil {
+		return IncrementalWindow{}, "", fmt.Errorf("failed to dry-run the input query over the changed rows: %w", err)
+	}
+	return w, query, nil
+}
+
+// windowTableRead is what reads the window's rows of a table in place of the
+// reference: the table as of the window end on the first run, its appended
+// or changed rows (less deletions) on later ones.
+func windowTableRead(ref string, w IncrementalWindow) string {
+	end := timestampLiteral(w.WindowEnd)
+	if !w.WindowStart.Valid {
+		return ref + " FOR SYSTEM_TIME AS OF " + end
+	}
+	start := timestampLiteral(w.WindowStart.Timestamp)
+	if w.Mode == incrementalChanges {
+		return fmt.Sprintf("(SELECT * EXCEPT (_CHANGE_TYPE, _CHANGE_TIMESTAMP) FROM CHANGES(TABLE %s, %s, %s) WHERE _CHANGE_TYPE != 'DELETE')", ref, start, end)
+	}
+	return fmt.Sprintf("(SELECT * EXCEPT (_CHANGE_TYPE, _CHANGE_TIMESTAMP) FROM APPENDS(TABLE %s, %s, %s))", ref, start, end)
+}
+
+// columnWindowQuery keeps the rows of the query whose column is in the window.
+func columnWindowQuery(query, column string, w IncrementalWindow) string {
+	cond := fmt.Sprintf("TIMESTAMP(%s) < %s", column, timestampLiteral(w.WindowEnd))
+	if w.WindowStart.Valid {
+		cond = fmt.Sprintf("TIMESTAMP(%s) >= %s AND %s", column, timestampLiteral(w.WindowStart.Timestamp), cond)
+	}
+	return fmt.Sprintf("SELECT * FROM (\n%s\n) WHERE %s", query, cond)
+}
+
+// timestampLiteral renders t as a BigQuery TIMESTAMP literal.
+func timestampLiteral(t time.Time) string {
+	return fmt.Sprintf("TIMESTAMP '%s'", t.UTC().Format("2006-01-02 15:04:05.999999+00"))
+}
+
+// lastIncrementalWindowEnd returns the end of the last window recorded for
+// the source, zero when there is none.
+func lastIncrementalWindowEnd(ctx context.Context, project, source string) (time.Time, error) {
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to create bigquery client: %w", err)
+	}
+	defer client.Close()
+	table := client.Dataset(outputDataset).Table(*incrementalState)
+	if _, err := table.Metadata(ctx); err != nil {
+		if isBigQueryNotFound(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, fmt.Errorf("failed to look up %s: %w", *incrementalState, err)
+	}
+	q := client.Query(fmt.Sprintf("SELECT MAX(WindowEnd) AS WindowEnd FROM `%s.%s.%s` WHERE Source = @source", project, outputDataset, *incrementalState))
+	q.Parameters = []bigquery.QueryParameter{{Name: "source", Value: source}}
+	it, err := q.Read(ctx)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read %s: %w", *incrementalState, err)
+	}
+	var row struct {
+		WindowEnd bigquery.NullTimestamp
+	}
+	if err := it.Next(&row); err != nil && err != iterator.Done {
+		return time.Time{}, fmt.Errorf("failed to read %s: %w", *incrementalState, err)
+	}
+	return row.WindowEnd.Timestamp, nil
+}
+
+// recordIncrementalWindow adds the window of a completed run to the state
+// table, creating it on first use.
+func recordIncrementalWindow(ctx context.Context, project string, w IncrementalWindow) error {
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return fmt.Errorf("failed to create bigquery client: %w", err)
+	}
+	defer client.Close()
+	table := client.Dataset(outputDataset).Table(*incrementalState)
+	if _, err := table.Metadata(ctx); err != nil {
+		if !isBigQueryNotFound(err) {
+			return err
+		}
+		schema, err := bigquery.InferSchema(IncrementalWindow{})
+		if err != nil {
+			return fmt.Errorf("failed to infer incremental state schema: %w", err)
+		}
+		tm := &bigquery.TableMetadata{Schema: schema, Description: "Input windows read by completed --incremental runs"}
+		if *kmsKey != "" {
+			tm.EncryptionConfig = &bigquery.EncryptionConfig{KMSKeyName: *kmsKey}
+		}
+		if err := table.Create(ctx, tm); err != nil {
+			return fmt.Errorf("failed to create incremental state table: %w", err)
+		}
+		log.Printf("Created incremental state table %s", table.FullyQualifiedName())
+	}
+	w.CompletedAt = time.Now().UTC()
+	q := client.Query(fmt.Sprintf("INSERT INTO `%s.%s.%s` (Source, Mode, RunID, WindowStart, WindowEnd, CompletedAt) VALUES (@source, @mode, @run_id, @start, @end, @completed)", project, outputDataset, *incrementalState))
+	q.Parameters = []bigquery.QueryParameter{
+		{Name: "source", Value: w.Source},
+		{Name: "mode", Value: w.Mode},
+		{Name: "run_id", Value: w.RunID},
+		{Name: "start", Value: w.WindowStart},
+		{Name: "end", Value: w.WindowEnd},
+		{Name: "completed", Value: w.CompletedAt},
+	}
+	job, err := q.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to record incremental window: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record incremental window: %w", err)
+	}
+	return nil
+}
+
+// finishIncrementalRun records the window of the run unless it is partial.
+func finishIncrementalRun(ctx context.Context, project string, w IncrementalWindow, partial bool) {
+	if partial {
+		log.Printf("Incremental window not recorded as the run is partial; the next run reads it again.")
+		return
+	}
+	if err := recordIncrementalWindow(ctx, project, w); err != nil {
+		log.Printf("Warning: the next run reads this window again: %v", err)
+		return
+	}
+	log.Printf("Recorded incremental window ending %s in %s", w.WindowEnd.Format(time.RFC3339), *incrementalState)
+}
+
+// logIncrementalWindow adds the window of the run to the launch log.
+func logIncrementalWindow(w IncrementalWindow) {
+	if !w.WindowStart.Valid {
+		log.Printf("  Incremental: %s, first run (every row up to %s)", w.Mode, w.WindowEnd.Format(time.RFC3339))
+		return
+	}
+	log.Printf("  Incremental: %s, rows changed from %s to %s", w.Mode, w.WindowStart.Timestamp.Format(time.RFC3339), w.WindowEnd.Format(time.RFC3339))
+}
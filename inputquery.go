@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// --- Configurable input query ---
+
+// inputQuery is the prompt SQL of the run: defaultInputQuery unless
+// --input_query or --input_query_file replace it. Set by main.
+var inputQuery = defaultInputQuery
+
+// loadInputQuery resolves --input_query and --input_query_file. A custom query
+// is dry-run so one without a prompt column fails at launch rather than on the
+// workers.
+func loadInputQuery(ctx context.Context, project string) error {
+	query := *inputQueryFlag
+	switch {
+	case query != "" && *inputQueryFile != "":
+		return fmt.Errorf("--input_query and --input_query_file are mutually exclusive")
+	case *promptColumnBudgets != "" && *promptColumns == "":
+		return fmt.Errorf("--prompt_column_budgets needs --prompt_columns")
+	case *inputQueryFile != "":
+		b, err := readConfigFile(ctx, *inputQueryFile)
+		if err != nil {
+			return fmt.Errorf("failed to read --input_query_file: %w", err)
+		}
+		query = string(b)
+	}
+	if query = strings.TrimSpace(query); query == "" {
+		if *promptColumns != "" {
+			return fmt.Errorf("--prompt_columns needs --input_query or --input_query_file")
+		}
+		if rowTemplate != "" {
+			return fmt.Errorf("--prompt_template needs --input_query or --input_query_file")
+		}
+		return nil
+	}
+	if rowTemplate != "" {
+		if *promptColumns != "" {
+			return fmt.Errorf("--prompt_template and --prompt_columns are mutually exclusive")
+		}
+		if !readsInputQuery() {
+			return fmt.Errorf("--prompt_template only applies to prompts read with the input query")
+		}
+		query = templateColumnsQuery(query)
+	}
+	if columns := splitList(*promptColumns); len(columns) > 0 {
+		if !readsInputQuery() {
+			return fmt.Errorf("--prompt_columns only applies to prompts read with the input query")
+		}
+		budgets, err := parseColumnBudgets(splitList(*promptColumnBudgets), columns)
+		if err != nil {
+			return err
+		}
+		composed, err := composePromptQuery(query, columns, budgets, *promptColumnFormat, *promptColumnSeparator)
+		if err != nil {
+			return err
+		}
+		query = composed
+	}
+	if readsInputQuery() {
+		if err := checkPromptColumn(ctx, project, query); err != nil {
+			return err
+		}
+	}
+	inputQuery = query
+	return nil
+}
+
+// readsInputQuery reports whether the run reads its prompts with the input query.
+func readsInputQuery() bool {
+	switch {
+	case *localMode, documentInputEnabled(), streamingMode(), gcsInputEnabled():
+		return false
+	case *task == taskPairwise:
+		return *pairsTable == ""
+	}
+	return *inputSheetID == ""
+}
+
+// checkPromptColumn dry-runs the query and checks that it returns a STRING
+// column named prompt.
+func checkPromptColumn(ctx context.Context, project, sql string) error {
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return fmt.Errorf("failed to create bigquery client: %w", err)
+	}
+	defer client.Close()
+	q := client.Query(sql)
+	q.DryRun = true
+	job, err := q.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to dry-run input query: %w", err)
+	}
+	stats, ok := job.LastStatus().Statistics.Details.(*bigquery.QueryStatistics)
+	if !ok {
+		return fmt.Errorf("dry run of input query returned no query statistics")
+	}
+	for _, f := range stats.Schema {
+		if f.Name != "prompt" {
+			continue
+		}
+		if f.Type != bigquery.StringFieldType || f.Repeated {
+			return fmt.Errorf("input query column prompt is %s, want STRING", f.Type)
+		}
+		return nil
+	}
+	return fmt.Errorf("input query returns no prompt column")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+)
+
+// --- Answer length limits ---
+
+// Destinations with hard field-length limits set --min_chars and/or
+// --max_chars. An answer outside the limits is retried up to --length_retries
+// times with the limits and its own length spelled out; if no attempt fits,
+// the last one is dead-lettered with ErrorStatus LENGTH_VIOLATION instead of
+// being written. Length is counted in characters (Unicode code points) of the
+// answer as generated, before the --text_watermark marker is appended.
+
+// lengthRetry is the Mutation recorded when a length retry produced the answer.
+const lengthRetry = "length"
+
+// errLengthViolation marks answers dead-lettered for breaking the length limits.
+var errLengthViolation = errors.New("generated text is outside the length limits")
+
+// lengthViolation describes how text breaks the limits, or returns "" when it
+// fits. A zero limit is unset.
+func lengthViolation(text string, minChars, maxChars int) string {
+	n := utf8.RuneCountInString(text)
+	switch {
+	case minChars > 0 && n < minChars:
+		return fmt.Sprintf("%d characters, below the minimum of %d", n, minChars)
+	case maxChars > 0 && n > maxChars:
+		return fmt.Sprintf("%d characters, above the maximum of %d", n, maxChars)
+	}
+	return ""
+}
+
+// lengthInstruction is appended to the prompt for a length retry.
+func lengthInstruction(minChars, maxChars int, violation string) string {
+	var limit string
+	switch {
+	case minChars > 0 && maxChars > 0:
+		limit = fmt.Sprintf("between %d and %d characters long", minChars, maxChars)
+	case maxChars > 0:
+		limit = fmt.Sprintf("at most %d characters long", maxChars)
+	default:
+		limit = fmt.Sprintf("at least %d characters long", minChars)
+	}
+	return fmt.Sprintf("\n\nYour answer must be %s, counting spaces and punctuation. A previous answer was %s.", limit, violation)
+}
+
+// checkLength enforces MinChars and MaxChars, retrying up to LengthRetries
+// times. The first attempt that fits replaces the answer; when none does, the
+// violation of the last one is returned and the caller dead-letters it.
+func (fn *GenerateTextFn) checkLength(ctx context.Context, p Prompt, model string, params VertexParameters, out *vertexOutput) string {
+	if fn.MinChars <= 0 && fn.MaxChars <= 0 || out.Fallback {
+		return ""
+	}
+	violation := lengthViolation(out.Text, fn.MinChars, fn.MaxChars)
+	for i := 0; violation != "" && i < fn.LengthRetries; i++ {
+		fn.LengthRetryCounter.Inc(ctx, 1)
+		retry, err := fn.guardedPredict(ctx, model, p.Prompt+lengthInstruction(fn.MinChars, fn.MaxChars, violation), params)
+		if err != nil {
+			beamlog.Warnf(ctx, "GenerateTextFn: Length retry failed for prompt '%s': %v", fn.LogPolicy.redact(p.Prompt), err)
+			break
+		}
+		out.PromptTokens += retry.PromptTokens
+		out.OutputTokens += retry.OutputTokens
+		if violation = lengthViolation(retry.Text, fn.MinChars, fn.MaxChars); violation != "" {
+			continue
+		}
+		retry.Attempt, retry.Mutation = out.Attempt+i+1, lengthRetry
+		retry.PromptTokens, retry.OutputTokens = out.PromptTokens, out.OutputTokens
+		if fn.EntityCheck != entityCheckOff {
+			retry.MissingTerms = missingTerms(retry.Text, p.RequiredTerms)
+		}
+		*out = retry
+	}
+	return violation
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// --- Lexicon filters ---
+
+// lexiconConfig is the JSON file named by --lexicons:
+//
+//	{"categories": [
+//	   {"name": "profanity", "terms_file": "gs://bucket/profanity.txt", "action": "mask"},
+//	   {"name": "health_claims", "terms": ["cures", "treats", "clinically proven"], "action": "dlq"}
+//	 ]}
+//
+// Every answer is searched for the terms of each category, case-insensitively
+// and as whole words or phrases. terms_file (local or gs://, one term per line,
+// # for comments) adds to terms and is read by the launcher. What happens on a
+// hit depends on the category's action: flag (the default) records it in the
+// LexiconHits column, mask also overwrites the term with asterisks, and dlq
+// dead-letters the answer with ErrorStatus LEXICON_VIOLATION.
+type lexiconConfig struct {
+	Categories []lexiconCategory `json:"categories"`
+}
+
+type lexiconCategory struct {
+	Name      string   `json:"name"`
+	Terms     []string `json:"terms"`
+	TermsFile string   `json:"terms_file"`
+	Action    string   `json:"action"` // flag (default), mask, or dlq
+}
+
+// Lexicon actions.
+const (
+	lexiconActionFlag = "flag"
+	lexiconActionMask = "mask"
+	lexiconActionDLQ  = "dlq"
+)
+
+// errLexiconViolation marks answers dead-lettered by a dlq category.
+var errLexiconViolation = errors.New("generated text uses prohibited terms")
+
+// lexicons is loaded by main when --lexicons is set.
+var lexicons *lexiconConfig
+
+// loadLexicons reads the configuration and its terms files from a local path
+// or gs:// URI, and validates it.
+func loadLexicons(ctx context.Context, path string) (*lexiconConfig, error) {
+	raw, err := readConfigFile(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg lexiconConfig
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse lexicons %s: %w", path, err)
+	}
+	for i := range cfg.Categories {
+		c := &cfg.Categories[i]
+		if c.TermsFile == "" {
+			continue
+		}
+		raw, err := readConfigFile(ctx, c.TermsFile)
+		if err != nil {
+			return nil, fmt.Errorf("category %s: %w", c.Name, err)
+		}
+		for _, line := range strings.Split(string(raw), "\n") {
+			if t := strings.TrimSpace(line); t != "" && !strings.HasPrefix(t, "#") {
+				c.Terms = append(c.Terms, t)
+			}
+		}
+		c.TermsFile = "" // Workers get the terms inline
+	}
+	if _, err := cfg.compile(); err != nil {
+		return nil, fmt.Errorf("invalid lexicons %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// compiledLexicon is a category with its terms as one pattern.
+type compiledLexicon struct {
+	lexiconCategory
+	pattern *regexp.Regexp
+	hits    beam.Counter
+}
+
+// lexiconSet is the compiled configuration used by GenerateTextFn.
+type lexiconSet struct {
+	categories []*compiledLexicon
+}
+
+// compile builds each category's pattern. Per-category counters live in the
+// lexicons namespace, e.g. hits_total/profanity.
+func (c *lexiconConfig) compile() (*lexiconSet, error) {
+	ls := &lexiconSet{}
+	names := make(map[string]bool)
+	for i, cat := range c.Categories {
+		if cat.Name == "" || names[cat.Name] {
+			return nil, fmt.Errorf("category %d: name must be set and unique", i+1)
+		}
+		names[cat.Name] = true
+		switch cat.Action {
+		case "":
+			cat.Action = lexiconActionFlag
+		case lexiconActionFlag, lexiconActionMask, lexiconActionDLQ:
+		default:
+			return nil, fmt.Errorf("category %s: action must be %s, %s, or %s", cat.Name, lexiconActionFlag, lexiconActionMask, lexiconActionDLQ)
+		}
+		var terms []string
+		for _, t := range cat.Terms {
+			if t = strings.TrimSpace(t); t != "" {
+				terms = append(terms, regexp.QuoteMeta(t))
+			}
+		}
+		if len(terms) == 0 {
+			return nil, fmt.Errorf("category %s: no terms", cat.Name)
+		}
+		// Longest first, so a phrase wins over a term it starts with
+		sort.SliceStable(terms, func(i, j int) bool { return len(terms[i]) > len(terms[j]) })
+		ls.categories = append(ls.categories, &compiledLexicon{
+			lexiconCategory: cat,
+			pattern:         regexp.MustCompile(`(?i)(?:` + strings.Join(terms, "|") + `)`),
+			hits:            beam.NewCounter("lexicons", "hits_total/"+cat.Name),
+		})
+	}
+	return ls, nil
+}
+
+// check searches an answer for every category's terms. It returns the hits as
+// "category: term", the answer with mask categories applied, and whether one
+// of the hits came from a dlq category.
+func (ls *lexiconSet) check(ctx context.Context, text string) ([]string, string, bool) {
+	var hits []string
+	dlq := false
+	for _, c := range ls.categories {
+		spans := wordMatches(c.pattern, text)
+		if len(spans) == 0 {
+			continue
+		}
+		c.hits.Inc(ctx, 1)
+		seen := make(map[string]bool)
+		for _, sp := range spans {
+			term := strings.ToLower(text[sp[0]:sp[1]])
+			if !seen[term] {
+				seen[term] = true
+				hits = append(hits, c.Name+": "+term)
+			}
+		}
+		switch c.Action {
+		case lexiconActionMask:
+			text = maskSpans(text, spans)
+		case lexiconActionDLQ:
+			dlq = true
+		}
+	}
+	return hits, text, dlq
+}
+
+// wordMatches returns the matches of re that are whole words: not preceded or
+// followed by a letter, digit, or underscore.
+func wordMatches(re *regexp.Regexp, text string) [][]int {
+	var spans [][]int
+	for _, sp := range re.FindAllStringIndex(text, -1) {
+		before, _ := utf8.DecodeLastRuneInString(text[:sp[0]])
+		after, _ := utf8.DecodeRuneInString(text[sp[1]:])
+		if !isWordRune(before) && !isWordRune(after) {
+			spans = append(spans, sp)
+		}
+	}
+	return spans
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// maskSpans replaces every rune of the given (ordered, disjoint) spans with *.
+func maskSpans(text string, spans [][]int) string {
+	var b strings.Builder
+	last := 0
+	for _, sp := range spans {
+		b.WriteString(text[last:sp[0]])
+		b.WriteString(strings.Repeat("*", utf8.RuneCountInString(text[sp[0]:sp[1]])))
+		last = sp[1]
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
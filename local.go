@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	_ "modernc.org/sqlite" // Pure Go driver, registered as "sqlite"
+)
+
+// --- Local quickstart mode ---
+
+// Under --local the pipeline runs on the DirectRunner, reads prompts from a
+// local file, and writes results to local files, so prompt templates and
+// answer parsing can be tried end-to-end with nothing but Vertex AI
+// credentials. BigQuery-only sinks (spot checks, run metrics, views, ...) are
+// skipped.
+
+// Local file formats, chosen by extension.
+const (
+	localCSV    = "csv"
+	localJSONL  = "jsonl"
+	localSQLite = "sqlite" // Output only
+)
+
+// Tables written under a SQLite --local_output or --local_dead_letters.
+const (
+	localResultsTable     = "results"
+	localDeadLettersTable = "failed_calls"
+)
+
+// localFormat returns the format of a local file from its extension.
+func localFormat(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return localCSV, nil
+	case ".jsonl", ".ndjson":
+		return localJSONL, nil
+	case ".db", ".sqlite", ".sqlite3":
+		return localSQLite, nil
+	}
+	return "", fmt.Errorf("unsupported file type %q (want .csv, .jsonl, .db, or .sqlite)", filepath.Ext(path))
+}
+
+// validateLocalFlags checks the --local flags before anything is launched.
+func validateLocalFlags() error {
+	if *task != taskGenerate {
+		return fmt.Errorf("--local only supports --task=%s", taskGenerate)
+	}
+	if *inputSheetID != "" || *outputSheetID != "" || documentInputEnabled() {
+		return fmt.Errorf("--local replaces sheet and document input/output; drop those flags")
+	}
+	if *progressTable != "" {
+		return fmt.Errorf("--progress_table writes to BigQuery; drop it under --local")
+	}
+	if *localInput == "" || *localOutput == "" {
+		return fmt.Errorf("--local requires --local_input and --local_output")
+	}
+	if f, err := localFormat(*localInput); err != nil {
+		return fmt.Errorf("--local_input: %w", err)
+	} else if f == localSQLite {
+		return fmt.Errorf("--local_input must be a .csv or .jsonl file")
+	}
+	for name, path := range map[string]string{"--local_output": *localOutput, "--local_dead_letters": *localDeadLetters} {
+		if path == "" {
+			continue
+		}
+		if _, err := localFormat(path); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*ReadLocalFileFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*WriteLocalResultsFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*WriteLocalDeadLettersFn)(nil)).Elem())
+}
+
+// ReadLocalFileFn reads prompt rows from a CSV or JSONL file. CSV files have a
+// header row using the column names of the BigQuery input (`prompt` is
+// required; `items` and `required_terms` are comma-separated); JSONL objects
+// use the same names as keys, with arrays for the list columns. Rows without a
+// `sequence` are sequenced by their position in the file.
+type ReadLocalFileFn struct {
+	Path string
+}
+
+// localPromptRow is one JSONL input line.
+type localPromptRow struct {
+	Prompt        string   `json:"prompt"`
+	RowKey        string   `json:"row_key"`
+	Items         []string `json:"items"`
+	OrderingKey   string   `json:"ordering_key"`
+	Sequence      *int64   `json:"sequence"`
+	RequiredTerms []string `json:"required_terms"`
+	Locale        string   `json:"locale"`
+}
+
+func (fn *ReadLocalFileFn) ProcessElement(ctx context.Context, _ []byte, emit func(PromptFromBQ)) error {
+	f, err := os.Open(fn.Path)
+	if err != nil {
+		return fmt.Errorf("failed to open local input: %w", err)
+	}
+	defer f.Close()
+	format, err := localFormat(fn.Path)
+	if err != nil {
+		return err
+	}
+	if format == localJSONL {
+		return fn.readJSONL(f, emit)
+	}
+	return fn.readCSV(f, emit)
+}
+
+func (fn *ReadLocalFileFn) readCSV(r io.Reader, emit func(PromptFromBQ)) error {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", fn.Path, err)
+	}
+	if len(rows) == 0 {
+		return fmt.Errorf("%s is empty", fn.Path)
+	}
+	col := make(map[string]int)
+	for i, name := range rows[0] {
+		col[strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))] = i
+	}
+	if _, ok := col["prompt"]; !ok {
+		return fmt.Errorf("%s has no `prompt` header column", fn.Path)
+	}
+	cell := func(row []string, name string) string {
+		if i, ok := col[name]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+
+	for i, row := range rows[1:] {
+		p := PromptFromBQ{
+			Prompt:        cell(row, "prompt"),
+			RowKey:        cell(row, "row_key"),
+			Items:         splitList(cell(row, "items")),
+			OrderingKey:   cell(row, "ordering_key"),
+			Sequence:      int64(i),
+			RequiredTerms: splitList(cell(row, "required_terms")),
+		}
+		if p.Prompt == "" {
+			continue
+		}
+		if seq := cell(row, "sequence"); seq != "" {
+			if p.Sequence, err = strconv.ParseInt(strings.TrimSpace(seq), 10, 64); err != nil {
+				return fmt.Errorf("%s line %d: invalid sequence %q: %w", fn.Path, i+2, seq, err)
+			}
+		}
+		emit(p)
+	}
+	return nil
+}
+
+func (fn *ReadLocalFileFn) readJSONL(r io.Reader, emit func(PromptFromBQ)) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	for line := 1; sc.Scan(); line++ {
+		raw := bytes.TrimSpace(sc.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		var row localPromptRow
+		if err := json.Unmarshal(raw, &row); err != nil {
+			return fmt.Errorf("%s line %d: %w", fn.Path, line, err)
+		}
+		if row.Prompt == "" {
+			continue
+		}
+		p := PromptFromBQ{
+			Prompt:        row.Prompt,
+			RowKey:        row.RowKey,
+			Items:         row.Items,
+			OrderingKey:   row.OrderingKey,
+			Sequence:      int64(line - 1),
+			RequiredTerms: row.RequiredTerms,
+			Locale:        row.Locale,
+		}
+		if row.Sequence != nil {
+			p.Sequence = *row.Sequence
+		}
+		emit(p)
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", fn.Path, err)
+	}
+	return nil
+}
+
+// readLocalPrompts reads --local_input once, on the single DirectRunner worker.
+func readLocalPrompts(s beam.Scope) beam.PCollection {
+	s = s.Scope("ReadLocalFile")
+	return beam.ParDo(s, &ReadLocalFileFn{Path: *localInput}, beam.Impulse(s))
+}
+
+// WriteLocalResultsFn receives all results as a side input of a single impulse,
+// so the file is written (possibly with no rows) exactly once, and writes them
+// in input order.
+type WriteLocalResultsFn struct {
+	Path string
+}
+
+func (fn *WriteLocalResultsFn) ProcessElement(ctx context.Context, _ []byte, results func(*GeminiResult) bool) error {
+	var all []GeminiResult
+	var r GeminiResult
+	for results(&r) {
+		all = append(all, r)
+	}
+	sortResults(all)
+	records := make([]any, len(all))
+	for i := range all {
+		records[i] = all[i]
+	}
+	return writeLocalRecords(ctx, fn.Path, localResultsTable, reflect.TypeOf(GeminiResult{}), records)
+}
+
+// WriteLocalDeadLettersFn is WriteLocalResultsFn for failed calls.
+type WriteLocalDeadLettersFn struct {
+	Path string
+}
+
+func (fn *WriteLocalDeadLettersFn) ProcessElement(ctx context.Context, _ []byte, failed func(*FailedCall) bool) error {
+	var all []FailedCall
+	var fc FailedCall
+	for failed(&fc) {
+		all = append(all, fc)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].ParentKey != all[j].ParentKey {
+			return all[i].ParentKey < all[j].ParentKey
+		}
+		if all[i].SubIndex != all[j].SubIndex {
+			return all[i].SubIndex < all[j].SubIndex
+		}
+		return all[i].PromptHash < all[j].PromptHash
+	})
+	records := make([]any, len(all))
+	for i := range all {
+		records[i] = all[i]
+	}
+	return writeLocalRecords(ctx, fn.Path, localDeadLettersTable, reflect.TypeOf(FailedCall{}), records)
+}
+
+// writeLocalRecords writes rows of a struct type to a local file. CSV and
+// SQLite get one column per field, named like the BigQuery columns; JSONL gets
+// the rows as they are. CSV and JSONL files are replaced, while SQLite rows are
+// appended so runs can be compared by RunID.
+func writeLocalRecords(ctx context.Context, path, table string, t reflect.Type, records []any) error {
+	format, err := localFormat(path)
+	if err != nil {
+		return err
+	}
+	if format == localSQLite {
+		return writeSQLiteRecords(ctx, path, table, t, records)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if format == localJSONL {
+		enc := json.NewEncoder(w)
+		for _, rec := range records {
+			if err := enc.Encode(rec); err != nil {
+				return fmt.Errorf("failed to encode row for %s: %w", path, err)
+			}
+		}
+	} else {
+		cw := csv.NewWriter(w)
+		cols := localColumns(t)
+		header := make([]string, len(cols))
+		for i, c := range cols {
+			header[i] = c.Name
+		}
+		cw.Write(header)
+		for _, rec := range records {
+			v := reflect.ValueOf(rec)
+			row := make([]string, len(cols))
+			for i, c := range cols {
+				row[i] = fmt.Sprint(localValue(v.Field(c.Index)))
+			}
+			cw.Write(row)
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// localColumn is an exported field of a row type and its SQLite type.
+type localColumn struct {
+	Name  string
+	Index int
+	Type  string
+}
+
+func localColumns(t reflect.Type) []localColumn {
+	var cols []localColumn
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		typ := "TEXT"
+		switch f.Type.Kind() {
+		case reflect.Bool, reflect.Int, reflect.Int32, reflect.Int64:
+			typ = "INTEGER"
+		case reflect.Float32, reflect.Float64:
+			typ = "REAL"
+		}
+		cols = append(cols, localColumn{Name: f.Name, Index: i, Type: typ})
+	}
+	return cols
+}
+
+// localValue flattens a field for a CSV cell or SQLite column: times as
+// RFC 3339, string lists comma-separated, and nested records as JSON.
+func localValue(v reflect.Value) any {
+	switch x := v.Interface().(type) {
+	case time.Time:
+		return x.Format(time.RFC3339Nano)
+	case []string:
+		return strings.Join(x, ", ")
+	case bool:
+		if x {
+			return 1
+		}
+		return 0
+	}
+	switch v.Kind() {
+	case reflect.Struct, reflect.Slice, reflect.Map:
+		raw, _ := json.Marshal(v.Interface())
+		return string(raw)
+	}
+	return v.Interface()
+}
+
+// writeSQLiteRecords appends rows to a table, creating the database and the
+// table as needed.
+func writeSQLiteRecords(ctx context.Context, path, table string, t reflect.Type, records []any) error {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(10000)")
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer db.Close()
+
+	cols := localColumns(t)
+	defs := make([]string, len(cols))
+	names := make([]string, len(cols))
+	marks := make([]string, len(cols))
+	for i, c := range cols {
+		defs[i] = fmt.Sprintf("%q %s", c.Name, c.Type)
+		names[i] = strconv.Quote(c.Name)
+		marks[i] = "?"
+	}
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %q (%s)", table, strings.Join(defs, ", "))); err != nil {
+		return fmt.Errorf("failed to create table %s in %s: %w", table, path, err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to start writing %s: %w", path, err)
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %q (%s) VALUES (%s)", table, strings.Join(names, ", "), strings.Join(marks, ", ")))
+	if err != nil {
+		return fmt.Errorf("failed to prepare insert into %s (is the table from an older version? drop it or use a new file): %w", table, err)
+	}
+	defer stmt.Close()
+	for _, rec := range records {
+		v := reflect.ValueOf(rec)
+		args := make([]any, len(cols))
+		for i, c := range cols {
+			args[i] = localValue(v.Field(c.Index))
+		}
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			return fmt.Errorf("failed to insert into %s: %w", table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit %s: %w", path, err)
+	}
+	return nil
+}
+
+// writeLocalOutputs writes results and, when --local_dead_letters is set, the
+// failed calls of every model stage.
+func writeLocalOutputs(s beam.Scope, results beam.PCollection, model *modelStage) {
+	ss := s.Scope("WriteLocalResults")
+	beam.ParDo0(ss, &WriteLocalResultsFn{Path: *localOutput}, beam.Impulse(ss), beam.SideInput{Input: results})
+
+	if *localDeadLetters == "" || len(model.failures) == 0 {
+		return
+	}
+	ss = s.Scope("WriteLocalDeadLetters")
+	failed := beam.Flatten(ss, model.failures...)
+	beam.ParDo0(ss, &WriteLocalDeadLettersFn{Path: *localDeadLetters}, beam.Impulse(ss), beam.SideInput{Input: failed})
+}
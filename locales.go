@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+	"gopkg.in/yaml.v3"
+)
+
+// --- Localized prompt templates ---
+
+// Under --prompt_templates every input row is rendered through the template
+// of its locale column, so an international catalog can send each row an
+// instruction in its own language. The directory (local or gs://) holds one
+// <locale>.yaml per locale:
+//
+//	template: "Genera una etiqueta nutricional para {{.Prompt}}"
+//
+// The template is a text/template over the input row (PromptFromBQ), with the
+// template variables of templatevars.go. A file
+// may instead name another locale to use, e.g. fallback: es-419 in es-mx.yaml.
+// A row's locale resolves through those fallbacks, then the base language
+// (pt-BR falls back to pt), and finally --default_locale, which must have a
+// template. Locales are matched case-insensitively, with _ read as -.
+
+// localeTemplate is one <locale>.yaml file.
+type localeTemplate struct {
+	Template string `yaml:"template"`
+	Fallback string `yaml:"fallback"` // Locale to use instead when Template is empty
+}
+
+// localeCatalog maps normalized locales to their templates; nil when
+// --prompt_templates is unset. Set by main.
+var localeCatalog map[string]localeTemplate
+
+// normalizeLocale lowercases a locale and spells it with dashes.
+func normalizeLocale(l string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(l), "_", "-"))
+}
+
+// loadLocaleTemplates reads every .yaml or .yml file of dir.
+func loadLocaleTemplates(ctx context.Context, dir string) (map[string]localeTemplate, error) {
+	var files []string
+	if strings.HasPrefix(dir, "gs://") {
+		objects, err := listGCSFiles(ctx, strings.TrimSuffix(dir, "/")+"/")
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range objects {
+			files = append(files, o.URI)
+		}
+	} else {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.IsDir() {
+				files = append(files, path.Join(dir, e.Name()))
+			}
+		}
+	}
+
+	catalog := make(map[string]localeTemplate)
+	for _, f := range files {
+		ext := path.Ext(f)
+		if ext != ".yaml" && ext != ".yml" {
+			continue
+		}
+		raw, err := readConfigFile(ctx, f)
+		if err != nil {
+			return nil, err
+		}
+		var t localeTemplate
+		if err := yaml.Unmarshal(raw, &t); err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		locale := normalizeLocale(strings.TrimSuffix(path.Base(f), ext))
+		if _, dup := catalog[locale]; dup {
+			return nil, fmt.Errorf("%s: locale %q has more than one file", f, locale)
+		}
+		t.Fallback = normalizeLocale(t.Fallback)
+		catalog[locale] = t
+	}
+	if len(catalog) == 0 {
+		return nil, fmt.Errorf("no .yaml templates in %s", dir)
+	}
+	return catalog, nil
+}
+
+// validateLocaleCatalog parses every template and checks that fallbacks exist,
+// that they don't loop, and that the default locale has a template.
+func validateLocaleCatalog(catalog map[string]localeTemplate, defaultLocale string, vars map[string]string) error {
+	if catalog[defaultLocale].Template == "" {
+		return fmt.Errorf("no template for --default_locale %q", defaultLocale)
+	}
+	locales := make([]string, 0, len(catalog))
+	for l := range catalog {
+		locales = append(locales, l)
+	}
+	sort.Strings(locales)
+	for _, l := range locales {
+		t := catalog[l]
+		if t.Template != "" {
+			if _, err := parseLocaleTemplate(l, t.Template, vars); err != nil {
+				return fmt.Errorf("%s: %w", l, err)
+			}
+			continue
+		}
+		if _, ok := catalog[t.Fallback]; t.Fallback == "" || !ok {
+			return fmt.Errorf("%s: needs a template, or a fallback to a locale with a file", l)
+		}
+		seen := map[string]bool{}
+		for cur := l; catalog[cur].Template == ""; cur = catalog[cur].Fallback {
+			if seen[cur] {
+				return fmt.Errorf("%s: fallback chain loops at %q", l, cur)
+			}
+			seen[cur] = true
+		}
+	}
+	return nil
+}
+
+func parseLocaleTemplate(locale, text string, vars map[string]string) (*template.Template, error) {
+	return template.New(locale).Option("missingkey=error").Funcs(templateFuncs(vars)).Parse(text)
+}
+
+// resolveLocale returns the locale whose template renders a row of the given
+// locale: the first one with a template along its fallback chain, else def.
+func resolveLocale(catalog map[string]localeTemplate, locale, def string) string {
+	seen := map[string]bool{}
+	for cur := normalizeLocale(locale); cur != "" && !seen[cur]; {
+		seen[cur] = true
+		t, ok := catalog[cur]
+		switch {
+		case ok && t.Template != "":
+			return cur
+		case ok && t.Fallback != "":
+			cur = t.Fallback
+		default:
+			cur, _, _ = strings.Cut(cur, "-") // The base language; a bare language ends the chain
+		}
+	}
+	return def
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*LocalizePromptsFn)(nil)).Elem())
+}
+
+// LocalizePromptsFn renders each row's prompt through its locale's template.
+type LocalizePromptsFn struct {
+	Catalog       map[string]localeTemplate
+	DefaultLocale string
+	Vars          map[string]string // Template variables, see templatevars.go
+
+	templates map[string]*template.Template
+	fallbacks beam.Counter
+	failures  beam.Counter
+}
+
+func (fn *LocalizePromptsFn) Setup() error {
+	fn.templates = make(map[string]*template.Template, len(fn.Catalog))
+	for l, t := range fn.Catalog {
+		if t.Template == "" {
+			continue
+		}
+		tmpl, err := parseLocaleTemplate(l, t.Template, fn.Vars)
+		if err != nil {
+			return fmt.Errorf("locale %s: %w", l, err)
+		}
+		fn.templates[l] = tmpl
+	}
+	fn.fallbacks = beam.NewCounter("locale", "fallbacks_total")
+	fn.failures = beam.NewCounter("locale", "render_failures_total")
+	return nil
+}
+
+func (fn *LocalizePromptsFn) ProcessElement(ctx context.Context, row PromptFromBQ, emit func(PromptFromBQ)) {
+	locale := resolveLocale(fn.Catalog, row.Locale, fn.DefaultLocale)
+	if locale != normalizeLocale(row.Locale) {
+		fn.fallbacks.Inc(ctx, 1)
+	}
+	var b strings.Builder
+	if err := fn.templates[locale].Execute(&b, row); err != nil {
+		fn.failures.Inc(ctx, 1)
+		beamlog.Errorf(ctx, "LocalizePromptsFn: Dropping row %q, template %s failed: %v", row.RowKey, locale, err)
+		return
+	}
+	row.Prompt = b.String()
+	emit(row)
+}
+
+// localizeRows applies --prompt_templates to the rows read by readPrompts.
+func localizeRows(s beam.Scope, rows beam.PCollection) beam.PCollection {
+	if localeCatalog == nil {
+		return rows
+	}
+	return beam.ParDo(s.Scope("LocalizePrompts"), &LocalizePromptsFn{
+		Catalog:       localeCatalog,
+		DefaultLocale: normalizeLocale(*defaultLocale),
+		Vars:          templateVars,
+	}, rows)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"sync"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// --- Worker-local result cache ---
+
+// cachedGeneration is what the LRU remembers for one prompt hash.
+type cachedGeneration struct {
+	Out   vertexOutput
+	Model string // Model that produced Out (may differ from the configured one after an upgrade)
+}
+
+// resultLRU is a fixed-size, mutex-guarded LRU map from prompt hash to generation.
+// It short-circuits duplicate prompts within a worker's element stream and is
+// independent of any external cache.
+type resultLRU struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // Front is most recently used; values are *lruEntry
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key string
+	val cachedGeneration
+}
+
+func newResultLRU(size int) *resultLRU {
+	return &resultLRU{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *resultLRU) get(key string) (cachedGeneration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return cachedGeneration{}, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry).val, true
+}
+
+func (c *resultLRU) put(key string, val cachedGeneration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*lruEntry).val = val
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, val: val})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// All DoFn instances on a worker process share one cache so duplicates are caught
+// regardless of which bundle thread sees them.
+var (
+	workerLRUOnce sync.Once
+	workerLRU     *resultLRU
+)
+
+// sharedResultLRU returns the worker-wide cache, sized by the first caller.
+func sharedResultLRU(size int) *resultLRU {
+	workerLRUOnce.Do(func() {
+		workerLRU = newResultLRU(size)
+	})
+	return workerLRU
+}
+
+// logLRUHitRate reports how many prompts the worker caches answered.
+func logLRUHitRate(pr beam.PipelineResult) {
+	t := counterTotals(pr, "vertexai")
+	hits, misses := t["lru_hits_total"], t["lru_misses_total"]
+	if hits+misses == 0 {
+		return
+	}
+	log.Printf("Worker LRU cache: %d hits / %d lookups (%.1f%% hit rate).", hits, hits+misses, 100*float64(hits)/float64(hits+misses))
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"golang.org/x/net/html"
+)
+
+// --- Markup to text ---
+
+// Input formats for --input_markup.
+const (
+	markupHTML     = "html"
+	markupMarkdown = "markdown"
+)
+
+// htmlSkipped are elements whose content is never visible text.
+var htmlSkipped = map[string]bool{
+	"script": true, "style": true, "noscript": true, "template": true,
+	"svg": true, "iframe": true, "head": true,
+}
+
+// htmlBlocks are elements that start a new line of text.
+var htmlBlocks = map[string]bool{
+	"p": true, "div": true, "br": true, "li": true, "tr": true, "section": true, "article": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"table": true, "ul": true, "ol": true, "dt": true, "dd": true, "header": true, "footer": true,
+}
+
+// markupOptions is the configurable part of the conversion.
+type markupOptions struct {
+	SkipTags  []string // Elements dropped with their content, on top of htmlSkipped
+	KeepLinks bool     // Render links as "text (url)" instead of just their text
+}
+
+func (o markupOptions) skipped(tag string) bool {
+	if htmlSkipped[tag] {
+		return true
+	}
+	for _, t := range o.SkipTags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// htmlToText extracts the page title and visible text, one block per line.
+func htmlToText(doc string) string {
+	return markupOptions{}.htmlText(doc)
+}
+
+// htmlText is htmlToText under these options. The tokenizer never fails on
+// malformed markup; it just stops at the end of input, which also makes it
+// safe on documents cut off by a size cap.
+func (o markupOptions) htmlText(doc string) string {
+	var lines []string
+	var line strings.Builder
+	flush := func() {
+		if s := strings.Join(strings.Fields(line.String()), " "); s != "" {
+			lines = append(lines, s)
+		}
+		line.Reset()
+	}
+
+	z := html.NewTokenizer(strings.NewReader(doc))
+	skip := 0
+	inTitle := false
+	href := ""
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			flush()
+			return strings.Join(lines, "\n")
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			name, hasAttr := z.TagName()
+			tag := string(name)
+			if tag == "title" {
+				inTitle = tt == html.StartTagToken
+				flush()
+				continue
+			}
+			if o.skipped(tag) && tt != html.SelfClosingTagToken {
+				if tt == html.StartTagToken {
+					skip++
+				} else if skip > 0 {
+					skip--
+				}
+				continue
+			}
+			if tag == "a" && o.KeepLinks && skip == 0 {
+				if tt == html.StartTagToken {
+					href = ""
+					for more := hasAttr; more; {
+						var key, val []byte
+						key, val, more = z.TagAttr()
+						if string(key) == "href" {
+							href = string(val)
+						}
+					}
+				} else if tt == html.EndTagToken && href != "" {
+					line.WriteString("(" + href + ") ")
+					href = ""
+				}
+			}
+			if htmlBlocks[tag] {
+				flush()
+			}
+		case html.TextToken:
+			if skip > 0 && !inTitle {
+				continue
+			}
+			line.Write(z.Text())
+			line.WriteByte(' ')
+		}
+	}
+}
+
+// Markdown syntax removed by markdownText, applied in order.
+var (
+	mdFence      = regexp.MustCompile("(?m)^[ \\t]*(```|~~~).*$\n?")
+	mdRule       = regexp.MustCompile(`(?m)^[ \t]*([-*_=][ \t]*){3,}$`)
+	mdHeading    = regexp.MustCompile(`(?m)^[ \t]{0,3}#{1,6}[ \t]+(.*?)[ \t]*#*[ \t]*$`)
+	mdQuote      = regexp.MustCompile(`(?m)^[ \t]*>[ \t]?`)
+	mdImage      = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	mdLink       = regexp.MustCompile(`\[([^\]]+)\]\(\s*([^)\s]+)[^)]*\)`)
+	mdBold       = regexp.MustCompile(`(\*\*|__)([^*_\n]+)(\*\*|__)`)
+	mdItalicStar = regexp.MustCompile(`\*([^*\n]+)\*`)
+	mdItalicLine = regexp.MustCompile(`(^|[^\w])_([^_\n]+)_([^\w]|$)`)
+	mdStrike     = regexp.MustCompile(`~~([^~\n]+)~~`)
+	mdCode       = regexp.MustCompile("`([^`\n]+)`")
+	mdBlankLines = regexp.MustCompile(`\n{3,}`)
+)
+
+// markdownText strips Markdown syntax, keeping the text of headings, links,
+// emphasis, and code. Embedded HTML goes through htmlText. Underscores inside
+// words (snake_case identifiers) are left alone.
+func (o markupOptions) markdownText(doc string) string {
+	doc = mdFence.ReplaceAllString(doc, "")
+	doc = mdRule.ReplaceAllString(doc, "")
+	doc = mdHeading.ReplaceAllString(doc, "$1")
+	doc = mdQuote.ReplaceAllString(doc, "")
+	doc = mdImage.ReplaceAllString(doc, "$1")
+	if o.KeepLinks {
+		doc = mdLink.ReplaceAllString(doc, "$1 ($2)")
+	} else {
+		doc = mdLink.ReplaceAllString(doc, "$1")
+	}
+	doc = mdBold.ReplaceAllString(doc, "$2")
+	doc = mdItalicStar.ReplaceAllString(doc, "$1")
+	doc = mdItalicLine.ReplaceAllString(doc, "$1$2$3")
+	doc = mdStrike.ReplaceAllString(doc, "$1")
+	doc = mdCode.ReplaceAllString(doc, "$1")
+	if strings.Contains(doc, "<") {
+		// Keep line breaks through the HTML pass, which only breaks at block elements
+		doc = o.htmlText(strings.ReplaceAll(doc, "\n", "<br>"))
+	}
+	return strings.TrimSpace(mdBlankLines.ReplaceAllString(doc, "\n\n"))
+}
+
+// text converts a document in the given format.
+func (o markupOptions) text(format, doc string) string {
+	switch format {
+	case markupHTML:
+		return o.htmlText(doc)
+	case markupMarkdown:
+		return o.markdownText(doc)
+	}
+	return doc
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*StripMarkupFn)(nil)).Elem())
+}
+
+// StripMarkupFn converts the prompt column (and fan-out items) of input rows
+// to plain text before they are formatted or templated, so markup neither
+// costs tokens nor smuggles hidden instructions into the prompt.
+type StripMarkupFn struct {
+	Format    string // html or markdown
+	SkipTags  []string
+	KeepLinks bool
+}
+
+func (fn *StripMarkupFn) ProcessElement(ctx context.Context, row PromptFromBQ, emit func(PromptFromBQ)) {
+	opts := markupOptions{SkipTags: fn.SkipTags, KeepLinks: fn.KeepLinks}
+	row.Prompt = opts.text(fn.Format, row.Prompt)
+	if len(row.Items) > 0 {
+		items := make([]string, len(row.Items))
+		for i, item := range row.Items {
+			items[i] = opts.text(fn.Format, item)
+		}
+		row.Items = items
+	}
+	emit(row)
+}
+
+// stripMarkup applies --input_markup to the rows read by readPrompts.
+func stripMarkup(s beam.Scope, rows beam.PCollection) beam.PCollection {
+	if *inputMarkup == "" {
+		return rows
+	}
+	return beam.ParDo(s.Scope("StripMarkup"), &StripMarkupFn{
+		Format:    *inputMarkup,
+		SkipTags:  splitList(*markupSkipTags),
+		KeepLinks: *markupKeepLinks,
+	}, rows)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+)
+
+// --- Numeric sanity bounds ---
+
+// percentLabel bounds every number written as a percentage.
+const percentLabel = "%"
+
+// numericRetry is the Mutation recorded when the bounds retry produced the answer.
+const numericRetry = "numeric_bounds"
+
+// errOutOfRange marks answers dead-lettered for failing --numeric_bounds.
+var errOutOfRange = errors.New("generated values are out of range")
+
+// numberPattern matches a number, with optional sign, thousands separators, and decimals.
+const numberPattern = `(-?(?:\d{1,3}(?:,\d{3})+|\d+)(?:\.\d+)?)`
+
+// numericBound is one --numeric_bounds entry: every value reported for Label
+// must lie within [Min, Max].
+type numericBound struct {
+	Label    string
+	Min, Max float64
+	pattern  *regexp.Regexp
+}
+
+// parseNumericBounds parses "label=min:max" entries, e.g. "calories=0:2000,%=0:100".
+// A label matches case-insensitively as a whole word, followed by its value within
+// a few characters ("Calories: 250", "calories 250 kcal"); "%" matches any percentage.
+func parseNumericBounds(entries []string) ([]numericBound, error) {
+	var bounds []numericBound
+	for _, e := range entries {
+		label, rng, ok := strings.Cut(e, "=")
+		lo, hi, ok2 := strings.Cut(rng, ":")
+		label = strings.TrimSpace(label)
+		min, err1 := strconv.ParseFloat(strings.TrimSpace(lo), 64)
+		max, err2 := strconv.ParseFloat(strings.TrimSpace(hi), 64)
+		if !ok || !ok2 || label == "" || err1 != nil || err2 != nil || min > max {
+			return nil, fmt.Errorf("invalid numeric bound %q (want label=min:max)", e)
+		}
+		b := numericBound{Label: label, Min: min, Max: max, pattern: labelPattern(label)}
+		if label == percentLabel {
+			b.pattern = regexp.MustCompile(numberPattern + `\s*%`)
+		}
+		bounds = append(bounds, b)
+	}
+	return bounds, nil
+}
+
+// labelPattern matches a labelled value in free text, capturing the number.
+func labelPattern(label string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)\b` + regexp.QuoteMeta(label) + `\b[^0-9\n-]{0,20}` + numberPattern)
+}
+
+// parseNumber parses a number matched by numberPattern.
+func parseNumber(s string) (float64, error) {
+	return strconv.ParseFloat(strings.ReplaceAll(s, ",", ""), 64)
+}
+
+// boundViolations lists every value in text that falls outside its bound.
+func boundViolations(text string, bounds []numericBound) []string {
+	var violations []string
+	for _, b := range bounds {
+		for _, m := range b.pattern.FindAllStringSubmatch(text, -1) {
+			v, err := parseNumber(m[1])
+			if err == nil && (v < b.Min || v > b.Max) {
+				violations = append(violations, fmt.Sprintf("%s=%s outside %g:%g", b.Label, m[1], b.Min, b.Max))
+			}
+		}
+	}
+	return violations
+}
+
+// checkBounds validates the numbers in an answer. An out-of-range answer gets
+// one retry that points out the offending values when NumericRetry is set;
+// the violations of the answer finally kept are returned, and the caller
+// dead-letters it rather than writing it.
+func (fn *GenerateTextFn) checkBounds(ctx context.Context, p Prompt, model string, params VertexParameters, out *vertexOutput) []string {
+	if len(fn.numericBounds) == 0 {
+		return nil
+	}
+	violations := boundViolations(out.Text, fn.numericBounds)
+	if len(violations) == 0 || !fn.NumericRetry {
+		return violations
+	}
+	fn.NumericRetryCounter.Inc(ctx, 1)
+	note := "\n\nA previous answer to this request had implausible figures (" + strings.Join(violations, "; ") + "). Double-check every number before answering."
+	retry, err := fn.guardedPredict(ctx, model, p.Prompt+note, params)
+	if err != nil {
+		beamlog.Warnf(ctx, "GenerateTextFn: Numeric bounds retry failed for prompt '%s': %v", fn.LogPolicy.redact(p.Prompt), err)
+		return violations
+	}
+	out.PromptTokens += retry.PromptTokens
+	out.OutputTokens += retry.OutputTokens
+	retryViolations := boundViolations(retry.Text, fn.numericBounds)
+	if len(retryViolations) > 0 {
+		return retryViolations
+	}
+	retry.Attempt, retry.Mutation = out.Attempt+1, numericRetry
+	retry.PromptTokens, retry.OutputTokens = out.PromptTokens, out.OutputTokens
+	retry.MissingTerms = missingTerms(retry.Text, p.RequiredTerms)
+	*out = retry
+	return nil
+}
+
+// invalidAnswerCall dead-letters an answer that failed validation. The status
+// says which check rejected it.
+func (fn *GenerateTextFn) invalidAnswerCall(p Prompt, promptHash, model string, out vertexOutput, status string, err error) FailedCall {
+	fc := fn.failedCall(p, promptHash, model, err)
+	fc.ErrorStatus = status
+	fc.VertexProject = out.Project
+	fc.RequestID = out.RequestID
+	return fc
+}
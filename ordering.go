@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/bigqueryio"
+)
+
+// --- Per-key output ordering ---
+
+// Inputs may carry an `ordering_key` and a `sequence` column. Results keep both,
+// and when an ordered table is configured the fragments of each key are
+// reassembled in sequence order, e.g. chapters of one generated document.
+
+// OrderedFragment is one generated fragment inside an OrderedDocument.
+type OrderedFragment struct {
+	Sequence      int64  `beam:"Sequence"`
+	SubIndex      int    `beam:"SubIndex"`
+	GeneratedText string `beam:"GeneratedText"`
+}
+
+// OrderedDocument holds every fragment generated for one ordering key, in order.
+type OrderedDocument struct {
+	RunID       string            `beam:"RunID"`
+	OrderingKey string            `beam:"OrderingKey"`
+	Fragments   []OrderedFragment `beam:"Fragments"`
+	Text        string            `beam:"Text"` // Fragments joined with --ordered_separator
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*OrderedDocument)(nil)).Elem())
+	beam.RegisterFunction(keyByOrderingKey)
+	beam.RegisterType(reflect.TypeOf((*AssembleOrderedFn)(nil)).Elem())
+}
+
+// lessInSequence orders results by ordering key, then sequence, then fan-out position.
+func lessInSequence(a, b GeminiResult) bool {
+	if a.OrderingKey != b.OrderingKey {
+		return a.OrderingKey < b.OrderingKey
+	}
+	if a.Sequence != b.Sequence {
+		return a.Sequence < b.Sequence
+	}
+	return a.SubIndex < b.SubIndex
+}
+
+// keyByOrderingKey drops results without an ordering key and keys the rest.
+func keyByOrderingKey(r GeminiResult, emit func(string, GeminiResult)) {
+	if r.OrderingKey != "" {
+		emit(r.OrderingKey, r)
+	}
+}
+
+// AssembleOrderedFn sorts each key's results by sequence and joins their text.
+type AssembleOrderedFn struct {
+	RunID     string
+	Separator string
+}
+
+func (fn *AssembleOrderedFn) ProcessElement(key string, results func(*GeminiResult) bool, emit func(OrderedDocument)) {
+	var all []GeminiResult
+	var r GeminiResult
+	for results(&r) {
+		all = append(all, r)
+	}
+	sort.Slice(all, func(i, j int) bool { return lessInSequence(all[i], all[j]) })
+
+	doc := OrderedDocument{RunID: fn.RunID, OrderingKey: key}
+	texts := make([]string, 0, len(all))
+	for _, r := range all {
+		doc.Fragments = append(doc.Fragments, OrderedFragment{Sequence: r.Sequence, SubIndex: r.SubIndex, GeneratedText: r.GeneratedText})
+		texts = append(texts, r.GeneratedText)
+	}
+	doc.Text = strings.Join(texts, fn.Separator)
+	emit(doc)
+}
+
+// writeOrderedDocuments reassembles keyed results in sequence order when a table is configured.
+func writeOrderedDocuments(s beam.Scope, projectID string, results beam.PCollection) {
+	if *orderedTable == "" {
+		return
+	}
+	s = s.Scope("AssembleOrdered")
+	grouped := beam.GroupByKey(s, beam.ParDo(s, keyByOrderingKey, results))
+	docs := beam.ParDo(s, &AssembleOrderedFn{RunID: *runID, Separator: *orderedSeparator}, grouped)
+	tableName := fmt.Sprintf("%s:%s.%s", projectID, outputDataset, *orderedTable)
+	bigqueryio.Write(s, projectID, tableName, docs)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// --- Output format conversion ---
+
+// Formats for --output_formats, each filling its own result column.
+const (
+	outputFormatHTML = "html" // GeneratedHTML
+	outputFormatText = "text" // GeneratedPlainText
+)
+
+// validOutputFormats reports whether every entry is a known format.
+func validOutputFormats(formats []string) bool {
+	for _, f := range formats {
+		if f != outputFormatHTML && f != outputFormatText {
+			return false
+		}
+	}
+	return true
+}
+
+// formatOutput fills the converted columns from GeneratedText as stored, so a
+// watermark (if any) carries over into them.
+func (fn *GenerateTextFn) formatOutput(res *GeminiResult) {
+	convertOutput(res, fn.OutputFormats)
+}
+
+// convertOutput renders GeneratedText into the columns of the given formats.
+func convertOutput(res *GeminiResult, formats []string) {
+	for _, f := range formats {
+		switch f {
+		case outputFormatHTML:
+			res.GeneratedHTML = markdownToHTML(res.GeneratedText)
+		case outputFormatText:
+			res.GeneratedPlainText = markupOptions{}.markdownText(res.GeneratedText)
+		}
+	}
+}
+
+// Block-level Markdown recognized by markdownToHTML.
+var (
+	mdHTMLHeading = regexp.MustCompile(`^[ \t]{0,3}(#{1,6})[ \t]+(.*?)[ \t]*#*[ \t]*$`)
+	mdHTMLBullet  = regexp.MustCompile(`^[ \t]*[-*+][ \t]+(.*)$`)
+	mdHTMLOrdered = regexp.MustCompile(`^[ \t]*\d+[.)][ \t]+(.*)$`)
+	mdHTMLQuote   = regexp.MustCompile(`^[ \t]*>[ \t]?(.*)$`)
+	mdHTMLFence   = regexp.MustCompile("^[ \t]*(```|~~~)")
+)
+
+// Inline Markdown, matched against already-escaped text.
+var (
+	mdHTMLBold   = regexp.MustCompile(`(\*\*|__)([^*_]+)(\*\*|__)`)
+	mdHTMLEmStar = regexp.MustCompile(`\*([^*]+)\*`)
+	mdHTMLEmLine = regexp.MustCompile(`(^|[^\w])_([^_]+)_([^\w]|$)`)
+	mdHTMLStrike = regexp.MustCompile(`~~([^~]+)~~`)
+	mdHTMLImage  = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	mdHTMLLink   = regexp.MustCompile(`\[([^\]]+)\]\(\s*([^)\s]+)[^)]*\)`)
+)
+
+// markdownToHTML renders the Markdown a model typically produces: headings,
+// paragraphs, lists, block quotes, fenced code, emphasis, and links. Output is
+// safe to embed as-is: all text is escaped, so raw HTML in the answer shows up
+// as text, images are reduced to their alt text, and only http, https, and
+// mailto links are kept.
+func markdownToHTML(md string) string {
+	var b strings.Builder
+	var para []string
+	list := "" // "ul" or "ol" while a list is open
+	quote := false
+	code := false
+
+	closeBlocks := func() {
+		if len(para) > 0 {
+			b.WriteString("<p>" + renderInline(strings.Join(para, " ")) + "</p>\n")
+			para = nil
+		}
+		if list != "" {
+			b.WriteString("</" + list + ">\n")
+			list = ""
+		}
+		if quote {
+			b.WriteString("</blockquote>\n")
+			quote = false
+		}
+	}
+
+	for _, line := range strings.Split(strings.ReplaceAll(md, "\r\n", "\n"), "\n") {
+		if mdHTMLFence.MatchString(line) {
+			if code {
+				b.WriteString("</code></pre>\n")
+			} else {
+				closeBlocks()
+				b.WriteString("<pre><code>")
+			}
+			code = !code
+			continue
+		}
+		if code {
+			b.WriteString(html.EscapeString(line) + "\n")
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			closeBlocks()
+			continue
+		}
+		if mdRule.MatchString(line) && !strings.Contains(line, "=") {
+			closeBlocks()
+			b.WriteString("<hr>\n")
+			continue
+		}
+		if m := mdHTMLHeading.FindStringSubmatch(line); m != nil {
+			closeBlocks()
+			fmt.Fprintf(&b, "<h%d>%s</h%d>\n", len(m[1]), renderInline(m[2]), len(m[1]))
+			continue
+		}
+		if m := mdHTMLQuote.FindStringSubmatch(line); m != nil {
+			if !quote {
+				closeBlocks()
+				b.WriteString("<blockquote>\n")
+				quote = true
+			}
+			para = append(para, m[1])
+			continue
+		}
+		item, kind := "", ""
+		if m := mdHTMLBullet.FindStringSubmatch(line); m != nil {
+			item, kind = m[1], "ul"
+		} else if m := mdHTMLOrdered.FindStringSubmatch(line); m != nil {
+			item, kind = m[1], "ol"
+		}
+		if kind != "" {
+			if list != kind {
+				closeBlocks()
+				b.WriteString("<" + kind + ">\n")
+				list = kind
+			}
+			b.WriteString("<li>" + renderInline(item) + "</li>\n")
+			continue
+		}
+		if list != "" || quote {
+			closeBlocks()
+		}
+		para = append(para, strings.TrimSpace(line))
+	}
+	if code {
+		b.WriteString("</code></pre>\n")
+	}
+	closeBlocks()
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// renderInline escapes a line of text and renders its inline Markdown. Code
+// spans are split out first so their contents are left alone.
+func renderInline(text string) string {
+	parts := strings.Split(text, "`")
+	var b strings.Builder
+	for i, part := range parts {
+		switch {
+		case i%2 == 1 && i < len(parts)-1:
+			b.WriteString("<code>" + html.EscapeString(part) + "</code>")
+		case i%2 == 1:
+			b.WriteString("`" + renderSpans(part)) // Unmatched backtick
+		default:
+			b.WriteString(renderSpans(part))
+		}
+	}
+	return b.String()
+}
+
+// renderSpans renders links and emphasis. Emphasis is applied around links and
+// within their text, never to their targets.
+func renderSpans(text string) string {
+	s := mdHTMLImage.ReplaceAllString(html.EscapeString(text), "$1")
+	var b strings.Builder
+	last := 0
+	for _, m := range mdHTMLLink.FindAllStringSubmatchIndex(s, -1) {
+		b.WriteString(renderEmphasis(s[last:m[0]]))
+		label, target := renderEmphasis(s[m[2]:m[3]]), s[m[4]:m[5]]
+		if safeLinkURL(html.UnescapeString(target)) {
+			b.WriteString(`<a href="` + target + `" rel="nofollow noopener">` + label + "</a>")
+		} else {
+			b.WriteString(label)
+		}
+		last = m[1]
+	}
+	b.WriteString(renderEmphasis(s[last:]))
+	return b.String()
+}
+
+func renderEmphasis(s string) string {
+	s = mdHTMLBold.ReplaceAllString(s, "<strong>$2</strong>")
+	s = mdHTMLEmStar.ReplaceAllString(s, "<em>$1</em>")
+	s = mdHTMLEmLine.ReplaceAllString(s, "$1<em>$2</em>$3")
+	return mdHTMLStrike.ReplaceAllString(s, "<del>$1</del>")
+}
+
+// safeLinkURL reports whether a link target may be rendered as an anchor.
+func safeLinkURL(u string) bool {
+	u = strings.ToLower(strings.TrimSpace(u))
+	return strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "mailto:")
+}
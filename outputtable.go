@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/bigqueryio"
+)
+
+// --- Output dataset and table ---
+
+// outputDataset and outputTable locate the results table; every other table
+// the run writes lives in outputDataset too. main sets them from
+// --output_dataset and --output_table before the graph is built; workers
+// only see what the launcher passes to their DoFns.
+var (
+	outputDataset = "sandboxdataset"
+	outputTable   = "gemini_dataflow_results"
+)
+
+// Values of --create_disposition, as in the BigQuery API.
+const (
+	createIfNeeded = "CREATE_IF_NEEDED"
+	createNever    = "CREATE_NEVER"
+)
+
+var errResultsTableMissing = errors.New("results table does not exist and --create_disposition is " + createNever)
+
+var errSchemaConflict = errors.New("table doesn't match this version's rows")
+
+// parseCreateDisposition maps --create_disposition to its BigQuery value.
+func parseCreateDisposition(v string) (bigquery.TableCreateDisposition, error) {
+	switch strings.ToUpper(v) {
+	case createIfNeeded:
+		return bigquery.CreateIfNeeded, nil
+	case createNever:
+		return bigquery.CreateNever, nil
+	}
+	return "", fmt.Errorf("%q: want %s or %s", v, createIfNeeded, createNever)
+}
+
+// resultsCreateDisposition applies --create_disposition to the results sink.
+func resultsCreateDisposition() bigqueryio.WriteOption {
+	cd, err := parseCreateDisposition(*createDisposition)
+	if err != nil {
+		cd = bigquery.CreateIfNeeded // main has rejected invalid values
+	}
+	return bigqueryio.WithCreateDisposition(cd)
+}
+
+// ensureResultsTable creates the results table with the GeminiResult schema
+// when it does not exist and --create_disposition allows it, partitioned on
+// GeneratedAt and clustered by PromptHash when asked to. Creating it here
+// rather than on the first write is what makes the partitioning possible; under
+// CREATE_NEVER a missing table fails the launch instead of the job, with
+// errResultsTableMissing. An existing table gets the columns added to
+// GeminiResult since it was created, see addMissingColumns.
+func ensureResultsTable(ctx context.Context, project string) error {
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return fmt.Errorf("failed to create bigquery client: %w", err)
+	}
+	defer client.Close()
+
+	schema, err := bigquery.InferSchema(GeminiResult{})
+	if err != nil {
+		return fmt.Errorf("failed to infer results schema: %w", err)
+	}
+	table := client.Dataset(outputDataset).Table(outputTable)
+	md, err := table.Metadata(ctx)
+	if err == nil {
+		return addMissingColumns(ctx, table, md, schema)
+	}
+	if !isBigQueryNotFound(err) {
+		return err
+	}
+	if cd, _ := parseCreateDisposition(*createDisposition); cd == bigquery.CreateNever {
+		return fmt.Errorf("%s: %w", table.FullyQualifiedName(), errResultsTableMissing)
+	}
+	tm := &bigquery.TableMetadata{Schema: schema, Description: "One model answer per prompt"}
+	if *outputPartitioning != "" {
+		tm.TimePartitioning = &bigquery.TimePartitioning{Type: bigquery.TimePartitioningType(strings.ToUpper(*outputPartitioning)), Field: "GeneratedAt"}
+	}
+	if *outputClusterByHash {
+		tm.Clustering = &bigquery.Clustering{Fields: []string{"PromptHash"}}
+	}
+	if *kmsKey != "" {
+		tm.EncryptionConfig = &bigquery.EncryptionConfig{KMSKeyName: *kmsKey}
+	}
+	if err := table.Create(ctx, tm); err != nil {
+		return fmt.Errorf("failed to create results table: %w", err)
+	}
+	log.Printf("Created results table %s", table.FullyQualifiedName())
+	return nil
+}
+
+// addMissingColumns adds the columns of the schema the existing table lacks,
+// as NULLABLE (or REPEATED) so its earlier rows stay valid, before the job's
+// writes would fail on them. A column whose type differs from the table's
+// fails with errSchemaConflict: BigQuery can't change it in place.
+func addMissingColumns(ctx context.Context, table *bigquery.Table, md *bigquery.TableMetadata, want bigquery.Schema) error {
+	merged, added, err := mergeSchema(md.Schema, want, "")
+	if err != nil {
+		return fmt.Errorf("%s: %w: %v; write to a new table or migrate the column", table.FullyQualifiedName(), errSchemaConflict, err)
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	if _, err := table.Update(ctx, bigquery.TableMetadataToUpdate{Schema: merged}, md.ETag); err != nil {
+		return fmt.Errorf("failed to add columns %s: %w", strings.Join(added, ", "), err)
+	}
+	log.Printf("Added columns %s to table %s", strings.Join(added, ", "), table.FullyQualifiedName())
+	return nil
+}
+
+// mergeSchema returns have with the fields of want it lacks appended, made
+// optional, and the names of those fields. Names match case-insensitively, as
+// BigQuery's do, and records are merged field by field.
+func mergeSchema(have, want bigquery.Schema, path string) (bigquery.Schema, []string, error) {
+	byName := make(map[string]*bigquery.FieldSchema, len(have))
+	merged := make(bigquery.Schema, len(have))
+	for i, f := range have {
+		c := *f
+		merged[i] = &c
+		byName[strings.ToLower(f.Name)] = &c
+	}
+	var added []string
+	for _, w := range want {
+		name := path + w.Name
+		h, ok := byName[strings.ToLower(w.Name)]
+		if !ok {
+			merged = append(merged, optionalField(w))
+			added = append(added, name)
+			continue
+		}
+		if standardFieldType(h.Type) != standardFieldType(w.Type) || h.Repeated != w.Repeated {
+			return nil, nil, fmt.Errorf("column %s is %s in the table but %s in the results", name, describeFieldType(h), describeFieldType(w))
+		}
+		if standardFieldType(w.Type) == bigquery.RecordFieldType {
+			fields, sub, err := mergeSchema(h.Schema, w.Schema, name+".")
+			if err != nil {
+				return nil, nil, err
+			}
+			h.Schema = fields
+			added = append(added, sub...)
+		}
+	}
+	return merged, added, nil
+}
+
+// optionalField copies a field with it and its subfields made NULLABLE,
+// leaving REPEATED ones as they are.
+func optionalField(f *bigquery.FieldSchema) *bigquery.FieldSchema {
+	c := *f
+	c.Required = false
+	c.Schema = make(bigquery.Schema, len(f.Schema))
+	for i, sub := range f.Schema {
+		c.Schema[i] = optionalField(sub)
+	}
+	return &c
+}
+
+// standardFieldType maps the GoogleSQL type names the API may report to the
+// legacy ones InferSchema uses.
+func standardFieldType(t bigquery.FieldType) bigquery.FieldType {
+	switch strings.ToUpper(string(t)) {
+	case "INT64":
+		return bigquery.IntegerFieldType
+	case "FLOAT64":
+		return bigquery.FloatFieldType
+	case "BOOL":
+		return bigquery.BooleanFieldType
+	case "STRUCT":
+		return bigquery.RecordFieldType
+	}
+	return bigquery.FieldType(strings.ToUpper(string(t)))
+}
+
+func describeFieldType(f *bigquery.FieldSchema) string {
+	if f.Repeated {
+		return "REPEATED " + string(standardFieldType(f.Type))
+	}
+	return string(standardFieldType(f.Type))
+}
+
+// validPartitioning reports whether v is empty or a BigQuery time partitioning type.
+func validPartitioning(v string) bool {
+	switch bigquery.TimePartitioningType(strings.ToUpper(v)) {
+	case "", bigquery.HourPartitioningType, bigquery.DayPartitioningType, bigquery.MonthPartitioningType, bigquery.YearPartitioningType:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// --- Rate-limit aware pacing report ---
+
+// Counters in this namespace are summed across workers and turned into a
+// breakdown of where GenerateTextFn spent its time once the job finishes.
+const pacingNamespace = "pacing"
+
+const (
+	pacingBundleMs    = "bundle_ms"    // Wall time between StartBundle and FinishBundle
+	pacingAPIMs       = "api_ms"       // Time waiting on successful or non-throttled API calls
+	pacingThrottledMs = "throttled_ms" // Time spent on requests rejected with 429
+	pacingWaitMs      = "wait_ms"      // Time held back by the rate limiters, quota cool-downs, and retry backoff
+	pacingRequests    = "requests_total"
+	pacingThrottled   = "throttled_total"
+)
+
+// pacingReport is the job-level time breakdown derived from pacing counters.
+type pacingReport struct {
+	BundleMs, APIMs, ThrottledMs, WaitMs, IOMs int64
+	Requests, ThrottledRequests                int64
+	QuotaExhausted                             int64 // Throttled requests that named a project quota
+}
+
+// counterTotals sums every counter in a namespace across all transforms, keyed by counter name.
+func counterTotals(pr beam.PipelineResult, namespace string) map[string]int64 {
+	totals := make(map[string]int64)
+	if pr == nil {
+		return totals
+	}
+	qr := pr.Metrics().Query(func(r beam.MetricResult) bool {
+		return r.Namespace() == namespace
+	})
+	for _, c := range qr.Counters() {
+		totals[c.Name()] += c.Result()
+	}
+	return totals
+}
+
+// newPacingReport builds the report from the pipeline result. Time not spent on the
+// API (throttled or otherwise) or held back before a request inside a bundle is
+// attributed to IO: reading inputs and handing results to the BigQuery sink.
+func newPacingReport(pr beam.PipelineResult) pacingReport {
+	t := counterTotals(pr, pacingNamespace)
+	r := pacingReport{
+		BundleMs:          t[pacingBundleMs],
+		APIMs:             t[pacingAPIMs],
+		ThrottledMs:       t[pacingThrottledMs],
+		WaitMs:            t[pacingWaitMs],
+		Requests:          t[pacingRequests],
+		ThrottledRequests: t[pacingThrottled],
+	}
+	r.QuotaExhausted = counterTotals(pr, "vertexai")["quota_exhausted_total"]
+	r.IOMs = r.BundleMs - r.APIMs - r.ThrottledMs - r.WaitMs
+	if r.IOMs < 0 {
+		r.IOMs = 0
+	}
+	return r
+}
+
+func (r pacingReport) fraction(ms int64) float64 {
+	total := r.APIMs + r.ThrottledMs + r.WaitMs + r.IOMs
+	if total == 0 {
+		return 0
+	}
+	return float64(ms) / float64(total)
+}
+
+// recommendations turns the breakdown into tuning advice. More workers only
+// help while the API, not the limits on it, holds the job back.
+func (r pacingReport) recommendations() []string {
+	var recs []string
+	if r.QuotaExhausted > 0 {
+		recs = append(recs, fmt.Sprintf("%d requests hit a project quota: request an increase, or set --quota_cooldown so workers pause instead of failing rows.", r.QuotaExhausted))
+	}
+	if r.ThrottledRequests > 0 && r.fraction(r.ThrottledMs) > 0.2 {
+		recs = append(recs, "Over 20% of worker time was throttled by Vertex AI quota: request a quota increase or lower --max_num_workers.")
+	}
+	if r.fraction(r.WaitMs) > 0.2 {
+		recs = append(recs, "Over 20% of worker time was held back by rate limits, quota cool-downs, or retry backoff: more workers would only wait longer; raise --requests_per_second or the quota, or lower --max_num_workers.")
+	}
+	if r.fraction(r.APIMs) > 0.7 && r.fraction(r.ThrottledMs+r.WaitMs) < 0.1 {
+		recs = append(recs, "API latency dominates: raise --max_num_workers (quota permitting) or send more prompts per request to amortize round trips.")
+	}
+	if r.fraction(r.IOMs) > 0.5 {
+		recs = append(recs, "Workers mostly waited on IO: fewer, busier workers or larger read/write batches would cut cost without slowing the job.")
+	}
+	return recs
+}
+
+// logPacingReport writes the breakdown and recommendations to the launcher log.
+func logPacingReport(pr beam.PipelineResult, wall time.Duration) {
+	r := newPacingReport(pr)
+	if r.Requests == 0 {
+		log.Printf("Pacing report: no Vertex AI requests recorded (metrics unavailable for this runner?).")
+		return
+	}
+	log.Printf("Pacing report (wall time %v, %d requests, %d throttled, %d quota exhausted):", wall, r.Requests, r.ThrottledRequests, r.QuotaExhausted)
+	log.Printf("  Throttled: %5.1f%% (%v)", 100*r.fraction(r.ThrottledMs), time.Duration(r.ThrottledMs)*time.Millisecond)
+	log.Printf("  Held back: %5.1f%% (%v)", 100*r.fraction(r.WaitMs), time.Duration(r.WaitMs)*time.Millisecond)
+	log.Printf("  API wait:  %5.1f%% (%v)", 100*r.fraction(r.APIMs), time.Duration(r.APIMs)*time.Millisecond)
+	log.Printf("  IO/other:  %5.1f%% (%v)", 100*r.fraction(r.IOMs), time.Duration(r.IOMs)*time.Millisecond)
+	recs := r.recommendations()
+	if len(recs) == 0 {
+		log.Printf("  No tuning recommendations; the job looks balanced.")
+	}
+	for _, rec := range recs {
+		log.Printf("  Recommendation: %s", rec)
+	}
+}
+
+// --- DoFn-side accounting ---
+
+// pacingCounters is embedded in model-calling DoFns to record where their time goes.
+type pacingCounters struct {
+	BundleMs    beam.Counter
+	APIMs       beam.Counter
+	ThrottledMs beam.Counter
+	WaitMs      beam.Counter
+	Requests    beam.Counter
+	Throttled   beam.Counter
+
+	bundleStart time.Time
+}
+
+func (pc *pacingCounters) setupPacing() {
+	pc.BundleMs = beam.NewCounter(pacingNamespace, pacingBundleMs)
+	pc.APIMs = beam.NewCounter(pacingNamespace, pacingAPIMs)
+	pc.ThrottledMs = beam.NewCounter(pacingNamespace, pacingThrottledMs)
+	pc.WaitMs = beam.NewCounter(pacingNamespace, pacingWaitMs)
+	pc.Requests = beam.NewCounter(pacingNamespace, pacingRequests)
+	pc.Throttled = beam.NewCounter(pacingNamespace, pacingThrottled)
+}
+
+func (pc *pacingCounters) startBundle() {
+	pc.bundleStart = time.Now()
+}
+
+func (pc *pacingCounters) finishBundle(ctx context.Context) {
+	if !pc.bundleStart.IsZero() {
+		pc.BundleMs.Inc(ctx, time.Since(pc.bundleStart).Milliseconds())
+	}
+}
+
+// recordRequest attributes one API round trip to either API wait or throttling.
+func (pc *pacingCounters) recordRequest(ctx context.Context, elapsed time.Duration, throttled bool) {
+	pc.Requests.Inc(ctx, 1)
+	if throttled {
+		pc.Throttled.Inc(ctx, 1)
+		pc.ThrottledMs.Inc(ctx, elapsed.Milliseconds())
+		return
+	}
+	pc.APIMs.Inc(ctx, elapsed.Milliseconds())
+}
+
+// recordWait attributes time a request was held back before it was sent, or
+// between attempts, to waiting.
+func (pc *pacingCounters) recordWait(ctx context.Context, elapsed time.Duration) {
+	pc.WaitMs.Inc(ctx, elapsed.Milliseconds())
+}
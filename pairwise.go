@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/bigqueryio"
+)
+
+// --- Pairwise comparison task ---
+
+// PairFromBQ is one pair of candidates to compare.
+type PairFromBQ struct {
+	LeftKey   string `bigquery:"left_key"`
+	LeftText  string `bigquery:"left_text"`
+	RightKey  string `bigquery:"right_key"`
+	RightText string `bigquery:"right_text"`
+}
+
+// PairwiseResult is the model's verdict for one pair.
+type PairwiseResult struct {
+	RunID      string    `beam:"RunID"`
+	LeftKey    string    `beam:"LeftKey"`
+	RightKey   string    `beam:"RightKey"`
+	Preference string    `beam:"Preference"` // "left", "right", "tie", or "unparsed"
+	Rationale  string    `beam:"Rationale"`
+	ModelUsed  string    `beam:"ModelUsed"`
+	ComparedAt time.Time `beam:"ComparedAt"`
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*PairFromBQ)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*PairwiseResult)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*BuildPairPromptFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*ParsePreferenceFn)(nil)).Elem())
+}
+
+// pairKeySep joins the two candidate keys into a single ParentKey; it cannot occur in normal text.
+const pairKeySep = "\x1f"
+
+// pairsQuery selects pairs from the configured table, or self-joins the input prompts
+// so every unordered pair of distinct prompts is compared once.
+func pairsQuery(query string) string {
+	if *pairsTable != "" {
+		return fmt.Sprintf("SELECT left_key, left_text, right_key, right_text FROM `%s`%s", *pairsTable, snapshotClause())
+	}
+	return fmt.Sprintf(`SELECT a.prompt AS left_key, a.prompt AS left_text, b.prompt AS right_key, b.prompt AS right_text
+FROM (%s) a JOIN (%s) b ON a.prompt < b.prompt`, query, query)
+}
+
+// BuildPairPromptFn renders a comparison prompt asking for a JSON verdict.
+type BuildPairPromptFn struct {
+	Instruction string
+}
+
+func (fn *BuildPairPromptFn) ProcessElement(ctx context.Context, pair PairFromBQ, emit func(Prompt)) {
+	leftKey, rightKey := pair.LeftKey, pair.RightKey
+	if leftKey == "" {
+		leftKey = pair.LeftText
+	}
+	if rightKey == "" {
+		rightKey = pair.RightText
+	}
+	prompt := fmt.Sprintf(`%s
+
+Candidate A:
+%s
+
+Candidate B:
+%s
+
+Respond only with JSON of the form {"preference": "A" | "B" | "tie", "rationale": "<one or two sentences>"}.`,
+		fn.Instruction, pair.LeftText, pair.RightText)
+	emit(Prompt{Prompt: prompt, ParentKey: leftKey + pairKeySep + rightKey})
+}
+
+// ParsePreferenceFn extracts the verdict from the model's answer.
+type ParsePreferenceFn struct {
+	RunID string
+}
+
+func (fn *ParsePreferenceFn) ProcessElement(ctx context.Context, r GeminiResult, emit func(PairwiseResult)) {
+	leftKey, rightKey, _ := strings.Cut(r.ParentKey, pairKeySep)
+	preference, rationale := parsePreference(r.GeneratedText)
+	emit(PairwiseResult{
+		RunID:      fn.RunID,
+		LeftKey:    leftKey,
+		RightKey:   rightKey,
+		Preference: preference,
+		Rationale:  rationale,
+		ModelUsed:  r.ModelUsed,
+		ComparedAt: time.Now().UTC(),
+	})
+}
+
+// parsePreference reads the JSON verdict, tolerating Markdown code fences around it.
+// Unparseable answers are kept verbatim as the rationale.
+func parsePreference(text string) (string, string) {
+	body := strings.TrimSpace(text)
+	if start, end := strings.Index(body, "{"), strings.LastIndex(body, "}"); start >= 0 && end > start {
+		body = body[start : end+1]
+	}
+	var verdict struct {
+		Preference string `json:"preference"`
+		Rationale  string `json:"rationale"`
+	}
+	if err := json.Unmarshal([]byte(body), &verdict); err != nil {
+		return "unparsed", text
+	}
+	switch strings.ToUpper(strings.TrimSpace(verdict.Preference)) {
+	case "A":
+		return "left", verdict.Rationale
+	case "B":
+		return "right", verdict.Rationale
+	case "TIE":
+		return "tie", verdict.Rationale
+	}
+	return "unparsed", text
+}
+
+// comparePairs runs the pairwise task and writes parsed preferences to the pairwise table.
+// The raw generations are returned so they flow through the regular result sinks.
+func comparePairs(s beam.Scope, projects runProjects, model *modelStage, query string) beam.PCollection {
+	s = s.Scope("ComparePairs")
+	pairs := bigqueryio.Query(s.Scope("ReadPairs"), projects.Input, pairsQuery(query), reflect.TypeOf(PairFromBQ{}), bigqueryio.UseStandardSQL())
+	if inputShard.enabled() {
+		pairs = beam.ParDo(s.Scope("ShardPairs"), &ShardPairsFn{Shard: inputShard}, pairs)
+	}
+	prompts := beam.ParDo(s.Scope("BuildPairPrompts"), &BuildPairPromptFn{Instruction: *pairwiseInstruction}, pairs)
+	results := model.generate(s.Scope("CallVertexAI"), stageCompare, prompts)
+
+	verdicts := beam.ParDo(s.Scope("ParsePreferences"), &ParsePreferenceFn{RunID: *runID}, results)
+	tableName := fmt.Sprintf("%s:%s.%s", projects.Output, outputDataset, *pairwiseTable)
+	bigqueryio.Write(s.Scope("WritePreferences"), projects.Output, tableName, verdicts)
+	return results
+}
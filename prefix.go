@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// --- Shared prompt prefix ---
+
+// Prompts built from one template often open with the same long block
+// (instructions, few-shot examples). Under --hoist_shared_prefix_chars the
+// prompts of each model stage are compared before any is sent: when all of them
+// start with the same text of at least that many characters, cut back to a line
+// end, generateContent gets that text as the system instruction and the rest as
+// the user turn. An identical leading block is what Vertex AI's context cache
+// matches on, so its tokens are billed at the cached rate; CachedTokens reports
+// per row how many prompt tokens the cache served. The Prompt column and
+// PromptHash keep the whole prompt, and predict models, which take no system
+// instruction, get it whole too. Finding the prefix needs every prompt of the
+// stage, so generation starts once the stage's input has been read.
+
+// sharedPrefixAccum is the longest prefix common to the prompts seen so far.
+type sharedPrefixAccum struct {
+	Prefix  string
+	Prompts int64
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*sharedPrefixCombineFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*HoistPrefixFn)(nil)).Elem())
+}
+
+// sharedPrefixCombineFn finds the prefix shared by all prompts.
+type sharedPrefixCombineFn struct{}
+
+func (fn *sharedPrefixCombineFn) CreateAccumulator() sharedPrefixAccum {
+	return sharedPrefixAccum{}
+}
+
+func (fn *sharedPrefixCombineFn) AddInput(a sharedPrefixAccum, p Prompt) sharedPrefixAccum {
+	return fn.MergeAccumulators(a, sharedPrefixAccum{Prefix: p.Prompt, Prompts: 1})
+}
+
+func (fn *sharedPrefixCombineFn) MergeAccumulators(a, b sharedPrefixAccum) sharedPrefixAccum {
+	switch {
+	case a.Prompts == 0:
+		return b
+	case b.Prompts == 0:
+		return a
+	}
+	return sharedPrefixAccum{Prefix: commonPrefix(a.Prefix, b.Prefix), Prompts: a.Prompts + b.Prompts}
+}
+
+// commonPrefix returns the longest common prefix of a and b.
+func commonPrefix(a, b string) string {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return a[:i]
+		}
+	}
+	return a[:n]
+}
+
+// hoistablePrefix cuts the shared prefix back to its last line end, so neither
+// a word nor a UTF-8 sequence is split, and returns "" when what is left is
+// shorter than minChars or only one prompt shares it.
+func hoistablePrefix(a sharedPrefixAccum, minChars int) string {
+	if a.Prompts < 2 {
+		return ""
+	}
+	prefix := a.Prefix[:strings.LastIndexByte(a.Prefix, '\n')+1]
+	if len([]rune(prefix)) < minChars {
+		return ""
+	}
+	return prefix
+}
+
+// HoistPrefixFn marks the shared prefix on every prompt that has text after it.
+// The prefix arrives as a side input holding the combine's accumulator.
+type HoistPrefixFn struct {
+	MinChars int
+
+	hoisted beam.Counter
+}
+
+func (fn *HoistPrefixFn) Setup() {
+	fn.hoisted = beam.NewCounter("prefix", "hoisted_prompts_total")
+}
+
+func (fn *HoistPrefixFn) ProcessElement(ctx context.Context, p Prompt, prefixes func(*sharedPrefixAccum) bool, emit func(Prompt)) {
+	var a sharedPrefixAccum
+	for prefixes(&a) {
+	}
+	if prefix := hoistablePrefix(a, fn.MinChars); prefix != "" && len(p.Prompt) > len(prefix) {
+		p.SharedPrefix = len(prefix)
+		fn.hoisted.Inc(ctx, 1)
+	}
+	emit(p)
+}
+
+// hoistSharedPrefix marks the prefix shared by all prompts for the system instruction.
+func hoistSharedPrefix(s beam.Scope, minChars int, prompts beam.PCollection) beam.PCollection {
+	s = s.Scope("HoistSharedPrefix")
+	prefix := beam.Combine(s, &sharedPrefixCombineFn{}, prompts)
+	return beam.ParDo(s, &HoistPrefixFn{MinChars: minChars}, prompts, beam.SideInput{Input: prefix})
+}
+
+// hoistedPrefix returns the part of the prompt marked for the system instruction.
+func hoistedPrefix(p Prompt) string {
+	if p.SharedPrefix <= 0 || p.SharedPrefix >= len(p.Prompt) {
+		return ""
+	}
+	return p.Prompt[:p.SharedPrefix]
+}
+
+// splitHoisted separates the hoisted prefix of the current prompt from a
+// prompt about to be sent. Retries extend the prompt at its end, so they keep
+// the prefix; a prompt without it is sent whole.
+func (fn *GenerateTextFn) splitHoisted(prompt string) (system, user string) {
+	if fn.hoisted == "" {
+		return "", prompt
+	}
+	if rest, ok := strings.CutPrefix(prompt, fn.hoisted); ok {
+		return fn.hoisted, rest
+	}
+	return "", prompt
+}
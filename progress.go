@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+)
+
+// --- Progress heartbeats ---
+
+// Under --progress_table every worker streams a row with its running totals
+// into BigQuery every --progress_interval while the job runs, so a long batch
+// job can be followed from SQL instead of from Dataflow counters alone. Totals
+// are cumulative per worker; the job's progress is the sum of each worker's
+// latest row:
+//
+//	SELECT SUM(ElementsProcessed), SUM(Errors), SUM(PromptTokens + OutputTokens)
+//	FROM (SELECT * FROM progress WHERE RunID = @run
+//	      QUALIFY ROW_NUMBER() OVER (PARTITION BY Worker ORDER BY ReportedAt DESC) = 1)
+
+// ProgressRow is one heartbeat of one worker.
+type ProgressRow struct {
+	RunID             string    `bigquery:"RunID"`
+	Worker            string    `bigquery:"Worker"` // Host and process of the SDK harness
+	ReportedAt        time.Time `bigquery:"ReportedAt"`
+	ElementsProcessed int64     `bigquery:"ElementsProcessed"` // Prompts received by GenerateTextFn, cache hits included
+	RowsSucceeded     int64     `bigquery:"RowsSucceeded"`
+	Errors            int64     `bigquery:"Errors"` // Dead letters, including ones a retry wave later recovered
+	PromptTokens      int64     `bigquery:"PromptTokens"`
+	OutputTokens      int64     `bigquery:"OutputTokens"`
+}
+
+// progressReporter keeps a worker's totals and writes them out periodically.
+type progressReporter struct {
+	runID    string
+	worker   string
+	inserter *bigquery.Inserter
+
+	elements, rows, errors, promptTokens, outputTokens atomic.Int64
+}
+
+var (
+	workerProgressOnce sync.Once
+	workerProgress     *progressReporter
+)
+
+// sharedProgressReporter returns the worker-wide reporter, configured and
+// started by the first caller. It is nil when the BigQuery client cannot be
+// created; the nil reporter records nothing.
+func sharedProgressReporter(ctx context.Context, project, dataset, table, runID string, interval time.Duration) *progressReporter {
+	workerProgressOnce.Do(func() {
+		// The reporter outlives the caller's bundle, so it gets its own context
+		client, err := bigquery.NewClient(context.Background(), project)
+		if err != nil {
+			beamlog.Errorf(ctx, "GenerateTextFn: Progress rows disabled, failed to create bigquery client: %v", err)
+			return
+		}
+		host, _ := os.Hostname()
+		workerProgress = &progressReporter{
+			runID:    runID,
+			worker:   fmt.Sprintf("%s/%d", host, os.Getpid()),
+			inserter: client.Dataset(dataset).Table(table).Inserter(),
+		}
+		go workerProgress.heartbeat(interval)
+	})
+	return workerProgress
+}
+
+// heartbeat writes a row every interval for the life of the worker process.
+func (r *progressReporter) heartbeat(interval time.Duration) {
+	for range time.Tick(interval) {
+		r.flush(context.Background())
+	}
+}
+
+// flush writes the current totals. Failures are logged and the next beat tries again.
+func (r *progressReporter) flush(ctx context.Context) {
+	if r == nil {
+		return
+	}
+	row := &ProgressRow{
+		RunID:             r.runID,
+		Worker:            r.worker,
+		ReportedAt:        time.Now().UTC(),
+		ElementsProcessed: r.elements.Load(),
+		RowsSucceeded:     r.rows.Load(),
+		Errors:            r.errors.Load(),
+		PromptTokens:      r.promptTokens.Load(),
+		OutputTokens:      r.outputTokens.Load(),
+	}
+	if err := r.inserter.Put(ctx, row); err != nil {
+		beamlog.Warnf(ctx, "GenerateTextFn: Failed to write progress row: %v", err)
+	}
+}
+
+func (r *progressReporter) addElement() {
+	if r != nil {
+		r.elements.Add(1)
+	}
+}
+
+func (r *progressReporter) addRow(res GeminiResult) {
+	if r != nil {
+		r.rows.Add(1)
+		r.promptTokens.Add(res.PromptTokens)
+		r.outputTokens.Add(res.OutputTokens)
+	}
+}
+
+func (r *progressReporter) addError() {
+	if r != nil {
+		r.errors.Add(1)
+	}
+}
+
+// ensureProgressTable creates the --progress_table when it does not exist, so
+// the first heartbeats are not lost to a missing table.
+func ensureProgressTable(ctx context.Context, project string) error {
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return fmt.Errorf("failed to create bigquery client: %w", err)
+	}
+	defer client.Close()
+	table := client.Dataset(outputDataset).Table(*progressTable)
+	if _, err := table.Metadata(ctx); err == nil || !isBigQueryNotFound(err) {
+		return err
+	}
+	schema, err := bigquery.InferSchema(ProgressRow{})
+	if err != nil {
+		return fmt.Errorf("failed to infer progress schema: %w", err)
+	}
+	tm := &bigquery.TableMetadata{Schema: schema, Description: "Per-worker progress heartbeats of running jobs"}
+	if *kmsKey != "" {
+		tm.EncryptionConfig = &bigquery.EncryptionConfig{KMSKeyName: *kmsKey}
+	}
+	if err := table.Create(ctx, tm); err != nil {
+		return fmt.Errorf("failed to create progress table: %w", err)
+	}
+	log.Printf("Created progress table %s", table.FullyQualifiedName())
+	return nil
+}
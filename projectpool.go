@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// --- Multi-project quota pooling ---
+
+// A pooled project whose quota runs out (a 429 naming a quota) cools down for
+// --quota_cooldown, or poolCooldown when that is unset, and pick passes it
+// over meanwhile, so the other projects carry on; its first success ends the
+// cool-down early. The worker-wide quota pause only starts once every project
+// is cooling down.
+
+// Rotation strategies for --project_rotation.
+const (
+	rotateRoundRobin = "round_robin" // Cycle through projects with budget left
+	rotateBudget     = "budget"      // Pick the project with the most budget left
+)
+
+// cloudPlatformScope is the broad scope used for Vertex AI calls.
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// poolCooldown is how long a pooled project whose quota ran out is passed
+// over when --quota_cooldown is unset.
+const poolCooldown = time.Minute
+
+// errProjectBudgetsSpent is returned once every pooled project has used its budget.
+var errProjectBudgetsSpent = errors.New("every --quota_projects budget is spent on this worker")
+
+// projectSpec is one parsed --quota_projects entry.
+type projectSpec struct {
+	Project     string
+	Credentials string // Service account key (local path or gs:// URI); empty uses ADC
+	Budget      int64  // Requests per worker; 0 is unlimited
+}
+
+// parseQuotaProjects parses "project" or "project=credentials_uri" entries and
+// attaches "project=requests" budgets.
+func parseQuotaProjects(entries, budgets []string) ([]projectSpec, error) {
+	var specs []projectSpec
+	index := make(map[string]int)
+	for _, e := range entries {
+		project, creds, _ := strings.Cut(e, "=")
+		project = strings.TrimSpace(project)
+		if project == "" {
+			return nil, fmt.Errorf("invalid quota project %q (want project or project=credentials_uri)", e)
+		}
+		if _, dup := index[project]; dup {
+			return nil, fmt.Errorf("duplicate quota project %q", project)
+		}
+		index[project] = len(specs)
+		specs = append(specs, projectSpec{Project: project, Credentials: strings.TrimSpace(creds)})
+	}
+	for _, b := range budgets {
+		project, n, ok := strings.Cut(b, "=")
+		i, known := index[strings.TrimSpace(project)]
+		budget, err := strconv.ParseInt(strings.TrimSpace(n), 10, 64)
+		if !ok || !known || err != nil || budget < 0 {
+			return nil, fmt.Errorf("invalid project budget %q (want a --quota_projects project=requests)", b)
+		}
+		specs[i].Budget = budget
+	}
+	return specs, nil
+}
+
+// poolMember is one project's client, budget, and usage counters.
+type poolMember struct {
+	Project string
+	client  *http.Client
+	budget  int64
+	used    int64 // Guarded by the pool's mutex
+
+	coolUntil time.Time // Quota cool-down; guarded by the pool's mutex
+
+	requests     beam.Counter
+	failures     beam.Counter
+	promptTokens beam.Counter
+	outputTokens beam.Counter
+}
+
+// remaining returns the requests left in the member's budget.
+func (m *poolMember) remaining() int64 {
+	if m.budget == 0 {
+		return math.MaxInt64
+	}
+	return m.budget - m.used
+}
+
+// record adds one call's outcome to the member's counters.
+func (m *poolMember) record(ctx context.Context, out vertexOutput, err error) {
+	m.requests.Inc(ctx, 1)
+	if err != nil {
+		m.failures.Inc(ctx, 1)
+		return
+	}
+	m.promptTokens.Inc(ctx, out.PromptTokens)
+	m.outputTokens.Inc(ctx, out.OutputTokens)
+}
+
+// projectPool hands out pooled projects according to the rotation strategy.
+type projectPool struct {
+	mu       sync.Mutex
+	strategy string
+	cooldown time.Duration
+	members  []*poolMember
+	next     int
+}
+
+// pick chooses a project with budget left and charges one request to it,
+// passing over projects that are cooling down unless all of them are; then
+// the one whose cool-down ends first is chosen.
+func (p *projectPool) pick() (*poolMember, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var chosen, coolest *poolMember
+	switch p.strategy {
+	case rotateBudget:
+		for _, m := range p.members {
+			if m.remaining() > 0 && now.After(m.coolUntil) && (chosen == nil || m.remaining() > chosen.remaining()) {
+				chosen = m
+			}
+		}
+	default:
+		for i := range p.members {
+			m := p.members[(p.next+i)%len(p.members)]
+			if m.remaining() > 0 && now.After(m.coolUntil) {
+				chosen = m
+				p.next = (p.next + i + 1) % len(p.members)
+				break
+			}
+		}
+	}
+	if chosen == nil {
+		for _, m := range p.members {
+			if m.remaining() > 0 && (coolest == nil || m.coolUntil.Before(coolest.coolUntil)) {
+				coolest = m
+			}
+		}
+		chosen = coolest
+	}
+	if chosen == nil {
+		return nil, errProjectBudgetsSpent
+	}
+	chosen.used++
+	return chosen, nil
+}
+
+// record adds a call's outcome to the member: a quota error starts its
+// cool-down and a success ends it.
+func (p *projectPool) record(ctx context.Context, m *poolMember, out vertexOutput, err error) {
+	m.record(ctx, out, err)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case errors.Is(err, errQuotaExhausted):
+		m.coolUntil = time.Now().Add(p.cooldown)
+	case err == nil:
+		m.coolUntil = time.Time{}
+	}
+}
+
+// allCooling reports whether every project with budget left is cooling down.
+func (p *projectPool) allCooling() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for _, m := range p.members {
+		if m.remaining() > 0 && now.After(m.coolUntil) {
+			return false
+		}
+	}
+	return true
+}
+
+// newProjectPool builds a client per project. Per-project counters live in the
+// vertexai_projects namespace, e.g. requests_total/my-project.
+func newProjectPool(ctx context.Context, specs []projectSpec, strategy string, cooldown time.Duration) (*projectPool, error) {
+	if cooldown <= 0 {
+		cooldown = poolCooldown
+	}
+	p := &projectPool{strategy: strategy, cooldown: cooldown}
+	for _, spec := range specs {
+		client, err := projectClient(ctx, spec.Credentials)
+		if err != nil {
+			return nil, fmt.Errorf("project %s: %w", spec.Project, err)
+		}
+		p.members = append(p.members, &poolMember{
+			Project:      spec.Project,
+			client:       client,
+			budget:       spec.Budget,
+			requests:     beam.NewCounter("vertexai_projects", "requests_total/"+spec.Project),
+			failures:     beam.NewCounter("vertexai_projects", "errors_total/"+spec.Project),
+			promptTokens: beam.NewCounter("vertexai_projects", "prompt_tokens/"+spec.Project),
+			outputTokens: beam.NewCounter("vertexai_projects", "output_tokens/"+spec.Project),
+		})
+	}
+	return p, nil
+}
+
+// projectClient returns the worker's authorized client for a service account
+// key, or ADC when none is given, so projects sharing credentials share it.
+func projectClient(ctx context.Context, credentials string) (*http.Client, error) {
+	return sharedWorkerRegistry().client(ctx, credentials, cloudPlatformScope)
+}
+
+var (
+	workerPoolOnce sync.Once
+	workerPool     *projectPool
+	workerPoolErr  error
+)
+
+// sharedProjectPool returns the worker-wide pool, configured by the first caller,
+// so budgets are tracked across every bundle thread on the worker.
+func sharedProjectPool(ctx context.Context, specs []projectSpec, strategy string, cooldown time.Duration) (*projectPool, error) {
+	workerPoolOnce.Do(func() {
+		workerPool, workerPoolErr = newProjectPool(ctx, specs, strategy, cooldown)
+	})
+	return workerPool, workerPoolErr
+}
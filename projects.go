@@ -0,0 +1,47 @@
+package main
+
+import "log"
+
+// --- Projects of a run ---
+
+// Many organizations keep their data lake, their ML quota, and their compute
+// in separate projects. --project is the Dataflow job's; the input query and
+// reference tables (glossary, taxonomy, response enum) are read and billed in
+// --input_project, every table the run writes goes to --output_dataset in
+// --output_project, and the Vertex AI endpoint (and its quota) of
+// --vertex_project serves the requests unless --quota_projects spreads them.
+// Each defaults to --project. The workers' service account needs access to all
+// of them: BigQuery read and job rights in the input project, BigQuery write
+// in the output project, and roles/aiplatform.user in the Vertex AI project.
+
+// runProjects are the projects one run spans.
+type runProjects struct {
+	Job    string // Runs the Dataflow job
+	Input  string // Runs and pays for the input reads
+	Output string // Holds the output dataset
+	Vertex string // Serves the Vertex AI requests
+}
+
+// resolveProjects fills the projects left unset with the job's.
+func resolveProjects(job string) runProjects {
+	p := runProjects{Job: job, Input: *inputProject, Output: *outputProject, Vertex: *vertexProject}
+	for _, project := range []*string{&p.Input, &p.Output, &p.Vertex} {
+		if *project == "" {
+			*project = job
+		}
+	}
+	return p
+}
+
+// logProjects adds the projects that differ from the job's to the launch log.
+func (p runProjects) logProjects() {
+	for _, project := range []struct{ name, id string }{
+		{"Input Project", p.Input},
+		{"Output Project", p.Output},
+		{"Vertex AI Project", p.Vertex},
+	} {
+		if project.id != p.Job {
+			log.Printf("  %s: %s", project.name, project.id)
+		}
+	}
+}
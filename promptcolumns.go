@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// --- Composite prompts from several columns ---
+
+// Under --prompt_columns the input query returns the parts of a prompt as
+// columns of their own, e.g. title, description, and ingredients, rather than
+// concatenating them into prompt. The launcher wraps the query so BigQuery
+// composes prompt from them: each column is rendered with
+// --prompt_column_format, where {column} is the column name and {value} its
+// value, and the parts are joined with --prompt_column_separator; \n and \t
+// in either stand for a newline and a tab. NULL columns are left out. The
+// columns must be scalars, and the query must not return a prompt column
+// itself; the launch dry run checks both. Every other column (row_key, items,
+// ...) passes through as before.
+//
+// --prompt_column_budgets caps columns at a number of tokens, e.g.
+// title=50,description=500,reviews=1000, so a long review can't push the
+// title and description out of the model's context. Tokens are estimated at
+// charsPerToken characters each, as for routing. A value over its budget is
+// cut at the last word boundary within it and ends in an ellipsis; columns
+// without a budget are kept whole.
+
+// flagEscapes turns the escapes a shell can pass in a flag into their characters.
+var flagEscapes = strings.NewReplacer(`\n`, "\n", `\t`, "\t")
+
+// columnNamePattern is an unquoted BigQuery column name.
+var columnNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseColumnBudgets parses --prompt_column_budgets entries of the form
+// column=tokens, each naming one of the columns.
+func parseColumnBudgets(entries, columns []string) (map[string]int, error) {
+	budgets := make(map[string]int)
+	for _, e := range entries {
+		column, v, ok := strings.Cut(e, "=")
+		if !ok || !slices.Contains(columns, column) {
+			return nil, fmt.Errorf("invalid column budget %q (want column=tokens for a --prompt_columns column)", e)
+		}
+		tokens, err := strconv.Atoi(v)
+		if err != nil || tokens < 1 {
+			return nil, fmt.Errorf("invalid column budget %q (want a positive number of tokens)", e)
+		}
+		if _, dup := budgets[column]; dup {
+			return nil, fmt.Errorf("column %s has two budgets", column)
+		}
+		budgets[column] = tokens
+	}
+	return budgets, nil
+}
+
+// composePromptQuery wraps the query so it returns the composite prompt.
+func composePromptQuery(query string, columns []string, budgets map[string]int, format, separator string) (string, error) {
+	if !strings.Contains(format, "{value}") {
+		return "", fmt.Errorf("--prompt_column_format %q has no {value}", format)
+	}
+	format, separator = flagEscapes.Replace(format), flagEscapes.Replace(separator)
+	parts := make([]string, len(columns))
+	for i, column := range columns {
+		if !columnNamePattern.MatchString(column) {
+			return "", fmt.Errorf("invalid --prompt_columns column %q", column)
+		}
+		parts[i] = columnPart(column, columnValue(column, budgets[column]), format)
+	}
+	return fmt.Sprintf("SELECT *, ARRAY_TO_STRING([%s], %s) AS prompt FROM (%s\n)", strings.Join(parts, ", "), strconv.Quote(separator), query), nil
+}
+
+// columnValue is the SQL of a column's text, truncated to a budget of tokens
+// unless it is 0.
+func columnValue(column string, tokens int) string {
+	v := fmt.Sprintf("CAST(`%s` AS STRING)", column)
+	if tokens == 0 {
+		return v
+	}
+	chars := tokens * charsPerToken
+	return fmt.Sprintf(`IF(CHAR_LENGTH(%[1]s) <= %[2]d, %[1]s, CONCAT(REGEXP_REPLACE(SUBSTR(%[1]s, 1, %[2]d), r'\s+\S*$', ''), '…'))`, v, chars)
+}
+
+// columnPart renders one column with the format, value being the SQL of its
+// text. CONCAT is NULL when the column is, which drops the part from
+// ARRAY_TO_STRING.
+func columnPart(column, value, format string) string {
+	var args []string
+	for rest := format; rest != ""; {
+		i := strings.Index(rest, "{")
+		if i < 0 {
+			args = append(args, strconv.Quote(rest))
+			break
+		}
+		switch {
+		case strings.HasPrefix(rest[i:], "{column}"):
+			args = append(args, strconv.Quote(rest[:i]+column))
+			rest = rest[i+len("{column}"):]
+		case strings.HasPrefix(rest[i:], "{value}"):
+			args = append(args, strconv.Quote(rest[:i]), value)
+			rest = rest[i+len("{value}"):]
+		default:
+			args = append(args, strconv.Quote(rest[:i+1]))
+			rest = rest[i+1:]
+		}
+	}
+	return "CONCAT(" + strings.Join(args, ", ") + ")"
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+)
+
+// --- Prompts rendered from the input columns ---
+
+// Under --prompt_template (or --prompt_template_file, a local path or gs://
+// URI) the prompt of every input row is rendered in the pipeline rather than
+// concatenated in SQL:
+//
+//	Write a product label for {{.title}}.
+//	{{with .allergens}}Allergens: {{json .}}{{end}}
+//
+// The template is a text/template over the columns of the row, by name, with
+// the template variables of templatevars.go. The launcher wraps the input
+// query so BigQuery hands each row over as JSON (TO_JSON_STRING), so every
+// column the query selects is available, including arrays and structs; the
+// query must not return a prompt column itself. NULL columns render empty,
+// and a template naming a column the row doesn't have fails to render, which
+// drops the row and counts it in prompt_template/render_failures_total.
+// Values are inserted as they are: {{json .x}} renders one as a quoted JSON
+// value and the built-in {{html .x}} escapes it, for prompts that delimit
+// their inputs. --prompt_templates and --input_markup apply to the rendered
+// prompt.
+
+// templateColumnsColumn carries the row's columns as JSON to the workers.
+const templateColumnsColumn = "template_columns"
+
+// rowTemplate is the text of --prompt_template or --prompt_template_file,
+// empty when neither is set. Set by main.
+var rowTemplate string
+
+// loadRowTemplate reads --prompt_template or --prompt_template_file and
+// checks that the template parses.
+func loadRowTemplate(ctx context.Context, vars map[string]string) error {
+	text := *rowTemplateFlag
+	switch {
+	case text != "" && *rowTemplateFile != "":
+		return fmt.Errorf("--prompt_template and --prompt_template_file are mutually exclusive")
+	case *rowTemplateFile != "":
+		b, err := readConfigFile(ctx, *rowTemplateFile)
+		if err != nil {
+			return fmt.Errorf("failed to read --prompt_template_file: %w", err)
+		}
+		text = string(b)
+	}
+	if text == "" {
+		return nil
+	}
+	if _, err := parseRowTemplate(text, vars); err != nil {
+		return err
+	}
+	rowTemplate = text
+	return nil
+}
+
+func parseRowTemplate(text string, vars map[string]string) (*template.Template, error) {
+	funcs := templateFuncs(vars)
+	funcs["json"] = jsonValue
+	return template.New("prompt").Option("missingkey=error").Funcs(funcs).Parse(text)
+}
+
+// jsonValue renders a value as JSON.
+func jsonValue(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// templateColumnsQuery wraps the query so each row also carries all its
+// columns as JSON, and an empty prompt for the template to fill.
+func templateColumnsQuery(query string) string {
+	return fmt.Sprintf("SELECT *, '' AS prompt, TO_JSON_STRING(t) AS %s FROM (\n%s\n) AS t", templateColumnsColumn, query)
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*RenderRowTemplateFn)(nil)).Elem())
+}
+
+// RenderRowTemplateFn renders each row's prompt from its columns.
+type RenderRowTemplateFn struct {
+	Template string
+	Vars     map[string]string // Template variables, see templatevars.go
+
+	tmpl     *template.Template
+	failures beam.Counter
+}
+
+func (fn *RenderRowTemplateFn) Setup() error {
+	tmpl, err := parseRowTemplate(fn.Template, fn.Vars)
+	if err != nil {
+		return err
+	}
+	fn.tmpl = tmpl
+	fn.failures = beam.NewCounter("prompt_template", "render_failures_total")
+	return nil
+}
+
+func (fn *RenderRowTemplateFn) ProcessElement(ctx context.Context, row PromptFromBQ, emit func(PromptFromBQ)) {
+	prompt, err := fn.render(row.TemplateColumns)
+	if err != nil {
+		fn.failures.Inc(ctx, 1)
+		beamlog.Errorf(ctx, "RenderRowTemplateFn: Dropping row %q: %v", row.RowKey, err)
+		return
+	}
+	row.Prompt = prompt
+	row.TemplateColumns = ""
+	emit(row)
+}
+
+// render executes the template over the columns of a row.
+func (fn *RenderRowTemplateFn) render(columns string) (string, error) {
+	d := json.NewDecoder(strings.NewReader(columns))
+	d.UseNumber() // Keeps INT64 and NUMERIC values exact
+	var data map[string]any
+	if err := d.Decode(&data); err != nil {
+		return "", fmt.Errorf("failed to decode the row's columns: %w", err)
+	}
+	for name, v := range data {
+		if v == nil {
+			data[name] = ""
+		}
+	}
+	var b bytes.Buffer
+	if err := fn.tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// renderRowTemplates applies --prompt_template to the rows read by readPrompts.
+func renderRowTemplates(s beam.Scope, rows beam.PCollection) beam.PCollection {
+	if rowTemplate == "" {
+		return rows
+	}
+	return beam.ParDo(s.Scope("RenderPromptTemplate"), &RenderRowTemplateFn{Template: rowTemplate, Vars: templateVars}, rows)
+}
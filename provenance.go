@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// --- Provenance ---
+
+// generatorName is written to every result row so downstream systems can tell AI-generated content apart.
+const generatorName = "gemini"
+
+// Safety status values for the SafetyStatus column.
+const (
+	safetyPassed  = "passed"
+	safetyBlocked = "blocked"
+	safetyUnknown = "unknown" // The endpoint returned no safety verdict
+)
+
+// Zero-width characters used by the invisible watermark: the marker is framed by
+// word joiners and encodes watermarkTag one bit per character.
+const (
+	zeroWidthZero  = "\u200b" // zero width space
+	zeroWidthOne   = "\u200c" // zero width non-joiner
+	zeroWidthFrame = "\u2060" // word joiner
+	watermarkTag   = "ai:gemini"
+)
+
+// stampProvenance fills the provenance columns, watermarking the text first when enabled
+// so ContentHash covers exactly what is stored. Closed-set answers are never watermarked,
+// since they must match existing dimension values byte for byte.
+func (fn *GenerateTextFn) stampProvenance(res *GeminiResult, out vertexOutput, closedSet bool) {
+	if fn.Watermark && !closedSet {
+		res.GeneratedText += invisibleWatermark()
+	}
+	res.Generator = generatorName
+	res.ModelVersion = out.ModelVersion
+	res.PromptVersion = fn.PromptVersion
+	res.SafetyStatus = out.SafetyStatus
+	res.SafetyRatings = out.SafetyRatings
+	res.Citations = out.Citations
+	res.ContentHash = contentHash(res.GeneratedText)
+}
+
+// contentHash is the hex SHA-256 of a generated text.
+func contentHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// invisibleWatermark renders watermarkTag as a run of zero-width characters.
+func invisibleWatermark() string {
+	var b strings.Builder
+	b.WriteString(zeroWidthFrame)
+	for _, c := range []byte(watermarkTag) {
+		for bit := 7; bit >= 0; bit-- {
+			if c&(1<<bit) != 0 {
+				b.WriteString(zeroWidthOne)
+			} else {
+				b.WriteString(zeroWidthZero)
+			}
+		}
+	}
+	b.WriteString(zeroWidthFrame)
+	return b.String()
+}
+
+// stripWatermark returns text without the invisible watermark, for the steps
+// that read an answer back rather than store it.
+func stripWatermark(text string) string {
+	return strings.TrimSuffix(text, invisibleWatermark())
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+)
+
+// --- Project quota exhaustion ---
+
+// errQuotaExhausted wraps 429 RESOURCE_EXHAUSTED responses that name a quota.
+// Those don't clear within a request's retries, unlike 429s from transient
+// shared-capacity limits, so they are counted and handled separately.
+var errQuotaExhausted = errors.New("vertex ai project quota exhausted")
+
+// isQuotaExhausted classifies a 429 by its Google API error status and message.
+func isQuotaExhausted(status int, apiStatus, message string) bool {
+	return status == 429 && apiStatus == "RESOURCE_EXHAUSTED" && strings.Contains(strings.ToLower(message), "quota")
+}
+
+// quotaPause holds back every request on a worker until a cool-down ends.
+type quotaPause struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// extend starts a cool-down, or lengthens the current one.
+func (q *quotaPause) extend(d time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if until := time.Now().Add(d); until.After(q.until) {
+		q.until = until
+	}
+}
+
+// wait blocks until the cool-down is over or the context is done.
+func (q *quotaPause) wait(ctx context.Context) error {
+	q.mu.Lock()
+	delay := time.Until(q.until)
+	q.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// noteQuotaError counts a quota error and, when a cool-down is configured,
+// pauses the worker; with --quota_projects only once every project is cooling
+// down, as another one takes the retry until then. It reports whether the
+// caller should retry (after the pause).
+func (fn *GenerateTextFn) noteQuotaError(ctx context.Context, err error) bool {
+	if !errors.Is(err, errQuotaExhausted) {
+		return false
+	}
+	fn.QuotaExhaustedCounter.Inc(ctx, 1)
+	if fn.projects != nil && !fn.projects.allCooling() {
+		return true
+	}
+	if fn.quotaPause == nil {
+		return false
+	}
+	beamlog.Warnf(ctx, "GenerateTextFn: Project quota exhausted, pausing requests on this worker for %v", fn.QuotaCooldown)
+	fn.quotaPause.extend(fn.QuotaCooldown)
+	return true
+}
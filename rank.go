@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/bigqueryio"
+)
+
+// --- Best-of-N candidate ranking ---
+
+// Under --task=best_of_n every input row is generated --num_candidates times,
+// a judge call scores the candidates together, and only the best one goes to
+// the main output table. Every candidate and its score go to the scores table.
+
+// CandidateScore is the judge's verdict on one candidate.
+type CandidateScore struct {
+	RunID         string    `beam:"RunID"`
+	ParentKey     string    `beam:"ParentKey"`
+	Candidate     int       `beam:"Candidate"` // 1-based, as shown to the judge
+	GeneratedText string    `beam:"GeneratedText"`
+	Score         float64   `beam:"Score"`
+	Reason        string    `beam:"Reason"`
+	Selected      bool      `beam:"Selected"`    // This candidate was written to the main output
+	JudgeParsed   bool      `beam:"JudgeParsed"` // False when the judge failed or answered unparseably
+	JudgedAt      time.Time `beam:"JudgedAt"`
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*CandidateScore)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*ExpandCandidatesFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*BuildJudgePromptFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*SelectBestFn)(nil)).Elem())
+}
+
+// candidateNote is appended to each candidate's prompt. Besides asking for
+// variety, it makes the prompts differ so the result cache doesn't collapse
+// them into one answer.
+func candidateNote(i, n int) string {
+	return fmt.Sprintf("\n\n(Candidate %d of %d; write it independently of any other version.)", i+1, n)
+}
+
+// ExpandCandidatesFn emits N prompts per input row, one per candidate.
+type ExpandCandidatesFn struct {
+	N int
+}
+
+func (fn *ExpandCandidatesFn) ProcessElement(ctx context.Context, row PromptFromBQ, emit func(Prompt)) {
+	key := row.RowKey
+	if key == "" {
+		key = row.Prompt
+	}
+	for i := 0; i < fn.N; i++ {
+		emit(Prompt{Prompt: row.Prompt + candidateNote(i, fn.N), ParentKey: key, SubIndex: i, OrderingKey: row.OrderingKey, Sequence: row.Sequence, RequiredTerms: row.RequiredTerms})
+	}
+}
+
+// BuildJudgePromptFn renders one prompt asking the judge to score all of a
+// row's candidates. Candidates are numbered by SubIndex, so a failed
+// generation leaves a gap rather than renumbering the rest.
+type BuildJudgePromptFn struct {
+	Instruction string
+	N           int
+}
+
+func (fn *BuildJudgePromptFn) ProcessElement(ctx context.Context, key string, results func(*GeminiResult) bool, emit func(Prompt)) {
+	all := collectCandidates(results)
+	if len(all) == 0 {
+		return
+	}
+	first := all[0]
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n\nTask:\n%s\n", fn.Instruction, strings.TrimSuffix(first.Prompt, candidateNote(first.SubIndex, fn.N)))
+	for _, r := range all {
+		fmt.Fprintf(&b, "\nCandidate %d:\n%s\n", r.SubIndex+1, r.GeneratedText)
+	}
+	b.WriteString(`
+Respond only with JSON of the form {"scores": [{"candidate": <number>, "score": <0-10>, "reason": "<one sentence>"}]}, with one entry per candidate.`)
+	emit(Prompt{Prompt: b.String(), ParentKey: key, OrderingKey: first.OrderingKey, Sequence: first.Sequence})
+}
+
+// collectCandidates drains a group of candidate results in SubIndex order.
+func collectCandidates(results func(*GeminiResult) bool) []GeminiResult {
+	var all []GeminiResult
+	var r GeminiResult
+	for results(&r) {
+		all = append(all, r)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].SubIndex < all[j].SubIndex })
+	return all
+}
+
+// judgeScore is one entry of the judge's answer.
+type judgeScore struct {
+	Candidate int     `json:"candidate"`
+	Score     float64 `json:"score"`
+	Reason    string  `json:"reason"`
+}
+
+// parseJudgeScores reads the judge's JSON, tolerating Markdown code fences,
+// and returns the scores by 1-based candidate number.
+func parseJudgeScores(text string) (map[int]judgeScore, bool) {
+	body := strings.TrimSpace(text)
+	if start, end := strings.Index(body, "{"), strings.LastIndex(body, "}"); start >= 0 && end > start {
+		body = body[start : end+1]
+	}
+	var verdict struct {
+		Scores []judgeScore `json:"scores"`
+	}
+	if err := json.Unmarshal([]byte(body), &verdict); err != nil || len(verdict.Scores) == 0 {
+		return nil, false
+	}
+	scores := make(map[int]judgeScore, len(verdict.Scores))
+	for _, s := range verdict.Scores {
+		scores[s.Candidate] = s
+	}
+	return scores, true
+}
+
+// SelectBestFn joins a row's candidates with its judge result, emits the
+// highest-scoring candidate, and records a score for every candidate. Ties go
+// to the lower candidate number. Without a usable verdict the first candidate
+// is kept, so a judge failure never drops a row.
+type SelectBestFn struct {
+	RunID string
+}
+
+func (fn *SelectBestFn) ProcessElement(key string, candidates func(*GeminiResult) bool, judged func(*GeminiResult) bool, emit func(GeminiResult), emitScore func(CandidateScore)) {
+	all := collectCandidates(candidates)
+	if len(all) == 0 {
+		return
+	}
+	var verdict GeminiResult
+	var scores map[int]judgeScore
+	parsed := false
+	if judged(&verdict) {
+		scores, parsed = parseJudgeScores(verdict.GeneratedText)
+	}
+
+	best := 0
+	if parsed {
+		for i, r := range all {
+			if scores[r.SubIndex+1].Score > scores[all[best].SubIndex+1].Score {
+				best = i
+			}
+		}
+	}
+	now := time.Now().UTC()
+	for i, r := range all {
+		row := CandidateScore{
+			RunID:         fn.RunID,
+			ParentKey:     key,
+			Candidate:     r.SubIndex + 1,
+			GeneratedText: r.GeneratedText,
+			Selected:      i == best,
+			JudgeParsed:   parsed,
+			JudgedAt:      now,
+		}
+		if s, ok := scores[row.Candidate]; ok {
+			row.Score, row.Reason = s.Score, s.Reason
+		} else if parsed {
+			row.Reason = "not scored by the judge"
+		}
+		emitScore(row)
+	}
+	emit(all[best])
+}
+
+// rankCandidates runs the best_of_n task and writes every candidate's score.
+// Only the selected candidates are returned to the regular result sinks.
+func rankCandidates(s beam.Scope, projectID string, model *modelStage, rows beam.PCollection) beam.PCollection {
+	s = s.Scope("RankCandidates")
+	prompts := beam.ParDo(s.Scope("ExpandCandidates"), &ExpandCandidatesFn{N: *numCandidates}, rows)
+	candidates := model.generate(s.Scope("GenerateCandidates"), stageCandidates, prompts)
+	keyedCandidates := beam.ParDo(s, keyByParent, candidates)
+
+	judgePrompts := beam.ParDo(s.Scope("BuildJudgePrompts"), &BuildJudgePromptFn{Instruction: *judgeInstruction, N: *numCandidates}, beam.GroupByKey(s, keyedCandidates))
+	verdicts := model.generate(s.Scope("JudgeCandidates"), stageJudge, judgePrompts)
+
+	joined := beam.CoGroupByKey(s, keyedCandidates, beam.ParDo(s, keyByParent, verdicts))
+	best, scores := beam.ParDo2(s.Scope("SelectBest"), &SelectBestFn{RunID: *runID}, joined)
+	tableName := fmt.Sprintf("%s:%s.%s", projectID, outputDataset, *candidateScoresTable)
+	bigqueryio.Write(s.Scope("WriteScores"), projectID, tableName, scores)
+	model.scores = scores
+	return best
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"sync"
+	"time"
+
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+	"github.com/redis/go-redis/v9"
+)
+
+// --- Worker rate limiter and persisted limiter state ---
+
+func init() {
+	// The limiter is per worker, so a job's request rate grows with its worker
+	// count; --max_qps_per_worker is the name that makes this explicit
+	flag.Float64Var(requestsPerSecond, "max_qps_per_worker", 0, "Alias of --requests_per_second")
+}
+
+// tokenBucket paces requests to the endpoint. It refills at rate tokens per
+// second up to burst.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// refill must be called with mu held.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// wait blocks until a token is available or the context is done.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		b.refill(time.Now())
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// currentRate returns the refill rate.
+func (b *tokenBucket) currentRate() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// setRate changes the refill rate from now on, see adaptive.go.
+func (b *tokenBucket) setRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.rate = rate
+}
+
+// limiterState is the snapshot of limiter and breaker state kept in Redis.
+// Workers share one key, so the snapshot reflects whichever worker wrote last;
+// that is enough for a restarted worker to resume cautiously instead of with a
+// full bucket and a closed circuit.
+type limiterState struct {
+	Tokens           float64   `json:"tokens"`
+	SavedAt          time.Time `json:"saved_at"`
+	BreakerFailures  int       `json:"breaker_failures"`
+	BreakerOpenUntil time.Time `json:"breaker_open_until"`
+}
+
+// limiterStateTTL bounds how long a snapshot outlives the job that wrote it.
+const limiterStateTTL = 24 * time.Hour
+
+// limiterStateStore loads and saves limiterState under a single Redis key.
+type limiterStateStore struct {
+	client *redis.Client
+	key    string
+}
+
+func (s *limiterStateStore) load(ctx context.Context) (limiterState, bool, error) {
+	var st limiterState
+	raw, err := s.client.Get(ctx, s.key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return st, false, nil
+	}
+	if err != nil {
+		return st, false, err
+	}
+	if err := json.Unmarshal(raw, &st); err != nil {
+		return st, false, err
+	}
+	return st, true, nil
+}
+
+func (s *limiterStateStore) save(ctx context.Context, st limiterState) error {
+	raw, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, s.key, raw, limiterStateTTL).Err()
+}
+
+var (
+	workerStoreOnce sync.Once
+	workerStore     *limiterStateStore
+)
+
+// sharedLimiterStateStore returns the worker-wide store for the given Redis address.
+func sharedLimiterStateStore(addr, key string) *limiterStateStore {
+	workerStoreOnce.Do(func() {
+		workerStore = &limiterStateStore{client: redis.NewClient(&redis.Options{Addr: addr}), key: key}
+	})
+	return workerStore
+}
+
+// limiterStateKey namespaces the snapshot by run so separate jobs don't share pacing.
+func limiterStateKey(runID string) string {
+	return "vertex_gemini:limiter:" + runID
+}
+
+// restoreLimiterOnce makes sure only the first DoFn instance on a worker restores state.
+var restoreLimiterOnce sync.Once
+
+// restoreLimiterState seeds the worker's bucket and breaker from the last snapshot.
+func (fn *GenerateTextFn) restoreLimiterState(ctx context.Context) {
+	restoreLimiterOnce.Do(func() {
+		st, ok, err := fn.stateStore.load(ctx)
+		if err != nil {
+			beamlog.Warnf(ctx, "GenerateTextFn: Failed to load limiter state from Redis, starting fresh: %v", err)
+			return
+		}
+		if !ok {
+			return
+		}
+		if b := fn.bucket; b != nil {
+			b.mu.Lock()
+			b.tokens, b.last = st.Tokens, st.SavedAt
+			b.refill(time.Now())
+			b.mu.Unlock()
+		}
+		if b := fn.breaker; b != nil {
+			b.mu.Lock()
+			b.failures, b.openUntil = st.BreakerFailures, st.BreakerOpenUntil
+			b.mu.Unlock()
+		}
+		beamlog.Infof(ctx, "GenerateTextFn: Restored limiter state saved at %v", st.SavedAt)
+	})
+}
+
+// saveLimiterState writes the worker's current bucket and breaker state.
+func (fn *GenerateTextFn) saveLimiterState(ctx context.Context) {
+	st := limiterState{SavedAt: time.Now()}
+	if b := fn.bucket; b != nil {
+		b.mu.Lock()
+		b.refill(st.SavedAt)
+		st.Tokens = b.tokens
+		b.mu.Unlock()
+	}
+	if b := fn.breaker; b != nil {
+		b.mu.Lock()
+		st.BreakerFailures, st.BreakerOpenUntil = b.failures, b.openUntil
+		b.mu.Unlock()
+	}
+	if err := fn.stateStore.save(ctx, st); err != nil {
+		beamlog.Warnf(ctx, "GenerateTextFn: Failed to save limiter state to Redis: %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// --- Raw response storage ---
+
+// Encodings of the RawResponse column.
+const (
+	rawEncodingJSON       = "json"
+	rawEncodingGzipBase64 = "gzip+base64"
+)
+
+// storeRawResponse fills RawResponse, compressing it when configured. Cached and
+// fallback rows carry whatever body (if any) produced their text.
+func (fn *GenerateTextFn) storeRawResponse(res *GeminiResult, raw string) {
+	if raw == "" {
+		return
+	}
+	res.RawResponse, res.RawResponseEncoding = raw, rawEncodingJSON
+	if !fn.CompressRawResponse {
+		return
+	}
+	if zipped, err := gzipBytes([]byte(raw)); err == nil {
+		res.RawResponse, res.RawResponseEncoding = base64.StdEncoding.EncodeToString(zipped), rawEncodingGzipBase64
+	}
+}
+
+// decodeRawResponse returns the response body stored on a result row.
+func decodeRawResponse(res GeminiResult) ([]byte, error) {
+	switch res.RawResponseEncoding {
+	case rawEncodingJSON:
+		return []byte(res.RawResponse), nil
+	case rawEncodingGzipBase64:
+		zipped, err := base64.StdEncoding.DecodeString(res.RawResponse)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode raw response: %w", err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(zipped))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	}
+	return nil, fmt.Errorf("unknown raw response encoding %q", res.RawResponseEncoding)
+}
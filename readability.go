@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+)
+
+// --- Readability ---
+
+// Every answer gets a Flesch-Kincaid grade level in the ReadingGrade column:
+// roughly the US school grade needed to follow it, from words per sentence and
+// syllables per word. Markdown is stripped first, and each list item or
+// heading line counts as a sentence. Syllables are estimated from vowel
+// groups, so the score is meant for English text. Under --max_reading_grade an
+// answer above the limit gets one retry asking for simpler wording, kept when
+// it scores lower.
+
+// simplifyRetry is the Mutation recorded when the simplify retry produced the answer.
+const simplifyRetry = "simplify"
+
+// readingGrade returns the Flesch-Kincaid grade level of a Markdown answer,
+// rounded to one decimal and never below 0; text without words scores 0.
+func readingGrade(doc string) float64 {
+	words, syllables, sentences := 0, 0, 0
+	for _, line := range strings.Split(markupOptions{}.markdownText(doc), "\n") {
+		open := false // The line has words after its last sentence end
+		for _, tok := range strings.Fields(line) {
+			if w := strings.TrimFunc(tok, func(r rune) bool { return !unicode.IsLetter(r) }); w != "" {
+				words++
+				syllables += countSyllables(w)
+				open = true
+			}
+			if end := strings.TrimRight(tok, `"')]*`); open && end != "" && strings.ContainsRune(".!?", rune(end[len(end)-1])) {
+				sentences++
+				open = false
+			}
+		}
+		if open {
+			sentences++
+		}
+	}
+	if words == 0 {
+		return 0
+	}
+	grade := 0.39*float64(words)/float64(sentences) + 11.8*float64(syllables)/float64(words) - 15.59
+	return math.Max(0, math.Round(grade*10)/10)
+}
+
+// countSyllables estimates the syllables of a word as its vowel groups, less a
+// silent final e, and at least one.
+func countSyllables(word string) int {
+	w := strings.ToLower(word)
+	n, inVowel := 0, false
+	for _, r := range w {
+		vowel := strings.ContainsRune("aeiouy", r)
+		if vowel && !inVowel {
+			n++
+		}
+		inVowel = vowel
+	}
+	if strings.HasSuffix(w, "e") && !strings.HasSuffix(w, "le") && n > 1 {
+		n--
+	}
+	return max(n, 1)
+}
+
+// simplify retries an answer whose grade is above MaxReadingGrade, asking for
+// plainer wording. The retry replaces the answer only if it scores lower; the
+// token counts of both calls are kept either way.
+func (fn *GenerateTextFn) simplify(ctx context.Context, p Prompt, model string, params VertexParameters, out vertexOutput) vertexOutput {
+	if fn.MaxReadingGrade <= 0 || out.Fallback {
+		return out
+	}
+	grade := readingGrade(out.Text)
+	if grade <= fn.MaxReadingGrade {
+		return out
+	}
+	fn.SimplifyCounter.Inc(ctx, 1)
+	note := fmt.Sprintf("\n\nWrite for a reader at US grade level %g or below: short sentences and everyday words.", math.Floor(fn.MaxReadingGrade))
+	retry, err := fn.guardedPredict(ctx, model, p.Prompt+note, params)
+	if err != nil {
+		beamlog.Warnf(ctx, "GenerateTextFn: Simplify retry failed for prompt '%s': %v", fn.LogPolicy.redact(p.Prompt), err)
+		return out
+	}
+	retry.PromptTokens += out.PromptTokens
+	retry.OutputTokens += out.OutputTokens
+	if retryGrade := readingGrade(retry.Text); retryGrade >= grade {
+		beamlog.Warnf(ctx, "GenerateTextFn: Simplify retry for prompt '%s' scored grade %g, keeping the first answer (grade %g)", fn.LogPolicy.redact(p.Prompt), retryGrade, grade)
+		out.PromptTokens, out.OutputTokens = retry.PromptTokens, retry.OutputTokens
+		return out
+	}
+	retry.Attempt, retry.Mutation = out.Attempt+1, simplifyRetry
+	if fn.EntityCheck != entityCheckOff {
+		retry.MissingTerms = missingTerms(retry.Text, p.RequiredTerms)
+	}
+	return retry
+}
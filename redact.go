@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"unicode/utf8"
+)
+
+// --- Log content redaction ---
+
+// Policies for prompt/response text that ends up in log statements (and thus Cloud Logging).
+const (
+	logContentFull     = "full"     // Log content verbatim (debugging only)
+	logContentTruncate = "truncate" // Log a short prefix
+	logContentHash     = "hash"     // Log a hash so occurrences can be correlated without exposing text
+	logContentNone     = "none"     // Log only the length
+)
+
+// logTruncateRunes is how much content the truncate policy keeps.
+const logTruncateRunes = 50
+
+// contentPolicy renders customer content for logs according to --log_content_policy.
+// Every log statement that includes prompt or response text must go through redact.
+type contentPolicy string
+
+func validContentPolicy(p string) bool {
+	switch p {
+	case logContentFull, logContentTruncate, logContentHash, logContentNone:
+		return true
+	}
+	return false
+}
+
+func (p contentPolicy) redact(content string) string {
+	switch p {
+	case logContentFull:
+		return content
+	case logContentHash:
+		sum := sha256.Sum256([]byte(content))
+		return fmt.Sprintf("sha256:%s (%d chars)", hex.EncodeToString(sum[:6]), len(content))
+	case logContentNone:
+		return fmt.Sprintf("[redacted, %d chars]", len(content))
+	}
+	// Default to truncation so an unset policy never logs more than before
+	if utf8.RuneCountInString(content) <= logTruncateRunes {
+		return content
+	}
+	return string([]rune(content)[:logTruncateRunes]) + "..."
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// --- Worker-wide service registry ---
+
+// Every DoFn on a worker that calls a Google API gets its clients and guards
+// from one registry, so connections and tokens are reused and rate limits,
+// circuit breakers, and quota pauses apply to an endpoint as a whole rather
+// than to each DoFn type. A judge, embedding, or moderation DoFn added next to
+// GenerateTextFn shares the Vertex AI guards simply by asking for them under
+// vertexEndpoint.
+
+// Endpoint names guards are registered under.
+const (
+	vertexEndpoint = "vertex_ai"
+)
+
+// Connection pool of the shared clients. Every bundle thread of a worker calls
+// the same few hosts, and http.DefaultTransport keeps only 2 idle connections
+// per host, so most calls would otherwise open a new TLS connection.
+const (
+	apiIdleConnsPerHost = 100
+	apiIdleConnTimeout  = 90 * time.Second
+)
+
+// apiTransport is the keep-alive transport under every shared client.
+var apiTransport = newAPITransport()
+
+func newAPITransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = 4 * apiIdleConnsPerHost
+	t.MaxIdleConnsPerHost = apiIdleConnsPerHost
+	t.IdleConnTimeout = apiIdleConnTimeout
+	t.ForceAttemptHTTP2 = true
+	return t
+}
+
+// workerRegistry holds the worker's shared clients and guards. Guards are
+// configured by the first caller for an endpoint; later callers get that
+// instance whatever they ask for, as with every worker-wide singleton here.
+type workerRegistry struct {
+	mu       sync.Mutex
+	clients  map[string]*http.Client
+	buckets  map[string]*tokenBucket
+	breakers map[string]*circuitBreaker
+	pauses   map[string]*quotaPause
+	budgets  map[string]*requestBudget
+	tuners   map[string]*batchTuner
+	hints    map[string]*authDiagnosis
+	adaptive map[string]*aimdThrottle
+}
+
+var (
+	workerRegistryOnce sync.Once
+	workerServices     *workerRegistry
+)
+
+// sharedWorkerRegistry returns the worker's registry.
+func sharedWorkerRegistry() *workerRegistry {
+	workerRegistryOnce.Do(func() {
+		workerServices = &workerRegistry{
+			clients:  make(map[string]*http.Client),
+			buckets:  make(map[string]*tokenBucket),
+			breakers: make(map[string]*circuitBreaker),
+			pauses:   make(map[string]*quotaPause),
+			budgets:  make(map[string]*requestBudget),
+			tuners:   make(map[string]*batchTuner),
+			hints:    make(map[string]*authDiagnosis),
+			adaptive: make(map[string]*aimdThrottle),
+		}
+	})
+	return workerServices
+}
+
+// client returns an authorized client for the scopes, from a service account
+// key when credentials names one and from ADC otherwise. A new client fetches
+// its first token before it is handed out and renews it in the background
+// (see tokenprefetch.go), so callers never pay for authentication; failures
+// are not cached. Clients share apiTransport, so their connections are pooled
+// and kept alive.
+func (r *workerRegistry) client(ctx context.Context, credentials string, scopes ...string) (*http.Client, error) {
+	sorted := append([]string(nil), scopes...)
+	sort.Strings(sorted)
+	key := credentials + "|" + strings.Join(sorted, " ")
+
+	r.mu.Lock()
+	c, ok := r.clients[key]
+	r.mu.Unlock()
+	if ok {
+		return c, nil
+	}
+
+	// Clients outlive the caller, so token refreshes must not be tied to its context
+	var src oauth2.TokenSource
+	if credentials == "" {
+		creds, err := google.FindDefaultCredentials(context.Background(), scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create google default client (ADC issue?): %w", err)
+		}
+		src = creds.TokenSource
+	} else {
+		key, err := readConfigFile(ctx, credentials)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read credentials %s: %w", credentials, err)
+		}
+		if src, err = keyTokenSource(key, scopes); err != nil {
+			return nil, fmt.Errorf("failed to parse credentials %s: %w", credentials, err)
+		}
+	}
+	ts, err := newPrefetchingTokenSource(src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to authenticate: %w", err)
+	}
+	c = &http.Client{Transport: &oauth2.Transport{Source: ts, Base: apiTransport}}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.clients[key]; ok {
+		return existing, nil // Another thread won the race
+	}
+	r.clients[key] = c
+	return c, nil
+}
+
+// keyTokenSource returns the token source of a credentials file. Service
+// account keys get the JWT source directly, which can renew early; other
+// credential types go through google.CredentialsFromJSON.
+func keyTokenSource(key []byte, scopes []string) (oauth2.TokenSource, error) {
+	if cfg, err := google.JWTConfigFromJSON(key, scopes...); err == nil {
+		return cfg.TokenSource(context.Background()), nil
+	}
+	creds, err := google.CredentialsFromJSON(context.Background(), key, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	return creds.TokenSource, nil
+}
+
+// bucket returns the endpoint's request rate limiter.
+func (r *workerRegistry) bucket(endpoint string, rate float64, burst int) *tokenBucket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if b, ok := r.buckets[endpoint]; ok {
+		return b
+	}
+	b := newTokenBucket(rate, burst)
+	r.buckets[endpoint] = b
+	return b
+}
+
+// adaptiveThrottle returns the endpoint's adaptive throttle over its bucket.
+func (r *workerRegistry) adaptiveThrottle(endpoint string, bucket *tokenBucket, floor float64) *aimdThrottle {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t, ok := r.adaptive[endpoint]; ok {
+		return t
+	}
+	t := newAIMDThrottle(bucket, floor)
+	r.adaptive[endpoint] = t
+	return t
+}
+
+// breaker returns the endpoint's circuit breaker, so every bundle thread and
+// DoFn type sees the same endpoint health.
+func (r *workerRegistry) breaker(endpoint string, threshold int, cooldown time.Duration) *circuitBreaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if b, ok := r.breakers[endpoint]; ok {
+		return b
+	}
+	b := &circuitBreaker{threshold: threshold, cooldown: cooldown}
+	r.breakers[endpoint] = b
+	return b
+}
+
+// quotaPause returns the endpoint's quota cool-down, so one quota error holds
+// back every caller of the endpoint.
+func (r *workerRegistry) quotaPause(endpoint string) *quotaPause {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p, ok := r.pauses[endpoint]; ok {
+		return p
+	}
+	p := &quotaPause{}
+	r.pauses[endpoint] = p
+	return p
+}
+
+// budget returns the named request budget, e.g. a stage's --stage_budgets.
+func (r *workerRegistry) budget(name string, limit int64) *requestBudget {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if b, ok := r.budgets[name]; ok {
+		return b
+	}
+	b := &requestBudget{limit: limit}
+	r.budgets[name] = b
+	return b
+}
+
+// batchTuner returns the stage's batch size tuner, so every bundle thread
+// adds to one experiment.
+func (r *workerRegistry) batchTuner(stage string, maxSize int, period time.Duration) *batchTuner {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if t, ok := r.tuners[stage]; ok {
+		return t
+	}
+	t := newBatchTuner(stage, maxSize, period)
+	r.tuners[stage] = t
+	return t
+}
+
+// authDiagnosis returns the diagnosis of an auth failure, so it is probed
+// once per worker however many bundle threads hit it.
+func (r *workerRegistry) authDiagnosis(key string) *authDiagnosis {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if d, ok := r.hints[key]; ok {
+		return d
+	}
+	d := &authDiagnosis{}
+	r.hints[key] = d
+	return d
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/bigqueryio"
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/x/beamx"
+)
+
+// --- Offline re-parse of stored responses ---
+
+// reparseCommand is the subcommand that re-applies the current response parser
+// to rows written under --store_raw_response:
+//
+//	vertex_gemini reparse --project ... --region ... --temp_location ... [--reparse_run_id ...]
+//
+// No model is called, so a parser fix can be rolled out over past runs for the
+// cost of a BigQuery read and write.
+const reparseCommand = "reparse"
+
+// isReparseCommand reports whether the arguments start with the reparse
+// subcommand, and strips it so the remaining flags parse as usual.
+func isReparseCommand() bool {
+	if len(os.Args) < 2 || os.Args[1] != reparseCommand {
+		return false
+	}
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+	return true
+}
+
+// reparseQuery selects the stored rows to re-parse, optionally from one run.
+// The table's schema is the one read at launch: every GeminiResult column is
+// selected by name, with NULLs and the columns the table predates (see
+// addMissingColumns) replaced by zero values, since the BigQuery loader
+// refuses NULL for the row's fields.
+func reparseQuery(projectID, runID string, have bigquery.Schema) (string, error) {
+	want, err := bigquery.InferSchema(GeminiResult{})
+	if err != nil {
+		return "", fmt.Errorf("failed to infer results schema: %w", err)
+	}
+	if fieldNamed(have, "RawResponse") == nil {
+		return "", fmt.Errorf("results table %s.%s has no RawResponse column; no run stored responses with --store_raw_response", outputDataset, outputTable)
+	}
+	query := fmt.Sprintf("SELECT %s FROM `%s.%s.%s` WHERE RawResponse IS NOT NULL AND RawResponse != ''",
+		strings.Join(columnExprs(want, have, ""), ", "), projectID, outputDataset, outputTable)
+	if runID == "" {
+		return query, nil
+	}
+	if strings.ContainsAny(runID, "'\\\n") {
+		return "", fmt.Errorf("invalid --reparse_run_id %q", runID)
+	}
+	return query + fmt.Sprintf(" AND RunID = '%s'", runID), nil
+}
+
+// columnExprs returns a select list expression per field of want, aliased to
+// its name, reading it from ref (a table alias or struct path with a trailing
+// dot) when have has it.
+func columnExprs(want, have bigquery.Schema, ref string) []string {
+	exprs := make([]string, len(want))
+	for i, f := range want {
+		exprs[i] = fmt.Sprintf("%s AS `%s`", columnExpr(f, fieldNamed(have, f.Name), ref+"`"+f.Name+"`"), f.Name)
+	}
+	return exprs
+}
+
+// columnExpr reads a field, or its zero value when the table lacks it.
+// Records are rebuilt field by field, so NULLs inside them are replaced too.
+func columnExpr(f, have *bigquery.FieldSchema, col string) string {
+	switch {
+	case have == nil:
+		return zeroValue(f)
+	case f.Type == bigquery.RecordFieldType && f.Repeated:
+		return fmt.Sprintf("ARRAY(SELECT AS STRUCT %s FROM UNNEST(%s) AS e)", strings.Join(columnExprs(f.Schema, have.Schema, "e."), ", "), col)
+	case f.Type == bigquery.RecordFieldType:
+		return fmt.Sprintf("STRUCT(%s)", strings.Join(columnExprs(f.Schema, have.Schema, col+"."), ", "))
+	}
+	return fmt.Sprintf("IFNULL(%s, %s)", col, zeroValue(f))
+}
+
+// zeroValue is the SQL literal of a field's Go zero value.
+func zeroValue(f *bigquery.FieldSchema) string {
+	if f.Repeated {
+		return sqlType(f) + "[]"
+	}
+	switch f.Type {
+	case bigquery.RecordFieldType:
+		fields := make([]string, len(f.Schema))
+		for i, sub := range f.Schema {
+			fields[i] = fmt.Sprintf("%s AS `%s`", zeroValue(sub), sub.Name)
+		}
+		return fmt.Sprintf("STRUCT(%s)", strings.Join(fields, ", "))
+	case bigquery.IntegerFieldType:
+		return "0"
+	case bigquery.FloatFieldType:
+		return "0.0"
+	case bigquery.BooleanFieldType:
+		return "FALSE"
+	case bigquery.TimestampFieldType:
+		return "TIMESTAMP '0001-01-01 00:00:00+00'"
+	case bigquery.BytesFieldType:
+		return "b''"
+	}
+	return "''"
+}
+
+// sqlType spells a field's GoogleSQL type, for typed empty arrays.
+func sqlType(f *bigquery.FieldSchema) string {
+	var t string
+	switch f.Type {
+	case bigquery.RecordFieldType:
+		fields := make([]string, len(f.Schema))
+		for i, sub := range f.Schema {
+			fields[i] = fmt.Sprintf("`%s` %s", sub.Name, sqlType(sub))
+		}
+		t = fmt.Sprintf("STRUCT<%s>", strings.Join(fields, ", "))
+	case bigquery.IntegerFieldType:
+		t = "INT64"
+	case bigquery.FloatFieldType:
+		t = "FLOAT64"
+	case bigquery.BooleanFieldType:
+		t = "BOOL"
+	default:
+		t = string(f.Type)
+	}
+	if f.Repeated {
+		return "ARRAY<" + t + ">"
+	}
+	return t
+}
+
+// fieldNamed finds a field by name, case-insensitively as BigQuery does.
+func fieldNamed(schema bigquery.Schema, name string) *bigquery.FieldSchema {
+	for _, f := range schema {
+		if strings.EqualFold(f.Name, name) {
+			return f
+		}
+	}
+	return nil
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*ReparseFn)(nil)).Elem())
+}
+
+// ReparseFn rebuilds the parsed columns of a result row from its stored body.
+// Everything describing the call itself (prompt, model, timing, request ID) is
+// kept as written.
+type ReparseFn struct {
+	LogPolicy    contentPolicy
+	ResponseEnum []string // Allowed answers; mismatches are counted, not dropped
+	unitNormalizer
+
+	ReparsedCounter     beam.Counter
+	ChangedCounter      beam.Counter
+	FailedCounter       beam.Counter
+	EnumMismatchCounter beam.Counter
+}
+
+func (fn *ReparseFn) Setup() {
+	fn.ReparsedCounter = beam.NewCounter("reparse", "rows_reparsed_total")
+	fn.ChangedCounter = beam.NewCounter("reparse", "rows_changed_total")
+	fn.FailedCounter = beam.NewCounter("reparse", "rows_failed_total")
+	fn.EnumMismatchCounter = beam.NewCounter("reparse", "enum_mismatches_total")
+	fn.setupUnits()
+}
+
+// ProcessElement emits the re-parsed row. Rows whose body no longer parses are
+// logged and dropped, leaving the original in place.
+func (fn *ReparseFn) ProcessElement(ctx context.Context, res GeminiResult, emit func(GeminiResult)) {
+	body, err := decodeRawResponse(res)
+	if err == nil {
+		var out vertexOutput
+		if out, err = parseVertexResponse(ctx, body, res.Prompt, fn.LogPolicy); err == nil {
+			fn.apply(ctx, &res, out)
+			emit(res)
+			return
+		}
+	}
+	fn.FailedCounter.Inc(ctx, 1)
+	beamlog.Warnf(ctx, "ReparseFn: Could not re-parse row %s/%d of run %s: %v", res.ParentKey, res.SubIndex, res.RunID, err)
+}
+
+// apply overwrites the parsed columns, including the --output_formats
+// renderings the row was written with. The watermark is kept when the original
+// text carried one; token counts are kept on finish-reason retries, whose
+// stored body covers only the second attempt.
+func (fn *ReparseFn) apply(ctx context.Context, res *GeminiResult, out vertexOutput) {
+	fn.ReparsedCounter.Inc(ctx, 1)
+	out.Text = fn.normalizeUnits(ctx, out.Text)
+	text := out.Text
+	if strings.HasSuffix(res.GeneratedText, invisibleWatermark()) {
+		text += invisibleWatermark()
+	}
+	if text != res.GeneratedText {
+		fn.ChangedCounter.Inc(ctx, 1)
+	}
+	if len(fn.ResponseEnum) > 0 && !isAllowed(out.Text, fn.ResponseEnum) {
+		fn.EnumMismatchCounter.Inc(ctx, 1)
+		beamlog.Warnf(ctx, "ReparseFn: Answer '%s' for prompt '%s' is not one of the allowed values", fn.LogPolicy.redact(strings.TrimSpace(out.Text)), fn.LogPolicy.redact(res.Prompt))
+	}
+	res.GeneratedText = text
+	res.FinishReason = out.FinishReason
+	res.ModelVersion = out.ModelVersion
+	res.SafetyStatus = out.SafetyStatus
+	res.SafetyRatings = out.SafetyRatings
+	res.Citations = out.Citations
+	res.ContentHash = contentHash(text)
+	var formats []string
+	if res.GeneratedHTML != "" {
+		formats = append(formats, outputFormatHTML)
+	}
+	if res.GeneratedPlainText != "" {
+		formats = append(formats, outputFormatText)
+	}
+	convertOutput(res, formats)
+	res.ReadingGrade = readingGrade(text)
+	if res.Attempt < 2 {
+		res.PromptTokens, res.OutputTokens = out.PromptTokens, out.OutputTokens
+		res.TotalTokens = out.PromptTokens + out.OutputTokens
+	}
+	res.CachedTokens = out.CachedTokens
+}
+
+// runReparse builds the reparse pipeline: stored rows are read from the output
+// table and written, re-parsed, to --reparse_table. BigQuery writes only append,
+// so the rewritten rows go to their own table rather than over the originals.
+func runReparse(p *beam.Pipeline, projectID string, have bigquery.Schema) error {
+	query, err := reparseQuery(projectID, *reparseRunID, have)
+	if err != nil {
+		return err
+	}
+	s := p.Root().Scope("Reparse")
+	rows := bigqueryio.Query(s.Scope("ReadStoredResponses"), projectID, query, reflect.TypeOf(GeminiResult{}), bigqueryio.UseStandardSQL())
+	reparsed := beam.ParDo(s, &ReparseFn{
+		LogPolicy:      contentPolicy(*logContentPolicy),
+		ResponseEnum:   responseEnum,
+		unitNormalizer: unitNormalizer{UnitConversions: splitList(*unitConversions)},
+	}, rows)
+	tableName := fmt.Sprintf("%s:%s.%s", projectID, outputDataset, *reparseTable)
+	bigqueryio.Write(s.Scope("WriteReparsed"), projectID, tableName, reparsed)
+	return nil
+}
+
+// resultsTableSchema reads the schema of the results table.
+func resultsTableSchema(ctx context.Context, project string) (bigquery.Schema, error) {
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bigquery client: %w", err)
+	}
+	defer client.Close()
+	md, err := client.Dataset(outputDataset).Table(outputTable).Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return md.Schema, nil
+}
+
+// reparseMain launches the reparse pipeline in place of the generation job.
+func reparseMain(ctx context.Context, project string) {
+	if *responseEnumValues != "" || *responseEnumColumn != "" {
+		values, err := loadResponseEnum(ctx, project)
+		if err != nil {
+			log.Fatalf("Failed to load allowed answers: %v", err)
+		}
+		responseEnum = values
+	}
+	log.Printf("Starting reparse job...")
+	log.Printf("  Source Table: %s:%s.%s", project, outputDataset, outputTable)
+	if *reparseRunID != "" {
+		log.Printf("  Run ID: %s", *reparseRunID)
+	}
+	log.Printf("  Reparse Table: %s:%s.%s", project, outputDataset, *reparseTable)
+
+	have, err := resultsTableSchema(ctx, project)
+	if err != nil {
+		log.Fatalf("Failed to read the results table: %v", err)
+	}
+	p := beam.NewPipeline()
+	if err := runReparse(p, project, have); err != nil {
+		log.Fatalf("Failed to construct the pipeline graph: %v", err)
+	}
+	if _, err := beamx.RunWithMetrics(ctx, p); err != nil {
+		log.Fatalf("Failed to execute pipeline: %v", err)
+	}
+	log.Printf("Reparse finished successfully.")
+}
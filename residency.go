@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+)
+
+// --- Data residency enforcement ---
+
+// checkDataResidency refuses the run unless every location the job touches falls inside
+// --allowed_regions: the Vertex AI endpoint region, the datasets read by the input query
+// (found with a dry run), the output dataset, and the buckets behind the GCS locations.
+func checkDataResidency(ctx context.Context, projects runProjects, region, inputQuery string, gcsPaths []string) error {
+	allowed := make(map[string]bool)
+	for _, r := range splitList(*allowedRegions) {
+		allowed[strings.ToLower(r)] = true
+	}
+
+	// resource -> location
+	locations := map[string]string{"Vertex AI endpoint": region}
+
+	bq, err := bigquery.NewClient(ctx, projects.Input)
+	if err != nil {
+		return fmt.Errorf("failed to create bigquery client: %w", err)
+	}
+	defer bq.Close()
+
+	datasets, err := queryDatasets(ctx, bq, inputQuery)
+	if err != nil {
+		return err
+	}
+	datasets = append(datasets, bq.DatasetInProject(projects.Output, outputDataset))
+	for _, ds := range datasets {
+		md, err := ds.Metadata(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read location of dataset %s.%s: %w", ds.ProjectID, ds.DatasetID, err)
+		}
+		locations["BigQuery dataset "+ds.ProjectID+"."+ds.DatasetID] = md.Location
+	}
+
+	gcs, err := storage.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create storage client: %w", err)
+	}
+	defer gcs.Close()
+	for _, path := range gcsPaths {
+		bucket, ok := gcsBucket(path)
+		if !ok {
+			continue
+		}
+		attrs, err := gcs.Bucket(bucket).Attrs(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read location of bucket %s: %w", bucket, err)
+		}
+		locations["GCS bucket "+bucket] = attrs.Location
+	}
+
+	var violations []string
+	for resource, loc := range locations {
+		if allowed[strings.ToLower(loc)] {
+			log.Printf("Data residency: %s in %s (allowed)", resource, loc)
+			continue
+		}
+		violations = append(violations, fmt.Sprintf("%s is in %s", resource, loc))
+	}
+	if len(violations) > 0 {
+		sort.Strings(violations)
+		return fmt.Errorf("data residency violation (allowed: %s): %s", *allowedRegions, strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+// queryDatasets dry-runs the query and returns the distinct datasets it reads from.
+func queryDatasets(ctx context.Context, client *bigquery.Client, sql string) ([]*bigquery.Dataset, error) {
+	if sql == "" {
+		return nil, nil
+	}
+	q := client.Query(sql)
+	q.DryRun = true
+	job, err := q.Run(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dry-run input query: %w", err)
+	}
+	stats, ok := job.LastStatus().Statistics.Details.(*bigquery.QueryStatistics)
+	if !ok {
+		return nil, fmt.Errorf("dry run of input query returned no query statistics")
+	}
+	seen := make(map[string]bool)
+	var datasets []*bigquery.Dataset
+	for _, t := range stats.ReferencedTables {
+		key := t.ProjectID + "." + t.DatasetID
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		datasets = append(datasets, client.DatasetInProject(t.ProjectID, t.DatasetID))
+	}
+	return datasets, nil
+}
+
+// gcsBucket extracts the bucket name from a gs:// path.
+func gcsBucket(path string) (string, bool) {
+	rest, ok := strings.CutPrefix(path, "gs://")
+	if !ok {
+		return "", false
+	}
+	bucket, _, _ := strings.Cut(rest, "/")
+	return bucket, bucket != ""
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// --- Safety ratings and citations ---
+
+// Besides the overall SafetyStatus and FinishReason, every row keeps the
+// endpoint's per-category safety ratings and the citations it attached to the
+// answer, so blocked, truncated, or recited generations can be audited in SQL
+// (e.g. UNNEST(SafetyRatings) WHERE Blocked). Gemini models rate probability
+// and severity; predict models only return a score per category. Both are
+// also recovered from stored responses by the reparse command.
+
+// SafetyRating is the endpoint's verdict on one harm category of the answer.
+type SafetyRating struct {
+	Category      string  `beam:"Category"`
+	Probability   string  `beam:"Probability"` // NEGLIGIBLE, LOW, MEDIUM, or HIGH; empty for predict models
+	Score         float64 `beam:"Score"`       // Probability score from 0 to 1
+	Severity      string  `beam:"Severity"`    // e.g. HARM_SEVERITY_LOW; empty when not rated
+	SeverityScore float64 `beam:"SeverityScore"`
+	Blocked       bool    `beam:"Blocked"` // This category blocked the answer
+}
+
+// Citation is a passage of the answer the endpoint attributes to a source.
+type Citation struct {
+	StartIndex      int64  `beam:"StartIndex"` // Span of the passage in the answer as generated
+	EndIndex        int64  `beam:"EndIndex"`
+	URI             string `beam:"URI"`
+	Title           string `beam:"Title"`
+	License         string `beam:"License"`
+	PublicationDate string `beam:"PublicationDate"` // YYYY-MM-DD, or shorter when only the year or month is known
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*SafetyRating)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*Citation)(nil)).Elem())
+}
+
+// VertexCitationMetadata lists the citations of a predict model's answer.
+type VertexCitationMetadata struct {
+	Citations []struct {
+		StartIndex      int64  `json:"startIndex"`
+		EndIndex        int64  `json:"endIndex"`
+		URL             string `json:"url"`
+		Title           string `json:"title"`
+		License         string `json:"license"`
+		PublicationDate string `json:"publicationDate"`
+	} `json:"citations"`
+}
+
+// GeminiCitationMetadata lists the citations of a Gemini candidate.
+type GeminiCitationMetadata struct {
+	Citations []struct {
+		StartIndex      int64  `json:"startIndex"`
+		EndIndex        int64  `json:"endIndex"`
+		URI             string `json:"uri"`
+		Title           string `json:"title"`
+		License         string `json:"license"`
+		PublicationDate *struct {
+			Year  int `json:"year"`
+			Month int `json:"month"`
+			Day   int `json:"day"`
+		} `json:"publicationDate"`
+	} `json:"citations"`
+}
+
+// predictSafetyRatings pairs the categories of a predict response with their scores.
+func predictSafetyRatings(attrs *VertexSafetyAttributes) []SafetyRating {
+	if attrs == nil {
+		return nil
+	}
+	var ratings []SafetyRating
+	for i, category := range attrs.Categories {
+		r := SafetyRating{Category: category}
+		if i < len(attrs.Scores) {
+			r.Score = attrs.Scores[i]
+		}
+		ratings = append(ratings, r)
+	}
+	return ratings
+}
+
+func predictCitations(meta *VertexCitationMetadata) []Citation {
+	if meta == nil {
+		return nil
+	}
+	var citations []Citation
+	for _, c := range meta.Citations {
+		citations = append(citations, Citation{
+			StartIndex:      c.StartIndex,
+			EndIndex:        c.EndIndex,
+			URI:             c.URL,
+			Title:           c.Title,
+			License:         c.License,
+			PublicationDate: c.PublicationDate,
+		})
+	}
+	return citations
+}
+
+func geminiSafetyRatings(ratings []GeminiSafetyRating) []SafetyRating {
+	var out []SafetyRating
+	for _, r := range ratings {
+		out = append(out, SafetyRating{
+			Category:      r.Category,
+			Probability:   r.Probability,
+			Score:         r.ProbabilityScore,
+			Severity:      r.Severity,
+			SeverityScore: r.SeverityScore,
+			Blocked:       r.Blocked,
+		})
+	}
+	return out
+}
+
+func geminiCitations(meta *GeminiCitationMetadata) []Citation {
+	if meta == nil {
+		return nil
+	}
+	var citations []Citation
+	for _, c := range meta.Citations {
+		citation := Citation{
+			StartIndex: c.StartIndex,
+			EndIndex:   c.EndIndex,
+			URI:        c.URI,
+			Title:      c.Title,
+			License:    c.License,
+		}
+		if d := c.PublicationDate; d != nil && d.Year > 0 {
+			switch {
+			case d.Month == 0:
+				citation.PublicationDate = fmt.Sprintf("%04d", d.Year)
+			case d.Day == 0:
+				citation.PublicationDate = fmt.Sprintf("%04d-%02d", d.Year, d.Month)
+			default:
+				citation.PublicationDate = fmt.Sprintf("%04d-%02d-%02d", d.Year, d.Month, d.Day)
+			}
+		}
+		citations = append(citations, citation)
+	}
+	return citations
+}
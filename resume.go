@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/bigqueryio"
+)
+
+// --- Resuming a partly failed run ---
+
+// Under --resume the generate task skips the prompts the results table
+// already answers, so rerunning a job that failed halfway only pays for the
+// rest. The PromptHash of every answered row is read from the results table
+// and joined with the PromptHash each prompt would get (see hash.go); prompts
+// with a match are dropped before the model stage. A change of model or
+// generation parameters changes the hashes, so those prompts run again.
+// Fallback rows don't count as answers. Per-run reports (run metrics, fan-out
+// aggregates, spot checks) only cover the prompts this run sends.
+
+// AnsweredPrompt is one PromptHash of the results table.
+type AnsweredPrompt struct {
+	PromptHash string `bigquery:"PromptHash"`
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*AnsweredPrompt)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*KeyPromptByHashFn)(nil)).Elem())
+	beam.RegisterFunction(keyAnsweredPrompt)
+	beam.RegisterType(reflect.TypeOf((*SkipAnsweredFn)(nil)).Elem())
+}
+
+// answeredQuery selects the distinct hashes of the real answers in the results table.
+func answeredQuery(project string) string {
+	return fmt.Sprintf("SELECT DISTINCT PromptHash FROM `%s.%s.%s` WHERE PromptHash IS NOT NULL AND Fallback IS NOT TRUE", project, outputDataset, outputTable)
+}
+
+// readAnsweredPrompts reads the hashes of the prompts the results table answers.
+func readAnsweredPrompts(s beam.Scope, project string) beam.PCollection {
+	return bigqueryio.Query(s.Scope("ReadAnsweredPrompts"), project, answeredQuery(project), reflect.TypeOf(AnsweredPrompt{}), bigqueryio.UseStandardSQL())
+}
+
+// KeyPromptByHashFn keys each prompt by the PromptHash Gen would give it.
+type KeyPromptByHashFn struct {
+	Gen *GenerateTextFn
+}
+
+func (fn *KeyPromptByHashFn) ProcessElement(p Prompt) (string, Prompt) {
+	params := fn.Gen.parametersFor(p)
+	return PromptHash(p.Prompt, fn.Gen.route(p, params).Model, params), p
+}
+
+func keyAnsweredPrompt(a AnsweredPrompt) (string, AnsweredPrompt) {
+	return a.PromptHash, a
+}
+
+// SkipAnsweredFn passes on the prompts of a hash nothing answers yet.
+type SkipAnsweredFn struct {
+	skipped beam.Counter
+}
+
+func (fn *SkipAnsweredFn) Setup() {
+	fn.skipped = beam.NewCounter("vertexai", "resume_skipped_total")
+}
+
+func (fn *SkipAnsweredFn) ProcessElement(ctx context.Context, _ string, prompts func(*Prompt) bool, answers func(*AnsweredPrompt) bool, emit func(Prompt)) {
+	var a AnsweredPrompt
+	answered := answers(&a)
+	var p Prompt
+	for prompts(&p) {
+		if answered {
+			fn.skipped.Inc(ctx, 1)
+			continue
+		}
+		emit(p)
+	}
+}
+
+// skipAnswered drops the prompts gen would send that answered already answers.
+func skipAnswered(s beam.Scope, gen *GenerateTextFn, answered, prompts beam.PCollection) beam.PCollection {
+	s = s.Scope("SkipAnswered")
+	keyed := beam.ParDo(s, &KeyPromptByHashFn{Gen: gen}, prompts)
+	joined := beam.CoGroupByKey(s, keyed, beam.ParDo(s, keyAnsweredPrompt, answered))
+	return beam.ParDo(s, &SkipAnsweredFn{}, joined)
+}
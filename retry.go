@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Configurable retry classification ---
+
+// retryConfigFile is the JSON file named by --retry_config:
+//
+//	{"max_attempts": 4, "initial_backoff": "1s", "max_backoff": "30s",
+//	 "rules": [
+//	   {"grpc_codes": ["INVALID_ARGUMENT", "PERMISSION_DENIED"], "action": "permanent"},
+//	   {"status_codes": [0, 429, 500, 503], "action": "retry"},
+//	   {"contains": ["deadline exceeded"], "action": "retry"}
+//	 ],
+//	 "default": "permanent"}
+//
+// Rules are tried in order and the first match decides. A rule matches when the
+// error has one of its HTTP status codes (0 means no response was received), one
+// of its Google API status names, or contains one of its substrings
+// (case-insensitively). Errors no rule matches get the default action.
+type retryConfigFile struct {
+	MaxAttempts    int         `json:"max_attempts"`
+	InitialBackoff string      `json:"initial_backoff"`
+	MaxBackoff     string      `json:"max_backoff"`
+	Rules          []retryRule `json:"rules"`
+	Default        string      `json:"default"`
+}
+
+// Retry actions.
+const (
+	retryAction     = "retry"
+	permanentAction = "permanent"
+)
+
+type retryRule struct {
+	StatusCodes []int    `json:"status_codes,omitempty"`
+	GRPCCodes   []string `json:"grpc_codes,omitempty"`
+	Contains    []string `json:"contains,omitempty"`
+	Action      string   `json:"action"`
+}
+
+// matches reports whether the rule applies to an error.
+func (r retryRule) matches(httpStatus int, grpcCode, message string) bool {
+	for _, c := range r.StatusCodes {
+		if c == httpStatus {
+			return true
+		}
+	}
+	for _, c := range r.GRPCCodes {
+		if grpcCode != "" && strings.EqualFold(c, grpcCode) {
+			return true
+		}
+	}
+	message = strings.ToLower(message)
+	for _, s := range r.Contains {
+		if strings.Contains(message, strings.ToLower(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryPolicy is the parsed configuration, carried to workers on GenerateTextFn.
+type retryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Rules          []retryRule
+	Default        string
+}
+
+// retryConfig is loaded by main when --retry_config is set, and is otherwise
+// the built-in policy of --max_retries.
+var retryConfig *retryPolicy
+
+// transientHTTPStatuses are retried by the built-in policy; 0 is a call that
+// got no response.
+var transientHTTPStatuses = []int{0, http.StatusRequestTimeout, http.StatusTooManyRequests,
+	http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// defaultRetryPolicy retries network errors, 408, 429, and 5xx responses up to
+// maxRetries times, with 1s to 30s of jittered exponential backoff; every other
+// error is permanent. It stands in for --retry_config when that is unset.
+func defaultRetryPolicy(maxRetries int) *retryPolicy {
+	return &retryPolicy{
+		MaxAttempts:    maxRetries + 1,
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+		Rules:          []retryRule{{StatusCodes: transientHTTPStatuses, Action: retryAction}},
+		Default:        permanentAction,
+	}
+}
+
+// loadRetryPolicy reads and validates a retry configuration from a local path or gs:// URI.
+func loadRetryPolicy(ctx context.Context, path string) (*retryPolicy, error) {
+	raw, err := readConfigFile(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg retryConfigFile
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse retry config %s: %w", path, err)
+	}
+	p := &retryPolicy{MaxAttempts: cfg.MaxAttempts, Rules: cfg.Rules, Default: cfg.Default, InitialBackoff: time.Second, MaxBackoff: 30 * time.Second}
+	if p.Default == "" {
+		p.Default = permanentAction
+	}
+	if cfg.InitialBackoff != "" {
+		if p.InitialBackoff, err = time.ParseDuration(cfg.InitialBackoff); err != nil {
+			return nil, fmt.Errorf("invalid retry config %s: initial_backoff: %w", path, err)
+		}
+	}
+	if cfg.MaxBackoff != "" {
+		if p.MaxBackoff, err = time.ParseDuration(cfg.MaxBackoff); err != nil {
+			return nil, fmt.Errorf("invalid retry config %s: max_backoff: %w", path, err)
+		}
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid retry config %s: %w", path, err)
+	}
+	return p, nil
+}
+
+func (p *retryPolicy) validate() error {
+	if p.MaxAttempts < 1 {
+		return fmt.Errorf("max_attempts must be at least 1")
+	}
+	if p.InitialBackoff <= 0 || p.MaxBackoff < p.InitialBackoff {
+		return fmt.Errorf("backoffs must be positive with max_backoff >= initial_backoff")
+	}
+	for i, r := range p.Rules {
+		if r.Action != retryAction && r.Action != permanentAction {
+			return fmt.Errorf("rule %d: action must be %s or %s", i+1, retryAction, permanentAction)
+		}
+	}
+	if p.Default != retryAction && p.Default != permanentAction {
+		return fmt.Errorf("default must be %s or %s", retryAction, permanentAction)
+	}
+	return nil
+}
+
+// classify returns the action for an error. Circuit-open rejections, spent
+// project and stage budgets, context cancellation, and prompts that are too
+// long are never retried: the breaker, the budgets, the job, and the model
+// ladder own those.
+func (p *retryPolicy) classify(err error) string {
+	if err == nil || errors.Is(err, errCircuitOpen) || errors.Is(err, errProjectBudgetsSpent) || errors.Is(err, errStageBudgetSpent) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || isContextOverflowError(err) {
+		return permanentAction
+	}
+	var httpStatus int
+	var grpcCode string
+	var apiErr *vertexAPIError
+	if errors.As(err, &apiErr) {
+		httpStatus, grpcCode = apiErr.HTTPStatus, apiErr.Status
+	}
+	for _, r := range p.Rules {
+		if r.matches(httpStatus, grpcCode, err.Error()) {
+			return r.Action
+		}
+	}
+	return p.Default
+}
+
+// backoff returns the jittered wait before the given retry (1 for the first).
+func (p *retryPolicy) backoff(retry int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// errorClass labels a final error for the dead-letter table.
+func (fn *GenerateTextFn) errorClass(err error) string {
+	if fn.Retry == nil {
+		return ""
+	}
+	return fn.Retry.classify(err)
+}
+
+// retryWait reports whether a failed attempt should be retried, and waits out
+// the backoff if so, or the response's Retry-After when that is longer.
+func (fn *GenerateTextFn) retryWait(ctx context.Context, err error, attempt int) bool {
+	if fn.Retry == nil || attempt >= fn.Retry.MaxAttempts || fn.Retry.classify(err) != retryAction {
+		return false
+	}
+	fn.RetryCounter.Inc(ctx, 1)
+	wait := fn.Retry.backoff(attempt)
+	var apiErr *vertexAPIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > wait {
+		wait = apiErr.RetryAfter
+	}
+	start := time.Now()
+	defer func() { fn.recordWait(ctx, time.Since(start)) }()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(wait):
+		return true
+	}
+}
+
+// parseRetryAfter reads a Retry-After header, given in seconds or as an HTTP
+// date; it returns 0 when the header is absent or invalid.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
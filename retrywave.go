@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// --- End-of-job retry wave ---
+
+// Under --end_of_job_retry each model stage gives its transiently failed
+// prompts one more attempt once the stage's first pass is over, so outages,
+// quota exhaustion, and an open circuit late in a run don't have to be cleaned
+// up with a separate replay run. The failures are joined back to the prompts
+// they came from; the join doubles as the barrier that holds the wave back
+// until every first-pass call has finished. Only failures of the wave itself
+// reach the dead-letter table, alongside first-pass failures that were not
+// transient.
+
+// transientStatuses are Google API statuses worth another attempt later in the job.
+var transientStatuses = map[string]bool{
+	"RESOURCE_EXHAUSTED": true,
+	"UNAVAILABLE":        true,
+	"DEADLINE_EXCEEDED":  true,
+	"INTERNAL":           true,
+	"ABORTED":            true,
+}
+
+// isTransientFailure reports whether a dead letter may succeed when retried
+// later. A --retry_config classification decides when there is one, except that
+// an open circuit always counts as transient: it is exactly what the wave
+// waits out. Without a classification, HTTP 408, 429, and 5xx responses and
+// calls that got no response count as transient; invalid answers, spent
+// budgets, and prompts skipped for --max_runtime never do.
+func isTransientFailure(fc FailedCall) bool {
+	if fc.ErrorStatus == maxRuntimeStatus {
+		return false
+	}
+	if strings.Contains(fc.ErrorMessage, errCircuitOpen.Error()) {
+		return true
+	}
+	switch fc.ErrorClass {
+	case retryAction:
+		return true
+	case permanentAction:
+		return false
+	}
+	if strings.Contains(fc.ErrorMessage, errProjectBudgetsSpent.Error()) || strings.Contains(fc.ErrorMessage, errStageBudgetSpent.Error()) {
+		return false
+	}
+	switch {
+	case fc.HTTPStatus == http.StatusRequestTimeout || fc.HTTPStatus == http.StatusTooManyRequests || fc.HTTPStatus >= 500:
+		return true
+	case fc.HTTPStatus == 0:
+		return fc.ErrorStatus == "" // Rejected answers (OUT_OF_RANGE, RULE_VIOLATION, and the like) have no HTTP status either
+	}
+	return transientStatuses[fc.ErrorStatus]
+}
+
+// retryKey identifies a prompt and the dead letters it produced.
+func retryKey(parentKey string, subIndex int, prompt string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%s", parentKey, subIndex, prompt)))
+	return hex.EncodeToString(sum[:])
+}
+
+func init() {
+	beam.RegisterFunction(keyPromptForRetry)
+	beam.RegisterFunction(keyFailureForRetry)
+	beam.RegisterType(reflect.TypeOf((*SelectRetriesFn)(nil)).Elem())
+}
+
+func keyPromptForRetry(p Prompt) (string, Prompt) {
+	return retryKey(p.ParentKey, p.SubIndex, p.Prompt), p
+}
+
+func keyFailureForRetry(fc FailedCall) (string, FailedCall) {
+	return retryKey(fc.ParentKey, fc.SubIndex, fc.Prompt), fc
+}
+
+// SelectRetriesFn emits the prompt of every transient failure for the retry
+// wave and passes the other failures through as final dead letters.
+type SelectRetriesFn struct {
+	retried beam.Counter
+	final   beam.Counter
+}
+
+func (fn *SelectRetriesFn) Setup() {
+	fn.retried = beam.NewCounter("vertexai", "end_of_job_retries_total")
+	fn.final = beam.NewCounter("vertexai", "end_of_job_retry_skipped_total")
+}
+
+func (fn *SelectRetriesFn) ProcessElement(ctx context.Context, key string, prompts func(*Prompt) bool, failures func(*FailedCall) bool, emit func(Prompt), emitFailed func(FailedCall)) {
+	var p Prompt
+	havePrompt := prompts(&p)
+	var fc FailedCall
+	for failures(&fc) {
+		if havePrompt && isTransientFailure(fc) {
+			fn.retried.Inc(ctx, 1)
+			emit(p)
+			continue
+		}
+		fn.final.Inc(ctx, 1)
+		emitFailed(fc)
+	}
+}
+
+// retryWave sends the transient failures of a first pass through fn once more
+// and returns the combined results and final dead letters.
+func retryWave(s beam.Scope, fn *GenerateTextFn, prompts, results, failed beam.PCollection) (beam.PCollection, beam.PCollection) {
+	s = s.Scope("EndOfJobRetry")
+	joined := beam.CoGroupByKey(s, beam.ParDo(s, keyPromptForRetry, prompts), beam.ParDo(s, keyFailureForRetry, failed))
+	retryPrompts, final := beam.ParDo2(s.Scope("SelectRetries"), &SelectRetriesFn{}, joined)
+	retried, failedAgain := beam.ParDo2(s.Scope("Retry"), fn, retryPrompts)
+	return beam.Flatten(s, results, retried), beam.Flatten(s, final, failedAgain)
+}
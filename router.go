@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// --- Model tier routing ---
+
+// Under --model_tiers each row goes to the cheapest model tier that can handle
+// it, judged by a complexity estimate, instead of to --model_name. The
+// estimate is deliberately simple and deterministic, so a row always routes
+// the same way and its prompt hash and cache entries stay stable:
+//   - about one point per input token (four characters), and
+//   - a surcharge of --tier_structured_points when the answer must follow a
+//     structure: a response schema, a closed set of answers, or JSON asked
+//     for in the prompt, which small models break more often.
+//
+// The chosen tier and the estimate are recorded in the ModelTier and
+// Complexity columns; escalation on context overflow (--model_ladder) still
+// starts from the routed model.
+
+// charsPerToken is the rough number of characters per input token.
+const charsPerToken = 4
+
+// modelTier is one --model_tiers entry.
+type modelTier struct {
+	Model     string
+	MaxPoints int64 // Highest complexity routed to the tier; 0 on the last tier, which takes the rest
+}
+
+// parseModelTiers parses --model_tiers entries of the form model:max_points,
+// ordered from cheapest to most capable. The last entry has no bound.
+func parseModelTiers(entries []string) ([]modelTier, error) {
+	var tiers []modelTier
+	for i, e := range entries {
+		model, bound, hasBound := strings.Cut(e, ":")
+		model = strings.TrimSpace(model)
+		if model == "" {
+			return nil, fmt.Errorf("%q: want model:max_points", e)
+		}
+		last := i == len(entries)-1
+		if last && hasBound {
+			return nil, fmt.Errorf("%q: the last tier takes every remaining row and has no bound", e)
+		}
+		t := modelTier{Model: model}
+		if !last {
+			n, err := strconv.ParseInt(strings.TrimSpace(bound), 10, 64)
+			if !hasBound || err != nil || n <= 0 {
+				return nil, fmt.Errorf("%q: want model:max_points with a positive bound", e)
+			}
+			if len(tiers) > 0 && n <= tiers[len(tiers)-1].MaxPoints {
+				return nil, fmt.Errorf("%q: bounds must increase from tier to tier", e)
+			}
+			t.MaxPoints = n
+		}
+		tiers = append(tiers, t)
+	}
+	if len(tiers) == 1 {
+		return nil, fmt.Errorf("one tier routes nothing; use --model_name instead")
+	}
+	return tiers, nil
+}
+
+// routeDecision is the model a row starts with.
+type routeDecision struct {
+	Model      string
+	Tier       int   // 1-based; 0 when routing is off
+	Complexity int64 // Estimate the tier was chosen by; 0 when routing is off
+}
+
+// route picks the model tier of a prompt, or --model_name when routing is off.
+func (fn *GenerateTextFn) route(p Prompt, params VertexParameters) routeDecision {
+	if len(fn.ModelTiers) == 0 {
+		return routeDecision{Model: fn.ModelName}
+	}
+	score := promptComplexity(p.Prompt, params, fn.TierStructuredPoints)
+	for i, t := range fn.ModelTiers[:len(fn.ModelTiers)-1] {
+		if score <= t.MaxPoints {
+			return routeDecision{Model: t.Model, Tier: i + 1, Complexity: score}
+		}
+	}
+	last := fn.ModelTiers[len(fn.ModelTiers)-1]
+	return routeDecision{Model: last.Model, Tier: len(fn.ModelTiers), Complexity: score}
+}
+
+// promptComplexity estimates how demanding a prompt is, in points.
+func promptComplexity(prompt string, params VertexParameters, structuredPoints int64) int64 {
+	points := int64((utf8.RuneCountInString(prompt) + charsPerToken - 1) / charsPerToken)
+	if params.ResponseSchema != nil || params.ResponseMimeType == "application/json" || strings.Contains(strings.ToLower(prompt), "json") {
+		points += structuredPoints
+	}
+	return points
+}
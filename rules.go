@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// --- Cross-field consistency rules ---
+
+// consistencyConfig is the JSON file named by --consistency_rules:
+//
+//	{"fields": {"calories": "calories", "fat_g": "total fat", "carbs_g": "carbohydrate", "protein_g": "protein"},
+//	 "rules": [
+//	   {"name": "atwater", "check": "fat_g*9 + carbs_g*4 + protein_g*4 within 20% of calories", "action": "dlq"},
+//	   {"name": "sat_fat", "check": "saturated_fat_g <= fat_g"}
+//	 ]}
+//
+// Values are read from the answer as a JSON object when it is one (by field
+// name, optionally inside a ```json fence), and otherwise from labelled text
+// like "Total Fat: 12g" using the label given in fields. A check compares two
+// arithmetic expressions (+ - * / and parentheses over numbers and fields)
+// with <=, >=, <, >, ==, or "within N% of". Rules naming a field the answer
+// doesn't have are skipped. Violations are recorded in the RuleViolations
+// column, or dead-lettered under the dlq action.
+type consistencyConfig struct {
+	Fields map[string]string `json:"fields"`
+	Rules  []consistencyRule `json:"rules"`
+}
+
+type consistencyRule struct {
+	Name   string `json:"name"`
+	Check  string `json:"check"`
+	Action string `json:"action"` // flag (default) or dlq
+}
+
+// Rule actions.
+const (
+	ruleActionFlag = "flag"
+	ruleActionDLQ  = "dlq"
+)
+
+// errRuleViolation marks answers dead-lettered by a dlq rule.
+var errRuleViolation = errors.New("generated values break consistency rules")
+
+// consistencyRules is loaded by main when --consistency_rules is set.
+var consistencyRules *consistencyConfig
+
+// loadConsistencyRules reads and validates rules from a local path or gs:// URI.
+func loadConsistencyRules(ctx context.Context, path string) (*consistencyConfig, error) {
+	raw, err := readConfigFile(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg consistencyConfig
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse consistency rules %s: %w", path, err)
+	}
+	if _, err := cfg.compile(); err != nil {
+		return nil, fmt.Errorf("invalid consistency rules %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// compiledRule is a parsed consistency rule.
+type compiledRule struct {
+	consistencyRule
+	lhs, rhs  *ruleExpr
+	cmp       string  // Comparison operator, or "within"
+	tolerance float64 // Relative tolerance for "within"
+	violated  beam.Counter
+}
+
+// ruleSet is the compiled configuration used by GenerateTextFn.
+type ruleSet struct {
+	rules    []*compiledRule
+	fields   []string // Every field the rules read
+	patterns map[string]*regexp.Regexp
+}
+
+// compile parses every check. Per-rule counters live in the consistency_rules
+// namespace, e.g. violations_total/atwater.
+func (c *consistencyConfig) compile() (*ruleSet, error) {
+	rs := &ruleSet{patterns: make(map[string]*regexp.Regexp)}
+	names := make(map[string]bool)
+	for i, r := range c.Rules {
+		if r.Name == "" || names[r.Name] {
+			return nil, fmt.Errorf("rule %d: name must be set and unique", i+1)
+		}
+		names[r.Name] = true
+		if r.Action == "" {
+			r.Action = ruleActionFlag
+		}
+		if r.Action != ruleActionFlag && r.Action != ruleActionDLQ {
+			return nil, fmt.Errorf("rule %s: action must be %s or %s", r.Name, ruleActionFlag, ruleActionDLQ)
+		}
+		cr, err := parseRuleCheck(r.Check)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", r.Name, err)
+		}
+		cr.consistencyRule = r
+		cr.violated = beam.NewCounter("consistency_rules", "violations_total/"+r.Name)
+		for _, f := range append(cr.lhs.fieldNames(), cr.rhs.fieldNames()...) {
+			if _, seen := rs.patterns[f]; seen {
+				continue
+			}
+			label := c.Fields[f]
+			if label == "" {
+				label = f
+			}
+			rs.patterns[f] = labelPattern(label)
+			rs.fields = append(rs.fields, f)
+		}
+		rs.rules = append(rs.rules, cr)
+	}
+	return rs, nil
+}
+
+// values extracts the rules' fields from an answer.
+func (rs *ruleSet) values(text string) map[string]float64 {
+	vals := make(map[string]float64)
+	if obj, ok := jsonObject(text); ok {
+		for _, f := range rs.fields {
+			switch v := obj[f].(type) {
+			case float64:
+				vals[f] = v
+			case string:
+				if n, err := parseNumber(strings.TrimSpace(v)); err == nil {
+					vals[f] = n
+				}
+			}
+		}
+		return vals
+	}
+	for _, f := range rs.fields {
+		if m := rs.patterns[f].FindStringSubmatch(text); m != nil {
+			if n, err := parseNumber(m[1]); err == nil {
+				vals[f] = n
+			}
+		}
+	}
+	return vals
+}
+
+// jsonObject parses an answer that is a JSON object, possibly fenced as a code block.
+func jsonObject(text string) (map[string]any, bool) {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "```") {
+		text = strings.TrimPrefix(text, "```json")
+		text = strings.TrimPrefix(text, "```")
+		text = strings.TrimSuffix(strings.TrimSpace(text), "```")
+	}
+	var obj map[string]any
+	if json.Unmarshal([]byte(text), &obj) != nil {
+		return nil, false
+	}
+	return obj, true
+}
+
+// check evaluates every rule against an answer. It returns the violations, and
+// whether one of them came from a dlq rule.
+func (rs *ruleSet) check(ctx context.Context, text string) ([]string, bool) {
+	vals := rs.values(text)
+	var violations []string
+	dlq := false
+	for _, r := range rs.rules {
+		desc, broken := r.broken(vals)
+		if !broken {
+			continue
+		}
+		r.violated.Inc(ctx, 1)
+		violations = append(violations, r.Name+": "+desc)
+		dlq = dlq || r.Action == ruleActionDLQ
+	}
+	return violations, dlq
+}
+
+// broken reports whether the rule applies to the values and fails.
+func (r *compiledRule) broken(vals map[string]float64) (string, bool) {
+	lhs, ok1 := r.lhs.eval(vals)
+	rhs, ok2 := r.rhs.eval(vals)
+	if !ok1 || !ok2 {
+		return "", false
+	}
+	var holds bool
+	switch r.cmp {
+	case "within":
+		holds = math.Abs(lhs-rhs) <= r.tolerance*math.Abs(rhs)
+	case "<=":
+		holds = lhs <= rhs
+	case ">=":
+		holds = lhs >= rhs
+	case "<":
+		holds = lhs < rhs
+	case ">":
+		holds = lhs > rhs
+	case "==":
+		holds = lhs == rhs
+	}
+	if holds {
+		return "", false
+	}
+	return fmt.Sprintf("%s (%g vs %g)", r.Check, lhs, rhs), true
+}
+
+// --- Rule expressions ---
+
+// ruleExpr is a node of an arithmetic expression over fields.
+type ruleExpr struct {
+	op    byte // 0 for a number, 'f' for a field, 'n' for negation, or + - * /
+	num   float64
+	field string
+	l, r  *ruleExpr
+}
+
+// eval computes the expression; it reports false when a field is missing or a
+// division is by zero.
+func (e *ruleExpr) eval(vals map[string]float64) (float64, bool) {
+	switch e.op {
+	case 0:
+		return e.num, true
+	case 'f':
+		v, ok := vals[e.field]
+		return v, ok
+	case 'n':
+		v, ok := e.l.eval(vals)
+		return -v, ok
+	}
+	l, ok1 := e.l.eval(vals)
+	r, ok2 := e.r.eval(vals)
+	if !ok1 || !ok2 {
+		return 0, false
+	}
+	switch e.op {
+	case '+':
+		return l + r, true
+	case '-':
+		return l - r, true
+	case '*':
+		return l * r, true
+	}
+	if r == 0 {
+		return 0, false
+	}
+	return l / r, true
+}
+
+func (e *ruleExpr) fieldNames() []string {
+	if e == nil {
+		return nil
+	}
+	if e.op == 'f' {
+		return []string{e.field}
+	}
+	return append(e.l.fieldNames(), e.r.fieldNames()...)
+}
+
+// ruleParser is a recursive-descent parser over the tokens of a check.
+type ruleParser struct {
+	toks []string
+	pos  int
+}
+
+// parseRuleCheck parses "expr op expr" or "expr within N% of expr".
+func parseRuleCheck(check string) (*compiledRule, error) {
+	toks, err := tokenizeRule(check)
+	if err != nil {
+		return nil, err
+	}
+	p := &ruleParser{toks: toks}
+	cr := &compiledRule{}
+	if cr.lhs, err = p.sum(); err != nil {
+		return nil, err
+	}
+	switch op := p.next(); op {
+	case "within":
+		n, err := strconv.ParseFloat(p.next(), 64)
+		if err != nil || p.next() != "%" || p.next() != "of" {
+			return nil, fmt.Errorf("want \"within N%% of\" in %q", check)
+		}
+		cr.cmp, cr.tolerance = "within", n/100
+	case "<=", ">=", "<", ">", "==":
+		cr.cmp = op
+	default:
+		return nil, fmt.Errorf("want a comparison in %q", check)
+	}
+	if cr.rhs, err = p.sum(); err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q in %q", p.toks[p.pos], check)
+	}
+	return cr, nil
+}
+
+func (p *ruleParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *ruleParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *ruleParser) sum() (*ruleExpr, error) {
+	l, err := p.product()
+	for err == nil && (p.peek() == "+" || p.peek() == "-") {
+		op := p.next()[0]
+		var r *ruleExpr
+		if r, err = p.product(); err == nil {
+			l = &ruleExpr{op: op, l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+func (p *ruleParser) product() (*ruleExpr, error) {
+	l, err := p.unary()
+	for err == nil && (p.peek() == "*" || p.peek() == "/") {
+		op := p.next()[0]
+		var r *ruleExpr
+		if r, err = p.unary(); err == nil {
+			l = &ruleExpr{op: op, l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+func (p *ruleParser) unary() (*ruleExpr, error) {
+	t := p.next()
+	switch {
+	case t == "-":
+		e, err := p.unary()
+		return &ruleExpr{op: 'n', l: e}, err
+	case t == "(":
+		e, err := p.sum()
+		if err == nil && p.next() != ")" {
+			err = fmt.Errorf("missing )")
+		}
+		return e, err
+	case t == "":
+		return nil, fmt.Errorf("unexpected end of check")
+	case t[0] >= '0' && t[0] <= '9' || t[0] == '.':
+		n, err := strconv.ParseFloat(t, 64)
+		return &ruleExpr{num: n}, err
+	case t == "within" || t == "of":
+		return nil, fmt.Errorf("unexpected %q", t)
+	case unicode.IsLetter(rune(t[0])) || t[0] == '_':
+		return &ruleExpr{op: 'f', field: t}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t)
+}
+
+// tokenizeRule splits a check into numbers, field names, and operators.
+func tokenizeRule(s string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.ContainsRune("+-*/()%", rune(c)):
+			toks = append(toks, string(c))
+			i++
+		case c == '<' || c == '>' || c == '=':
+			if i+1 < len(s) && s[i+1] == '=' {
+				toks = append(toks, s[i:i+2])
+				i += 2
+			} else if c == '=' {
+				return nil, fmt.Errorf("use == for equality in %q", s)
+			} else {
+				toks = append(toks, string(c))
+				i++
+			}
+		case c >= '0' && c <= '9' || c == '.':
+			j := i
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.') {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		case c == '_' || c < utf8.RuneSelf && unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(s) && (s[j] == '_' || s[j] < utf8.RuneSelf && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])))) {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q in %q", c, s)
+		}
+	}
+	return toks, nil
+}
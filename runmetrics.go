@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"path"
+	"reflect"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/core"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/bigqueryio"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/transforms/stats"
+)
+
+// --- Run metrics table ---
+
+// RunMetrics is one aggregate row per run, shaped for Looker Studio dashboards.
+type RunMetrics struct {
+	RunID            string    `beam:"RunID"`
+	Task             string    `beam:"Task"`
+	Model            string    `beam:"Model"`
+	FinishedAt       time.Time `beam:"FinishedAt"`
+	PromptsSent      int64     `beam:"PromptsSent"`   // Prompts handed to the model stage
+	RowsSucceeded    int64     `beam:"RowsSucceeded"` // Result rows produced
+	Errors           int64     `beam:"Errors"`
+	ErrorRatio       float64   `beam:"ErrorRatio"`
+	AvgPromptTokens  float64   `beam:"AvgPromptTokens"`
+	AvgOutputTokens  float64   `beam:"AvgOutputTokens"`
+	AvgLatencyMs     float64   `beam:"AvgLatencyMs"`
+	EstimatedCostUSD float64   `beam:"EstimatedCostUSD"`
+	Status           string    `beam:"Status"`         // complete, or partial when --max_runtime cut the run short
+	VertexLogTable   string    `beam:"VertexLogTable"` // Vertex AI request-response log table, see vertexlogging.go; empty when off
+
+	// Evaluation scores, NULL when the run produced none
+	AvgReadingGrade bigquery.NullFloat64 `beam:"AvgReadingGrade"` // Mean ReadingGrade of the result rows, see readability.go
+	AvgJudgeScore   bigquery.NullFloat64 `beam:"AvgJudgeScore"`   // Mean judge score of the selected candidates under --task=best_of_n, see rank.go
+
+	// Infrastructure the run used, so performance can be compared across runs
+	JobID       string `beam:"JobID"` // Dataflow job ID; empty on other runners
+	Runner      string `beam:"Runner"`
+	Region      string `beam:"Region"`
+	MachineType string `beam:"MachineType"` // Worker machine type, as reported by the worker when possible
+	MaxWorkers  int64  `beam:"MaxWorkers"`  // --max_num_workers; 0 when left to the service
+	SDKVersion  string `beam:"SDKVersion"`  // Apache Beam Go SDK version
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*RunMetrics)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*scoreSum)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*runMetricsCombineFn)(nil)).Elem())
+	beam.RegisterFunction(mergeScoreSums)
+	beam.RegisterFunction(selectedJudgeScore)
+	beam.RegisterType(reflect.TypeOf((*FinalizeRunMetricsFn)(nil)).Elem())
+}
+
+// runMetricsAccum holds the running sums of the combine.
+type runMetricsAccum struct {
+	Rows, PromptTokens, OutputTokens, LatencyMs int64
+	CostUSD, ReadingGrade                       float64
+}
+
+// runMetricsCombineFn sums per-row counters over all results, pricing each row
+// by the model that produced it (see costs.go).
+type runMetricsCombineFn struct {
+	Prices tokenPrices
+}
+
+func (fn *runMetricsCombineFn) CreateAccumulator() runMetricsAccum {
+	return runMetricsAccum{}
+}
+
+func (fn *runMetricsCombineFn) AddInput(a runMetricsAccum, r GeminiResult) runMetricsAccum {
+	a.Rows++
+	a.PromptTokens += r.PromptTokens
+	a.OutputTokens += r.OutputTokens
+	a.LatencyMs += r.LatencyMs
+	a.ReadingGrade += r.ReadingGrade
+	a.CostUSD += fn.Prices.of(r.ModelUsed).cost(r.PromptTokens, r.OutputTokens)
+	return a
+}
+
+func (fn *runMetricsCombineFn) MergeAccumulators(a, b runMetricsAccum) runMetricsAccum {
+	return runMetricsAccum{
+		Rows:         a.Rows + b.Rows,
+		PromptTokens: a.PromptTokens + b.PromptTokens,
+		OutputTokens: a.OutputTokens + b.OutputTokens,
+		LatencyMs:    a.LatencyMs + b.LatencyMs,
+		CostUSD:      a.CostUSD + b.CostUSD,
+		ReadingGrade: a.ReadingGrade + b.ReadingGrade,
+	}
+}
+
+// scoreSum is the running total of a mean score.
+type scoreSum struct {
+	Sum   float64
+	Count int64
+}
+
+func mergeScoreSums(a, b scoreSum) scoreSum {
+	return scoreSum{Sum: a.Sum + b.Sum, Count: a.Count + b.Count}
+}
+
+// selectedJudgeScore keeps the score of each candidate written to the results.
+func selectedJudgeScore(c CandidateScore, emit func(scoreSum)) {
+	if c.Selected && c.JudgeParsed {
+		emit(scoreSum{Sum: c.Score, Count: 1})
+	}
+}
+
+// judgeScoreSums returns the total of the selected candidates' judge scores,
+// for use as a side input; it is empty unless the task judges candidates.
+func judgeScoreSums(s beam.Scope, model *modelStage) beam.PCollection {
+	if !model.scores.IsValid() {
+		return beam.CreateList(s, []scoreSum{})
+	}
+	return beam.Combine(s, mergeScoreSums, beam.ParDo(s, selectedJudgeScore, model.scores))
+}
+
+// FinalizeRunMetricsFn turns the sums into averages and ratios. It starts from an
+// impulse and takes the sums as a side input, which is empty when no row
+// succeeded, so such runs still get their row. The number of prompts sent
+// arrives as another side input so failed calls count toward the error ratio,
+// the prompts skipped for --max_runtime as another that decides the Status,
+// and the judge scores as a third.
+type FinalizeRunMetricsFn struct {
+	RunID          string
+	Task           string
+	Model          string
+	VertexLogTable string
+
+	Runner      string
+	Region      string
+	MachineType string // Launcher-side --worker_machine_type, used when the worker can't report its own
+	MaxWorkers  int64
+	SDKVersion  string
+}
+
+func (fn *FinalizeRunMetricsFn) ProcessElement(ctx context.Context, _ []byte, sums func(*runMetricsAccum) bool, promptCounts func(*int) bool, skipped func(*int) bool, judgeScores func(*scoreSum) bool, emit func(RunMetrics)) {
+	var a, part runMetricsAccum
+	for sums(&part) {
+		a = (&runMetricsCombineFn{}).MergeAccumulators(a, part)
+	}
+	var sent int64
+	var n int
+	for promptCounts(&n) {
+		sent += int64(n)
+	}
+	status := runStatusComplete
+	if skipped(&n) {
+		status = runStatusPartial
+	}
+	m := RunMetrics{
+		RunID:            fn.RunID,
+		Task:             fn.Task,
+		Model:            fn.Model,
+		FinishedAt:       time.Now().UTC(),
+		PromptsSent:      sent,
+		RowsSucceeded:    a.Rows,
+		EstimatedCostUSD: a.CostUSD,
+		Status:           status,
+		VertexLogTable:   fn.VertexLogTable,
+
+		Runner:      fn.Runner,
+		Region:      fn.Region,
+		MachineType: fn.MachineType,
+		MaxWorkers:  fn.MaxWorkers,
+		SDKVersion:  fn.SDKVersion,
+	}
+	fn.workerMetadata(&m)
+	if sent > a.Rows {
+		m.Errors = sent - a.Rows
+		m.ErrorRatio = float64(m.Errors) / float64(sent)
+	}
+	if a.Rows > 0 {
+		m.AvgPromptTokens = float64(a.PromptTokens) / float64(a.Rows)
+		m.AvgOutputTokens = float64(a.OutputTokens) / float64(a.Rows)
+		m.AvgLatencyMs = float64(a.LatencyMs) / float64(a.Rows)
+		m.AvgReadingGrade = bigquery.NullFloat64{Float64: a.ReadingGrade / float64(a.Rows), Valid: true}
+	}
+	var judged, sum scoreSum
+	for judgeScores(&sum) {
+		judged = mergeScoreSums(judged, sum)
+	}
+	if judged.Count > 0 {
+		m.AvgJudgeScore = bigquery.NullFloat64{Float64: judged.Sum / float64(judged.Count), Valid: true}
+	}
+	emit(m)
+}
+
+// workerMetadata fills what only the worker knows from the metadata server:
+// Dataflow sets a job_id attribute on its worker VMs. Off GCE the lookups fail
+// fast and the launcher-side values stay.
+func (fn *FinalizeRunMetricsFn) workerMetadata(m *RunMetrics) {
+	if jobID, err := getMetadataValue("instance/attributes/job_id"); err == nil {
+		m.JobID = jobID
+	} else {
+		return
+	}
+	if mt, err := getMetadataValue("instance/machine-type"); err == nil {
+		m.MachineType = path.Base(mt) // projects/<number>/machineTypes/<type>
+	}
+}
+
+// writeRunMetrics combines all results into a single per-run metrics row.
+func writeRunMetrics(s beam.Scope, projectID string, model *modelStage, results beam.PCollection) {
+	if *metricsTable == "" {
+		return
+	}
+	s = s.Scope("RunMetrics")
+	sums := beam.Combine(s, &runMetricsCombineFn{Prices: flagTokenPrices()}, results)
+	promptCount := stats.CountElms(s, beam.Flatten(s, model.inputs...))
+	metrics := beam.ParDo(s, &FinalizeRunMetricsFn{
+		RunID:          *runID,
+		Task:           *task,
+		Model:          model.model,
+		VertexLogTable: vertexLogTableRef(projectID),
+
+		Runner:      flagValue("runner"),
+		Region:      flagValue("region"),
+		MachineType: flagValue("worker_machine_type"),
+		MaxWorkers:  maxNumWorkers(),
+		SDKVersion:  core.SdkVersion,
+	}, beam.Impulse(s), beam.SideInput{Input: sums}, beam.SideInput{Input: promptCount}, beam.SideInput{Input: countRuntimeSkips(s, model)}, beam.SideInput{Input: judgeScoreSums(s, model)})
+	tableName := fmt.Sprintf("%s:%s.%s", projectID, outputDataset, *metricsTable)
+	bigqueryio.Write(s, projectID, tableName, metrics)
+}
+
+// ensureMetricsColumns adds the RunMetrics columns an existing --metrics_table
+// lacks; a missing table is left to the first write.
+func ensureMetricsColumns(ctx context.Context, project string) error {
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return fmt.Errorf("failed to create bigquery client: %w", err)
+	}
+	defer client.Close()
+
+	schema, err := bigquery.InferSchema(RunMetrics{})
+	if err != nil {
+		return fmt.Errorf("failed to infer run metrics schema: %w", err)
+	}
+	table := client.Dataset(outputDataset).Table(*metricsTable)
+	md, err := table.Metadata(ctx)
+	if isBigQueryNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return addMissingColumns(ctx, table, md, schema)
+}
+
+// flagValue returns a flag registered by Beam or its runners, or "" when the
+// flag is not linked into this binary.
+func flagValue(name string) string {
+	if f := flag.Lookup(name); f != nil {
+		return f.Value.String()
+	}
+	return ""
+}
+
+// maxNumWorkers returns the Dataflow --max_num_workers setting.
+func maxNumWorkers() int64 {
+	n, _ := strconv.ParseInt(flagValue("max_num_workers"), 10, 64)
+	return n
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+	"golang.org/x/oauth2/google"
+)
+
+// --- Runner portability ---
+
+// The pipeline runs on Dataflow and on the portable runners (Flink, Spark, and
+// Prism via a job server). What differs between them is kept here: only
+// Dataflow workers have a metadata server to ask for their identity, and only
+// Dataflow needs --temp_location and --staging_location.
+//
+// Every runner but the direct one serializes the pipeline, which needs each
+// DoFn type and each function passed to ParDo or Combine registered in an
+// init of its file; check_runners.sh translates every task to catch a missing
+// one.
+
+// isDataflowRunner reports whether --runner selects Dataflow.
+func isDataflowRunner(runner string) bool {
+	switch strings.ToLower(runner) {
+	case "dataflow", "dataflowrunner":
+		return true
+	}
+	return false
+}
+
+// resolveWorkerIdentity returns the identity the worker calls Vertex AI as.
+// Dataflow workers ask the metadata server first; workers of the portable
+// runners usually run off GCE, so they go straight to ADC.
+func resolveWorkerIdentity(ctx context.Context, onDataflow bool) (string, error) {
+	if onDataflow {
+		email, err := getMetadataServiceAccountEmail()
+		if err == nil {
+			return email, nil
+		}
+		beamlog.Warnf(ctx, "GenerateTextFn: Failed to get identity from metadata server (%v), trying ADC tokeninfo fallback...", err)
+	}
+	email, err := getADCIdentityEmail(ctx)
+	if err == nil {
+		return email, nil
+	}
+	// Federated (Workload Identity Federation) tokens carry no email for
+	// tokeninfo, but the credentials file still names who they act as.
+	if who, ok := credentialsIdentity(ctx); ok {
+		return who, nil
+	}
+	return "", err
+}
+
+// credentialsIdentity names the principal of the ADC credentials file: the
+// service account of a key, the impersonated service account of a federated
+// configuration, or the credential type when neither is recorded.
+func credentialsIdentity(ctx context.Context) (string, bool) {
+	creds, err := google.FindDefaultCredentials(ctx, cloudPlatformScope)
+	if err != nil || len(creds.JSON) == 0 {
+		return "", false
+	}
+	var f struct {
+		Type                           string `json:"type"`
+		ClientEmail                    string `json:"client_email"`
+		ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+		Audience                       string `json:"audience"`
+	}
+	if json.Unmarshal(creds.JSON, &f) != nil || f.Type == "" {
+		return "", false
+	}
+	switch {
+	case f.ClientEmail != "":
+		return f.ClientEmail, true
+	case f.ServiceAccountImpersonationURL != "":
+		// .../serviceAccounts/<email>:generateAccessToken
+		_, rest, _ := strings.Cut(f.ServiceAccountImpersonationURL, "/serviceAccounts/")
+		email, _, _ := strings.Cut(rest, ":")
+		if email != "" {
+			return email, true
+		}
+	case f.Audience != "":
+		return fmt.Sprintf("%s (%s)", f.Type, f.Audience), true
+	}
+	return f.Type, true
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+)
+
+// --- Wall-clock limit ---
+
+// Under --max_runtime GenerateTextFn stops calling the model once the run has
+// lasted that long, counted from launch. Prompts that arrive later are
+// dead-lettered with ErrorStatus MAX_RUNTIME instead of being sent, so the job
+// drains quickly while batches already in flight finish, every sink still
+// commits its rows, and the skipped prompts can be replayed in the next
+// window. The run metrics row is marked partial and the launcher exits with
+// exitPartial.
+
+const (
+	maxRuntimeStatus = "MAX_RUNTIME" // ErrorStatus of prompts skipped after the deadline
+	exitPartial      = 3             // Launcher exit code of a partial run
+)
+
+// Run statuses recorded in the metrics table.
+const (
+	runStatusComplete = "complete"
+	runStatusPartial  = "partial"
+)
+
+// launchTime is when the launcher started; --max_runtime counts from here.
+var launchTime = time.Now()
+
+var errMaxRuntime = errors.New("--max_runtime was reached before the prompt was sent")
+
+// pastDeadline reports whether the run has used up --max_runtime.
+func (fn *GenerateTextFn) pastDeadline() bool {
+	return !fn.Deadline.IsZero() && time.Now().After(fn.Deadline)
+}
+
+// skipPastDeadline dead-letters a prompt that arrived after the deadline.
+func (fn *GenerateTextFn) skipPastDeadline(ctx context.Context, p Prompt, promptHash, model string, emitFailed func(FailedCall)) {
+	fn.RuntimeSkipCounter.Inc(ctx, 1)
+	if fn.warnedDeadline.CompareAndSwap(false, true) {
+		beamlog.Warnf(ctx, "GenerateTextFn: --max_runtime reached at %v, dead-lettering the remaining prompts", fn.Deadline)
+	}
+	fc := fn.failedCall(p, promptHash, model, errMaxRuntime)
+	fc.ErrorStatus = maxRuntimeStatus
+	emitFailed(fc)
+}
+
+func init() {
+	beam.RegisterFunction(runtimeSkips)
+}
+
+// runtimeSkips emits 1 per dead letter skipped for --max_runtime.
+func runtimeSkips(fc FailedCall, emit func(int)) {
+	if fc.ErrorStatus == maxRuntimeStatus {
+		emit(1)
+	}
+}
+
+// countRuntimeSkips returns a PCollection of 1s, one per prompt skipped for
+// --max_runtime, for use as a side input.
+func countRuntimeSkips(s beam.Scope, model *modelStage) beam.PCollection {
+	if len(model.failures) == 0 {
+		return beam.CreateList(s, []int{})
+	}
+	return beam.ParDo(s, runtimeSkips, beam.Flatten(s, model.failures...))
+}
+
+// reportPartialRun logs the prompts skipped for --max_runtime and reports
+// whether there were any.
+func reportPartialRun(pr beam.PipelineResult) bool {
+	skipped := counterTotals(pr, "vertexai")["max_runtime_skipped_total"]
+	if skipped == 0 {
+		return false
+	}
+	log.Printf("Run is partial: %d prompts were dead-lettered with ErrorStatus %s after --max_runtime; replay them in the next window.", skipped, maxRuntimeStatus)
+	return true
+}
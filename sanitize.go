@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// --- Prompt text sanitation ---
+
+// byteOrderMark shows up at the start of fields loaded from some CSV exports,
+// and mid-string where such fields were concatenated in SQL.
+const byteOrderMark = '\ufeff'
+
+// sanitizeText strips invalid UTF-8, byte order marks, and control characters
+// other than tab, newline, and carriage return. It reports whether anything changed.
+func sanitizeText(s string) (string, bool) {
+	clean := strings.ToValidUTF8(s, "")
+	clean = strings.Map(func(r rune) rune {
+		if r == byteOrderMark || (unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r') {
+			return -1
+		}
+		return r
+	}, clean)
+	return clean, clean != s
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*SanitizePromptFn)(nil)).Elem())
+}
+
+// SanitizePromptFn cleans prompt text before it is marshaled into a request,
+// so the request (and its prompt hash) doesn't depend on stray bytes in the source.
+type SanitizePromptFn struct {
+	SanitizedCounter beam.Counter
+}
+
+func (fn *SanitizePromptFn) Setup() {
+	fn.SanitizedCounter = beam.NewCounter("vertexai", "prompts_sanitized_total")
+}
+
+func (fn *SanitizePromptFn) ProcessElement(ctx context.Context, p Prompt, emit func(Prompt)) {
+	if clean, changed := sanitizeText(p.Prompt); changed {
+		fn.SanitizedCounter.Inc(ctx, 1)
+		p.Prompt = clean
+	}
+	emit(p)
+}
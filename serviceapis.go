@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// --- Required APIs ---
+
+// A run in a project where the Vertex AI or BigQuery API is disabled only
+// fails once the workers are up, with every prompt dead-lettered as a 403.
+// Before launching, the launcher asks Service Usage whether Vertex AI is
+// enabled in the Vertex AI project and BigQuery in the input and output
+// projects (see projects.go; --local runs only need Vertex AI, and runs on
+// another --backend not even that) and refuses to run when one isn't, with
+// the commands that enable them. Under --auto_enable_apis it enables them
+// itself, which takes serviceusage.services.enable on the project (e.g.
+// roles/serviceusage.serviceUsageAdmin). When Service Usage can't be asked
+// (the identity may not read it), the run goes ahead with a warning.
+
+const (
+	bigQueryService   = "bigquery.googleapis.com"
+	apiEnableTimeout  = 5 * time.Minute
+	apiEnablePollWait = 5 * time.Second
+)
+
+// projectService is an API the run calls in a project.
+type projectService struct {
+	Project, Service string
+}
+
+// requiredServices lists the APIs the run calls, once per project.
+func requiredServices(projects runProjects) []projectService {
+	var required []projectService
+	if *backend == backendVertex {
+		required = append(required, projectService{projects.Vertex, vertexService})
+	}
+	if *localMode {
+		return required
+	}
+	required = append(required, projectService{projects.Input, bigQueryService})
+	if projects.Output != projects.Input {
+		required = append(required, projectService{projects.Output, bigQueryService})
+	}
+	return required
+}
+
+// checkServices makes sure every required API is enabled, enabling the
+// missing ones under --auto_enable_apis.
+func checkServices(ctx context.Context, projects runProjects) error {
+	client, err := sharedWorkerRegistry().client(ctx, "", cloudPlatformScope)
+	if err != nil {
+		log.Printf("Warning: could not check the APIs enabled in the run's projects: %v", err)
+		return nil
+	}
+	var disabled []string
+	for _, ps := range requiredServices(projects) {
+		enabled, err := serviceEnabled(ctx, client, ps.Project, ps.Service)
+		switch {
+		case err != nil:
+			log.Printf("Warning: could not check whether %s is enabled in project %s: %v", ps.Service, ps.Project, err)
+		case enabled:
+			log.Printf("API %s in project %s: enabled", ps.Service, ps.Project)
+		case *autoEnableAPIs:
+			if err := enableService(ctx, client, ps.Project, ps.Service); err != nil {
+				return fmt.Errorf("%s is disabled in project %s and could not be enabled (enabling takes serviceusage.services.enable): %w", ps.Service, ps.Project, err)
+			}
+			log.Printf("API %s in project %s: enabled by --auto_enable_apis", ps.Service, ps.Project)
+		default:
+			disabled = append(disabled, fmt.Sprintf("%s is disabled in project %s (`gcloud services enable %s --project=%s`)", ps.Service, ps.Project, ps.Service, ps.Project))
+		}
+	}
+	if len(disabled) > 0 {
+		return fmt.Errorf("%s; enable them, or rerun with --auto_enable_apis", strings.Join(disabled, "; "))
+	}
+	return nil
+}
+
+// enableService enables a service and waits for the operation to finish.
+func enableService(ctx context.Context, client *http.Client, project, service string) error {
+	type operation struct {
+		Name  string `json:"name"`
+		Done  bool   `json:"done"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	var op operation
+	u := fmt.Sprintf("https://serviceusage.googleapis.com/v1/projects/%s/services/%s:enable", url.PathEscape(project), service)
+	if err := probeJSON(ctx, client, http.MethodPost, u, struct{}{}, &op); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(apiEnableTimeout)
+	for !op.Done {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("operation %s still running after %v", op.Name, apiEnableTimeout)
+		}
+		time.Sleep(apiEnablePollWait)
+		name := op.Name
+		op = operation{}
+		if err := probeJSON(ctx, client, http.MethodGet, "https://serviceusage.googleapis.com/v1/"+name, nil, &op); err != nil {
+			return err
+		}
+	}
+	if op.Error != nil {
+		return fmt.Errorf("operation failed: %s", op.Error.Message)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// --- Input sharding ---
+
+// Under --shard=i/N a launch only processes the input rows whose key hashes
+// to i modulo N, so a backfill too large for one job can run as N independent
+// jobs, on different days if need be. The hash is stable, so relaunching a
+// shard processes exactly the same rows, and the N shards together cover the
+// input once. A row's key is its group_key under group_summarize (groups are
+// never split), else its row_key, else its prompt; pairs are keyed by both of
+// their keys and crawled documents by URI.
+
+// shardSpec is a parsed --shard; the zero value means the whole input.
+type shardSpec struct {
+	Index int // 0 <= Index < Count
+	Count int
+}
+
+// inputShard is set by main from --shard.
+var inputShard shardSpec
+
+// parseShard parses i/N, with 0 <= i < N. An empty value is the whole input.
+func parseShard(v string) (shardSpec, error) {
+	if v == "" {
+		return shardSpec{}, nil
+	}
+	i, n, ok := strings.Cut(v, "/")
+	index, err1 := strconv.Atoi(strings.TrimSpace(i))
+	count, err2 := strconv.Atoi(strings.TrimSpace(n))
+	if !ok || err1 != nil || err2 != nil || count < 1 || index < 0 || index >= count {
+		return shardSpec{}, fmt.Errorf("%q: want i/N with 0 <= i < N", v)
+	}
+	return shardSpec{Index: index, Count: count}, nil
+}
+
+func (s shardSpec) enabled() bool { return s.Count > 1 }
+
+func (s shardSpec) String() string { return fmt.Sprintf("%d/%d", s.Index, s.Count) }
+
+// owns reports whether the key belongs to the shard.
+func (s shardSpec) owns(key string) bool {
+	if !s.enabled() {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()%uint64(s.Count) == uint64(s.Index)
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*ShardRowsFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*ShardPairsFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*ShardPromptsFn)(nil)).Elem())
+}
+
+// ShardRowsFn drops input rows outside the shard.
+type ShardRowsFn struct {
+	Shard   shardSpec
+	ByGroup bool // Key rows by group_key
+
+	selected beam.Counter
+	skipped  beam.Counter
+}
+
+func (fn *ShardRowsFn) Setup() {
+	fn.selected = beam.NewCounter("shard", "rows_selected_total")
+	fn.skipped = beam.NewCounter("shard", "rows_skipped_total")
+}
+
+func (fn *ShardRowsFn) ProcessElement(ctx context.Context, row PromptFromBQ, emit func(PromptFromBQ)) {
+	key := row.RowKey
+	switch {
+	case fn.ByGroup:
+		key = row.GroupKey
+	case key == "":
+		key = row.Prompt
+	}
+	if !fn.Shard.owns(key) {
+		fn.skipped.Inc(ctx, 1)
+		return
+	}
+	fn.selected.Inc(ctx, 1)
+	emit(row)
+}
+
+// ShardPairsFn drops pairs outside the shard.
+type ShardPairsFn struct {
+	Shard shardSpec
+}
+
+func (fn *ShardPairsFn) ProcessElement(pair PairFromBQ, emit func(PairFromBQ)) {
+	if fn.Shard.owns(pair.LeftKey + pairKeySep + pair.RightKey) {
+		emit(pair)
+	}
+}
+
+// ShardPromptsFn drops prompts outside the shard, by ParentKey.
+type ShardPromptsFn struct {
+	Shard shardSpec
+}
+
+func (fn *ShardPromptsFn) ProcessElement(p Prompt, emit func(Prompt)) {
+	if fn.Shard.owns(p.ParentKey) {
+		emit(p)
+	}
+}
+
+// shardRows keeps the input rows of --shard, if set.
+func shardRows(s beam.Scope, rows beam.PCollection) beam.PCollection {
+	if !inputShard.enabled() {
+		return rows
+	}
+	return beam.ParDo(s.Scope("ShardRows"), &ShardRowsFn{Shard: inputShard, ByGroup: *task == taskGroupSummarize}, rows)
+}
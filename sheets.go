@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/transforms/top"
+	"golang.org/x/oauth2/google"
+)
+
+// --- Google Sheets input ---
+
+const sheetsAPI = "https://sheets.googleapis.com/v4/spreadsheets"
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*ReadSheetFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*WriteSheetFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*SheetOverflowFn)(nil)).Elem())
+	beam.RegisterFunction(lessResult)
+}
+
+// ReadSheetFn reads prompt rows from a Google Sheets range. The first row is a header
+// naming the columns; `prompt` is required and `row_key`, `items` (comma-separated),
+// `ordering_key`, `sequence`, and the --group_by column map onto the same fields as
+// the BigQuery input. Rows without a `sequence` are sequenced by their sheet position.
+type ReadSheetFn struct {
+	SpreadsheetID string
+	Range         string
+	GroupBy       string
+}
+
+func (fn *ReadSheetFn) ProcessElement(ctx context.Context, _ []byte, emit func(PromptFromBQ)) error {
+	rows, err := fetchSheetValues(ctx, fn.SpreadsheetID, fn.Range, "https://www.googleapis.com/auth/spreadsheets.readonly")
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return fmt.Errorf("sheet %s range %q is empty", fn.SpreadsheetID, fn.Range)
+	}
+
+	col := make(map[string]int)
+	for i, name := range rows[0] {
+		col[strings.TrimSpace(name)] = i
+	}
+	if _, ok := col["prompt"]; !ok {
+		return fmt.Errorf("sheet %s range %q has no `prompt` header column", fn.SpreadsheetID, fn.Range)
+	}
+	cell := func(row []string, name string) string {
+		if i, ok := col[name]; ok && i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+
+	for i, row := range rows[1:] {
+		p := PromptFromBQ{
+			Prompt:      cell(row, "prompt"),
+			RowKey:      cell(row, "row_key"),
+			Items:       splitList(cell(row, "items")),
+			OrderingKey: cell(row, "ordering_key"),
+			Sequence:    int64(i),
+		}
+		if p.Prompt == "" {
+			continue
+		}
+		if seq := cell(row, "sequence"); seq != "" {
+			if p.Sequence, err = strconv.ParseInt(strings.TrimSpace(seq), 10, 64); err != nil {
+				return fmt.Errorf("sheet %s row %d: invalid sequence %q: %w", fn.SpreadsheetID, i+2, seq, err)
+			}
+		}
+		if fn.GroupBy != "" {
+			p.GroupKey = cell(row, fn.GroupBy)
+		}
+		emit(p)
+	}
+	return nil
+}
+
+// fetchSheetValues returns the formatted cell values of a range as rows of strings.
+func fetchSheetValues(ctx context.Context, spreadsheetID, rng, scope string) ([][]string, error) {
+	client, err := google.DefaultClient(ctx, scope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create google default client (ADC issue?): %w", err)
+	}
+	reqURL := fmt.Sprintf("%s/%s/values/%s", sheetsAPI, url.PathEscape(spreadsheetID), url.PathEscape(rng))
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sheets request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sheets api: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("sheets api request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var valueRange struct {
+		Values [][]string `json:"values"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&valueRange); err != nil {
+		return nil, fmt.Errorf("failed to decode sheets response: %w", err)
+	}
+	return valueRange.Values, nil
+}
+
+// readSheetPrompts reads the configured sheet once, on a single worker.
+func readSheetPrompts(s beam.Scope) beam.PCollection {
+	s = s.Scope("ReadSheet")
+	return beam.ParDo(s, &ReadSheetFn{
+		SpreadsheetID: *inputSheetID,
+		Range:         *inputSheetRange,
+		GroupBy:       *groupBy,
+	}, beam.Impulse(s))
+}
+
+// --- Google Sheets output ---
+
+// sheetHeader is the first row written to the output sheet.
+var sheetHeader = []string{"Prompt", "GeneratedText", "ModelUsed", "SafetyStatus", "PromptHash"}
+
+// maxSheetCellChars is the most characters a Sheets cell holds.
+const maxSheetCellChars = 50000
+
+// truncatedCellMark ends a cell value cut to fit in a cell.
+const truncatedCellMark = " [truncated]"
+
+// WriteSheetFn writes the first MaxRows results, picked by a bounded combine,
+// to the sheet in a stable order. Cell values too long for Sheets are cut to
+// fit and marked.
+type WriteSheetFn struct {
+	SpreadsheetID string
+	Range         string
+
+	truncated beam.Counter
+}
+
+func (fn *WriteSheetFn) Setup() {
+	fn.truncated = beam.NewCounter("sheets", "truncated_cells_total")
+}
+
+func (fn *WriteSheetFn) ProcessElement(ctx context.Context, first []GeminiResult) error {
+	sortResults(first)
+	values := [][]string{sheetHeader}
+	for _, r := range first {
+		row := []string{r.Prompt, r.GeneratedText, r.ModelUsed, r.SafetyStatus, r.PromptHash}
+		for i, v := range row {
+			if len(v) > maxSheetCellChars {
+				row[i] = truncateCell(v)
+				fn.truncated.Inc(ctx, 1)
+			}
+		}
+		values = append(values, row)
+	}
+	return writeSheetValues(ctx, fn.SpreadsheetID, fn.Range, values)
+}
+
+// truncateCell cuts a value to fit in a cell, on a UTF-8 boundary, and marks
+// it. Bytes are counted, which is never fewer than the characters Sheets counts.
+func truncateCell(v string) string {
+	n := maxSheetCellChars - len(truncatedCellMark)
+	for n > 0 && !utf8.RuneStart(v[n]) {
+		n--
+	}
+	return v[:n] + truncatedCellMark
+}
+
+// sheetRowKey identifies a result among those written to the sheet.
+type sheetRowKey struct {
+	ParentKey   string
+	SubIndex    int
+	PromptHash  string
+	OrderingKey string
+	Sequence    int64
+	GeneratedAt time.Time
+}
+
+func sheetRowKeyOf(r GeminiResult) sheetRowKey {
+	return sheetRowKey{r.ParentKey, r.SubIndex, r.PromptHash, r.OrderingKey, r.Sequence, r.GeneratedAt}
+}
+
+// SheetOverflowFn passes on the results the sheet didn't take. The sheet's
+// rows arrive as a side input holding the combine's output.
+type SheetOverflowFn struct {
+	written map[sheetRowKey]bool
+}
+
+func (fn *SheetOverflowFn) ProcessElement(r GeminiResult, first func(*[]GeminiResult) bool, overflow func(GeminiResult)) {
+	if fn.written == nil {
+		fn.written = make(map[sheetRowKey]bool)
+		var rows []GeminiResult
+		for first(&rows) {
+			for _, w := range rows {
+				fn.written[sheetRowKeyOf(w)] = true
+			}
+		}
+	}
+	if !fn.written[sheetRowKeyOf(r)] {
+		overflow(r)
+	}
+}
+
+// lessResult orders results in input order, breaking ties by fan-out position
+// and prompt hash so the order is stable across runs.
+func lessResult(a, b GeminiResult) bool {
+	if a.OrderingKey != b.OrderingKey || a.Sequence != b.Sequence {
+		return lessInSequence(a, b)
+	}
+	if a.ParentKey != b.ParentKey {
+		return a.ParentKey < b.ParentKey
+	}
+	if a.SubIndex != b.SubIndex {
+		return a.SubIndex < b.SubIndex
+	}
+	return a.PromptHash < b.PromptHash
+}
+
+// sortResults puts results in the order of lessResult.
+func sortResults(all []GeminiResult) {
+	sort.Slice(all, func(i, j int) bool { return lessResult(all[i], all[j]) })
+}
+
+// writeSheetValues overwrites the range with the given rows, starting at its top-left cell.
+func writeSheetValues(ctx context.Context, spreadsheetID, rng string, values [][]string) error {
+	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/spreadsheets")
+	if err != nil {
+		return fmt.Errorf("failed to create google default client (ADC issue?): %w", err)
+	}
+	body, err := json.Marshal(map[string]any{"range": rng, "majorDimension": "ROWS", "values": values})
+	if err != nil {
+		return fmt.Errorf("failed to marshal sheets request body: %w", err)
+	}
+	reqURL := fmt.Sprintf("%s/%s/values/%s?valueInputOption=RAW", sheetsAPI, url.PathEscape(spreadsheetID), url.PathEscape(rng))
+	req, err := http.NewRequestWithContext(ctx, "PUT", reqURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create sheets request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request to sheets api: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("sheets api update failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
+
+// writeSheetResults writes results to the output sheet and returns the overflow rows.
+// Only the rows the sheet takes are brought together on one worker.
+func writeSheetResults(s beam.Scope, results beam.PCollection) beam.PCollection {
+	s = s.Scope("WriteSheet")
+	first := top.Smallest(s, results, *outputSheetMaxRows, lessResult)
+	beam.ParDo0(s, &WriteSheetFn{
+		SpreadsheetID: *outputSheetID,
+		Range:         *outputSheetRange,
+	}, first)
+	return beam.ParDo(s, &SheetOverflowFn{}, results, beam.SideInput{Input: first})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log"
+	"unicode/utf8"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// --- Prompt and response size distributions ---
+
+// Distributions in this namespace record the size of every successful call.
+const sizesNamespace = "vertexai_sizes"
+
+const (
+	sizePromptChars  = "prompt_chars"
+	sizePromptTokens = "prompt_tokens"
+	sizeOutputTokens = "output_tokens"
+)
+
+// truncationWarnFraction is how close the average response may get to
+// --max_output_tokens before the launcher warns of systematic truncation.
+const truncationWarnFraction = 0.9
+
+// sizeDistributions is embedded in GenerateTextFn to record request and response sizes.
+type sizeDistributions struct {
+	PromptChars  beam.Distribution
+	PromptTokens beam.Distribution
+	OutputTokens beam.Distribution
+}
+
+func (sd *sizeDistributions) setupSizes() {
+	sd.PromptChars = beam.NewDistribution(sizesNamespace, sizePromptChars)
+	sd.PromptTokens = beam.NewDistribution(sizesNamespace, sizePromptTokens)
+	sd.OutputTokens = beam.NewDistribution(sizesNamespace, sizeOutputTokens)
+}
+
+// recordSizes adds one successful call. Token counts the endpoint did not
+// report are left out rather than recorded as zero.
+func (sd *sizeDistributions) recordSizes(ctx context.Context, prompt string, out vertexOutput) {
+	sd.PromptChars.Update(ctx, int64(utf8.RuneCountInString(prompt)))
+	if out.PromptTokens > 0 {
+		sd.PromptTokens.Update(ctx, out.PromptTokens)
+	}
+	if out.OutputTokens > 0 {
+		sd.OutputTokens.Update(ctx, out.OutputTokens)
+	}
+}
+
+// sizeSummary is a distribution merged across transforms.
+type sizeSummary struct {
+	Count, Sum, Min, Max int64
+}
+
+func (s sizeSummary) mean() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.Sum) / float64(s.Count)
+}
+
+// distributionTotals merges every distribution in a namespace, keyed by name.
+func distributionTotals(pr beam.PipelineResult, namespace string) map[string]sizeSummary {
+	totals := make(map[string]sizeSummary)
+	if pr == nil {
+		return totals
+	}
+	qr := pr.Metrics().Query(func(r beam.MetricResult) bool {
+		return r.Namespace() == namespace
+	})
+	for _, d := range qr.Distributions() {
+		v := d.Result()
+		s, seen := totals[d.Name()]
+		if !seen || v.Min < s.Min {
+			s.Min = v.Min
+		}
+		if v.Max > s.Max {
+			s.Max = v.Max
+		}
+		s.Count += v.Count
+		s.Sum += v.Sum
+		totals[d.Name()] = s
+	}
+	return totals
+}
+
+// logSizeReport writes the size distributions to the launcher log and warns
+// when responses average close to the output limit.
+func logSizeReport(pr beam.PipelineResult, maxOutputTokens int) {
+	t := distributionTotals(pr, sizesNamespace)
+	if t[sizePromptChars].Count == 0 {
+		return
+	}
+	log.Printf("Request sizes:")
+	for _, name := range []string{sizePromptChars, sizePromptTokens, sizeOutputTokens} {
+		if s := t[name]; s.Count > 0 {
+			log.Printf("  %-13s avg %.1f, min %d, max %d (%d calls)", name+":", s.mean(), s.Min, s.Max, s.Count)
+		}
+	}
+	out := t[sizeOutputTokens]
+	if maxOutputTokens > 0 && out.mean() >= truncationWarnFraction*float64(maxOutputTokens) {
+		log.Printf("Warning: responses average %.0f of the %d --max_output_tokens; answers are probably being truncated. Raise the limit or ask for shorter answers.", out.mean(), maxOutputTokens)
+	}
+}
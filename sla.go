@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/core/graph/mtime"
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+)
+
+// --- SLA fallback for stale elements ---
+
+// elementAge reports how long ago an element's event time was. Elements read
+// from bounded sources (BigQuery, Sheets, GCS) carry no real event time, so the
+// age is only meaningful for timestamped streaming input.
+func elementAge(ts beam.EventTime) (time.Duration, bool) {
+	if ts <= mtime.MinTimestamp || ts >= mtime.MaxTimestamp {
+		return 0, false
+	}
+	return time.Since(ts.ToTime()), true
+}
+
+// isStale reports whether an element has waited longer than MaxElementAge.
+func (fn *GenerateTextFn) isStale(ctx context.Context, ts beam.EventTime) bool {
+	if fn.MaxElementAge <= 0 {
+		return false
+	}
+	age, ok := elementAge(ts)
+	if !ok || age <= fn.MaxElementAge {
+		return false
+	}
+	fn.StaleCounter.Inc(ctx, 1)
+	return true
+}
+
+// emitFallback emits the configured fallback text for a stale element without
+// calling the endpoint.
+func (fn *GenerateTextFn) emitFallback(ctx context.Context, p Prompt, promptHash string, emit func(GeminiResult)) {
+	beamlog.Warnf(ctx, "GenerateTextFn: Prompt '%s' is older than %v, emitting fallback text", fn.LogPolicy.redact(p.Prompt), fn.MaxElementAge)
+	fn.traceFallback("stale")
+	fn.emitResult(p, promptHash, fn.route(p, fn.parametersFor(p)).Model, vertexOutput{Text: fn.FallbackText, SafetyStatus: safetyUnknown, Fallback: true}, emit)
+}
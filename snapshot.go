@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// --- Time-travel input reads ---
+
+// Source tables keep changing, so rerunning a job or debugging one of its rows
+// reads other rows than the run did. --snapshot_time pins the input reads to
+// the table state at that time: every table the input query reads (found with
+// a dry run) gets FOR SYSTEM_TIME AS OF in the query, as does --pairs_table.
+// The time is a timestamp, or the --run_id of an earlier run, which is its
+// start time unless it was set by hand. BigQuery keeps a table's history for
+// its time travel window only (7 days by default), and views and external
+// tables have none; the launch dry run rejects those. A table the query
+// names in a form that can't be found (e.g. `project`.`dataset`.`table`)
+// fails the launch, as it would otherwise be read live.
+
+// runIDLayout is the format of default run IDs, the UTC launch time.
+const runIDLayout = "20060102T150405Z"
+
+// parseSnapshotTime parses --snapshot_time.
+func parseSnapshotTime(v string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, runIDLayout} {
+		if t, err := time.Parse(layout, v); err == nil {
+			if t.After(time.Now()) {
+				return time.Time{}, fmt.Errorf("%s is in the future", v)
+			}
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 timestamp nor a run ID like %s", v, runIDLayout)
+}
+
+// snapshotClause is the time travel clause of the table reads, empty without
+// --snapshot_time (validated in main).
+func snapshotClause() string {
+	if *snapshotTime == "" {
+		return ""
+	}
+	t, _ := parseSnapshotTime(*snapshotTime)
+	return " FOR SYSTEM_TIME AS OF " + timestampLiteral(t)
+}
+
+// forSystemTime matches a time travel clause a reference already has.
+var forSystemTime = regexp.MustCompile(`^\s+(?i:FOR\s+SYSTEM_TIME)`)
+
+// snapshotQuery adds the time travel clause to every table the query reads.
+func snapshotQuery(ctx context.Context, project, sql string) (string, error) {
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return "", fmt.Errorf("failed to create bigquery client: %w", err)
+	}
+	defer client.Close()
+	tables, err := queryTables(ctx, client, sql)
+	if err != nil {
+		return "", err
+	}
+	for _, t := range tables {
+		pinned, n := pinTableReads(sql, t.ProjectID, t.DatasetID, t.TableID, snapshotClause())
+		if n == 0 {
+			return "", fmt.Errorf("can't find table %s.%s.%s in the input query to pin its reads; name it as `%[1]s.%[2]s.%[3]s`", t.ProjectID, t.DatasetID, t.TableID)
+		}
+		sql = pinned
+	}
+	q := client.Query(sql)
+	q.DryRun = true
+	if _, err := q.Run(ctx); err != nil {
+		return "", fmt.Errorf("failed to dry-run input query as of the snapshot time: %w", err)
+	}
+	return sql, nil
+}
+
+// queryTables dry-runs the query and returns the tables it reads.
+func queryTables(ctx context.Context, client *bigquery.Client, sql string) ([]*bigquery.Table, error) {
+	q := client.Query(sql)
+	q.DryRun = true
+	job, err := q.Run(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dry-run input query: %w", err)
+	}
+	stats, ok := job.LastStatus().Statistics.Details.(*bigquery.QueryStatistics)
+	if !ok {
+		return nil, fmt.Errorf("dry run of input query returned no query statistics")
+	}
+	return stats.ReferencedTables, nil
+}
+
+// pinTableReads adds the clause after every reference to the table, quoted or
+// not, with or without its project, and returns how many references it found.
+func pinTableReads(sql, project, dataset, table, clause string) (string, int) {
+	return rewriteTableReads(sql, project, dataset, table, func(ref, rest string) string {
+		if forSystemTime.MatchString(rest) {
+			return ref
+		}
+		return ref + clause
+	})
+}
+
+// rewriteTableReads replaces every reference to the table with what rewrite
+// makes of it and the SQL that follows, and returns how many it found.
+func rewriteTableReads(sql, project, dataset, table string, rewrite func(ref, rest string) string) (string, int) {
+	pd, dt := regexp.QuoteMeta(project+"."+dataset+"."+table), regexp.QuoteMeta(dataset+"."+table)
+	ref := regexp.MustCompile("(?:^|[^\\w.`])(`" + pd + "`|`" + dt + "`|" + pd + "|" + dt + ")")
+	var b strings.Builder
+	n, last := 0, 0
+	for _, m := range ref.FindAllStringSubmatchIndex(sql, -1) {
+		start, end := m[2], m[3]
+		if end < len(sql) && (strings.ContainsAny(sql[end:end+1], ".`-") || isWordByte(sql[end])) {
+			continue // Part of a longer name
+		}
+		n++
+		b.WriteString(sql[last:start])
+		b.WriteString(rewrite(sql[start:end], sql[end:]))
+		last = end
+	}
+	b.WriteString(sql[last:])
+	return b.String(), n
+}
+
+// isWordByte reports whether c is a letter, digit, or underscore.
+func isWordByte(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/bigqueryio"
+)
+
+// --- Spot-check sampling ---
+
+// SpotCheck is one sampled (prompt, response) pair written for human review.
+type SpotCheck struct {
+	RunID         string    `beam:"RunID"`
+	PromptHash    string    `beam:"PromptHash"`
+	Prompt        string    `beam:"Prompt"`
+	GeneratedText string    `beam:"GeneratedText"`
+	ModelUsed     string    `beam:"ModelUsed"`
+	SampledAt     time.Time `beam:"SampledAt"`
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*SpotCheck)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*SampleSpotChecksFn)(nil)).Elem())
+}
+
+// SampleSpotChecksFn keeps a deterministic fraction of results. Selection only
+// depends on the seed and the prompt hash, so reruns with the same seed pick the same rows.
+type SampleSpotChecksFn struct {
+	RunID string
+	Rate  float64
+	Seed  string
+}
+
+func (fn *SampleSpotChecksFn) ProcessElement(ctx context.Context, r GeminiResult, emit func(SpotCheck)) {
+	if !inSample(fn.Seed, r.PromptHash, fn.Rate) {
+		return
+	}
+	emit(SpotCheck{
+		RunID:         fn.RunID,
+		PromptHash:    r.PromptHash,
+		Prompt:        r.Prompt,
+		GeneratedText: r.GeneratedText,
+		ModelUsed:     r.ModelUsed,
+		SampledAt:     time.Now().UTC(),
+	})
+}
+
+// inSample maps seed+key onto [0, 1) and compares it against the sampling rate.
+func inSample(seed, key string, rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	if rate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	return float64(h.Sum64())/float64(math.MaxUint64) < rate
+}
+
+// writeSpotChecks samples results and writes them to the spot-check table in the output dataset.
+func writeSpotChecks(s beam.Scope, projectID, runID string, results beam.PCollection) {
+	if *spotCheckRate <= 0 || *spotCheckTable == "" {
+		return
+	}
+	s = s.Scope("SpotChecks")
+	samples := beam.ParDo(s, &SampleSpotChecksFn{
+		RunID: runID,
+		Rate:  *spotCheckRate,
+		Seed:  *spotCheckSeed,
+	}, results)
+	tableName := fmt.Sprintf("%s:%s.%s", projectID, outputDataset, *spotCheckTable)
+	bigqueryio.Write(s, projectID, tableName, samples)
+}
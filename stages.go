@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// --- Per-stage quotas ---
+
+// Model-calling stages. Each modelStage.generate call site names its stage, so
+// --stage_rate_limits and --stage_budgets can hold an expensive stage (a
+// best-of-N judge, say) to its own share of the quota without starving the
+// others. Workflow steps are stages named after the step.
+const (
+	stageGenerate   = "generate"   // generate task
+	stageAgent      = "agent"      // agent task
+	stageSummarize  = "summarize"  // group_summarize chunks
+	stageMerge      = "merge"      // group_summarize merges
+	stageCompare    = "compare"    // pairwise task
+	stageCandidates = "candidates" // best_of_n candidates
+	stageJudge      = "judge"      // best_of_n judge calls
+	stageClassify   = "classify"   // Both classify levels
+)
+
+// errStageBudgetSpent is returned once a stage has used its --stage_budgets requests.
+var errStageBudgetSpent = errors.New("the stage's --stage_budgets requests are spent on this worker")
+
+// stageLimit is the per-worker quota of one stage; zero values are unlimited.
+type stageLimit struct {
+	Rate   float64 // Requests per second
+	Burst  int
+	Budget int64 // Requests
+}
+
+// taskStages returns the stages a task calls the model in.
+func taskStages(task string, wf *workflowConfig) []string {
+	switch task {
+	case taskGenerate:
+		return []string{stageGenerate}
+	case taskAgent:
+		return []string{stageAgent}
+	case taskGroupSummarize:
+		return []string{stageSummarize, stageMerge}
+	case taskPairwise:
+		return []string{stageCompare}
+	case taskBestOfN:
+		return []string{stageCandidates, stageJudge}
+	case taskClassify:
+		return []string{stageClassify}
+	case taskWorkflow:
+		var stages []string
+		if wf != nil {
+			for _, step := range wf.Steps {
+				stages = append(stages, step.Name)
+			}
+		}
+		return stages
+	}
+	return nil
+}
+
+// parseStageLimits parses --stage_rate_limits entries of the form
+// stage=requests_per_second[:burst] and --stage_budgets entries of the form
+// stage=requests, keeping only stages of the given list.
+func parseStageLimits(rates, budgets, stages []string) (map[string]stageLimit, error) {
+	known := make(map[string]bool, len(stages))
+	for _, s := range stages {
+		known[s] = true
+	}
+	limits := make(map[string]stageLimit)
+	stage := func(e string) (string, string, error) {
+		name, v, ok := strings.Cut(e, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return "", "", fmt.Errorf("%q: want stage=value", e)
+		}
+		if !known[name] {
+			return "", "", fmt.Errorf("%q: the task has no stage %s (want one of %s)", e, name, strings.Join(stages, ", "))
+		}
+		return name, strings.TrimSpace(v), nil
+	}
+	for _, e := range rates {
+		name, v, err := stage(e)
+		if err != nil {
+			return nil, err
+		}
+		rate, burst, hasBurst := strings.Cut(v, ":")
+		l := limits[name]
+		if l.Rate, err = strconv.ParseFloat(rate, 64); err != nil || l.Rate <= 0 {
+			return nil, fmt.Errorf("%q: want stage=requests_per_second[:burst] with a positive rate", e)
+		}
+		l.Burst = 1
+		if hasBurst {
+			if l.Burst, err = strconv.Atoi(burst); err != nil || l.Burst < 1 {
+				return nil, fmt.Errorf("%q: burst must be a positive integer", e)
+			}
+		}
+		limits[name] = l
+	}
+	for _, e := range budgets {
+		name, v, err := stage(e)
+		if err != nil {
+			return nil, err
+		}
+		l := limits[name]
+		if l.Budget, err = strconv.ParseInt(v, 10, 64); err != nil || l.Budget <= 0 {
+			return nil, fmt.Errorf("%q: want stage=requests with a positive number of requests", e)
+		}
+		limits[name] = l
+	}
+	return limits, nil
+}
+
+// requestBudget counts a stage's requests against its budget.
+type requestBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+}
+
+// take reserves one request, reporting false once the budget is spent.
+func (b *requestBudget) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used >= b.limit {
+		return false
+	}
+	b.used++
+	return true
+}
+
+// stageGuardName is the registry name of a stage's limiter and budget.
+func stageGuardName(stage string) string {
+	return vertexEndpoint + "/" + stage
+}
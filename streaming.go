@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/core/graph/window"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/bigqueryio"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/pubsubio"
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+)
+
+// --- Streaming mode ---
+
+// Under --mode=streaming the job serves prompts as they arrive instead of
+// working through an input query: every message of --input_subscription is a
+// JSON object with the keys of the local JSONL input (prompt, row_key, items,
+// ordering_key, sequence, required_terms, locale), and its answer is written
+// to the results table by BigQuery streaming inserts, in windows of
+// --streaming_window. Failed prompts go to the dead-letter table the same way.
+// The job runs until it is drained or cancelled. Only --task=generate streams;
+// the run-level tables (metrics, spot checks, aggregates) need a bounded input
+// and are not written, and --max_element_age becomes meaningful, as messages
+// carry their publish time.
+
+// Values of --mode.
+const (
+	modeBatch     = "batch"
+	modeStreaming = "streaming"
+)
+
+// streamingWindowDefault batches streaming inserts without holding answers back long.
+const streamingWindowDefault = 10 * time.Second
+
+func streamingMode() bool {
+	return *mode == modeStreaming
+}
+
+// checkStreamingFlags rejects settings that need a bounded input.
+func checkStreamingFlags() error {
+	switch {
+	case *inputSubscription == "" || *inputTopic == "":
+		return fmt.Errorf("--mode=%s requires --input_subscription and its --input_topic", modeStreaming)
+	case *task != taskGenerate:
+		return fmt.Errorf("--mode=%s only supports --task=%s", modeStreaming, taskGenerate)
+	case *localMode, *inputSheetID != "", *outputSheetID != "", documentInputEnabled():
+		return fmt.Errorf("--mode=%s reads Pub/Sub and writes BigQuery; --local, Sheets, and document input don't apply", modeStreaming)
+	case *endOfJobRetry:
+		return fmt.Errorf("--end_of_job_retry waits for the end of the input, which --mode=%s never reaches", modeStreaming)
+	case *hoistSharedPrefixChars > 0:
+		return fmt.Errorf("--hoist_shared_prefix_chars compares all prompts before sending any, which --mode=%s never has", modeStreaming)
+	case *streamingWindow <= 0:
+		return fmt.Errorf("invalid --streaming_window %v (want a positive duration)", *streamingWindow)
+	}
+	return nil
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*DecodePromptMessageFn)(nil)).Elem())
+}
+
+// DecodePromptMessageFn parses Pub/Sub messages into input rows. Messages that
+// aren't a JSON object with a prompt are counted and dropped, since
+// redelivering them would fail the same way.
+type DecodePromptMessageFn struct {
+	invalid beam.Counter
+}
+
+func (fn *DecodePromptMessageFn) Setup() {
+	fn.invalid = beam.NewCounter("streaming", "invalid_messages_total")
+}
+
+func (fn *DecodePromptMessageFn) ProcessElement(ctx context.Context, msg []byte, emit func(PromptFromBQ)) {
+	var row localPromptRow
+	if err := json.Unmarshal(msg, &row); err != nil || row.Prompt == "" {
+		fn.invalid.Inc(ctx, 1)
+		beamlog.Warnf(ctx, "DecodePromptMessageFn: Dropping message without a JSON prompt (%d bytes): %v", len(msg), err)
+		return
+	}
+	p := PromptFromBQ{
+		Prompt:        row.Prompt,
+		RowKey:        row.RowKey,
+		Items:         row.Items,
+		OrderingKey:   row.OrderingKey,
+		RequiredTerms: row.RequiredTerms,
+		Locale:        row.Locale,
+	}
+	if row.Sequence != nil {
+		p.Sequence = *row.Sequence
+	}
+	emit(p)
+}
+
+// runStreaming builds the streaming graph: Pub/Sub prompts through the generate
+// stage into the results and dead-letter tables.
+func runStreaming(s beam.Scope, projects runProjects, stage *modelStage) {
+	msgs := pubsubio.Read(s.Scope("ReadPrompts"), projects.Input, *inputTopic, &pubsubio.ReadOptions{Subscription: *inputSubscription})
+	rows := beam.ParDo(s.Scope("DecodePrompts"), &DecodePromptMessageFn{}, msgs)
+	rows = localizeRows(s, stripMarkup(s, shardRows(s, rows)))
+	prompts := beam.ParDo(s.Scope("FormatPrompts"), &FormatPromptsFn{
+		FanOut:      *fanOut,
+		Placeholder: *fanOutPlaceholder,
+	}, rows)
+	results := stage.generate(s.Scope("CallVertexAI"), stageGenerate, prompts)
+
+	// bigqueryio.Write groups its rows before inserting them, which only
+	// happens at the end of a window
+	w := window.NewFixedWindows(*streamingWindow)
+	results = beam.WindowInto(s.Scope("WindowResults"), w, results)
+	for i, failed := range stage.failures {
+		stage.failures[i] = beam.WindowInto(s.Scope("WindowDeadLetters"), w, failed)
+	}
+	tableName := fmt.Sprintf("%s:%s.%s", projects.Output, outputDataset, outputTable)
+	bigqueryio.Write(s.Scope("WriteResults"), projects.Output, tableName, countedForSink(s, outputTable, results), resultsCreateDisposition())
+	writeDeadLetters(s, projects.Output, stage)
+
+	log.Println("Streaming pipeline graph constructed successfully.")
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// --- Output table documentation ---
+
+// documentOutputTables makes every planned output table self-describing: the
+// table description says what a row is and summarizes the configuration of
+// the latest run, and known columns get descriptions derived from the same
+// configuration. Missing tables are created with the documentation (bigqueryio
+// would create them bare); existing ones are updated in place.
+func documentOutputTables(ctx context.Context, projects runProjects, region string) error {
+	client, err := bigquery.NewClient(ctx, projects.Output)
+	if err != nil {
+		return fmt.Errorf("failed to create bigquery client: %w", err)
+	}
+	defer client.Close()
+
+	docs := columnDescriptions()
+	summary := runConfigSummary(projects, region)
+	for _, spec := range plannedOutputTables() {
+		table := client.Dataset(outputDataset).Table(spec.Table)
+		desc := spec.About + ".\n\n" + summary
+		if err := documentTable(ctx, table, spec.Row, desc, docs); err != nil {
+			return fmt.Errorf("table %s.%s: %w", outputDataset, spec.Table, err)
+		}
+	}
+	return nil
+}
+
+func documentTable(ctx context.Context, table *bigquery.Table, row reflect.Type, desc string, docs map[string]string) error {
+	md, err := table.Metadata(ctx)
+	if err != nil && !isBigQueryNotFound(err) {
+		return fmt.Errorf("failed to read table metadata: %w", err)
+	}
+	if err != nil {
+		schema, err := bigquery.InferSchema(reflect.Zero(row).Interface())
+		if err != nil {
+			return fmt.Errorf("failed to infer schema from %v: %w", row, err)
+		}
+		describeColumns(schema, docs)
+		tm := &bigquery.TableMetadata{Schema: schema, Description: desc}
+		if *kmsKey != "" {
+			tm.EncryptionConfig = &bigquery.EncryptionConfig{KMSKeyName: *kmsKey}
+		}
+		if err := table.Create(ctx, tm); err != nil {
+			return fmt.Errorf("failed to create documented table: %w", err)
+		}
+		log.Printf("Created table %s with column descriptions", table.FullyQualifiedName())
+		return nil
+	}
+
+	describeColumns(md.Schema, docs)
+	update := bigquery.TableMetadataToUpdate{Description: desc, Schema: md.Schema}
+	if _, err := table.Update(ctx, update, md.ETag); err != nil {
+		return fmt.Errorf("failed to update table documentation: %w", err)
+	}
+	return nil
+}
+
+// describeColumns sets the description of every top-level column it has one
+// for, leaving other columns (and hand-written descriptions of unknown
+// columns) as they are.
+func describeColumns(schema bigquery.Schema, docs map[string]string) {
+	for _, f := range schema {
+		if d, ok := docs[f.Name]; ok {
+			f.Description = d
+		}
+	}
+}
+
+// columnDescriptions describes output columns by name, in whichever table
+// they appear, filled in from the run configuration.
+func columnDescriptions() map[string]string {
+	version := *promptVersion
+	if version == "" {
+		version = "unset"
+	}
+	model := *modelName
+	if *modelTiers != "" {
+		model = "the --model_tiers model routed to"
+	}
+	modelUsed := fmt.Sprintf("Model that produced the answer; %s unless it was upgraded", model)
+	if ladder := splitList(*modelLadder); len(ladder) > 0 {
+		model += " (escalating to " + strings.Join(ladder, ", ") + " on context overflow)"
+	}
+	answer := fmt.Sprintf("Answer generated by %s for --task=%s", model, *task)
+	if *textWatermark {
+		answer += ", ending in an invisible provenance watermark"
+	}
+	return map[string]string{
+		"RunID":          "Run that wrote the row (--run_id, or the UTC launch time)",
+		"GeneratedAt":    "When the answer was produced (UTC)",
+		"Prompt":         "Prompt sent to the model after formatting and sanitizing",
+		"PromptHash":     "SHA-256 of the prompt, model, and generation parameters; equal hashes mean equal requests",
+		"ParentKey":      "row_key of the input row a fanned-out prompt came from",
+		"SubIndex":       "Position of the item within its parent row under --fan_out",
+		"SubCount":       "Chunks or partial summaries of the group under --task=group_summarize; 0 otherwise",
+		"GeneratedText":  answer,
+		"ModelUsed":      modelUsed,
+		"UpgradedFrom":   "Original model when a larger-context model was substituted",
+		"ModelTier":      "--model_tiers tier the row was routed to, 1 being the cheapest; 0 when routing is off",
+		"Complexity":     fmt.Sprintf("Complexity estimate the tier was chosen by: about one point per input token, plus %d for structured answers", *tierStructuredPoints),
+		"PromptTokens":   "Input tokens reported by the endpoint (0 when unavailable)",
+		"CachedTokens":   "Of PromptTokens, those Vertex AI served from its context cache at the cached rate",
+		"OutputTokens":   "Output tokens reported by the endpoint",
+		"TotalTokens":    "PromptTokens plus OutputTokens",
+		"LatencyMs":      "Vertex AI time spent on the row, including retries; 0 for cache hits",
+		"Fallback":       "The answer came from a fallback responder, not the model; regenerate it by replaying the run",
+		"FinishReason":   "Finish reason reported by the endpoint, e.g. STOP or MAX_TOKENS",
+		"Attempt":        "1 for the first call; higher when a retry produced the answer",
+		"Mutation":       "Retry strategy applied on the attempt that produced the answer",
+		"MissingTerms":   fmt.Sprintf("Input required_terms absent from the answer (--entity_check=%s)", *entityCheck),
+		"RuleViolations": "--consistency_rules the answer breaks",
+		"GlossaryMisses": "--glossary_table entries (source -> target) whose target term the answer lacks",
+		"LexiconHits":    "--lexicons terms (category: term) found in the answer; masked in GeneratedText under the mask action",
+		"VertexProject":  "Project whose Vertex AI endpoint served the request",
+		"RequestID":      "Server-side request ID of the call, for support escalation",
+		"RawResponse":    "Response body as received, under --store_raw_response",
+		"Generator":      "Always gemini; marks the row as AI-generated",
+		"ModelVersion":   "Model version reported by the endpoint, if any",
+		"PromptVersion":  fmt.Sprintf("Prompt template version (--prompt_version; %s for the latest run)", version),
+		"SafetyStatus":   "passed, blocked, or unknown",
+		"ContentHash":    "SHA-256 of GeneratedText as stored",
+		"SafetyRatings":  "Per-category safety ratings of the answer (probability, severity, and whether the category blocked it)",
+		"Citations":      "Passages of the answer the endpoint attributed to a source, with its URI, title, license, and publication date",
+		"OrderingKey":    "Input ordering key; ORDER BY OrderingKey, Sequence, SubIndex restores input order",
+		"Sequence":       "Position of the input row within its ordering key",
+		"WorkflowStep":   "Workflow step that produced the row",
+		"WorkflowPath":   "Workflow steps taken to reach the row, e.g. classify>nutrition",
+		"Trace":          "Attempts, latencies, and cache status of the row under --trace_rows",
+		"ReadingGrade":   "Flesch-Kincaid grade level of GeneratedText (US school grade; higher is harder)",
+
+		"GeneratedHTML":      "GeneratedText rendered from Markdown to escaped HTML, under --output_formats",
+		"GeneratedPlainText": "GeneratedText with Markdown removed, under --output_formats",
+
+		"ErrorStatus":  "Google API status of the failure, e.g. RESOURCE_EXHAUSTED; MAX_RUNTIME for prompts skipped after --max_runtime",
+		"ErrorMessage": "Error of the last attempt; for a 401 or 403, with a remediation",
+		"ErrorDetails": "Raw JSON details of the API error",
+		"ErrorClass":   "retry or permanent under --retry_config or --max_retries",
+		"HTTPStatus":   "HTTP status of the last attempt; 0 when no response was received",
+		"FailedAt":     "When the prompt was dead-lettered (UTC)",
+		"Attempts":     "Calls made to the last model before the prompt was dead-lettered; 0 when no call failed",
+		"SampledAt":    "When the answer was copied for review (UTC)",
+
+		"Task":             "--task of the run",
+		"Model":            "--model_name of the run",
+		"FinishedAt":       "When the run's metrics were aggregated (UTC)",
+		"PromptsSent":      "Prompts handed to the model, across every stage of the task",
+		"RowsSucceeded":    "Result rows produced",
+		"Errors":           "Prompts that failed",
+		"ErrorRatio":       "Errors / PromptsSent",
+		"AvgPromptTokens":  "Mean input tokens per result row",
+		"AvgOutputTokens":  "Mean output tokens per result row",
+		"AvgLatencyMs":     "Mean Vertex AI time per result row",
+		"AvgReadingGrade":  "Mean ReadingGrade of the result rows; NULL without rows",
+		"AvgJudgeScore":    "Mean judge score of the selected candidates under --task=best_of_n; NULL otherwise",
+		"EstimatedCostUSD": "Token cost estimate of the result rows, priced per ModelUsed by --token_prices or the flat --input_price_per_1k_tokens and --output_price_per_1k_tokens",
+		"VertexLogTable":   "Table Vertex AI logged the run's requests and responses to under --vertex_request_logging",
+		"JobID":            "Dataflow job ID; empty on other runners",
+		"Runner":           "Beam runner of the run",
+		"Region":           "Region of the run",
+		"MachineType":      "Worker machine type",
+		"MaxWorkers":       "--max_num_workers; 0 when left to the service",
+		"SDKVersion":       "Apache Beam Go SDK version",
+
+		"Worker":            "Host and process of the worker reporting progress",
+		"ReportedAt":        "When the progress row was written (UTC); totals are cumulative per worker",
+		"ElementsProcessed": "Prompts the worker has received so far, cache hits included",
+	}
+}
+
+// runConfigSummary lists the settings that shaped the latest run's rows.
+func runConfigSummary(projects runProjects, region string) string {
+	input := "BigQuery input query"
+	switch {
+	case streamingMode():
+		input = "Pub/Sub subscription " + *inputSubscription + " (streaming)"
+	case *inputQueryFile != "" && readsInputQuery():
+		input = "BigQuery input query from " + *inputQueryFile
+	case *inputSheetID != "":
+		input = "Google Sheet " + *inputSheetID
+	case gcsInputEnabled():
+		input = "Cloud Storage files " + *inputGCSPattern
+	case *inputDocumentsPrefix != "":
+		input = "documents under " + *inputDocumentsPrefix
+	case *inputDriveFolderID != "":
+		input = "documents in Drive folder " + *inputDriveFolderID
+	}
+	lines := []string{
+		"Latest run: " + *runID,
+		"Task: " + *task,
+		fmt.Sprintf("Model: %s (Vertex AI %s, project %s, --api_mode %s)", *modelName, region, projects.Vertex, *apiMode),
+		"Generation: " + describeGeneration(generationParameters),
+		"Input: " + input,
+	}
+	if inputShard.enabled() {
+		lines = append(lines, "Shard: "+inputShard.String())
+	}
+	if ref := vertexLogTableRef(projects.Output); ref != "" {
+		lines = append(lines, "Vertex AI request-response log: "+ref)
+	}
+	if *maxRuntime > 0 {
+		lines = append(lines, fmt.Sprintf("Max runtime: %v", *maxRuntime))
+	}
+	if *promptTemplates != "" {
+		lines = append(lines, fmt.Sprintf("Localized prompt templates: %s (default locale %s)", *promptTemplates, *defaultLocale))
+	}
+	if *promptVersion != "" {
+		lines = append(lines, "Prompt template version: "+*promptVersion)
+	}
+	if *workflowFile != "" {
+		lines = append(lines, "Workflow: "+*workflowFile)
+	}
+	if *fanOut {
+		lines = append(lines, fmt.Sprintf("Fan-out: placeholder %q", *fanOutPlaceholder))
+	}
+	if *modelTiers != "" {
+		lines = append(lines, "Model tiers: "+*modelTiers)
+	}
+	if *modelLadder != "" {
+		lines = append(lines, "Model ladder: "+*modelLadder)
+	}
+	if len(responseEnum) > 0 {
+		lines = append(lines, fmt.Sprintf("Allowed answers: %d values", len(responseEnum)))
+	}
+	if *numericBounds != "" {
+		lines = append(lines, "Numeric bounds: "+*numericBounds)
+	}
+	if *consistencyRulesPath != "" {
+		lines = append(lines, "Consistency rules: "+*consistencyRulesPath)
+	}
+	if *minChars > 0 || *maxChars > 0 {
+		lines = append(lines, fmt.Sprintf("Length limits: %d to %d characters (0 is unset); answers outside them are dead-lettered", *minChars, *maxChars))
+	}
+	if gcsOutputEnabled() {
+		lines = append(lines, "Results also written to Cloud Storage: "+gcsResultsDir(*outputGCSPrefix, *runID)+"/results-*.jsonl")
+	}
+	if *templateVarsFlag != "" {
+		lines = append(lines, "Template variables: "+strings.Join(templateVarNames(templateVars), ", "))
+	}
+	if *hoistSharedPrefixChars > 0 {
+		lines = append(lines, fmt.Sprintf("Shared prompt prefixes of at least %d characters sent as the system instruction", *hoistSharedPrefixChars))
+	}
+	if *maxReadingGrade > 0 {
+		lines = append(lines, fmt.Sprintf("Max reading grade: %g (one simplify retry above it)", *maxReadingGrade))
+	}
+	if *lexiconsPath != "" {
+		lines = append(lines, "Lexicons: "+*lexiconsPath)
+	}
+	if *unitConversions != "" {
+		lines = append(lines, "Unit conversions: "+*unitConversions)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+
+	"google.golang.org/api/googleapi"
+)
+
+// --- Output table inventory ---
+
+// outputTableSpec describes one BigQuery table the pipeline writes to.
+type outputTableSpec struct {
+	Table string       // Table ID within outputDataset
+	Row   reflect.Type // Row struct written by bigqueryio
+	About string       // What a row is, for the table description
+}
+
+// plannedOutputTables lists the tables the current flag combination will write,
+// so launcher-side setup (encryption, creation) covers exactly what the pipeline touches.
+func plannedOutputTables() []outputTableSpec {
+	tables := []outputTableSpec{{Table: outputTable, Row: reflect.TypeOf(GeminiResult{}), About: "One model answer per prompt"}}
+	if *spotCheckRate > 0 && *spotCheckTable != "" {
+		tables = append(tables, outputTableSpec{Table: *spotCheckTable, Row: reflect.TypeOf(SpotCheck{}), About: "Deterministic sample of answers for manual review"})
+	}
+	if *fanOutAggregateTable != "" {
+		tables = append(tables, outputTableSpec{Table: *fanOutAggregateTable, Row: reflect.TypeOf(FanOutAggregate{}), About: "Fanned-out answers regrouped into one row per parent row"})
+	}
+	if *orderedTable != "" {
+		tables = append(tables, outputTableSpec{Table: *orderedTable, Row: reflect.TypeOf(OrderedDocument{}), About: "Answers sharing an ordering key reassembled in sequence order"})
+	}
+	if *dlqTable != "" {
+		tables = append(tables, outputTableSpec{Table: *dlqTable, Row: reflect.TypeOf(FailedCall{}), About: "Prompts whose generation failed, with the error details needed to replay or escalate them"})
+	}
+	if *metricsTable != "" {
+		tables = append(tables, outputTableSpec{Table: *metricsTable, Row: reflect.TypeOf(RunMetrics{}), About: "One row of aggregate quality, cost, and infrastructure metrics per run"})
+	}
+	if *progressTable != "" {
+		tables = append(tables, outputTableSpec{Table: *progressTable, Row: reflect.TypeOf(ProgressRow{}), About: "Running totals of each worker, written every --progress_interval while a run is in progress"})
+	}
+	if *task == taskPairwise {
+		tables = append(tables, outputTableSpec{Table: *pairwiseTable, Row: reflect.TypeOf(PairwiseResult{}), About: "Model preference between two rows for --task=pairwise"})
+	}
+	if *task == taskClassify {
+		tables = append(tables, outputTableSpec{Table: *classificationTable, Row: reflect.TypeOf(ClassificationResult{}), About: "Validated two-level classification per row for --task=classify"})
+	}
+	if *task == taskBestOfN {
+		tables = append(tables, outputTableSpec{Table: *candidateScoresTable, Row: reflect.TypeOf(CandidateScore{}), About: "Every candidate and its judge score for --task=best_of_n"})
+	}
+	if *task == taskAgent && *agentTrajectoryTable != "" {
+		tables = append(tables, outputTableSpec{Table: *agentTrajectoryTable, Row: reflect.TypeOf(AgentTrajectory{}), About: "Turns and tool calls of each agent run for --task=agent"})
+	}
+	if workflow != nil {
+		for _, step := range workflow.Steps {
+			if step.Table != "" {
+				tables = append(tables, outputTableSpec{Table: step.Table, Row: reflect.TypeOf(GeminiResult{}), About: "Answers of workflow step " + step.Name})
+			}
+		}
+	}
+	return tables
+}
+
+// isBigQueryNotFound reports whether a BigQuery API call failed with 404.
+func isBigQueryNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
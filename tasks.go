@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+)
+
+// --- Task modes ---
+
+const (
+	taskGenerate       = "generate"        // One generation per prompt (default)
+	taskGroupSummarize = "group_summarize" // One generation per group of rows
+	taskPairwise       = "pairwise"        // One comparison per pair of rows
+	taskWorkflow       = "workflow"        // A chain of prompts per row, see workflow.go
+	taskAgent          = "agent"           // Multi-turn tool use per row, see agent.go
+	taskBestOfN        = "best_of_n"       // N judged candidates per row, see rank.go
+	taskClassify       = "classify"        // Two-level taxonomy classification per row, see classify.go
+)
+
+// taskInputQuery returns the SQL the selected task actually reads.
+func taskInputQuery(query string) string {
+	switch *task {
+	case taskGroupSummarize:
+		return groupSummarizeQuery(query, *groupBy)
+	case taskPairwise:
+		return pairsQuery(query)
+	}
+	return query
+}
+
+// --- Group summarization ---
+
+// groupSummarizeQuery wraps the input query so every row carries its group key.
+func groupSummarizeQuery(query, groupBy string) string {
+	return fmt.Sprintf("SELECT CAST(`%s` AS STRING) AS group_key, prompt FROM (%s)", groupBy, query)
+}
+
+func init() {
+	beam.RegisterFunction(keyByGroup)
+	beam.RegisterType(reflect.TypeOf((*PackGroupFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*ReduceGroupFn)(nil)).Elem())
+}
+
+func keyByGroup(row PromptFromBQ) (string, string) {
+	return row.GroupKey, row.Prompt
+}
+
+// groupReduceLevels bounds how often the partial summaries of a group are
+// merged: a level whose partials don't fit in --group_chunk_chars together
+// packs them into several merge prompts, and the last level merges whatever
+// is left in one.
+const groupReduceLevels = 3
+
+// PackGroupFn packs a group's texts into chunks of at most MaxChunkChars and emits
+// one summarization prompt per chunk (the "map" side of the map-reduce). Each
+// prompt carries the group's chunk count, so the reduce side can tell when a
+// chunk failed.
+type PackGroupFn struct {
+	Instruction   string
+	MaxChunkChars int
+}
+
+func (fn *PackGroupFn) ProcessElement(ctx context.Context, groupKey string, texts func(*string) bool, emit func(Prompt)) {
+	var all []string
+	var text string
+	for texts(&text) {
+		all = append(all, text)
+	}
+	chunks := packChunks(all, "\n", fn.MaxChunkChars)
+	for i, chunk := range chunks {
+		emit(Prompt{Prompt: fn.Instruction + "\n\n" + chunk, ParentKey: groupKey, SubIndex: i, SubCount: len(chunks)})
+	}
+}
+
+// packChunks joins texts with sep into chunks of at most maxChars, starting a
+// new chunk rather than splitting a text; a longer text is a chunk of its own.
+func packChunks(texts []string, sep string, maxChars int) []string {
+	var chunks []string
+	var cur strings.Builder
+	for _, text := range texts {
+		if cur.Len() > 0 && cur.Len()+len(sep)+len(text) > maxChars {
+			chunks = append(chunks, cur.String())
+			cur.Reset()
+		}
+		if cur.Len() > 0 {
+			cur.WriteString(sep)
+		}
+		cur.WriteString(text)
+	}
+	if cur.Len() > 0 {
+		chunks = append(chunks, cur.String())
+	}
+	return chunks
+}
+
+// partialSep separates the partial summaries of a merge prompt.
+const partialSep = "\n\n---\n\n"
+
+// ReduceGroupFn collects the partial summaries of a group in SubIndex order. A
+// single partial is already final. Otherwise the partials are merged, in one
+// prompt when they fit in MaxChunkChars or on the last level, else in several
+// whose answers the next level merges again. A group missing a partial, its
+// chunk having failed, is dead-lettered rather than summarized without it.
+type ReduceGroupFn struct {
+	RunID         string
+	Instruction   string
+	MaxChunkChars int
+	Last          bool // Merge into one prompt whatever the size
+
+	incomplete beam.Counter
+}
+
+func (fn *ReduceGroupFn) Setup() {
+	fn.incomplete = beam.NewCounter("group_summarize", "incomplete_groups_total")
+}
+
+func (fn *ReduceGroupFn) ProcessElement(ctx context.Context, groupKey string, partials func(*GeminiResult) bool, final func(GeminiResult), reduce func(Prompt), emitFailed func(FailedCall)) {
+	byIndex := map[int]GeminiResult{}
+	want := 0
+	var r GeminiResult
+	for partials(&r) {
+		byIndex[r.SubIndex] = r
+		want = r.SubCount
+	}
+	all := make([]GeminiResult, 0, len(byIndex))
+	for _, p := range byIndex {
+		all = append(all, p)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].SubIndex < all[j].SubIndex })
+	if len(all) < want {
+		fn.incomplete.Inc(ctx, 1)
+		beamlog.Errorf(ctx, "ReduceGroupFn: Group %q has %d of %d partial summaries, dead-lettering it", groupKey, len(all), want)
+		emitFailed(FailedCall{
+			RunID:        fn.RunID,
+			FailedAt:     time.Now().UTC(),
+			ParentKey:    groupKey,
+			ModelUsed:    all[0].ModelUsed,
+			ErrorStatus:  "incomplete_group",
+			ErrorMessage: fmt.Sprintf("%d of %d partial summaries of the group were generated; the failed chunks are dead-lettered under the same ParentKey", len(all), want),
+		})
+		return
+	}
+	if len(all) == 1 {
+		final(all[0])
+		return
+	}
+	texts := make([]string, len(all))
+	for i, p := range all {
+		texts[i] = p.GeneratedText
+	}
+	budget := fn.MaxChunkChars - len(fn.Instruction) - 2
+	chunks := []string{strings.Join(texts, partialSep)}
+	if !fn.Last && len(chunks[0]) > budget {
+		// Partials too long to pair up are merged in one prompt all the same
+		if packed := packChunks(texts, partialSep, budget); len(packed) < len(texts) {
+			chunks = packed
+		}
+	}
+	for i, chunk := range chunks {
+		reduce(Prompt{Prompt: fn.Instruction + "\n\n" + chunk, ParentKey: groupKey, SubIndex: i, SubCount: len(chunks)})
+	}
+}
+
+// summarizeGroups runs the group_summarize task: rows are grouped by key, packed into
+// chunks, summarized per chunk, and the partial summaries of large groups are merged,
+// over up to groupReduceLevels levels.
+func summarizeGroups(s beam.Scope, model *modelStage, rows beam.PCollection) beam.PCollection {
+	s = s.Scope("SummarizeGroups")
+	grouped := beam.GroupByKey(s, beam.ParDo(s, keyByGroup, rows))
+	chunkPrompts := beam.ParDo(s.Scope("PackGroups"), &PackGroupFn{
+		Instruction:   *groupInstruction,
+		MaxChunkChars: *groupChunkChars,
+	}, grouped)
+	partials := model.generate(s.Scope("SummarizeChunks"), stageSummarize, chunkPrompts)
+
+	var summaries []beam.PCollection
+	for level := 1; level <= groupReduceLevels; level++ {
+		byGroup := beam.GroupByKey(s, beam.ParDo(s, keyByParent, partials))
+		single, reducePrompts, incomplete := beam.ParDo3(s.Scope(fmt.Sprintf("ReduceGroups%d", level)), &ReduceGroupFn{
+			RunID:         *runID,
+			Instruction:   *groupReduceInstruction,
+			MaxChunkChars: *groupChunkChars,
+			Last:          level == groupReduceLevels,
+		}, byGroup)
+		summaries = append(summaries, single)
+		model.failures = append(model.failures, incomplete)
+		partials = model.generate(s.Scope(fmt.Sprintf("MergeSummaries%d", level)), stageMerge, reducePrompts)
+	}
+	return beam.Flatten(s, append(summaries, partials)...)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// --- Template variables ---
+
+// Prompt templates (--prompt_templates, --workflow_file steps, and
+// --fallback_template) can use run context through {{var "name"}}. The
+// launcher resolves every variable once, before the graph is built:
+//
+//	run_id, date (UTC, YYYY-MM-DD), launch_time (RFC 3339), project, model
+//
+// are always defined, and --template_vars adds name=value pairs, where a value
+// of secret://projects/P/secrets/S[/versions/V] is read from Secret Manager
+// (one trailing newline dropped), e.g. api_doc=secret://projects/p/secrets/api-doc.
+// Resolved values travel to the workers with the job graph, so secrets used
+// here are visible to anyone who can inspect the job. A template naming an
+// undefined variable fails to render.
+
+// templateVars is resolved by main; workers get it through their DoFns.
+var templateVars map[string]string
+
+// resolveTemplateVars builds the variables from the built-ins and the
+// --template_vars entries.
+func resolveTemplateVars(ctx context.Context, project, model string, entries []string) (map[string]string, error) {
+	vars := map[string]string{
+		"run_id":      *runID,
+		"date":        launchTime.UTC().Format("2006-01-02"),
+		"launch_time": launchTime.UTC().Format(time.RFC3339),
+		"project":     project,
+		"model":       model,
+	}
+	for _, e := range entries {
+		name, value, ok := strings.Cut(e, "=")
+		if name = strings.TrimSpace(name); !ok || name == "" {
+			return nil, fmt.Errorf("%q: want name=value", e)
+		}
+		if strings.HasPrefix(value, secretSourcePrefix) {
+			raw, err := accessSecret(ctx, secretVersion(value))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			value = strings.TrimSuffix(string(raw), "\n")
+		}
+		vars[name] = value
+	}
+	return vars, nil
+}
+
+// templateFuncs provides {{var "name"}} over vars to a template.
+func templateFuncs(vars map[string]string) template.FuncMap {
+	return template.FuncMap{
+		"var": func(name string) (string, error) {
+			v, ok := vars[name]
+			if !ok {
+				return "", fmt.Errorf("undefined template variable %q", name)
+			}
+			return v, nil
+		},
+	}
+}
+
+// templateVarNames lists the variables for logs, without their values.
+func templateVarNames(vars map[string]string) []string {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
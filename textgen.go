@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- Text generation backends ---
+
+// GenerateTextFn sends its requests through a TextGenerator, so the guards,
+// retries, checks, and rows around a call are the same whichever service
+// answers it. --backend picks one:
+//
+//   - vertex (default) calls Vertex AI as described in generatecontent.go,
+//     with ADC or the --quota_projects credentials.
+//   - gemini_api calls the Gemini API of Google AI Studio with an API key.
+//   - openai calls an OpenAI-compatible chat completions endpoint at
+//     --backend_url, e.g. Ollama's http://localhost:11434/v1 for local
+//     pipeline tests, with an optional API key.
+//
+// The key is read on the workers from --backend_api_key_file (local path or
+// gs:// URI) so it never appears in the job graph, and otherwise from the
+// GEMINI_API_KEY or OPENAI_API_KEY environment variable. The other backends
+// take one prompt per request and answer in their own formats; their bodies
+// are stored and re-parsed like Vertex AI's, and their rows name the backend
+// in VertexProject. Errors carry the HTTP status, so retries, dead letters,
+// and the adaptive throttle treat them alike.
+//
+// The vertex backend stays on the REST API rather than the
+// cloud.google.com/go/vertexai/genai client: that package was deprecated in
+// June 2025 with its removal set for June 2026, and it returns typed
+// responses instead of the bodies the rows store for reparse, hides the HTTP
+// status and request ID the dead letters carry, and only serves
+// generateContent models, not predict ones. Its successor,
+// google.golang.org/genai, also has typed responses only and no gRPC
+// transport. Retries are already configurable with --retry_config.
+
+// TextGenerator sends one request for the prompts to a model and returns one
+// output per prompt, in order.
+type TextGenerator interface {
+	Generate(ctx context.Context, model string, prompts []string, params VertexParameters) ([]vertexOutput, error)
+}
+
+// Values of --backend.
+const (
+	backendVertex    = "vertex"
+	backendGeminiAPI = "gemini_api"
+	backendOpenAI    = "openai"
+)
+
+func validBackend(b string) bool {
+	return b == backendVertex || b == backendGeminiAPI || b == backendOpenAI
+}
+
+const geminiAPIBaseURL = "https://generativelanguage.googleapis.com/v1beta"
+
+// usesVertex reports whether the DoFn calls Vertex AI; unset means it does.
+func (fn *GenerateTextFn) usesVertex() bool {
+	return fn.Backend == "" || fn.Backend == backendVertex
+}
+
+// newTextGenerator returns the generator of the DoFn's backend.
+func (fn *GenerateTextFn) newTextGenerator(ctx context.Context) (TextGenerator, error) {
+	switch fn.Backend {
+	case "", backendVertex:
+		return vertexGenerator{fn}, nil
+	case backendGeminiAPI:
+		key, err := backendAPIKey(ctx, fn.BackendKeyFile, "GEMINI_API_KEY")
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			return nil, fmt.Errorf("the gemini_api backend needs --backend_api_key_file or GEMINI_API_KEY")
+		}
+		return &httpGenerator{fn: fn, name: backendGeminiAPI, header: http.Header{"X-Goog-Api-Key": {key}}, request: fn.geminiAPIRequest}, nil
+	case backendOpenAI:
+		key, err := backendAPIKey(ctx, fn.BackendKeyFile, "OPENAI_API_KEY")
+		if err != nil {
+			return nil, err
+		}
+		header := http.Header{}
+		if key != "" {
+			header.Set("Authorization", "Bearer "+key)
+		}
+		return &httpGenerator{fn: fn, name: backendOpenAI, header: header, request: fn.chatCompletionRequest}, nil
+	}
+	return nil, fmt.Errorf("unknown backend %q", fn.Backend)
+}
+
+// callBackend sends one request through the DoFn's generator.
+func (fn *GenerateTextFn) callBackend(ctx context.Context, model string, prompts []string, params VertexParameters) ([]vertexOutput, error) {
+	if fn.generatorErr != nil {
+		return nil, fn.generatorErr
+	}
+	return fn.generator.Generate(ctx, model, prompts, params)
+}
+
+// finishOutput records a parsed output in the size and token metrics,
+// normalizes its units, and keeps the body under StoreRawResponse.
+func (fn *GenerateTextFn) finishOutput(ctx context.Context, model, prompt string, body []byte, out vertexOutput) vertexOutput {
+	fn.recordSizes(ctx, prompt, out)
+	fn.CachedTokensCounter.Inc(ctx, out.CachedTokens)
+	countTokens(ctx, model, out)
+	out.Text = fn.normalizeUnits(ctx, out.Text)
+	if fn.StoreRawResponse {
+		out.RawResponse = string(body)
+	}
+	return out
+}
+
+// backendAPIKey reads the key file, or the environment variable without one.
+func backendAPIKey(ctx context.Context, file, env string) (string, error) {
+	if file == "" {
+		return os.Getenv(env), nil
+	}
+	b, err := readConfigFile(ctx, file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read --backend_api_key_file: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// vertexGenerator calls Vertex AI, see callVertexPredictAPI.
+type vertexGenerator struct {
+	fn *GenerateTextFn
+}
+
+func (g vertexGenerator) Generate(ctx context.Context, model string, prompts []string, params VertexParameters) ([]vertexOutput, error) {
+	return g.fn.callVertexPredictAPI(ctx, model, prompts, params)
+}
+
+// httpGenerator calls a backend that takes one prompt per JSON request.
+type httpGenerator struct {
+	fn      *GenerateTextFn
+	name    string
+	header  http.Header
+	request func(model, prompt string, params VertexParameters) (url string, body []byte, err error)
+}
+
+func (g *httpGenerator) Generate(ctx context.Context, model string, prompts []string, params VertexParameters) ([]vertexOutput, error) {
+	if len(prompts) != 1 {
+		return nil, fmt.Errorf("the %s backend takes one prompt per request, got %d", g.name, len(prompts))
+	}
+	fn := g.fn
+	u, body, err := g.request(model, prompts[0], params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s request body: %w", g.name, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create http request for %s: %w", g.name, err)
+	}
+	req.Header = g.header.Clone()
+	req.Header.Set("Content-Type", "application/json")
+
+	reqStart := time.Now()
+	resp, err := (&http.Client{Transport: apiTransport}).Do(req)
+	if err != nil {
+		fn.recordRequest(ctx, time.Since(reqStart), false)
+		return nil, fmt.Errorf("failed to send request to %s: %w", g.name, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := readResponseBody(resp)
+	fn.recordRequest(ctx, time.Since(reqStart), resp.StatusCode == http.StatusTooManyRequests)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s response body: %w", g.name, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fn.newVertexAPIError(resp, respBody, g.name)
+	}
+	out, err := parseVertexResponse(ctx, respBody, prompts[0], fn.LogPolicy)
+	if err != nil {
+		return nil, err
+	}
+	out.Project = g.name
+	return []vertexOutput{fn.finishOutput(ctx, model, prompts[0], respBody, out)}, nil
+}
+
+// geminiAPIRequest is the generateContent request of the Gemini API, which
+// shares its body with Vertex AI's.
+func (fn *GenerateTextFn) geminiAPIRequest(model, prompt string, params VertexParameters) (string, []byte, error) {
+	if params.Document != nil {
+		return "", nil, fmt.Errorf("the %s backend can't take the document %s", backendGeminiAPI, params.Document.URI)
+	}
+	system, user := fn.splitHoisted(prompt)
+	body, err := generateContentBody(system, user, params, nil)
+	return fmt.Sprintf("%s/models/%s:generateContent", geminiAPIBaseURL, model), body, err
+}
+
+// --- OpenAI-compatible chat completions ---
+
+type chatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type chatCompletionRequest struct {
+	Model          string        `json:"model"`
+	Messages       []chatMessage `json:"messages"`
+	Temperature    float64       `json:"temperature"`
+	TopP           float64       `json:"top_p,omitempty"`
+	MaxTokens      int           `json:"max_tokens,omitempty"`
+	Stop           []string      `json:"stop,omitempty"`
+	ResponseFormat *struct {
+		Type string `json:"type"`
+	} `json:"response_format,omitempty"`
+}
+
+type chatCompletionResponse struct {
+	Object  string `json:"object"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Message      chatMessage `json:"message"`
+		FinishReason string      `json:"finish_reason"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int64 `json:"prompt_tokens"`
+		CompletionTokens int64 `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// chatFinishReasons maps OpenAI finish reasons to the Vertex AI ones the
+// checks and retries look for.
+var chatFinishReasons = map[string]string{
+	"stop":           "STOP",
+	"length":         "MAX_TOKENS",
+	"content_filter": "SAFETY",
+}
+
+// chatCompletionRequest is the chat completions request of a prompt. Top-k,
+// candidate counts, and response schemas have no equivalent; JSON output is
+// asked for as a JSON object.
+func (fn *GenerateTextFn) chatCompletionRequest(model, prompt string, params VertexParameters) (string, []byte, error) {
+	if params.Document != nil {
+		return "", nil, fmt.Errorf("the %s backend can't take the document %s", backendOpenAI, params.Document.URI)
+	}
+	system, user := fn.splitHoisted(prompt)
+	req := chatCompletionRequest{Model: model, Temperature: params.Temperature, TopP: params.TopP, MaxTokens: params.MaxOutputTokens, Stop: params.StopSequences}
+	if system != "" {
+		req.Messages = append(req.Messages, chatMessage{Role: "system", Content: system})
+	}
+	req.Messages = append(req.Messages, chatMessage{Role: "user", Content: user})
+	if params.ResponseMimeType == "application/json" {
+		req.ResponseFormat = &struct {
+			Type string `json:"type"`
+		}{"json_object"}
+	}
+	body, err := json.Marshal(req)
+	return strings.TrimSuffix(fn.BackendURL, "/") + "/chat/completions", body, err
+}
+
+// isChatCompletionBody reports whether a stored response body came from a
+// chat completions endpoint.
+func isChatCompletionBody(body []byte) bool {
+	var probe struct {
+		Object string `json:"object"`
+	}
+	return json.Unmarshal(body, &probe) == nil && probe.Object == "chat.completion"
+}
+
+// parseChatCompletionResponse extracts the text of the first choice, the
+// counterpart of parseVertexResponse for chat completions bodies.
+func parseChatCompletionResponse(body []byte, policy contentPolicy) (vertexOutput, error) {
+	var resp chatCompletionResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return vertexOutput{}, fmt.Errorf("failed to unmarshal chat completion response (body: %s): %w", policy.redact(string(body)), err)
+	}
+	out := vertexOutput{
+		ModelVersion: resp.Model,
+		SafetyStatus: safetyUnknown,
+		PromptTokens: resp.Usage.PromptTokens,
+		OutputTokens: resp.Usage.CompletionTokens,
+	}
+	if len(resp.Choices) == 0 {
+		out.Text = "No prediction content from the chat completions endpoint"
+		return out, nil
+	}
+	out.Text = resp.Choices[0].Message.Content
+	out.FinishReason = chatFinishReasons[resp.Choices[0].FinishReason]
+	if out.FinishReason == "" {
+		out.FinishReason = strings.ToUpper(resp.Choices[0].FinishReason)
+	}
+	return out, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+	"golang.org/x/oauth2"
+)
+
+// --- Background token renewal ---
+
+// Access tokens last about an hour, and an oauth2.ReuseTokenSource renews one
+// only when a request finds it (nearly) expired, so that request waits on the
+// metadata server or token endpoint, and one sent just before expiry can be
+// rejected in flight. Each shared client (see registry.go) instead renews its
+// token on a goroutine tokenRefreshLead before it expires, while requests keep
+// using the current one. If renewal keeps failing, requests fetch a token
+// themselves once the current one has expired, as before.
+
+const (
+	tokenRefreshLead  = 5 * time.Minute  // Renew this long before the token expires
+	tokenRefreshRetry = 15 * time.Second // Wait after a failed or premature renewal
+)
+
+// prefetchingTokenSource serves the current token and renews it in the background.
+type prefetchingTokenSource struct {
+	src oauth2.TokenSource // Hands out a new token within tokenRefreshLead of expiry
+
+	mu  sync.Mutex
+	tok *oauth2.Token
+}
+
+// newPrefetchingTokenSource fetches the first token and starts renewing it. The
+// renewal goroutine lives as long as the worker, like the client it serves.
+func newPrefetchingTokenSource(src oauth2.TokenSource) (*prefetchingTokenSource, error) {
+	// Wrapping a ReuseTokenSource (what credentials usually hand out) moves its
+	// own expiry margin up to tokenRefreshLead, so it renews when asked to
+	p := &prefetchingTokenSource{src: oauth2.ReuseTokenSourceWithExpiry(nil, src, tokenRefreshLead)}
+	if _, err := p.fetch(); err != nil {
+		return nil, err
+	}
+	go p.renew()
+	return p, nil
+}
+
+func (p *prefetchingTokenSource) Token() (*oauth2.Token, error) {
+	p.mu.Lock()
+	tok := p.tok
+	p.mu.Unlock()
+	if tok.Valid() {
+		return tok, nil
+	}
+	return p.fetch()
+}
+
+// fetch asks the underlying source for a token and keeps it if it lasts
+// longer than the current one.
+func (p *prefetchingTokenSource) fetch() (*oauth2.Token, error) {
+	tok, err := p.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tok == nil || tok.Expiry.After(p.tok.Expiry) {
+		p.tok = tok
+	}
+	return p.tok, nil
+}
+
+// renew replaces the token tokenRefreshLead before it expires, for good.
+func (p *prefetchingTokenSource) renew() {
+	for {
+		p.mu.Lock()
+		expiry := p.tok.Expiry
+		p.mu.Unlock()
+		if expiry.IsZero() {
+			return // The token never expires
+		}
+		time.Sleep(time.Until(expiry.Add(-tokenRefreshLead)))
+		tok, err := p.fetch()
+		switch {
+		case err != nil:
+			beamlog.Warnf(context.Background(), "Token renewal failed, retrying in %v: %v", tokenRefreshRetry, err)
+			time.Sleep(tokenRefreshRetry)
+		case !tok.Expiry.After(expiry):
+			// The source still hands out the old token (lifetimes shorter
+			// than the lead, or a source that can't renew early)
+			time.Sleep(tokenRefreshRetry)
+		}
+	}
+}
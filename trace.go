@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// --- Per-row processing trace ---
+
+// RowTrace is the nested Trace column written under --trace_rows: how a row's
+// answer came about, for debugging one row at a time. It is empty otherwise.
+type RowTrace struct {
+	Cache    string         `beam:"Cache"`    // hit or miss; empty when the LRU cache is off
+	Fallback string         `beam:"Fallback"` // stale or circuit_open when a fallback answered
+	Identity string         `beam:"Identity"` // Worker service account
+	Host     string         `beam:"Host"`     // Worker hostname
+	TotalMs  int64          `beam:"TotalMs"`  // Time from receiving the prompt to emitting the row
+	Attempts []TraceAttempt `beam:"Attempts"` // Every call made for the row, in order
+}
+
+// TraceAttempt is one call to the endpoint, or one rejected before it was sent.
+type TraceAttempt struct {
+	Model      string `beam:"Model"`
+	Project    string `beam:"Project"`
+	Status     string `beam:"Status"`     // ok, api_error, circuit_open, quota_exhausted, or error
+	HTTPStatus int    `beam:"HTTPStatus"` // 0 when no response was received
+	LatencyMs  int64  `beam:"LatencyMs"`
+	RequestID  string `beam:"RequestID"`
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*RowTrace)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*TraceAttempt)(nil)).Elem())
+}
+
+// rowTrace accumulates the trace of the element being processed. A DoFn
+// instance handles one element at a time, so it lives on the DoFn.
+type rowTrace struct {
+	RowTrace
+	start time.Time
+}
+
+// startTrace begins tracing an element when --trace_rows is set.
+func (fn *GenerateTextFn) startTrace() {
+	if !fn.TraceRows {
+		return
+	}
+	host, _ := os.Hostname()
+	fn.trace = &rowTrace{RowTrace: RowTrace{Identity: fn.workerIdentity, Host: host}, start: time.Now()}
+}
+
+// traceCache records whether the worker cache answered.
+func (fn *GenerateTextFn) traceCache(hit bool) {
+	if fn.trace == nil {
+		return
+	}
+	fn.trace.Cache = "miss"
+	if hit {
+		fn.trace.Cache = "hit"
+	}
+}
+
+// traceFallback records which fallback answered.
+func (fn *GenerateTextFn) traceFallback(kind string) {
+	if fn.trace != nil {
+		fn.trace.Fallback = kind
+	}
+}
+
+// traceAttempt records one guarded call.
+func (fn *GenerateTextFn) traceAttempt(model string, out vertexOutput, err error, start time.Time) {
+	if fn.trace == nil {
+		return
+	}
+	a := TraceAttempt{Model: model, Project: out.Project, Status: "ok", LatencyMs: time.Since(start).Milliseconds(), RequestID: out.RequestID}
+	var apiErr *vertexAPIError
+	switch {
+	case err == nil:
+		a.HTTPStatus = 200
+	case errors.As(err, &apiErr):
+		a.Status, a.HTTPStatus, a.Project, a.RequestID = "api_error", apiErr.HTTPStatus, apiErr.Project, apiErr.RequestID
+		if apiErr.quotaExhausted() {
+			a.Status = "quota_exhausted"
+		}
+	case errors.Is(err, errCircuitOpen):
+		a.Status = "circuit_open"
+	default:
+		a.Status = "error"
+	}
+	fn.trace.Attempts = append(fn.trace.Attempts, a)
+}
+
+// finishTrace returns the trace to attach to the row being emitted.
+func (fn *GenerateTextFn) finishTrace() RowTrace {
+	if fn.trace == nil {
+		return RowTrace{}
+	}
+	t := fn.trace.RowTrace
+	t.TotalMs = time.Since(fn.trace.start).Milliseconds()
+	t.Attempts = append([]TraceAttempt(nil), t.Attempts...)
+	return t
+}
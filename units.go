@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+)
+
+// --- Unit normalization ---
+
+// unitAliases are the spellings recognized for each unit, longest first where
+// one is a prefix of another ("fl oz" must win over "oz").
+var unitAliases = map[string][]string{
+	"g":     {"grams", "gram", "g"},
+	"kg":    {"kilograms", "kilogram", "kg"},
+	"oz":    {"ounces", "ounce", "oz"},
+	"lb":    {"pounds", "pound", "lbs", "lb"},
+	"kcal":  {"kilocalories", "kcal"},
+	"kJ":    {"kilojoules", "kJ"},
+	"fl oz": {"fluid ounces", "fl. oz.", "fl oz"},
+	"ml":    {"milliliters", "millilitres", "mL", "ml"},
+}
+
+// unitFactors multiply a value in the first unit to get the second.
+var unitFactors = map[[2]string]float64{
+	{"oz", "g"}:     28.349523125,
+	{"g", "oz"}:     1 / 28.349523125,
+	{"lb", "kg"}:    0.45359237,
+	{"kg", "lb"}:    1 / 0.45359237,
+	{"kcal", "kJ"}:  4.184,
+	{"kJ", "kcal"}:  1 / 4.184,
+	{"fl oz", "ml"}: 29.5735295625,
+	{"ml", "fl oz"}: 1 / 29.5735295625,
+}
+
+// unitConversion rewrites every quantity in one unit into another.
+type unitConversion struct {
+	From, To string
+	factor   float64
+	pattern  *regexp.Regexp
+}
+
+// parseUnitConversions parses "from=to" entries, e.g. "oz=g,kcal=kJ".
+func parseUnitConversions(entries []string) ([]unitConversion, error) {
+	var convs []unitConversion
+	for _, e := range entries {
+		from, to, _ := strings.Cut(e, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		factor, ok := unitFactors[[2]string{from, to}]
+		if !ok {
+			return nil, fmt.Errorf("unsupported unit conversion %q (supported: %s)", e, supportedConversions())
+		}
+		alts := make([]string, len(unitAliases[from]))
+		for i, a := range unitAliases[from] {
+			alts[i] = regexp.QuoteMeta(a)
+		}
+		// A unit must follow its number and not run into a longer word ("5 glasses")
+		pattern := regexp.MustCompile(`(?i)` + numberPattern + `[ \t]?(?:` + strings.Join(alts, "|") + `)([^\w]|$)`)
+		convs = append(convs, unitConversion{From: from, To: to, factor: factor, pattern: pattern})
+	}
+	return convs, nil
+}
+
+// supportedConversions lists the from=to pairs for error messages.
+func supportedConversions() string {
+	var pairs []string
+	for k := range unitFactors {
+		pairs = append(pairs, k[0]+"="+k[1])
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// convert rewrites the quantities in text, returning how many it changed.
+// Numbers keep at most one decimal place.
+func (c unitConversion) convert(text string) (string, int) {
+	n := 0
+	text = c.pattern.ReplaceAllStringFunc(text, func(m string) string {
+		sub := c.pattern.FindStringSubmatchIndex(m)
+		v, err := parseNumber(m[sub[2]:sub[3]])
+		if err != nil {
+			return m
+		}
+		n++
+		rounded := strconv.FormatFloat(math.Round(v*c.factor*10)/10, 'f', -1, 64)
+		return rounded + " " + c.To + m[sub[4]:sub[5]] // Keep the character that ended the unit
+	})
+	return text, n
+}
+
+// unitNormalizer is embedded in DoFns that rewrite quantities in answers.
+type unitNormalizer struct {
+	UnitConversions []string // from=to entries, validated in main
+	UnitsConverted  beam.Counter
+
+	conversions []unitConversion
+}
+
+func (u *unitNormalizer) setupUnits() {
+	u.UnitsConverted = beam.NewCounter("vertexai", "units_converted_total")
+	u.conversions, _ = parseUnitConversions(u.UnitConversions)
+}
+
+// normalizeUnits applies every configured conversion to an answer.
+func (u *unitNormalizer) normalizeUnits(ctx context.Context, text string) string {
+	for _, c := range u.conversions {
+		var n int
+		if text, n = c.convert(text); n > 0 {
+			u.UnitsConverted.Inc(ctx, int64(n))
+		}
+	}
+	return text
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// --- Vertex request-response logging ---
+
+// Under --vertex_request_logging the launcher asks Vertex AI to log the
+// requests and responses of every model the run may call into
+// --vertex_log_table, in the output dataset. Vertex writes those rows itself,
+// so platform teams can line them up with the run's own rows by model and
+// time; the table is recorded in the run metrics row (VertexLogTable) and the
+// table descriptions. Logging is a setting of the model in the project, so it
+// stays on after the run. Models that don't support it only produce a warning.
+
+// publisherLoggingConfig is the body of setPublisherModelConfig.
+type publisherLoggingConfig struct {
+	PublisherModelConfig struct {
+		LoggingConfig struct {
+			Enabled             bool    `json:"enabled"`
+			SamplingRate        float64 `json:"samplingRate"`
+			BigqueryDestination struct {
+				OutputURI string `json:"outputUri"`
+			} `json:"bigqueryDestination"`
+		} `json:"loggingConfig"`
+	} `json:"publisherModelConfig"`
+}
+
+// vertexLogTableRef returns the project.dataset.table Vertex logs to, or ""
+// when --vertex_request_logging is off.
+func vertexLogTableRef(project string) string {
+	if !*vertexRequestLogging {
+		return ""
+	}
+	return fmt.Sprintf("%s.%s.%s", project, outputDataset, *vertexLogTable)
+}
+
+// calledModels lists the models the run may call: --model_name, the ladder,
+// and the routing tiers.
+func calledModels(model string) []string {
+	seen := map[string]bool{model: true}
+	models := []string{model}
+	add := func(m string) {
+		if !seen[m] {
+			seen[m] = true
+			models = append(models, m)
+		}
+	}
+	for _, m := range splitList(*modelLadder) {
+		add(m)
+	}
+	tiers, _ := parseModelTiers(splitList(*modelTiers))
+	for _, t := range tiers {
+		add(t.Model)
+	}
+	return models
+}
+
+// enableVertexRequestLogging turns on request-response logging for every model
+// the run may call. The returned error lists the models it failed for.
+func enableVertexRequestLogging(ctx context.Context, projects runProjects, region, model string) error {
+	client, err := sharedWorkerRegistry().client(ctx, "", cloudPlatformScope)
+	if err != nil {
+		return err
+	}
+	var cfg publisherLoggingConfig
+	lc := &cfg.PublisherModelConfig.LoggingConfig
+	lc.Enabled = true
+	lc.SamplingRate = *vertexLogSamplingRate
+	lc.BigqueryDestination.OutputURI = "bq://" + vertexLogTableRef(projects.Output)
+	body, err := json.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal logging config: %w", err)
+	}
+
+	var failed []string
+	for _, m := range calledModels(model) {
+		url := fmt.Sprintf("https://%s-aiplatform.googleapis.com/v1beta1/projects/%s/locations/%s/publishers/google/models/%s:setPublisherModelConfig",
+			region, projects.Vertex, region, m)
+		if err := postLoggingConfig(ctx, client, url, body); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", m, err))
+			continue
+		}
+		log.Printf("Vertex AI request-response logging of %s -> %s", m, lc.BigqueryDestination.OutputURI)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to enable logging for %v", failed)
+	}
+	return nil
+}
+
+// postLoggingConfig sends one setPublisherModelConfig request. It returns once
+// Vertex has accepted the long-running operation; the setting takes effect
+// shortly after.
+func postLoggingConfig(ctx context.Context, client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// --- Latest-results view ---
+
+// latestViewQuery keeps the newest row per key across all runs in the output table.
+func latestViewQuery(project string, keyColumns []string) string {
+	return fmt.Sprintf("SELECT * EXCEPT(_rank) FROM (\n"+
+		"  SELECT *, ROW_NUMBER() OVER (PARTITION BY %s ORDER BY GeneratedAt DESC) AS _rank\n"+
+		"  FROM `%s.%s.%s`\n"+
+		") WHERE _rank = 1",
+		strings.Join(keyColumns, ", "), project, outputDataset, outputTable)
+}
+
+// createOrUpdateLatestView points the latest view at the newest run per key, so consumers
+// get current results without knowing run IDs.
+func createOrUpdateLatestView(ctx context.Context, project string) error {
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return fmt.Errorf("failed to create bigquery client: %w", err)
+	}
+	defer client.Close()
+
+	query := latestViewQuery(project, splitList(*latestViewKey))
+	view := client.Dataset(outputDataset).Table(*latestView)
+	md, err := view.Metadata(ctx)
+	if err != nil {
+		if !isBigQueryNotFound(err) {
+			return fmt.Errorf("failed to read view metadata: %w", err)
+		}
+		if err := view.Create(ctx, &bigquery.TableMetadata{ViewQuery: query}); err != nil {
+			return fmt.Errorf("failed to create view: %w", err)
+		}
+		log.Printf("Created view %s", view.FullyQualifiedName())
+		return nil
+	}
+	if md.ViewQuery == query {
+		return nil
+	}
+	if _, err := view.Update(ctx, bigquery.TableMetadataToUpdate{ViewQuery: query}, md.ETag); err != nil {
+		return fmt.Errorf("failed to update view: %w", err)
+	}
+	log.Printf("Updated view %s", view.FullyQualifiedName())
+	return nil
+}
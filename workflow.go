@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"cloud.google.com/go/storage"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam/io/bigqueryio"
+	beamlog "github.com/apache/beam/sdks/v2/go/pkg/beam/log"
+)
+
+// --- Multi-step prompt workflows ---
+
+// workflowConfig is the JSON file named by --workflow_file:
+//
+//	{"steps": [
+//	  {"name": "extract", "template": "List the ingredients in: {{.Input}}"},
+//	  {"name": "validate", "template": "Check this list for errors: {{.Steps.extract}}", "table": "validated"},
+//	  {"name": "rewrite", "template": "Rewrite as a label: {{.Steps.validate}}"}
+//	]}
+//
+// Steps run in file order. A template sees the input prompt as .Input, the row
+// key as .Key, the output of every earlier step as .Steps.<name>, and the
+// run's template variables as {{var "name"}} (see templatevars.go). A step
+// with a `when` condition only runs for rows whose earlier output matches,
+// so two steps with opposite conditions form an if/else branch:
+//
+//	{"name": "nutrition", "when": {"step": "classify", "equals": "recipe"}, ...},
+//	{"name": "summary", "when": {"step": "classify", "not_equals": "recipe"}, ...}
+//
+// Templates that follow a branch should use {{index .Steps "name"}}, which is
+// empty for steps the row skipped. Each row's last executed step goes to the
+// main output table, with the steps it took in WorkflowPath; any step with a
+// `table` also writes its own results there.
+type workflowConfig struct {
+	Steps []workflowStep `json:"steps"`
+}
+
+type workflowStep struct {
+	Name     string         `json:"name"`
+	Template string         `json:"template"`
+	Table    string         `json:"table,omitempty"`
+	When     *stepCondition `json:"when,omitempty"`
+}
+
+// stepCondition compares an earlier step's output, trimmed and case-insensitively.
+// Exactly one of Equals, NotEquals, or Contains is set.
+type stepCondition struct {
+	Step      string `json:"step"`
+	Equals    string `json:"equals,omitempty"`
+	NotEquals string `json:"not_equals,omitempty"`
+	Contains  string `json:"contains,omitempty"`
+}
+
+// matches evaluates the condition against a row's outputs so far. A step the
+// row skipped counts as empty output.
+func (c *stepCondition) matches(outputs map[string]string) bool {
+	if c == nil {
+		return true
+	}
+	got := strings.ToLower(strings.TrimSpace(outputs[c.Step]))
+	switch {
+	case c.Equals != "":
+		return got == strings.ToLower(strings.TrimSpace(c.Equals))
+	case c.NotEquals != "":
+		return got != strings.ToLower(strings.TrimSpace(c.NotEquals))
+	default:
+		return strings.Contains(got, strings.ToLower(strings.TrimSpace(c.Contains)))
+	}
+}
+
+// workflowPathSep joins step names in the WorkflowPath column.
+const workflowPathSep = ">"
+
+// workflow is loaded by main for --task=workflow, before the graph is built.
+var workflow *workflowConfig
+
+// loadWorkflowConfig reads and validates a workflow file from a local path or gs:// URI.
+func loadWorkflowConfig(ctx context.Context, path string) (*workflowConfig, error) {
+	raw, err := readConfigFile(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg workflowConfig
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse workflow %s: %w", path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid workflow %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// readConfigFile returns the contents of a local file or GCS object.
+func readConfigFile(ctx context.Context, path string) ([]byte, error) {
+	bucket, object, ok := strings.Cut(strings.TrimPrefix(path, "gs://"), "/")
+	if !strings.HasPrefix(path, "gs://") || !ok {
+		return os.ReadFile(path)
+	}
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage client: %w", err)
+	}
+	defer client.Close()
+	r, err := client.Bucket(bucket).Object(object).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// validate checks step names and renders every template against the outputs it
+// could see at run time, so references to later or unknown steps fail at launch.
+func (cfg *workflowConfig) validate() error {
+	if len(cfg.Steps) == 0 {
+		return fmt.Errorf("no steps")
+	}
+	seen := make(map[string]string)
+	for _, step := range cfg.Steps {
+		if step.Name == "" {
+			return fmt.Errorf("every step needs a name")
+		}
+		if _, dup := seen[step.Name]; dup {
+			return fmt.Errorf("duplicate step %q", step.Name)
+		}
+		if c := step.When; c != nil {
+			if _, ok := seen[c.Step]; !ok {
+				return fmt.Errorf("step %q: condition refers to %q, which is not an earlier step", step.Name, c.Step)
+			}
+			set := 0
+			for _, v := range []string{c.Equals, c.NotEquals, c.Contains} {
+				if v != "" {
+					set++
+				}
+			}
+			if set != 1 {
+				return fmt.Errorf("step %q: condition needs exactly one of equals, not_equals, or contains", step.Name)
+			}
+		}
+		tmpl, err := parseStepTemplate(step, templateVars)
+		if err != nil {
+			return err
+		}
+		if err := tmpl.Execute(io.Discard, stepData{Steps: seen}); err != nil {
+			return fmt.Errorf("step %q: %w", step.Name, err)
+		}
+		seen[step.Name] = ""
+	}
+	return nil
+}
+
+func parseStepTemplate(step workflowStep, vars map[string]string) (*template.Template, error) {
+	tmpl, err := template.New(step.Name).Option("missingkey=error").Funcs(templateFuncs(vars)).Parse(step.Template)
+	if err != nil {
+		return nil, fmt.Errorf("step %q: %w", step.Name, err)
+	}
+	return tmpl, nil
+}
+
+// stepData is what a step template is rendered against.
+type stepData struct {
+	Key   string
+	Input string
+	Steps map[string]string
+}
+
+// WorkflowOutput is one completed step's text for a row, without the
+// --text_watermark marker, so conditions and later templates see the answer.
+type WorkflowOutput struct {
+	Step string `beam:"Step"`
+	Text string `beam:"Text"`
+}
+
+// WorkflowState carries one input row through the steps.
+type WorkflowState struct {
+	Key     string           `beam:"Key"`
+	Input   string           `beam:"Input"`
+	Outputs []WorkflowOutput `beam:"Outputs"`
+}
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*WorkflowState)(nil)).Elem())
+	beam.RegisterFunction(startWorkflow)
+	beam.RegisterType(reflect.TypeOf((*BuildStepPromptFn)(nil)).Elem())
+	beam.RegisterType(reflect.TypeOf((*AdvanceWorkflowFn)(nil)).Elem())
+	beam.RegisterFunction(selectFinalResult)
+	beam.RegisterFunction(keyWorkflowState)
+}
+
+// startWorkflow turns an input row into the initial state. Rows are keyed by
+// row_key, falling back to the prompt, so keys must be unique within a run.
+func startWorkflow(row PromptFromBQ) WorkflowState {
+	key := row.RowKey
+	if key == "" {
+		key = row.Prompt
+	}
+	return WorkflowState{Key: key, Input: row.Prompt}
+}
+
+// BuildStepPromptFn renders one step's prompt for each row and passes the
+// state along, keyed, so it can be joined with the step's result. Rows that
+// fail the step's condition pass through unchanged on the third output.
+type BuildStepPromptFn struct {
+	Step workflowStep
+	Vars map[string]string // Template variables, see templatevars.go
+
+	tmpl *template.Template
+}
+
+func (fn *BuildStepPromptFn) Setup() error {
+	var err error
+	fn.tmpl, err = parseStepTemplate(fn.Step, fn.Vars)
+	return err
+}
+
+func (fn *BuildStepPromptFn) ProcessElement(ctx context.Context, st WorkflowState, emitPrompt func(Prompt), emitState func(string, WorkflowState), emitSkipped func(WorkflowState)) {
+	data := stepData{Key: st.Key, Input: st.Input, Steps: make(map[string]string, len(st.Outputs))}
+	path := make([]string, 0, len(st.Outputs)+1)
+	for _, o := range st.Outputs {
+		data.Steps[o.Step] = o.Text
+		path = append(path, o.Step)
+	}
+	if !fn.Step.When.matches(data.Steps) {
+		emitSkipped(st)
+		return
+	}
+	var buf bytes.Buffer
+	if err := fn.tmpl.Execute(&buf, data); err != nil {
+		beamlog.Errorf(ctx, "BuildStepPromptFn: Dropping row %q at step %q: %v", st.Key, fn.Step.Name, err)
+		return
+	}
+	path = append(path, fn.Step.Name)
+	emitPrompt(Prompt{Prompt: buf.String(), ParentKey: st.Key, WorkflowStep: fn.Step.Name, WorkflowPath: strings.Join(path, workflowPathSep)})
+	emitState(st.Key, st)
+}
+
+// AdvanceWorkflowFn appends a step's generated text to each row's state.
+// Rows whose generation failed have no result and stop here.
+type AdvanceWorkflowFn struct {
+	Step string
+}
+
+func (fn *AdvanceWorkflowFn) ProcessElement(key string, states func(*WorkflowState) bool, results func(*GeminiResult) bool, emit func(WorkflowState)) {
+	var r GeminiResult
+	if !results(&r) {
+		return
+	}
+	var st WorkflowState
+	for states(&st) {
+		next := st
+		next.Outputs = append(append([]WorkflowOutput(nil), st.Outputs...), WorkflowOutput{Step: fn.Step, Text: stripWatermark(r.GeneratedText)})
+		emit(next)
+	}
+}
+
+// selectFinalResult keeps, for each row that finished the workflow, the
+// result of the last step the row actually ran.
+func selectFinalResult(key string, states func(*WorkflowState) bool, results func(*GeminiResult) bool, emit func(GeminiResult)) {
+	var last []string
+	var st WorkflowState
+	for states(&st) {
+		if n := len(st.Outputs); n > 0 {
+			last = append(last, st.Outputs[n-1].Step)
+		}
+	}
+	if len(last) == 0 {
+		return
+	}
+	var r GeminiResult
+	for results(&r) {
+		for _, step := range last {
+			if r.WorkflowStep == step {
+				emit(r)
+				break
+			}
+		}
+	}
+}
+
+// runWorkflow applies the configured steps in order and returns each row's final result.
+func runWorkflow(s beam.Scope, projectID string, model *modelStage, cfg *workflowConfig, rows beam.PCollection) beam.PCollection {
+	s = s.Scope("Workflow")
+	states := beam.ParDo(s.Scope("StartWorkflow"), startWorkflow, rows)
+	var allResults []beam.PCollection
+	for _, step := range cfg.Steps {
+		ss := s.Scope("Step_" + step.Name)
+		prompts, keyedStates, skipped := beam.ParDo3(ss, &BuildStepPromptFn{Step: step, Vars: templateVars}, states)
+		results := model.generate(ss.Scope("CallVertexAI"), step.Name, prompts)
+		allResults = append(allResults, results)
+		if step.Table != "" {
+			tableName := fmt.Sprintf("%s:%s.%s", projectID, outputDataset, step.Table)
+			bigqueryio.Write(ss.Scope("WriteStep"), projectID, tableName, results)
+		}
+		keyedResults := beam.ParDo(ss, keyByParent, results)
+		joined := beam.CoGroupByKey(ss, keyedStates, keyedResults)
+		advanced := beam.ParDo(ss, &AdvanceWorkflowFn{Step: step.Name}, joined)
+		states = beam.Flatten(ss, advanced, skipped)
+	}
+
+	fs := s.Scope("SelectFinalResults")
+	keyedStates := beam.ParDo(fs, keyWorkflowState, states)
+	keyedResults := beam.ParDo(fs, keyByParent, beam.Flatten(fs, allResults...))
+	return beam.ParDo(fs, selectFinalResult, beam.CoGroupByKey(fs, keyedStates, keyedResults))
+}
+
+func keyWorkflowState(st WorkflowState) (string, WorkflowState) {
+	return st.Key, st
+}
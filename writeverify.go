@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"reflect"
+	"sort"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/apache/beam/sdks/v2/go/pkg/beam"
+	"google.golang.org/api/iterator"
+)
+
+// --- Write verification ---
+
+// A BigQuery sink can lose rows without failing the job, for example when a
+// bundle's insert errors are swallowed. Every row handed to a verified sink is
+// counted on its way in, and once the job is done the launcher counts the
+// run's rows in each table. Under --verify_writes a gap beyond
+// --write_verify_tolerance fails the launch instead of logging success.
+
+const sinkNamespace = "sink" // Counter namespace; counter names are table names
+
+func init() {
+	beam.RegisterType(reflect.TypeOf((*CountSinkRowsFn)(nil)).Elem())
+}
+
+// CountSinkRowsFn counts the rows handed to a sink and passes them through.
+type CountSinkRowsFn struct {
+	Table string
+
+	rows beam.Counter
+}
+
+func (fn *CountSinkRowsFn) Setup() {
+	fn.rows = beam.NewCounter(sinkNamespace, fn.Table)
+}
+
+func (fn *CountSinkRowsFn) ProcessElement(ctx context.Context, row beam.T, emit func(beam.T)) {
+	fn.rows.Inc(ctx, 1)
+	emit(row)
+}
+
+// countedForSink returns rows unchanged, counted toward table's verification.
+// The table must have a RunID column.
+func countedForSink(s beam.Scope, table string, rows beam.PCollection) beam.PCollection {
+	if !*verifyWrites {
+		return rows
+	}
+	return beam.ParDo(s.Scope("CountSinkRows"), &CountSinkRowsFn{Table: table}, rows)
+}
+
+// checkWrittenRows compares the rows handed to each counted sink with the rows of
+// this run found in its table.
+func checkWrittenRows(ctx context.Context, project string, pr beam.PipelineResult) error {
+	handed := counterTotals(pr, sinkNamespace)
+	if len(handed) == 0 {
+		return nil
+	}
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return fmt.Errorf("failed to create bigquery client: %w", err)
+	}
+	defer client.Close()
+
+	tables := make([]string, 0, len(handed))
+	for table := range handed {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	var diverged []string
+	for _, table := range tables {
+		written, err := countRunRows(ctx, client, project, table)
+		if err != nil {
+			return fmt.Errorf("failed to count rows in %s: %w", table, err)
+		}
+		want := handed[table]
+		log.Printf("  Verified %s: %d rows handed to the sink, %d written", table, want, written)
+		if math.Abs(float64(written-want)) > *writeVerifyTolerance*float64(want) {
+			diverged = append(diverged, fmt.Sprintf("%s (%d handed to the sink, %d written)", table, want, written))
+		}
+	}
+	if len(diverged) > 0 {
+		return fmt.Errorf("row counts diverge beyond --write_verify_tolerance %g: %v", *writeVerifyTolerance, diverged)
+	}
+	return nil
+}
+
+// countRunRows counts the rows of this run in a table of the output dataset.
+func countRunRows(ctx context.Context, client *bigquery.Client, project, table string) (int64, error) {
+	q := client.Query(fmt.Sprintf("SELECT COUNT(*) AS n FROM `%s.%s.%s` WHERE RunID = @run", project, outputDataset, table))
+	q.Parameters = []bigquery.QueryParameter{{Name: "run", Value: *runID}}
+	it, err := q.Read(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var row struct {
+		N int64 `bigquery:"n"`
+	}
+	if err := it.Next(&row); err != nil && err != iterator.Done {
+		return 0, err
+	}
+	return row.N, nil
+}